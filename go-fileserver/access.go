@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+)
+
+// Access presets, set globally with "access" in the config or per root
+const (
+	// accessOpen lets everyone read and write (the default)
+	accessOpen = "open"
+	// accessPublicRead lets everyone list, view and download, but uploads and
+	// other changes need a logged-in user
+	accessPublicRead = "public-read"
+)
+
+func validAccess(mode string) error {
+	switch mode {
+	case "", accessOpen, accessPublicRead:
+		return nil
+	}
+	return fmt.Errorf("unknown access mode: %s", mode)
+}
+
+// accessFor returns the access preset of the root containing path
+func (fs *FileServer) accessFor(path string) string {
+	if rc := fs.rootConfig(path); rc != nil && rc.Access != "" {
+		return rc.Access
+	}
+	if access := fs.cfg().Access; access != "" {
+		return access
+	}
+	return accessOpen
+}
+
+// accessPaths returns path and, if a link takes it into another root, what
+// it resolves to: access and visibility checks apply to the roots of both
+func (fs *FileServer) accessPaths(path string) []string {
+	paths := []string{path}
+	if real, err := realPath(path); err == nil {
+		if root := fs.rootOf(real); root != "" && root != fs.rootOf(path) {
+			paths = append(paths, real)
+		}
+	}
+	return paths
+}
+
+// publicRead reports whether anonymous visitors may read path once logging in
+// is on: its root and the one a link in it leads to are public-read
+func (fs *FileServer) publicRead(path string) bool {
+	for _, p := range fs.accessPaths(path) {
+		if fs.accessFor(p) != accessPublicRead {
+			return false
+		}
+	}
+	return true
+}
+
+// canRead reports whether r may view and download path. Once logging in is
+// on, anonymous visitors may only read public-read roots, and private roots
+// are only for users (see visibleTo).
+func (fs *FileServer) canRead(r *http.Request, path string) bool {
+	if !fs.visibleTo(r, path) {
+		return false
+	}
+	return !authEnabled() || authenticated(r) || fs.publicRead(path)
+}
+
+// requireRead answers and returns false unless r may read all paths: 404 for
+// paths r may not see, so as not to reveal them, and 401 for those it could
+// read once logged in
+func (fs *FileServer) requireRead(w http.ResponseWriter, r *http.Request, paths ...string) bool {
+	for _, p := range paths {
+		p = filepath.FromSlash(p)
+		if !fs.visibleTo(r, p) {
+			httpError(w, "Not found", http.StatusNotFound)
+			return false
+		}
+		if !fs.canRead(r, p) {
+			authChallenge(w)
+			httpError(w, "Login required to read "+fs.publicPath(p), http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
+
+// canWrite reports whether r may change anything at path. Once logging in
+// is on, that takes a user with the read-write or admin role.
+func (fs *FileServer) canWrite(r *http.Request, path string) bool {
+	if *roMode || fs.readOnly(path) {
+		return false
+	}
+	if a := accountOf(r); a != nil {
+		return a.has(roleReadWrite)
+	}
+	if authEnabled() {
+		return false
+	}
+	// Anonymous, without any way to log in
+	for _, p := range fs.accessPaths(path) {
+		if fs.accessFor(p) == accessPublicRead {
+			return false
+		}
+	}
+	return true
+}
+
+// readOnlyError answers a request that would change files under -readonly
+func readOnlyError(w http.ResponseWriter) {
+	apiError(w, http.StatusForbidden, codeReadOnly, "The server is read-only")
+}
+
+// readOnly reports whether the root containing path, or the one a link in it
+// leads to, is read-only in the config
+func (fs *FileServer) readOnly(path string) bool {
+	for _, p := range fs.accessPaths(path) {
+		if rc := fs.rootConfig(p); rc != nil && rc.ReadOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// requireWrite answers 401 and returns false unless r may change all paths.
+// Under -readonly nothing may be changed and the answer is readOnlyError, as
+// it is for paths in read-only roots.
+func (fs *FileServer) requireWrite(w http.ResponseWriter, r *http.Request, paths ...string) bool {
+	if *roMode {
+		readOnlyError(w)
+		return false
+	}
+	for _, p := range paths {
+		if fs.readOnly(p) {
+			apiError(w, http.StatusForbidden, codeReadOnly, "The folder is read-only: "+fs.publicPath(fs.rootOf(p)))
+			return false
+		}
+	}
+	for _, p := range paths {
+		if !fs.canWrite(r, p) {
+			if authenticated(r) {
+				apiError(w, http.StatusForbidden, codeForbidden, "Your account may not modify "+fs.publicPath(p))
+				return false
+			}
+			authChallenge(w)
+			httpError(w, "Login required to modify "+fs.publicPath(p), http.StatusUnauthorized)
+			return false
+		}
+	}
+	return fs.requireLocal(w, r, paths...)
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveWriter is implemented by the streaming zip and tar.gz writers
+type archiveWriter interface {
+	addDir(name string, fi os.FileInfo) error
+	addFile(name string, fi os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// archiveFormats maps the accepted format names to file extensions and content types
+var archiveFormats = map[string][2]string{
+	"zip":    {".zip", "application/zip"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "", "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		return &tarArchive{gz: gz, tw: tar.NewWriter(gz)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", format)
+	}
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) addDir(name string, fi os.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name + "/"
+	_, err = a.zw.CreateHeader(hdr)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, fi os.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	out, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) addDir(name string, fi os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name + "/"
+	return a.tw.WriteHeader(hdr)
+}
+
+func (a *tarArchive) addFile(name string, fi os.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// addToArchive writes src (a file, or a folder recursively) into aw as name,
+// usually the item's own name (see archiveNames).
+// When j is not nil, bytes read count as its progress. With noHidden, dot files
+// and folders below src are left out.
+func addToArchive(aw archiveWriter, src, name string, j *job, noHidden bool) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && isInternal(fi.Name()) {
+			return filepath.SkipDir
+		}
+		if noHidden && p != src && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		entry := name
+		if rel != "." {
+			entry += "/" + filepath.ToSlash(rel)
+		}
+		if fi.IsDir() {
+			return aw.addDir(entry, fi)
+		}
+		if !fi.Mode().IsRegular() {
+			// Skip sockets, devices and symlinks
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if j != nil {
+			j.add(0, entry)
+			return aw.addFile(entry, fi, jobReader{j, f})
+		}
+		return aw.addFile(entry, fi, f)
+	})
+}
+
+// downloadFolder streams the folder at path as an archive, written while the
+// folder is read so nothing is buffered on disk. Zip archives switch to zip64
+// by themselves for files and archives over 4 GiB.
+func (fs *FileServer) downloadFolder(w http.ResponseWriter, r *http.Request, path string) {
+	if !fs.requireLocalDisk(w, "folder downloads", path) {
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	f, ok := archiveFormats[format]
+	if !ok {
+		httpError(w, "Unsupported format: "+format, 400)
+		return
+	}
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+archiveName([]string{path}, format))
+	w.Header().Set("Content-Type", f[1])
+	if err := addToArchive(aw, path, filepath.Base(path), nil, q.Get("hidden") == "false" || fs.hidesDotFiles(path)); err != nil {
+		fs.notef("Folder download aborted: %v", err)
+		return
+	}
+	if err := aw.Close(); err != nil {
+		fs.notef("Folder download aborted: %v", err)
+	}
+}
+
+// archiveNames names the selected items inside an archive: by their own name,
+// with " (2)", " (3)", ... added when items from different folders share one
+func archiveNames(paths []string) []string {
+	names := make([]string, len(paths))
+	taken := make(map[string]bool)
+	for i, p := range paths {
+		base := filepath.Base(p)
+		name := base
+		for n := 2; taken[name]; n++ {
+			ext := filepath.Ext(base)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), n, ext)
+		}
+		taken[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// archiveName picks a download file name for a set of selected paths
+func archiveName(paths []string, format string) string {
+	ext := archiveFormats["zip"][0]
+	if f, ok := archiveFormats[format]; ok {
+		ext = f[0]
+	}
+	if len(paths) == 1 {
+		return strings.TrimSuffix(filepath.Base(paths[0]), string(filepath.Separator)) + ext
+	}
+	return "download" + ext
+}
+
+// buildArchive writes an archive of paths into the job result directory
+func (fs *FileServer) buildArchive(j *job, paths []string, format, name string, noHidden bool) (interface{}, error) {
+	var total int64
+	for _, p := range paths {
+		if s, err := computeDirSize(p); err == nil {
+			total += s.Bytes
+		}
+	}
+	j.progress(func() { j.Total = total })
+	dir := statePath(jobResultDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := fs.checkFreeSpace(dir, total); err != nil {
+		return nil, err
+	}
+
+	out := filepath.Join(dir, j.ID+archiveFormats[format][0])
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	j.progress(func() {
+		j.resultFile = out
+		j.resultName = name
+	})
+	aw, err := newArchiveWriter(f, format)
+	if err == nil {
+		for i, p := range archiveNames(paths) {
+			if err = addToArchive(aw, paths[i], p, j, noHidden); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = aw.Close()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	fi, err := os.Stat(out)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"name": name, "size": fi.Size()}, nil
+}
+
+// archiveKind returns the format of an archive file by its name, or "" if it isn't one
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// extractTarget resolves an archive entry name below dest, rejecting entries
+// that would escape it ("zip slip"), write into the server's internal folders
+// or leave the served folders through a link already on disk
+func (fs *FileServer) extractTarget(dest, name string) (string, error) {
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	if target != dest && !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry outside destination: %s", name)
+	}
+	if hasInternal(target) || !fs.inRoots(target) {
+		return "", fmt.Errorf("archive entry outside the served folders: %s", name)
+	}
+	return target, nil
+}
+
+// Conflict policies for archive entries whose target already exists
+const (
+	conflictFail      = "fail"      // stop with an error
+	conflictSkip      = "skip"      // keep the existing file
+	conflictOverwrite = "overwrite" // replace it
+	conflictRename    = "rename"    // write "name (2).ext" next to it
+)
+
+func validConflict(policy string) bool {
+	switch policy {
+	case conflictFail, conflictSkip, conflictOverwrite, conflictRename:
+		return true
+	}
+	return false
+}
+
+// placeEntry writes one archive entry to target according to the conflict
+// policy. It returns the path written, or "" if the entry was skipped.
+func placeEntry(target string, mode os.FileMode, r io.Reader, policy string) (string, error) {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return target, extractFile(target, mode, r)
+	}
+	switch {
+	case policy == conflictSkip:
+		return "", nil
+	case policy == conflictRename:
+		dir := filepath.Dir(target)
+		target = filepath.Join(dir, freeName(localDisk, dir, filepath.Base(target)))
+		return target, extractFile(target, mode, r)
+	case policy == conflictOverwrite && fi.Mode().IsRegular():
+		// Replace only once the entry is complete
+		tmp := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".part")
+		os.Remove(tmp)
+		if err := extractFile(tmp, mode, r); err != nil {
+			return "", err
+		}
+		return target, os.Rename(tmp, target)
+	}
+	return "", fmt.Errorf("%s already exists", filepath.Base(target))
+}
+
+// extractTar unpacks a tar stream, gzipped or not, into dest. each is called
+// for every entry with its name and the file written ("" for folders and
+// skipped files). Links and devices are skipped, as are files kept by the
+// conflict policy; the latter are returned.
+func (fs *FileServer) extractTar(r io.Reader, dest, policy string, each func(name, target string)) (files int, skipped []string, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, skipped, nil
+		}
+		if err != nil {
+			return files, skipped, err
+		}
+		target, err := fs.extractTarget(dest, hdr.Name)
+		if err != nil {
+			return files, skipped, err
+		}
+		written := ""
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()|0700); err != nil {
+				return files, skipped, err
+			}
+		case tar.TypeReg:
+			if written, err = placeEntry(target, hdr.FileInfo().Mode(), tr, policy); err != nil {
+				return files, skipped, err
+			}
+			if written == "" {
+				skipped = append(skipped, hdr.Name)
+			} else {
+				os.Chtimes(written, hdr.ModTime, hdr.ModTime)
+				files++
+			}
+		}
+		if each != nil {
+			each(hdr.Name, written)
+		}
+	}
+}
+
+// extractZip unpacks a zip archive into dest, like extractTar. wrap, if set,
+// wraps the reader of each entry, e.g. to count progress.
+func (fs *FileServer) extractZip(zr *zip.Reader, dest, policy string, wrap func(io.Reader) io.Reader, each func(name, target string)) (files int, skipped []string, err error) {
+	var total int64
+	for _, f := range zr.File {
+		total += int64(f.UncompressedSize64)
+	}
+	if err := fs.checkFreeSpace(dest, total); err != nil {
+		return 0, nil, err
+	}
+	for _, f := range zr.File {
+		target, err := fs.extractTarget(dest, f.Name)
+		if err != nil {
+			return files, skipped, err
+		}
+		written := ""
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return files, skipped, err
+			}
+		} else if f.Mode().IsRegular() {
+			rc, err := f.Open()
+			if err != nil {
+				return files, skipped, err
+			}
+			var r io.Reader = rc
+			if wrap != nil {
+				r = wrap(rc)
+			}
+			written, err = placeEntry(target, f.Mode(), r, policy)
+			rc.Close()
+			if err != nil {
+				return files, skipped, err
+			}
+			if written == "" {
+				skipped = append(skipped, f.Name)
+			} else {
+				os.Chtimes(written, f.Modified, f.Modified)
+				files++
+			}
+		}
+		if each != nil {
+			each(f.Name, written)
+		}
+	}
+	return files, skipped, nil
+}
+
+// extractFile writes one archive entry, refusing to overwrite existing files
+func extractFile(target string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	return out.Close()
+}
+
+// extractArchive unpacks a zip or tar(.gz) archive into dest as job j
+func (fs *FileServer) extractArchive(j *job, src, dest string) (interface{}, error) {
+	var files int
+	switch archiveKind(src) {
+	case "zip":
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		var total int64
+		for _, f := range zr.File {
+			total += int64(f.UncompressedSize64)
+		}
+		j.progress(func() {
+			j.Total = total
+			j.ItemsTotal = len(zr.File)
+		})
+		files, _, err = fs.extractZip(&zr.Reader, dest, conflictFail, func(r io.Reader) io.Reader {
+			return jobReader{j, r}
+		}, func(name, target string) {
+			j.add(0, name)
+			j.progress(func() { j.ItemsDone++ })
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case "tar", "tar.gz":
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil {
+			// Progress is measured in archive bytes consumed
+			j.progress(func() { j.Total = fi.Size() })
+		}
+		// Compression is detected from the data
+		files, _, err = fs.extractTar(jobReader{j, f}, dest, conflictFail, func(name, target string) {
+			j.add(0, name)
+			j.progress(func() { j.ItemsDone++ })
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("not a supported archive: %s", filepath.Base(src))
+	}
+	return map[string]interface{}{"dest": fs.publicPath(dest), "files": files}, nil
+}
+
+// API: Extract a zip or tar(.gz) archive as a background job (see /api/jobs).
+// Body: {path, dest}; dest defaults to a new folder named after the archive.
+func (fs *FileServer) handleExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+		Dest string `json:"dest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	if req.Path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	if !fs.resolvePaths(w, &req.Path) || req.Dest != "" && !fs.resolvePaths(w, &req.Dest) {
+		return
+	}
+	if !fs.requireRead(w, r, req.Path, req.Dest) || !fs.requireLocal(w, r, req.Path) {
+		return
+	}
+	src, _ := filepath.Abs(filepath.FromSlash(req.Path))
+	if !fs.inRoots(src) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	kind := archiveKind(src)
+	if kind == "" {
+		httpError(w, "Not a supported archive (zip, tar, tar.gz)", 400)
+		return
+	}
+	if _, err := os.Stat(src); err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	dest := req.Dest
+	if dest == "" {
+		base := filepath.Base(src)
+		for _, ext := range []string{".tar.gz", ".tgz", ".zip", ".tar"} {
+			if strings.HasSuffix(strings.ToLower(base), ext) {
+				base = base[:len(base)-len(ext)]
+				break
+			}
+		}
+		dest = filepath.Join(filepath.Dir(src), base)
+		if fileExists(dest) {
+			httpError(w, "Destination already exists: "+fs.publicPath(dest), 409)
+			return
+		}
+	}
+	dest, _ = filepath.Abs(filepath.FromSlash(dest))
+	if !fs.inRoots(dest) {
+		httpError(w, "Destination is not inside a served folder", 403)
+		return
+	}
+	if !fs.requireWrite(w, r, dest) {
+		return
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		writeError(w, err, 500)
+		return
+	}
+
+	j := fs.jobs.start("extract", "Extract "+filepath.Base(src), func(j *job) (interface{}, error) {
+		return fs.extractArchive(j, src, dest)
+	})
+	acceptedJob(w, r, j)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarOf returns a tar archive holding a file for each name
+func tarOf(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("data"))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractRefusesEscapes(t *testing.T) {
+	fs, docs, _, outside := testServer(t)
+	for _, name := range []string{"../outside/x.txt", "sub/../../x.txt", "out/x.txt", "out-rel/x.txt", "dangling", casDirName + "/x", "to-cas/x", "sub/" + casDirName + "/x"} {
+		if _, _, err := fs.extractTar(tarOf(t, name), docs, conflictOverwrite, nil); err == nil {
+			t.Errorf("%s: extracted", name)
+		}
+	}
+	// An entry is checked before anything of it is written
+	if _, _, err := fs.extractTar(tarOf(t, "ok.txt", "out/x.txt"), docs, conflictFail, nil); err == nil {
+		t.Error("archive with an entry through a link out extracted")
+	}
+	for _, p := range []string{filepath.Join(outside, "x.txt"), filepath.Join(outside, "new.txt"), filepath.Join(filepath.Dir(docs), "x.txt"), filepath.Join(docs, casDirName, "x"), filepath.Join(docs, "sub", casDirName)} {
+		if fileExists(p) {
+			t.Errorf("%s was written", p)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("out/x.txt")
+	w.Write([]byte("data"))
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.extractZip(zr, docs, conflictOverwrite, nil, nil); err == nil || fileExists(filepath.Join(outside, "x.txt")) {
+		t.Errorf("zip entry through a link out: %v", err)
+	}
+
+	files, _, err := fs.extractTar(tarOf(t, "new/a.txt", "to-sub/b.txt"), docs, conflictFail, nil)
+	if err != nil || files != 2 {
+		t.Fatalf("extracting: %d files, %v", files, err)
+	}
+	for _, p := range []string{filepath.Join(docs, "new", "a.txt"), filepath.Join(docs, "sub", "b.txt")} {
+		if data, _ := os.ReadFile(p); string(data) != "data" {
+			t.Errorf("%s holds %q", p, data)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// archiveSep ends the archive part of a path into an archive, as in
+	// /data/logs.zip!/2024/app.log
+	archiveSep = "!"
+	// maxArchiveIndex caps how many entries of an archive can be browsed
+	maxArchiveIndex = 100000
+	// archiveIndexCache is how many archive listings are kept for browsing
+	archiveIndexCache = 16
+)
+
+// errNoEntry is returned for names that aren't files in an archive
+var errNoEntry = errors.New("no such file in the archive")
+
+// splitArchivePath splits a path into a zip, tar or tar.gz file into the
+// archive and the slash-separated name inside it, "" for its top folder. ok is
+// false for ordinary paths.
+func splitArchivePath(p string) (archive, name string, ok bool) {
+	p = filepath.Clean(p)
+	for i := 0; i < len(p); i++ {
+		j := strings.Index(p[i:], archiveSep)
+		if j < 0 {
+			return "", "", false
+		}
+		i += j
+		rest := p[i+len(archiveSep):]
+		if rest != "" && rest[0] != filepath.Separator || archiveKind(p[:i]) == "" {
+			continue
+		}
+		return p[:i], strings.Trim(filepath.ToSlash(rest), "/"), true
+	}
+	return "", "", false
+}
+
+// entryName normalizes the name of an archive entry, "" for names that
+// can't be browsed, like ones leading out of the archive
+func entryName(name string) string {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return ""
+	}
+	return name
+}
+
+// archiveIndex is the folder structure of an archive, with the folders that
+// are only implied by the names of files in them
+type archiveIndex struct {
+	entries  map[string]archiveEntry // by name, folders included
+	children map[string][]string     // folder name ("" for the top) -> names in it
+}
+
+func newArchiveIndex(list []archiveEntry) *archiveIndex {
+	ix := &archiveIndex{
+		entries:  make(map[string]archiveEntry),
+		children: map[string][]string{"": nil},
+	}
+	for _, e := range list {
+		name := entryName(e.Name)
+		if name == "" {
+			continue
+		}
+		if e.Type == "folder" {
+			ix.addFolder(name, e.Modified)
+			continue
+		}
+		if _, ok := ix.entries[name]; ok {
+			continue // the first of the same name, as extracting keeps it
+		}
+		dir := path.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		ix.addFolder(dir, time.Time{})
+		e.Name = name
+		ix.entries[name] = e
+		ix.children[dir] = append(ix.children[dir], name)
+	}
+	for _, names := range ix.children {
+		sort.Strings(names)
+	}
+	return ix
+}
+
+// addFolder adds a folder and the ones it is in, unless they're known. An
+// entry for the folder itself sets its time.
+func (ix *archiveIndex) addFolder(name string, modified time.Time) {
+	if _, ok := ix.children[name]; ok {
+		if e, ok := ix.entries[name]; ok && !modified.IsZero() {
+			e.Modified = modified
+			ix.entries[name] = e
+		}
+		return
+	}
+	ix.children[name] = nil
+	parent := path.Dir(name)
+	if parent == "." {
+		parent = ""
+	}
+	ix.addFolder(parent, time.Time{})
+	ix.entries[name] = archiveEntry{Name: name, Type: "folder", Modified: modified}
+	ix.children[parent] = append(ix.children[parent], name)
+}
+
+// archiveIndexes keeps the listings of recently browsed archives, keyed by
+// path, size and modification time
+var archiveIndexes = struct {
+	sync.Mutex
+	m map[string]*archiveIndex
+}{m: make(map[string]*archiveIndex)}
+
+// indexArchive lists an archive for browsing, from the cache if it hasn't
+// changed since
+func indexArchive(ctx context.Context, archive string) (*archiveIndex, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("not an archive: %s", filepath.Base(archive))
+	}
+	key := fmt.Sprintf("%s\x00%d\x00%d", archive, fi.Size(), fi.ModTime().UnixNano())
+	archiveIndexes.Lock()
+	ix := archiveIndexes.m[key]
+	archiveIndexes.Unlock()
+	if ix != nil {
+		return ix, nil
+	}
+
+	var list []archiveEntry
+	if archiveKind(archive) == "zip" {
+		list, _, err = listZip(f, fi.Size(), maxArchiveIndex)
+	} else {
+		list, _, err = listTar(ctx, f, maxArchiveIndex)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ix = newArchiveIndex(list)
+	archiveIndexes.Lock()
+	if len(archiveIndexes.m) >= archiveIndexCache {
+		for k := range archiveIndexes.m {
+			delete(archiveIndexes.m, k) // any one will do
+			break
+		}
+	}
+	archiveIndexes.m[key] = ix
+	archiveIndexes.Unlock()
+	return ix, nil
+}
+
+// listArchiveFolder answers /api/tree for a folder inside an archive, with
+// the same entries as for folders on disk
+func (fs *FileServer) listArchiveFolder(w http.ResponseWriter, r *http.Request, archive, name string) {
+	if !fs.requireInRoots(w, archive) {
+		return
+	}
+	page, err := parseTreePage(r.URL.Query())
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	ix, err := indexArchive(r.Context(), archive)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	names, ok := ix.children[name]
+	if !ok {
+		httpError(w, "No such folder in the archive", 404)
+		return
+	}
+	out := []map[string]interface{}{}
+	for _, n := range names {
+		e := ix.entries[n]
+		item := map[string]interface{}{
+			"name":     path.Base(n),
+			"type":     e.Type,
+			"path":     fs.publicPath(archive) + archiveSep + "/" + n,
+			"modified": e.Modified.Unix(),
+		}
+		if e.Type == "file" {
+			item["size"] = e.Size
+		}
+		out = append(out, item)
+	}
+	if wantsText(r) {
+		writeTextListing(w, out)
+		return
+	}
+	if wantsNDJSON(r) {
+		nw := newNDJSONWriter(w)
+		for _, item := range out {
+			nw.write(item)
+		}
+		return
+	}
+	tw := newTreeWriter(w, page)
+	for i, item := range out {
+		if page.has(i) {
+			tw.write(item)
+		}
+	}
+	tw.close(len(out))
+}
+
+// openArchiveEntry copies a file out of an archive into a temporary file,
+// so it can be served and previewed like any other. The caller removes it
+// with closeTemp.
+func openArchiveEntry(ctx context.Context, archive, name string) (*os.File, archiveEntry, error) {
+	ix, err := indexArchive(ctx, archive)
+	if err != nil {
+		return nil, archiveEntry{}, err
+	}
+	e, ok := ix.entries[name]
+	if !ok || e.Type != "file" {
+		return nil, archiveEntry{}, errNoEntry
+	}
+	tmp, err := os.CreateTemp("", "archive-entry-*")
+	if err != nil {
+		return nil, e, err
+	}
+	if err := copyArchiveEntry(ctx, tmp, archive, name); err != nil {
+		closeTemp(tmp)
+		return nil, e, err
+	}
+	tmp.Seek(0, io.SeekStart)
+	return tmp, e, nil
+}
+
+// copyArchiveEntry writes the first file called name in an archive to w
+func copyArchiveEntry(ctx context.Context, w io.Writer, archive, name string) error {
+	if archiveKind(archive) == "zip" {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || entryName(f.Name) != name {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			_, err = io.Copy(w, rc)
+			return err
+		}
+		return errNoEntry
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errNoEntry
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if hdr.Typeflag == tar.TypeReg && entryName(hdr.Name) == name {
+			_, err = io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+// closeTemp closes and removes a temporary file
+func closeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// serveArchiveEntry answers /api/raw and /api/download for a file inside an
+// archive, attachment forcing a download
+func (fs *FileServer) serveArchiveEntry(w http.ResponseWriter, r *http.Request, archive, name string, attachment bool) {
+	if !fs.requireInRoots(w, archive) || !fs.requireLocalDisk(w, "files in archives", archive) {
+		return
+	}
+	f, e, err := openArchiveEntry(r.Context(), archive, name)
+	if err == errNoEntry || os.IsNotExist(err) {
+		httpError(w, "File not found", 404)
+		return
+	}
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	defer closeTemp(f)
+	ct := detectFileContentType(f, name)
+	w.Header().Set("Content-Type", ct)
+	if attachment {
+		w.Header().Set("Content-Disposition", "attachment; filename="+path.Base(name))
+	} else {
+		fs.setDisposition(w, filepath.Join(archive, filepath.FromSlash(name)), ct)
+	}
+	http.ServeContent(w, r, path.Base(name), e.Modified, f)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxArchiveEntries caps how many entries an archive listing shows
+const maxArchiveEntries = 10000
+
+// archiveEntry is one file or folder in an archive listing
+type archiveEntry struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"` // "file" or "folder"
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// renderArchive lists the entries of a zip, tar or tar.gz file without
+// unpacking it, up to maxArchiveEntries of them
+func renderArchive(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	if archiveKind(p.Path) == "" {
+		renderBinary(w, r, p) // a .gz of a single file
+		return
+	}
+	src := io.NewSectionReader(p.File, 0, p.Info.Size())
+	var entries []archiveEntry
+	var truncated bool
+	var err error
+	if archiveKind(p.Path) == "zip" {
+		entries, truncated, err = listZip(src, p.Info.Size(), maxArchiveEntries)
+	} else {
+		entries, truncated, err = listTar(r.Context(), src, maxArchiveEntries)
+	}
+	if err != nil {
+		// Not readable as an archive, e.g. misnamed or damaged
+		p.File.Seek(0, io.SeekStart)
+		renderBinary(w, r, p)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      "archive",
+		"format":    archiveKind(p.Path),
+		"entries":   entries,
+		"truncated": truncated,
+	})
+}
+
+// listZip reads the entries of a zip archive, up to limit of them
+func listZip(ra io.ReaderAt, size int64, limit int) ([]archiveEntry, bool, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, false, err
+	}
+	entries := []archiveEntry{}
+	for _, f := range zr.File {
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+		e := archiveEntry{Name: strings.TrimSuffix(f.Name, "/"), Type: "file", Size: int64(f.UncompressedSize64), Modified: f.Modified}
+		if f.FileInfo().IsDir() {
+			e.Type, e.Size = "folder", 0
+		}
+		entries = append(entries, e)
+	}
+	return entries, false, nil
+}
+
+// listTar reads the headers of a tar stream, gzipped or not, up to limit of
+// them. Gzipped archives have to be read to the end, so ctx can cut it short.
+func listTar(ctx context.Context, src io.Reader, limit int) ([]archiveEntry, bool, error) {
+	br := bufio.NewReader(src)
+	var rd io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, false, err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	tr := tar.NewReader(rd)
+	entries := []archiveEntry{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, false, nil
+		}
+		if err != nil {
+			if len(entries) > 0 {
+				return entries, true, nil // show what was read before the damage
+			}
+			return nil, false, err
+		}
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		if len(entries) == limit {
+			return entries, true, nil
+		}
+		e := archiveEntry{Name: path.Clean(hdr.Name), Type: "file", Size: hdr.Size, Modified: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.Type, e.Size = "folder", 0
+		case tar.TypeReg:
+		default:
+			continue // links and devices aren't extracted either
+		}
+		entries = append(entries, e)
+	}
+}
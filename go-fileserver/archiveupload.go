@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// tarContentTypes are the request bodies /api/upload unpacks instead of
+// reading them as a multipart form
+var tarContentTypes = map[string]bool{
+	"application/x-tar":  true,
+	"application/tar":    true,
+	"application/x-gtar": true,
+	"application/gzip":   true,
+	"application/x-gzip": true,
+}
+
+func isTarUpload(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && tarContentTypes[mt]
+}
+
+// conflictPolicy reads ?conflict= for archive uploads, answering 400 if it is invalid
+func conflictPolicy(w http.ResponseWriter, r *http.Request) (string, bool) {
+	policy := r.URL.Query().Get("conflict")
+	if policy == "" {
+		policy = conflictOverwrite
+	}
+	if !validConflict(policy) {
+		httpError(w, "Invalid conflict policy: "+policy, 400)
+		return "", false
+	}
+	return policy, true
+}
+
+// uploadTar unpacks a tar or tar.gz request body into folder while it streams
+// in, keeping the folder structure, permissions and modification times.
+// ?conflict= decides what happens to existing files (default overwrite, like
+// regular uploads).
+func (fs *FileServer) uploadTar(w http.ResponseWriter, r *http.Request, folder string) {
+	policy, ok := conflictPolicy(w, r)
+	if !ok {
+		return
+	}
+	dest, err := filepath.Abs(folder)
+	if err != nil || !fs.inRoots(dest) {
+		httpError(w, "Folder is not inside a served folder", 403)
+		return
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	src := &freeSpaceGuard{fs: fs, r: r.Body, dir: dest, limit: fs.uploadLimit(dest)}
+	files, skipped, err := fs.extractTar(src, dest, policy, fs.publishExtracted)
+	if err == errLowDisk {
+		lowDiskError(w)
+		return
+	}
+	if errors.Is(err, errUploadTooLarge) {
+		writeErrorJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{"error": errorBody(codeTooLarge, errorMessage(err)), "files": files})
+		return
+	}
+	if err != nil {
+		// A broken archive, with what was extracted before the damage
+		writeErrorJSON(w, http.StatusBadRequest, map[string]interface{}{"error": errorBody(codeBadRequest, errorMessage(err)), "files": files})
+		return
+	}
+	if skipped == nil {
+		skipped = []string{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "files": files, "skipped": skipped})
+}
+
+// publishExtracted reports a file unpacked from an uploaded archive as uploaded
+func (fs *FileServer) publishExtracted(name, target string) {
+	if target != "" {
+		fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(target)})
+	}
+}
+
+// extractUpload unpacks an archive uploaded with extract=true into dest. Tar
+// archives are unpacked as they stream in; a zip needs its central directory
+// at the end, so it is written to a temporary file first.
+func (fs *FileServer) extractUpload(r io.Reader, name, dest, policy string) (files int, skipped []string, err error) {
+	if dest, err = filepath.Abs(dest); err != nil {
+		return 0, nil, err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, nil, err
+	}
+	src := &freeSpaceGuard{fs: fs, r: r, dir: dest, limit: fs.uploadLimit(dest)}
+	if archiveKind(name) != "zip" {
+		return fs.extractTar(src, dest, policy, fs.publishExtracted)
+	}
+	tmp, err := os.CreateTemp(dest, ".upload-*.zip")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, src)
+	if err != nil {
+		return 0, nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return fs.extractZip(zr, dest, policy, nil, fs.publishExtracted)
+}
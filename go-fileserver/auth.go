@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With -auth user:pass, -token <secret> or user accounts (see users.go) the
+// server wants credentials: HTTP basic auth, a session cookie from /api/login,
+// or the token as "Authorization: Bearer <token>" or ?token=. A browser opened
+// with ?token= keeps it in a cookie, so the web UI goes on working. Requests
+// without credentials get 401 (browsers get the login page), except where the
+// configuration lets anonymous visitors in: public-read access, the kiosk
+// upload page, shares and signed /api/raw URLs.
+
+const (
+	authRealm   = "fileserver"
+	tokenCookie = "fileserver_token"
+)
+
+// ownerCredentials are the -auth and -token settings
+type ownerCredentials struct {
+	user, pass, token string
+}
+
+// credentials are the current ownerCredentials, replaced as a whole when the
+// config is reloaded
+var credentials atomic.Pointer[ownerCredentials]
+
+func init() {
+	credentials.Store(&ownerCredentials{})
+}
+
+// setCredentials checks and applies the -auth and -token flags
+func setCredentials(auth, token string) error {
+	c, err := parseCredentials(auth, token)
+	if err != nil {
+		return err
+	}
+	credentials.Store(c)
+	return nil
+}
+
+// parseCredentials checks the -auth and -token flags
+func parseCredentials(auth, token string) (*ownerCredentials, error) {
+	c := &ownerCredentials{token: token}
+	if auth != "" {
+		user, pass, ok := strings.Cut(auth, ":")
+		if !ok || user == "" || pass == "" {
+			return nil, fmt.Errorf("-auth: want user:password")
+		}
+		c.user, c.pass = user, pass
+	}
+	return c, nil
+}
+
+// authEnabledByFlags reports whether -auth or -token is set
+func authEnabledByFlags() bool {
+	c := credentials.Load()
+	return c.user != "" || c.token != ""
+}
+
+// authEnabled reports whether logging in is possible, and so required for
+// all that isn't open to anonymous visitors
+func authEnabled() bool {
+	return authEnabledByFlags() || atomic.LoadInt64(&accountCount) > 0
+}
+
+// ownerAccount is who the -auth and -token credentials log in as
+func ownerAccount(name string) *account {
+	return &account{Name: name, Role: roleAdmin}
+}
+
+type accountKey struct{}
+
+// accountOf returns the logged-in user of r, nil for anonymous visitors
+func accountOf(r *http.Request) *account {
+	a, _ := r.Context().Value(accountKey{}).(*account)
+	return a
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// checkCredentials looks at the credentials r carries and returns whose they
+// are. If they are wrong, a is nil and reason is what the auth failure is
+// logged as; if there are none, reason is empty too.
+func checkCredentials(r *http.Request) (a *account, user, reason string) {
+	if u, p, has := r.BasicAuth(); has {
+		a, reason := passwordAccount(u, p)
+		return a, u, reason
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	owner := credentials.Load()
+	if token != "" {
+		if owner.token != "" && secretEqual(token, owner.token) {
+			return ownerAccount("token"), "", ""
+		}
+		return nil, "", "bad-token"
+	}
+	// Stale cookies, e.g. after a logout elsewhere or a new token, are like none
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if a := sessionAccount(c.Value); a != nil {
+			return a, a.Name, ""
+		}
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil && owner.token != "" && secretEqual(c.Value, owner.token) {
+		return ownerAccount("token"), "", ""
+	}
+	return nil, "", ""
+}
+
+// passwordAccount checks user and password against -auth and the stored
+// accounts. If they are wrong, a is nil and reason says why.
+func passwordAccount(user, password string) (a *account, reason string) {
+	if owner := credentials.Load(); owner.user != "" && user == owner.user {
+		if secretEqual(password, owner.pass) {
+			return ownerAccount(user), ""
+		}
+		return nil, "bad-password"
+	}
+	stored, ok := getAccount(user)
+	if !ok {
+		return nil, "unknown-user"
+	}
+	if !stored.passwordOK(password) {
+		return nil, "bad-password"
+	}
+	return stored, ""
+}
+
+// authChallenge tells the client which credentials the server takes
+func authChallenge(w http.ResponseWriter) {
+	owner := credentials.Load()
+	if owner.user != "" || atomic.LoadInt64(&accountCount) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+authRealm+`", charset="UTF-8"`)
+	}
+	if owner.token != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+authRealm+`"`)
+	}
+}
+
+// anonymousAllowed reports whether r may go on without credentials, to be
+// checked by the handler where needed
+func (fs *FileServer) anonymousAllowed(r *http.Request) bool {
+	switch {
+	case *kiosk != "" && kioskPath(r.URL.Path),
+		r.URL.Path == "/api/login",
+		r.URL.Path == "/api/me",
+		r.URL.Path == "/api/logout",
+		strings.HasPrefix(r.URL.Path, "/static/"),
+		strings.HasPrefix(r.URL.Path, sharePrefix),
+		r.URL.Path == "/api/raw" && *signRaw && r.URL.Query().Get("sig") != "":
+		return true
+	}
+	if fs.cfg().Access == accessPublicRead {
+		return true
+	}
+	return fs.publicReadRequest(r)
+}
+
+// anonymousListings are the endpoints that show anonymous visitors only what
+// they may read when asked without a path: the page, the list of roots and
+// searches
+var anonymousListings = map[string]bool{
+	"/":           true,
+	"/index.html": true,
+	"/api/tree":   true,
+	"/api/search": true,
+}
+
+// publicReadRequest reports whether r only reads, and only from roots with
+// public-read access, or lists what is readable of them
+func (fs *FileServer) publicReadRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case "PROPFIND", http.MethodOptions:
+		if !strings.HasPrefix(r.URL.Path, davPrefix) {
+			return false
+		}
+	default:
+		return false
+	}
+	var paths []string
+	if token, ok := strings.CutPrefix(r.URL.Path, "/r/"); ok {
+		l, ok := fs.shortLinks.lookup(token)
+		if !ok {
+			return false
+		}
+		paths = append(paths, fs.publicPath(l.Path))
+	}
+	for _, prefix := range []string{browsePrefix, davPrefix} {
+		if rest, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+			if name, _, _ := strings.Cut(rest, "/"); name != "" {
+				paths = append(paths, "/"+name)
+			}
+		}
+	}
+	q := r.URL.Query()
+	for _, key := range pathParams {
+		for _, v := range q[key] {
+			if isPathParam(r, key, v) {
+				paths = append(paths, v)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return anonymousListings[r.URL.Path] || strings.HasPrefix(r.URL.Path, browsePrefix) || strings.HasPrefix(r.URL.Path, davPrefix)
+	}
+	for _, p := range paths {
+		local := fs.localPath(p)
+		if local == "" || !fs.publicRead(local) {
+			return false
+		}
+	}
+	return true
+}
+
+// authMiddleware finds out who sent the request (see accountOf), answers 401
+// to requests without valid credentials unless anonymous visitors are let in,
+// and logs wrong ones
+func (fs *FileServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a, user, reason := checkCredentials(r)
+		switch {
+		case a != nil:
+			r = r.WithContext(context.WithValue(r.Context(), accountKey{}, a))
+			if t := r.URL.Query().Get("token"); t != "" {
+				http.SetCookie(w, &http.Cookie{
+					Name:     tokenCookie,
+					Value:    t,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+					Expires:  time.Now().Add(30 * 24 * time.Hour),
+				})
+			}
+		case reason != "":
+			fs.logAuthFailure(r, user, reason)
+			authChallenge(w)
+			apiError(w, http.StatusUnauthorized, codeBadCredentials, "Invalid credentials")
+			return
+		case !fs.anonymousAllowed(r):
+			if r.Method == http.MethodGet && (r.URL.Path == "/" || r.URL.Path == "/index.html") {
+				http.ServeFile(w, r, "./static/login.html")
+				return
+			}
+			authChallenge(w)
+			httpError(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// With logins on, anonymous visitors only get to read public-read roots
+func TestAnonymousAccess(t *testing.T) {
+	fs, docs, other, _ := testServer(t)
+	configure(t, fs, docs, other, rootConfig{Path: docs, Access: accessPublicRead})
+	withLogins(t)
+	h := fs.authMiddleware(fs.jailMiddleware(fs.visibilityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+
+	tests := []struct {
+		method, url string
+		login       bool
+		status      int
+	}{
+		{"GET", "/api/file?path=/docs/a.txt", false, 200},
+		{"HEAD", "/api/raw?path=/docs/sub", false, 200},
+		{"GET", "/api/tree", false, 200},
+		{"GET", "/browse/docs/", false, 200},
+		{"GET", "/api/file?path=/other/b.txt", false, 401},
+		{"GET", "/api/file?path=/docs/a.txt&path=/other/b.txt", false, 401},
+		{"GET", "/api/file?path=/docs/to-other/b.txt", false, 401},
+		{"GET", "/api/search?q=b&root=/other", false, 401},
+		{"GET", "/browse/other/", false, 401},
+		{"GET", "/api/jobs", false, 401},
+		{"GET", "/r/unknown", false, 401},
+		{"POST", "/api/upload?folder=/docs", false, 401},
+		{"DELETE", "/api/file?path=/docs/a.txt", false, 401},
+		{"GET", "/api/file?path=/other/b.txt", true, 200},
+		{"POST", "/api/upload?folder=/other", true, 200},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.login {
+			r.SetBasicAuth("u", "p")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s (logged in: %v) = %d, want %d", tt.method, tt.url, tt.login, w.Code, tt.status)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/file?path=/docs/a.txt", nil)
+	r.SetBasicAuth("u", "wrong")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 401 {
+		t.Errorf("wrong password = %d, want 401", w.Code)
+	}
+}
+
+// Private roots are hidden from anonymous visitors, even behind a link
+func TestPrivateRoot(t *testing.T) {
+	fs, docs, other, _ := testServer(t)
+	configure(t, fs, docs, other, rootConfig{Path: other, Visibility: visibilityPrivate})
+	h := fs.jailMiddleware(fs.visibilityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, url := range []string{"/api/file?path=/other/b.txt", "/api/file?path=/docs/to-other/b.txt"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 404 {
+			t.Errorf("%s = %d, want 404", url, w.Code)
+		}
+	}
+	if roots := fs.visibleRoots(httptest.NewRequest("GET", "/api/search", nil), nil); len(roots) != 1 || roots[0] != docs {
+		t.Errorf("visible roots %v, want only %s", roots, docs)
+	}
+	if !fs.visibleTo(as(httptest.NewRequest("GET", "/", nil), "alice", roleReadOnly), other) {
+		t.Error("a private root is hidden from users")
+	}
+}
+
+// Changes take the read-write role, managing the server the admin role
+func TestRoles(t *testing.T) {
+	fs, docs, _, _ := testServer(t)
+	withLogins(t)
+	tests := []struct {
+		role          string
+		write, manage int
+	}{
+		{"", 401, 401},
+		{roleReadOnly, 403, 403},
+		{roleReadWrite, 200, 403},
+		{roleAdmin, 200, 200},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		if tt.role != "" {
+			r = as(r, "someone", tt.role)
+		}
+		w := httptest.NewRecorder()
+		if fs.requireWrite(w, r, docs) {
+			w.WriteHeader(200)
+		}
+		if w.Code != tt.write {
+			t.Errorf("%q changing files: %d, want %d", tt.role, w.Code, tt.write)
+		}
+		w = httptest.NewRecorder()
+		if requireRole(w, r, roleAdmin) {
+			w.WriteHeader(200)
+		}
+		if w.Code != tt.manage {
+			t.Errorf("%q managing: %d, want %d", tt.role, w.Code, tt.manage)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication failures are written one per line to the -auth-log file in a
+// fixed format that fail2ban (or any log scanner) can match:
+//
+//	2026-01-02T15:04:05Z auth failure ip=203.0.113.7 user="alice" reason=bad-password
+//
+// The user is always quoted ("" if unknown) and the reason is a single word.
+
+var authLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openAuthLog starts appending auth failures to path, "" for nowhere,
+// closing the file they went to before
+func openAuthLog(path string) error {
+	f, err := createAuthLog(path)
+	if err != nil {
+		return err
+	}
+	useAuthLog(f)
+	return nil
+}
+
+// createAuthLog opens path for appending, nil for ""
+func createAuthLog(path string) (*os.File, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+}
+
+// useAuthLog sends auth failures to f, closing the file they went to before
+func useAuthLog(f *os.File) {
+	authLog.mu.Lock()
+	defer authLog.mu.Unlock()
+	if authLog.f != nil {
+		authLog.f.Close()
+	}
+	authLog.f = f
+}
+
+// logAuthFailure records a failed authentication attempt from r and
+// publishes it to the notification channels
+func (fs *FileServer) logAuthFailure(r *http.Request, user, reason string) {
+	reason = strings.Join(strings.Fields(reason), "-")
+	fs.events.publish(event{Type: eventAuth, Data: map[string]string{"ip": clientIP(r).String(), "user": user, "reason": reason}})
+	authLog.mu.Lock()
+	defer authLog.mu.Unlock()
+	if authLog.f == nil {
+		return
+	}
+	fmt.Fprintf(authLog.f, "%s auth failure ip=%s user=%q reason=%s\n",
+		time.Now().UTC().Format(time.RFC3339), clientIP(r), user, reason)
+}
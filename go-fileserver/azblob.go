@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the version of the Blob service REST API used
+const azureAPIVersion = "2021-08-06"
+
+// azureClient talks to a container of Azure Blob Storage through its REST API
+type azureClient struct {
+	container string
+	account   string
+	endpoint  *url.URL   // of the Blob service, e.g. https://account.blob.core.windows.net
+	key       []byte     // the account key requests are signed with, or
+	sas       url.Values // a shared access signature added to them
+	client    *http.Client
+}
+
+// newAzureClient is the client of an azblob:// container. The account is
+// taken from the environment like the Azure CLI does:
+// AZURE_STORAGE_CONNECTION_STRING, or AZURE_STORAGE_ACCOUNT with
+// AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN.
+func newAzureClient(container string) (objectClient, error) {
+	c := &azureClient{container: container, client: &http.Client{}}
+	var key, sas, endpoint string
+	if cs := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); cs != "" {
+		fields := make(map[string]string)
+		for _, part := range strings.Split(cs, ";") {
+			if k, v, ok := strings.Cut(part, "="); ok {
+				fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		c.account, key, sas, endpoint = fields["AccountName"], fields["AccountKey"], fields["SharedAccessSignature"], fields["BlobEndpoint"]
+		if endpoint == "" && c.account != "" {
+			endpoint = firstNonEmpty(fields["DefaultEndpointsProtocol"], "https") + "://" + c.account + ".blob." + firstNonEmpty(fields["EndpointSuffix"], "core.windows.net")
+		}
+	} else {
+		c.account, key, sas = os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY"), os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+		if c.account != "" {
+			endpoint = "https://" + c.account + ".blob.core.windows.net"
+		}
+	}
+	if endpoint == "" || key == "" && sas == "" {
+		return nil, fmt.Errorf("azblob://%s: no storage account in AZURE_STORAGE_CONNECTION_STRING or AZURE_STORAGE_ACCOUNT with AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN", container)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Azure Blob endpoint %q", endpoint)
+	}
+	c.endpoint = u
+	if key != "" {
+		if c.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("invalid Azure storage key: %v", err)
+		}
+	} else if c.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+		return nil, fmt.Errorf("invalid Azure SAS token: %v", err)
+	}
+	return c, nil
+}
+
+// blobURL is the URL of key in the container, of the container for ""
+func (c *azureClient) blobURL(key string, q url.Values) *url.URL {
+	u := *c.endpoint
+	p := "/" + c.container
+	if key != "" {
+		p += "/" + key
+	}
+	u.Path = c.endpoint.Path + p
+	u.RawPath = c.endpoint.EscapedPath() + s3Escape(p, true)
+	query := url.Values{}
+	for k, v := range q {
+		query[k] = v
+	}
+	for k, v := range c.sas {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// request sends a request for key, "" for the container, signed with the
+// account key unless a SAS token is used
+func (c *azureClient) request(method, key string, q url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.blobURL(key, q).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	if c.key != nil {
+		c.signSharedKey(req)
+	}
+	return c.client.Do(req)
+}
+
+// signSharedKey signs req with the account key (Shared Key authorization)
+func (c *azureClient) signSharedKey(req *http.Request) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var headers []string
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			headers = append(headers, k+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + c.account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	names := make([]string, 0, len(q))
+	for k := range q {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, as x-ms-date is sent
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(headers, "\n"),
+		resource,
+	}, "\n")
+	sig := base64.StdEncoding.EncodeToString(hmacSHA256(c.key, toSign))
+	req.Header.Set("Authorization", "SharedKey "+c.account+":"+sig)
+}
+
+func (c *azureClient) list(prefix string, recursive bool, limit int) ([]objectInfo, []string, error) {
+	var objects []objectInfo
+	var prefixes []string
+	q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+	if !recursive {
+		q.Set("delimiter", "/")
+	}
+	if limit > 0 {
+		q.Set("maxresults", strconv.Itoa(limit))
+	}
+	for {
+		resp, err := c.request(http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, nil, objectHTTPError("list", c.container+"/"+prefix, resp)
+		}
+		var result struct {
+			Blobs struct {
+				Blob []struct {
+					Name       string
+					Properties struct {
+						LastModified  string `xml:"Last-Modified"`
+						ContentLength int64  `xml:"Content-Length"`
+					}
+				}
+				BlobPrefix []struct{ Name string }
+			}
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("list %s/%s: %v", c.container, prefix, err)
+		}
+		for _, b := range result.Blobs.Blob {
+			modified, _ := http.ParseTime(b.Properties.LastModified)
+			objects = append(objects, objectInfo{key: b.Name, size: b.Properties.ContentLength, modified: modified})
+		}
+		for _, p := range result.Blobs.BlobPrefix {
+			prefixes = append(prefixes, p.Name)
+		}
+		if result.NextMarker == "" || limit > 0 {
+			return objects, prefixes, nil
+		}
+		q.Set("marker", result.NextMarker)
+	}
+}
+
+func (c *azureClient) head(key string) (objectInfo, error) {
+	resp, err := c.request(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectInfo{}, objectHTTPError("stat", key, resp)
+	}
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{key: key, size: resp.ContentLength, modified: modified}, nil
+}
+
+func (c *azureClient) get(key string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if n < 0 {
+		header.Set("X-Ms-Range", fmt.Sprintf("bytes=%d-", off))
+	} else {
+		header.Set("X-Ms-Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	}
+	resp, err := c.request(http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && off == 0) {
+		defer resp.Body.Close()
+		return nil, objectHTTPError("read", key, resp)
+	}
+	return resp.Body, nil
+}
+
+func (c *azureClient) put(key string, r io.Reader, size int64) error {
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Type", "BlockBlob")
+	resp, err := c.request(http.MethodPut, key, nil, header, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return objectHTTPError("write", key, resp)
+	}
+	return nil
+}
+
+func (c *azureClient) delete(key string) error {
+	resp, err := c.request(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return objectHTTPError("remove", key, resp)
+	}
+	return nil
+}
+
+// copy starts a server-side copy and waits for it, as a copy within an
+// account usually is done at once but may be left pending
+func (c *azureClient) copy(from, to string) error {
+	header := http.Header{}
+	header.Set("X-Ms-Copy-Source", c.blobURL(from, nil).String())
+	resp, err := c.request(http.MethodPut, to, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return objectHTTPError("copy", from, resp)
+	}
+	status := resp.Header.Get("X-Ms-Copy-Status")
+	for status == "pending" {
+		time.Sleep(time.Second)
+		if resp, err = c.request(http.MethodHead, to, nil, nil, nil, 0); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		status = resp.Header.Get("X-Ms-Copy-Status")
+	}
+	if status != "success" {
+		return fmt.Errorf("copy %s to %s: %s %s", from, to, status, resp.Header.Get("X-Ms-Copy-Status-Description"))
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A server export is a .tar.gz holding everything but the served files: the
+// config file, the metadata store and the URL signing key, so signed links and
+// short links keep working on the new host.
+const (
+	exportInfoName   = "export.json"
+	exportConfigName = "config.json"
+	exportFormat     = 1
+)
+
+// exportInfo describes an export archive
+type exportInfo struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+	Host    string    `json:"host"`
+	Schema  int       `json:"schema"` // store schema version
+}
+
+// storeLocation is where the store of the config at cfgPath lives
+func storeLocation(cfgPath string) (string, error) {
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Database != "" {
+		return cfg.Database, nil
+	}
+	return statePath(storeFile), nil
+}
+
+// runExportCommand implements `go-fileserver export -o <file>`
+func runExportCommand(args []string) {
+	cmd := flag.NewFlagSet("export", flag.ExitOnError)
+	out := cmd.String("o", "", "Archive to write (.tar.gz)")
+	dir := cmd.String("data-dir", *dataDir, "Directory for server state")
+	cfgPath := cmd.String("config", "", "Config file to include")
+	cmd.Parse(args)
+	if *out == "" {
+		log.Fatal("Usage: go-fileserver export -o <backup.tar.gz> [-data-dir <dir>] [-config <file>]")
+	}
+	*dataDir = *dir
+	if err := exportState(*out, *cfgPath); err != nil {
+		os.Remove(*out)
+		log.Fatalf("Export: %v", err)
+	}
+	log.Printf("Exported server state to %s", *out)
+}
+
+func exportState(out, cfgPath string) error {
+	dbPath, err := storeLocation(cfgPath)
+	if err != nil {
+		return err
+	}
+	b, err := bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("%s is in use, stop the server first", dbPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	info := exportInfo{Format: exportFormat, Created: time.Now()}
+	info.Host, _ = os.Hostname()
+	err = b.View(func(tx *bolt.Tx) error {
+		if m := tx.Bucket([]byte(bucketMeta)); m != nil {
+			info.Schema, _ = strconv.Atoi(string(m.Get([]byte("version"))))
+		}
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, exportInfoName, data, 0644); err != nil {
+			return err
+		}
+		// A transaction gives a consistent copy of the database
+		if err := tw.WriteHeader(&tar.Header{Name: storeFile, Mode: 0600, Size: tx.Size(), ModTime: info.Created}); err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(tw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if key, err := os.ReadFile(statePath(signingKeyFile)); err == nil {
+		if err := writeTarFile(tw, signingKeyFile, key, 0600); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if cfgPath != "" {
+		data, err := os.ReadFile(cfgPath)
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, exportConfigName, data, 0600); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// runImportCommand implements `go-fileserver import <file>`
+func runImportCommand(args []string) {
+	cmd := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := cmd.String("data-dir", *dataDir, "Directory for server state")
+	cfgPath := cmd.String("config", "", "Where to write the exported config file")
+	force := cmd.Bool("force", false, "Replace existing state")
+	cmd.Parse(args)
+	if cmd.NArg() != 1 {
+		log.Fatal("Usage: go-fileserver import [-data-dir <dir>] [-config <file>] [-force] <backup.tar.gz>")
+	}
+	*dataDir = *dir
+	if err := importState(cmd.Arg(0), *cfgPath, *force); err != nil {
+		log.Fatalf("Import: %v", err)
+	}
+}
+
+func importState(archive, cfgPath string, force bool) error {
+	files, err := readExport(archive)
+	if err != nil {
+		return err
+	}
+	var info exportInfo
+	if err := json.Unmarshal(files[exportInfoName], &info); err != nil {
+		return fmt.Errorf("%s is not a server export", archive)
+	}
+	if info.Format > exportFormat {
+		return fmt.Errorf("%s was written by a newer server (format %d)", archive, info.Format)
+	}
+	if files[storeFile] == nil {
+		return fmt.Errorf("%s contains no %s", archive, storeFile)
+	}
+
+	// The database goes where the imported config (if written) expects it
+	dbPath := statePath(storeFile)
+	if cfg := files[exportConfigName]; cfg != nil && cfgPath != "" {
+		var c Config
+		if err := json.Unmarshal(cfg, &c); err != nil {
+			return fmt.Errorf("%s: %v", exportConfigName, err)
+		}
+		if c.Database != "" {
+			dbPath = c.Database
+		}
+	}
+	targets := map[string][]byte{dbPath: files[storeFile]}
+	if key := files[signingKeyFile]; key != nil {
+		targets[statePath(signingKeyFile)] = key
+	}
+	if cfg := files[exportConfigName]; cfg != nil {
+		if cfgPath == "" {
+			log.Printf("Import: the export contains a config file; pass -config to restore it")
+		} else {
+			targets[cfgPath] = cfg
+		}
+	}
+	if !force {
+		for p := range targets {
+			if _, err := os.Stat(p); err == nil {
+				return fmt.Errorf("%s already exists (use -force to replace it)", p)
+			}
+		}
+	}
+	for p, data := range targets {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+		log.Printf("Import: wrote %s", p)
+	}
+	// Open the store once so it is checked and migrated right away
+	s, err := openStore(dbPath)
+	if err != nil {
+		return err
+	}
+	s.bolt.Close()
+	log.Printf("Imported server state from %s (exported %s from %s)", archive, info.Created.Format(time.RFC3339), info.Host)
+	return nil
+}
+
+// readExport loads the files of an export archive into memory
+func readExport(archive string) (map[string][]byte, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a server export: %v", archive, err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Name {
+		case exportInfoName, exportConfigName, storeFile, signingKeyFile:
+			if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
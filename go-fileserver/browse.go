@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// browsePrefix serves the served folders as plain HTML directory listings, in
+// the style of nginx autoindex, for clients without JavaScript (curl, wget
+// --mirror, old browsers). /browse/<root>/<path> maps to <path> inside the
+// served folder named <root>; nothing outside the served folders is reachable.
+const browsePrefix = "/browse/"
+
+// browseRoot finds the visible served folder with the given name (see rootName)
+func (fs *FileServer) browseRoot(r *http.Request, name string) string {
+	for _, f := range fs.visibleRoots(r, nil) {
+		if abs, err := filepath.Abs(f); err == nil && fs.rootName(abs) == name {
+			return abs
+		}
+	}
+	return ""
+}
+
+// API: Plain HTML directory listings and file downloads under /browse/
+func (fs *FileServer) handleBrowse(w http.ResponseWriter, r *http.Request) {
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, browsePrefix))
+	if rel == "/" {
+		var names []string
+		for _, f := range fs.visibleRoots(r, nil) {
+			if abs, err := filepath.Abs(f); err == nil {
+				names = append(names, fs.rootName(abs)+"/")
+			}
+		}
+		writeIndex(w, "/", names, nil)
+		return
+	}
+
+	name, sub, _ := strings.Cut(strings.TrimPrefix(rel, "/"), "/")
+	root := fs.browseRoot(r, name)
+	if root == "" {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	full := filepath.Join(root, filepath.FromSlash(sub))
+	if !fs.requireRead(w, r, full) {
+		return
+	}
+	store := fs.storageFor(full)
+	fi, err := store.Stat(full)
+	if err != nil || !fs.inRoots(full) {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if !fi.IsDir() {
+		if !fs.rawAllowed(r, full) {
+			httpError(w, "Missing or expired signature", 403)
+			return
+		}
+		f, err := store.Open(full)
+		if err != nil {
+			httpError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		ct := detectFileContentType(f, full)
+		w.Header().Set("Content-Type", ct)
+		fs.setDisposition(w, full, ct)
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	names, infos, err := readIndex(store, full, fs.hidesDotFiles(full))
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	writeIndex(w, rel+"/", names, func(n string) (string, os.FileInfo) {
+		if q := fs.rawSigned(filepath.Join(full, n)); len(q) > 0 && !strings.HasSuffix(n, "/") {
+			return "?" + q.Encode(), infos[n]
+		}
+		return "", infos[n]
+	})
+}
+
+// readIndex reads a folder of store for writeIndex: the names of its
+// entries, folders first and with a slash, and their details. With noHidden,
+// dot entries are left out.
+func readIndex(store Storage, dir string, noHidden bool) ([]string, map[string]os.FileInfo, error) {
+	entries, err := store.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	infos := make(map[string]os.FileInfo)
+	for _, e := range entries {
+		if isInternal(e.Name()) || noHidden && strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		n := e.Name()
+		if info.IsDir() {
+			n += "/"
+		}
+		names = append(names, n)
+		infos[n] = info
+	}
+	// Folders first, like nginx
+	sort.SliceStable(names, func(a, b int) bool {
+		return strings.HasSuffix(names[a], "/") && !strings.HasSuffix(names[b], "/")
+	})
+	return names, infos, nil
+}
+
+// writeIndex renders an "Index of" page. details returns the query string to
+// append to an entry's link and its file info (nil for none).
+func writeIndex(w http.ResponseWriter, dir string, names []string, details func(string) (string, os.FileInfo)) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	title := html.EscapeString("Index of " + dir)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1><hr><pre>", title, title)
+	if dir != "/" {
+		fmt.Fprint(w, "<a href=\"../\">../</a>\n")
+	}
+	for _, n := range names {
+		href := (&url.URL{Path: n}).EscapedPath()
+		if strings.Contains(n, ":") {
+			href = "./" + href // "a:b" would be read as a URL scheme
+		}
+		var q string
+		var fi os.FileInfo
+		if details != nil {
+			q, fi = details(n)
+		}
+		label := []rune(n)
+		if len(label) > 50 {
+			label = append(label[:47], []rune("..>")...)
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>", html.EscapeString(href+q), html.EscapeString(string(label)))
+		if fi == nil {
+			fmt.Fprint(w, "\n")
+			continue
+		}
+		fmt.Fprint(w, strings.Repeat(" ", 51-len(label)))
+		size := "-"
+		if !fi.IsDir() {
+			size = fmt.Sprint(fi.Size())
+		}
+		fmt.Fprintf(w, "%s %19s\n", fi.ModTime().Format("02-Jan-2006 15:04"), size)
+	}
+	fmt.Fprint(w, "</pre><hr></body>\n</html>\n")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// casGCEvery is how often unreferenced blobs are removed in content-addressable mode
+const casGCEvery = time.Hour
+
+// In content-addressable mode (-cas) every uploaded file is stored once per root
+// under .cas/blobs/<hash[:2]>/<hash>, and the visible file is a hardlink to the
+// blob. Identical uploads share storage, and the HTTP API is unchanged because
+// the tree still contains ordinary files.
+
+func casBlobPath(root, sum string) string {
+	return filepath.Join(root, casDirName, "blobs", sum[:2], sum)
+}
+
+// casWrite stores r as a blob in dst's root and links dst to it, replacing any
+// existing file at dst without touching its old content (other references may share it).
+func (fs *FileServer) casWrite(dst string, r io.Reader) (string, error) {
+	root := fs.rootOf(dst)
+	if root == "" {
+		return "", fmt.Errorf("destination is not inside a served folder")
+	}
+	tmpDir := filepath.Join(root, casDirName, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return "", err
+	}
+	// CreateTemp makes the file private; blobs are regular files in the tree
+	tmp.Chmod(0644)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	blob := casBlobPath(root, sum)
+	if _, err := os.Stat(blob); err == nil {
+		// Already stored: drop the new copy
+		os.Remove(tmp.Name())
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		if err := os.Rename(tmp.Name(), blob); err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	return sum, replaceWithLink(blob, dst)
+}
+
+// casGC removes blobs that no file in the tree links to anymore
+func casGC(root string) {
+	dir := filepath.Join(root, casDirName, "blobs")
+	var removed int
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if n, ok := linkCount(fi); ok && n == 1 {
+			if os.Remove(p) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	// Leftovers from interrupted uploads
+	tmps, _ := filepath.Glob(filepath.Join(root, casDirName, "tmp", "upload-*"))
+	for _, t := range tmps {
+		if fi, err := os.Stat(t); err == nil && time.Since(fi.ModTime()) > casGCEvery {
+			os.Remove(t)
+		}
+	}
+	if removed > 0 {
+		log.Printf("CAS: removed %d unreferenced blobs from %s", removed, root)
+	}
+}
+
+// startCASGC collects garbage in every root now and then periodically
+func (fs *FileServer) startCASGC() {
+	go func() {
+		for {
+			for _, f := range fs.folderList() {
+				if abs, err := filepath.Abs(f); err == nil {
+					casGC(abs)
+				}
+			}
+			time.Sleep(casGCEvery)
+		}
+	}()
+}
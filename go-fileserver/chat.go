@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chatSlack   = "slack"
+	chatDiscord = "discord"
+	// chatMaxLines caps the events listed in one message
+	chatMaxLines = 15
+	// discordMaxContent is Discord's limit on the length of a message
+	discordMaxContent = 2000
+)
+
+// chatConfig posts human readable notifications to a Slack or Discord
+// incoming webhook (or anything that accepts their payloads, e.g. Mattermost).
+// Routing by event type is done with one entry per channel, each with its own
+// events filter.
+type chatConfig struct {
+	URL string `json:"url"`
+	// Format is "slack" or "discord"; by default it's guessed from the URL
+	Format string `json:"format"`
+	eventFilter
+	// BaseURL is the public address of this server, for links in messages
+	BaseURL string `json:"baseUrl"`
+	// Debounce is the quiet period before a batch is posted (default 2s)
+	Debounce string `json:"debounce"`
+}
+
+func (c *chatConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("chat: invalid url %q", c.URL)
+	}
+	if c.Format == "" {
+		c.Format = chatSlack
+		if strings.HasSuffix(u.Hostname(), "discord.com") || strings.HasSuffix(u.Hostname(), "discordapp.com") {
+			c.Format = chatDiscord
+		}
+	}
+	if c.Format != chatSlack && c.Format != chatDiscord {
+		return fmt.Errorf("chat %s: unknown format %q", u.Host, c.Format)
+	}
+	if c.Debounce != "" {
+		if d, err := time.ParseDuration(c.Debounce); err != nil || d < 0 {
+			return fmt.Errorf("chat %s: invalid debounce %q", u.Host, c.Debounce)
+		}
+	}
+	if err := c.eventFilter.validate(); err != nil {
+		return fmt.Errorf("chat %s: %v", u.Host, err)
+	}
+	return nil
+}
+
+// startChat subscribes the chat webhooks to the event bus
+func (fs *FileServer) startChat(cfgs []chatConfig) {
+	watch := false
+	for i := range cfgs {
+		c := &cfgs[i]
+		h := &webhook{cfg: webhookConfig{URL: c.URL}, client: &http.Client{Timeout: webhookTimeout}}
+		debounce := eventDebounce
+		if c.Debounce != "" {
+			debounce, _ = time.ParseDuration(c.Debounce)
+		}
+		fs.subscribeBatched("Chat webhook", c.eventFilter, debounce, true, func(events []event) {
+			text := c.message(events)
+			field := "text"
+			if c.Format == chatDiscord {
+				field = "content"
+				if len(text) > discordMaxContent {
+					text = text[:strings.LastIndex(text[:discordMaxContent-4], "\n")+1] + "…"
+				}
+			}
+			body, err := json.Marshal(map[string]string{field: text})
+			if err != nil {
+				return
+			}
+			h.send(body, len(events))
+		})
+		watch = watch || c.eventFilter.wantsFileEvents()
+	}
+	if watch {
+		fs.watchFiles()
+	}
+}
+
+// message formats a batch of events, one line each
+func (c *chatConfig) message(events []event) string {
+	var lines []string
+	for i, ev := range events {
+		if i == chatMaxLines {
+			lines = append(lines, fmt.Sprintf("… and %d more", len(events)-i))
+			break
+		}
+		lines = append(lines, c.describe(ev))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *chatConfig) describe(ev event) string {
+	what := "`" + ev.Path + "`"
+	if ev.Folder {
+		what = "folder " + what
+	}
+	switch ev.Type {
+	case eventCreated:
+		return "Created " + what
+	case eventModified:
+		return "Modified " + what
+	case eventDeleted:
+		return "Deleted " + what
+	case eventRenamed:
+		return "Renamed or moved away " + what
+	case eventUploaded:
+		return "Uploaded " + what
+	case eventShared:
+		s := "Shared " + what + " as " + c.link(ev.Data["url"])
+		if exp := ev.Data["expires"]; exp != "" {
+			s += " until " + exp
+		}
+		return s
+	case eventAccessed:
+		return fmt.Sprintf("Short link %s to %s opened from %s", c.link("/r/"+ev.Data["token"]), what, ev.Data["ip"])
+	case eventLowDisk:
+		avail, _ := strconv.ParseInt(ev.Data["available"], 10, 64)
+		min, _ := strconv.ParseInt(ev.Data["minFree"], 10, 64)
+		return fmt.Sprintf(":warning: Low disk space for %s: %s available, minimum is %s", what, formatSize(avail), formatSize(min))
+	case eventReport:
+		return strings.TrimSpace(ev.Data["summary"]) + "\nDetails: " + c.link(ev.Data["url"])
+	case eventAuth:
+		s := ":warning: Authentication failure from " + ev.Data["ip"]
+		if u := ev.Data["user"]; u != "" {
+			s += fmt.Sprintf(" (user %q)", u)
+		}
+		return s + ": " + ev.Data["reason"]
+	}
+	return ev.Type + " " + what
+}
+
+// link makes a server path absolute when a base URL is configured
+func (c *chatConfig) link(p string) string {
+	if c.BaseURL == "" {
+		return p
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + p
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clipboardTTL is how long an untouched clipboard is kept
+const clipboardTTL = 24 * time.Hour
+
+// clipboardEntry is the set of paths a client cut or copied
+type clipboardEntry struct {
+	Mode    string    `json:"mode"` // "cut" or "copy"
+	Paths   []string  `json:"paths"`
+	Updated time.Time `json:"updated"`
+}
+
+// clipboards holds one clipboard per client, in memory
+type clipboards struct {
+	mu      sync.Mutex
+	entries map[string]*clipboardEntry
+}
+
+func newClipboards() *clipboards {
+	return &clipboards{entries: make(map[string]*clipboardEntry)}
+}
+
+func (c *clipboards) get(id string) *clipboardEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[id]
+}
+
+func (c *clipboards) set(id string, e *clipboardEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, old := range c.entries {
+		if time.Since(old.Updated) > clipboardTTL {
+			delete(c.entries, k)
+		}
+	}
+	if e == nil {
+		delete(c.entries, id)
+	} else {
+		c.entries[id] = e
+	}
+}
+
+// copyName returns a free name in dir for a copy of base, e.g. "a (copy).txt"
+func copyName(dir, base string) string {
+	if !fileExists(filepath.Join(dir, base)) {
+		return base
+	}
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		suffix := " (copy)"
+		if i > 1 {
+			suffix = fmt.Sprintf(" (copy %d)", i)
+		}
+		if name := stem + suffix + ext; !fileExists(filepath.Join(dir, name)) {
+			return name
+		}
+	}
+}
+
+// API: Clipboard. GET shows the client's clipboard, POST {mode, paths} fills it,
+// DELETE clears it. POST /api/clipboard/paste {dest} moves (cut) or copies the
+// paths into dest as a background job.
+func (fs *FileServer) handleClipboard(w http.ResponseWriter, r *http.Request) {
+	id := clientID(w, r)
+	if strings.TrimSuffix(r.URL.Path, "/") == "/api/clipboard/paste" {
+		fs.handlePaste(w, r, id)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		e := fs.clipboard.get(id)
+		if e == nil {
+			e = &clipboardEntry{Paths: []string{}}
+		}
+		json.NewEncoder(w).Encode(e)
+	case http.MethodPost:
+		var req clipboardEntry
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid JSON body", 400)
+			return
+		}
+		if req.Mode != "cut" && req.Mode != "copy" {
+			httpError(w, "mode must be cut or copy", 400)
+			return
+		}
+		if len(req.Paths) == 0 {
+			httpError(w, "Missing paths", 400)
+			return
+		}
+		// Kept as the client sent them, paste resolves them again
+		local := append([]string(nil), req.Paths...)
+		if !fs.resolvePathList(w, local) || !fs.requireRead(w, r, local...) || !fs.requireInRoots(w, local...) {
+			return
+		}
+		req.Updated = time.Now()
+		fs.clipboard.set(id, &req)
+		json.NewEncoder(w).Encode(req)
+	case http.MethodDelete:
+		fs.clipboard.set(id, nil)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (fs *FileServer) handlePaste(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Dest string `json:"dest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	clip := fs.clipboard.get(id)
+	if clip == nil {
+		httpError(w, "Clipboard is empty", 400)
+		return
+	}
+	op := "copy"
+	if clip.Mode == "cut" {
+		op = "move"
+	}
+	paths, dest, ok := fs.transferPaths(w, r, op, clip.Paths, req.Dest)
+	if !ok {
+		return
+	}
+
+	items := transferItems(paths, dest)
+	if clip.Mode != "cut" {
+		// Pasting a copy next to its original works like a file manager: it gets a new name
+		for i := range items {
+			items[i].dst = filepath.Join(dest, copyName(dest, filepath.Base(items[i].src)))
+		}
+	}
+	if err := fs.checkTransfer(items); err != nil {
+		writeError(w, err, 409)
+		return
+	}
+	for _, it := range items {
+		if _, err := os.Stat(it.src); err != nil {
+			writeError(w, err, 400)
+			return
+		}
+	}
+	if clip.Mode == "cut" {
+		// Cut items can only be pasted once
+		fs.clipboard.set(id, nil)
+	}
+	acceptedJob(w, r, fs.startTransfer(op, items, dest))
+}
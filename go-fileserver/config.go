@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds settings that don't fit on the command line. It is read from
+// the JSON, YAML or TOML file given with -config.
+type Config struct {
+	// Listen is the address to serve on, e.g. ":8080" or "127.0.0.1:8080"
+	Listen string `json:"listen"`
+
+	// TLS serves HTTPS with a certificate or through Let's Encrypt
+	TLS *tlsConfig `json:"tls"`
+
+	// Auth sets the credentials of -auth and -token
+	Auth *authConfig `json:"auth"`
+
+	// SmartFolders are virtual folders listed next to the served roots whose
+	// contents are the results of a search query, evaluated at list time.
+	SmartFolders []smartFolder `json:"smartFolders"`
+
+	// Previewers map extensions/MIME types to viewer renderers, including
+	// renderers that convert files with an external command.
+	Previewers []previewerConfig `json:"previewers"`
+
+	// MimeTypes adds or overrides extension to content type mappings
+	MimeTypes map[string]string `json:"mimeTypes"`
+
+	// Disposition controls which types /api/raw shows inline and which it
+	// forces to download. Nil means defaultDisposition.
+	Disposition *dispositionPolicy `json:"disposition"`
+
+	// Roots are the served folders unless -folders is given, which
+	// overrides them; either way their settings apply to the served folder
+	// with the same path
+	Roots []rootConfig `json:"roots"`
+
+	// Access is the default access preset for all roots (see access.go)
+	Access string `json:"access"`
+
+	// Hidden is the default hidden-file policy for all roots (see visibility.go)
+	Hidden string `json:"hidden"`
+
+	// LogLevel is "info" (default) or "warn", which leaves out routine notes
+	LogLevel string `json:"logLevel"`
+
+	// GeoIP enables country-based access rules when set
+	GeoIP *geoIPConfig `json:"geoip"`
+
+	// ClientLimits caps the transfers of each client address (see limits.go)
+	ClientLimits *clientLimitsConfig `json:"clientLimits"`
+
+	// Sites are folders published as plain static websites (see site.go)
+	Sites []siteConfig `json:"sites"`
+
+	// Webhooks receive batches of filesystem change events
+	Webhooks []webhookConfig `json:"webhooks"`
+
+	// MQTT publishes events to a broker when set
+	MQTT *mqttConfig `json:"mqtt"`
+
+	// SMTP is the mail server used by EmailRules
+	SMTP       *smtpConfig `json:"smtp"`
+	EmailRules []emailRule `json:"emailRules"`
+
+	// Chat posts notifications to Slack or Discord webhooks
+	Chat []chatConfig `json:"chat"`
+
+	// Fetch enables /api/fetch, downloading URLs into served folders
+	Fetch *fetchConfig `json:"fetch"`
+
+	// IPFS connects to a local IPFS node to publish and fetch content
+	IPFS *ipfsConfig `json:"ipfs"`
+
+	// Trackers are announced in torrents and magnet links (see torrent.go)
+	Trackers []string `json:"trackers"`
+
+	// Database is the metadata store file, by default fileserver.db in -data-dir
+	Database string `json:"database"`
+}
+
+// rootConfig holds settings for one served folder
+type rootConfig struct {
+	Path string `json:"path"`
+	// Alias is the name the folder is served under instead of its base name
+	Alias       string             `json:"alias"`
+	Disposition *dispositionPolicy `json:"disposition"`
+	Access      string             `json:"access"`
+	Visibility  string             `json:"visibility"`
+	Hidden      string             `json:"hidden"`
+	// ReadOnly refuses all changes to the folder, like -readonly does for all
+	ReadOnly bool `json:"readOnly"`
+	// MaxUpload caps the size of one uploaded file, e.g. "2G"
+	MaxUpload string `json:"maxUpload"`
+
+	uploadLimit int64 // MaxUpload in bytes, 0 for no limit
+}
+
+// tlsConfig is the "tls" config key, the counterpart of the TLS flags
+type tlsConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// Autocert are the domains to get Let's Encrypt certificates for
+	Autocert     []string `json:"autocert"`
+	Email        string   `json:"email"`
+	HTTPRedirect string   `json:"httpRedirect"`
+	HSTSMaxAge   string   `json:"hstsMaxAge"`
+}
+
+// authConfig is the "auth" config key, the counterpart of -auth and -token
+type authConfig struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	Log      string `json:"log"`
+}
+
+// smartFolder is a named search shown as a top-level folder in the tree
+type smartFolder struct {
+	searchQuery
+	Limit int `json:"limit,omitempty"`
+}
+
+// loadConfig reads the config file at path. An empty path yields the
+// defaults. Files ending in .yaml, .yml or .toml are read as YAML or TOML,
+// with the same keys as in JSON.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if doc != nil {
+		// Decoded through JSON, so all formats share the keys and parsing
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range cfg.Roots {
+		if cfg.Roots[i].Path == "" {
+			continue // reported by validate
+		}
+		if isObjectURL(cfg.Roots[i].Path) {
+			continue // matched once the bucket is mounted
+		}
+		abs, err := filepath.Abs(filepath.FromSlash(cfg.Roots[i].Path))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Roots[i].Path = abs
+	}
+	for i := range cfg.Sites {
+		if cfg.Sites[i].Path == "" {
+			continue // reported by validate
+		}
+		abs, err := filepath.Abs(filepath.FromSlash(cfg.Sites[i].Path))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Sites[i].Path = abs
+	}
+	return cfg, cfg.validate()
+}
+
+// configFlags are the flags the config file has keys for
+var configFlags = []string{"host", "port", "tls-cert", "tls-key", "autocert-domain", "autocert-email",
+	"http-redirect", "hsts-max-age", "auth", "token", "auth-log", "folders"}
+
+// cmdlineFlags are the flags given on the command line, noted before the
+// config file sets any
+var cmdlineFlags map[string]bool
+
+// applyFlags sets the flags the config file has keys for, except those given
+// on the command line, which override the file. Flags without a value in
+// the file get their defaults back, so a reload can also remove settings.
+func (c *Config) applyFlags() error {
+	values, err := c.flagValues()
+	if err != nil {
+		return err
+	}
+	setFlags(values)
+	return nil
+}
+
+// flagValues is what applyFlags sets, by flag name, checked but not applied
+func (c *Config) flagValues() (map[string]string, error) {
+	if cmdlineFlags == nil {
+		cmdlineFlags = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+	}
+	values := make(map[string]string)
+	if c.Listen != "" {
+		host, port, err := net.SplitHostPort(c.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("listen: %v", err)
+		}
+		values["host"] = host
+		if port != "" {
+			values["port"] = port
+		}
+	}
+	if t := c.TLS; t != nil {
+		values["tls-cert"] = t.Cert
+		values["tls-key"] = t.Key
+		values["autocert-domain"] = strings.Join(t.Autocert, ",")
+		values["autocert-email"] = t.Email
+		values["http-redirect"] = t.HTTPRedirect
+		values["hsts-max-age"] = t.HSTSMaxAge
+	}
+	if a := c.Auth; a != nil {
+		if a.User != "" || a.Password != "" {
+			values["auth"] = a.User + ":" + a.Password
+		}
+		values["token"] = a.Token
+		values["auth-log"] = a.Log
+	}
+	if len(c.Roots) > 0 {
+		paths := make([]string, len(c.Roots))
+		for i, rc := range c.Roots {
+			paths[i] = rc.Path
+		}
+		values["folders"] = strings.Join(paths, ",")
+	}
+	set := make(map[string]string)
+	for _, name := range configFlags {
+		if cmdlineFlags[name] {
+			continue
+		}
+		v := values[name]
+		if v == "" {
+			v = flag.Lookup(name).DefValue
+		}
+		if err := checkFlagValue(name, v); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		set[name] = v
+	}
+	return set, nil
+}
+
+// checkFlagValue reports whether flag.Set would take v for the flag name,
+// without setting it
+func checkFlagValue(name, v string) error {
+	var err error
+	switch flag.Lookup(name).Value.(flag.Getter).Get().(type) {
+	case time.Duration:
+		_, err = time.ParseDuration(v)
+	case bool:
+		_, err = strconv.ParseBool(v)
+	case int:
+		_, err = strconv.Atoi(v)
+	}
+	return err
+}
+
+// setFlags sets the flags of values, as checked by flagValues
+func setFlags(values map[string]string) {
+	for name, v := range values {
+		flag.Set(name, v)
+	}
+}
+
+// flagValue is the value of the flag name in values, or its current one
+func flagValue(values map[string]string, name string) string {
+	if v, ok := values[name]; ok {
+		return v
+	}
+	return flag.Lookup(name).Value.String()
+}
+
+func (c *Config) validate() error {
+	if err := validAccess(c.Access); err != nil {
+		return err
+	}
+	if err := validHidden(c.Hidden); err != nil {
+		return err
+	}
+	if err := validLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	aliases := make(map[string]bool)
+	for i := range c.Roots {
+		rc := &c.Roots[i]
+		if rc.Path == "" {
+			return fmt.Errorf("root %d: no path", i+1)
+		}
+		if err := validAccess(rc.Access); err != nil {
+			return fmt.Errorf("root %s: %v", rc.Path, err)
+		}
+		if err := validVisibility(rc.Visibility); err != nil {
+			return fmt.Errorf("root %s: %v", rc.Path, err)
+		}
+		if err := validHidden(rc.Hidden); err != nil {
+			return fmt.Errorf("root %s: %v", rc.Path, err)
+		}
+		if rc.Alias != "" {
+			if err := validRootName(rc.Alias); err != nil {
+				return fmt.Errorf("root %s: alias: %v", rc.Path, err)
+			}
+			if aliases[rc.Alias] {
+				return fmt.Errorf("duplicate root alias: %s", rc.Alias)
+			}
+			aliases[rc.Alias] = true
+		}
+		if rc.MaxUpload != "" {
+			n, err := parseSize(rc.MaxUpload)
+			if err != nil {
+				return fmt.Errorf("root %s: maxUpload: %v", rc.Path, err)
+			}
+			rc.uploadLimit = n
+		}
+	}
+	for i := range c.Sites {
+		if err := c.Sites[i].validate(); err != nil {
+			return err
+		}
+	}
+	for _, h := range c.Webhooks {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+	if c.MQTT != nil {
+		if err := c.MQTT.validate(); err != nil {
+			return err
+		}
+	}
+	if c.SMTP != nil {
+		if err := c.SMTP.validate(); err != nil {
+			return err
+		}
+	} else if len(c.EmailRules) > 0 {
+		return fmt.Errorf("emailRules need smtp settings")
+	}
+	for i := range c.EmailRules {
+		if err := c.EmailRules[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Chat {
+		if err := c.Chat[i].validate(); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, sf := range c.SmartFolders {
+		if sf.Name == "" {
+			return fmt.Errorf("smart folder without a name")
+		}
+		if seen[sf.Name] {
+			return fmt.Errorf("duplicate smart folder: %s", sf.Name)
+		}
+		seen[sf.Name] = true
+		if _, err := sf.filter(); err != nil {
+			return fmt.Errorf("smart folder %s: %v", sf.Name, err)
+		}
+	}
+	return nil
+}
+
+// rootConfig returns the config entry for the served folder containing path, if any
+func (fs *FileServer) rootConfig(path string) *rootConfig {
+	root := fs.rootOf(path)
+	if root == "" {
+		return nil
+	}
+	cfg := fs.cfg()
+	for i := range cfg.Roots {
+		if cfg.Roots[i].Path == root {
+			return &cfg.Roots[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentIndexKey = "content-index"
+	// contentIndexSaveEvery is how often a changed content index is written to disk
+	contentIndexSaveEvery = time.Minute
+)
+
+// contentEntry is the cached hash of a file, valid while size and mtime match
+type contentEntry struct {
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // UnixNano
+}
+
+// contentIndex remembers the SHA-256 of files the server has seen (uploads and
+// hashed destinations), so identical content can be found without rehashing.
+type contentIndex struct {
+	mu      sync.Mutex
+	byPath  map[string]contentEntry
+	byHash  map[string]map[string]bool
+	changed bool
+}
+
+func loadContentIndex() *contentIndex {
+	c := &contentIndex{byPath: make(map[string]contentEntry), byHash: make(map[string]map[string]bool)}
+	if err := loadState(contentIndexKey, &c.byPath); err != nil {
+		log.Printf("Content index: ignoring unreadable state: %v", err)
+		c.byPath = make(map[string]contentEntry)
+	}
+	for p, e := range c.byPath {
+		c.link(p, e.Hash)
+	}
+	go func() {
+		for range time.Tick(contentIndexSaveEvery) {
+			c.save()
+		}
+	}()
+	return c
+}
+
+func (c *contentIndex) link(path, hash string) {
+	if c.byHash[hash] == nil {
+		c.byHash[hash] = make(map[string]bool)
+	}
+	c.byHash[hash][path] = true
+}
+
+// add records the hash of a file that was just written or hashed
+func (c *contentIndex) add(path, hash string, fi os.FileInfo) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.byPath[abs]; ok {
+		delete(c.byHash[old.Hash], abs)
+	}
+	c.byPath[abs] = contentEntry{Hash: hash, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	c.link(abs, hash)
+	c.changed = true
+}
+
+// current reports whether a cached entry still describes the file on disk
+func (e contentEntry) current(fi os.FileInfo) bool {
+	return e.Size == fi.Size() && e.ModTime == fi.ModTime().UnixNano()
+}
+
+// hashOf returns the SHA-256 of path, using the cached value when the file is unchanged
+func (c *contentIndex) hashOf(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	abs, _ := filepath.Abs(path)
+	c.mu.Lock()
+	e, ok := c.byPath[abs]
+	c.mu.Unlock()
+	if ok && e.current(fi) {
+		return e.Hash, nil
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	c.add(path, sum, fi)
+	return sum, nil
+}
+
+// find returns an indexed file that still has the given content, among
+// those allowed reports true for
+func (c *contentIndex) find(hash string, allowed func(string) bool) (string, bool) {
+	c.mu.Lock()
+	var candidates []string
+	for p := range c.byHash[hash] {
+		candidates = append(candidates, p)
+	}
+	c.mu.Unlock()
+	for _, p := range candidates {
+		if !allowed(p) {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		c.mu.Lock()
+		e := c.byPath[p]
+		c.mu.Unlock()
+		if e.current(fi) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (c *contentIndex) save() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return
+	}
+	c.changed = false
+	if err := saveState(contentIndexKey, c.byPath); err != nil {
+		log.Printf("Content index: save failed: %v", err)
+	}
+}
+
+// API: Check which files of a pending upload are already present.
+// Files whose content exists at the destination are reported as "present"; files
+// whose content exists elsewhere on the server are copied into place ("copied").
+// Only "missing" files need to be uploaded.
+func (fs *FileServer) handleUploadCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Folder string `json:"folder"`
+		Files  []struct {
+			Path   string `json:"path"`
+			SHA256 string `json:"sha256"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	if req.Folder == "" {
+		httpError(w, "Missing folder", 400)
+		return
+	}
+	if !fs.resolvePaths(w, &req.Folder) {
+		return
+	}
+	folder := req.Folder
+	if !fs.requireInRoots(w, folder) || !fs.requireRead(w, r, folder) || !fs.requireWrite(w, r, folder) {
+		return
+	}
+
+	results := []map[string]string{}
+	for _, f := range req.Files {
+		want := strings.ToLower(f.SHA256)
+		if b, err := hex.DecodeString(want); err != nil || len(b) != sha256.Size {
+			httpError(w, "Invalid sha256 for "+f.Path, 400)
+			return
+		}
+		// As for uploads, files go below the folder and nowhere else
+		outPath := filepath.Join(folder, filepath.FromSlash(f.Path))
+		if rel, err := filepath.Rel(folder, outPath); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || hasInternal(rel) || !fs.inRoots(outPath) || !fs.canWrite(r, outPath) {
+			httpError(w, "Invalid path "+f.Path, 400)
+			return
+		}
+		status := "missing"
+		if sum, err := fs.contents.hashOf(outPath); err == nil && sum == want {
+			status = "present"
+		} else if root := fs.rootOf(outPath); *casMode && root != "" && fileExists(casBlobPath(root, want)) {
+			// Content-addressable mode: a new reference to the stored blob is enough
+			if os.MkdirAll(filepath.Dir(outPath), 0755) == nil && replaceWithLink(casBlobPath(root, want), outPath) == nil {
+				status = "copied"
+			}
+		} else if src, ok := fs.contents.find(want, func(p string) bool {
+			// Only content the caller could have downloaded
+			return fs.inRoots(p) && fs.canRead(r, p)
+		}); ok && src != outPath {
+			if err := copyFile(src, outPath); err == nil {
+				if fi, err := os.Stat(outPath); err == nil {
+					fs.contents.add(outPath, want, fi)
+				}
+				status = "copied"
+			}
+		}
+		results = append(results, map[string]string{"path": f.Path, "status": status})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": results})
+}
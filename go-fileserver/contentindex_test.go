@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// indexed writes data to p and adds it to the content index, returning its hash
+func indexed(t *testing.T, fs *FileServer, p, data string) string {
+	t.Helper()
+	if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(data))
+	fs.contents.add(p, hex.EncodeToString(sum[:]), fi)
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadCheck posts one file to /api/upload/check and returns the answer's
+// status code and the file's status
+func uploadCheck(fs *FileServer, folder, path, sum string) (int, string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"folder": folder,
+		"files":  []map[string]string{{"path": path, "sha256": sum}},
+	})
+	w := httptest.NewRecorder()
+	fs.handleUploadCheck(w, httptest.NewRequest("POST", "/api/upload/check", strings.NewReader(string(body))))
+	var resp struct {
+		Files []struct{ Status string } `json:"files"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Files) != 1 {
+		return w.Code, ""
+	}
+	return w.Code, resp.Files[0].Status
+}
+
+func TestUploadCheck(t *testing.T) {
+	fs, docs, other, outside := testServer(t)
+	known := indexed(t, fs, filepath.Join(docs, "a.txt"), "known content")
+
+	if code, status := uploadCheck(fs, "/docs", "a.txt", known); code != 200 || status != "present" {
+		t.Errorf("same file: %d %q, want present", code, status)
+	}
+	if code, status := uploadCheck(fs, "/docs", "sub/copy.txt", known); code != 200 || status != "copied" {
+		t.Errorf("known content: %d %q, want copied", code, status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(docs, "sub", "copy.txt")); string(data) != "known content" {
+		t.Errorf("copy holds %q", data)
+	}
+	sum := sha256.Sum256([]byte("new"))
+	if code, status := uploadCheck(fs, "/docs", "new.txt", hex.EncodeToString(sum[:])); code != 200 || status != "missing" {
+		t.Errorf("new content: %d %q, want missing", code, status)
+	}
+
+	// Nothing is written outside the folder
+	for _, p := range []string{"../../outside/x.txt", "sub/../../x.txt", "..", ".", "out/x.txt", casDirName + "/x", "to-cas/x"} {
+		if code, _ := uploadCheck(fs, "/docs", p, known); code != 400 {
+			t.Errorf("%s: %d, want 400", p, code)
+		}
+	}
+	for _, p := range []string{filepath.Join(outside, "x.txt"), filepath.Join(filepath.Dir(docs), "x.txt"), filepath.Join(docs, casDirName, "x")} {
+		if fileExists(p) {
+			t.Errorf("%s was written", p)
+		}
+	}
+	if code, _ := uploadCheck(fs, "/docs/out", "x.txt", known); code != 403 {
+		t.Errorf("folder through a link out: %d, want 403", code)
+	}
+
+	// Content the caller can't read isn't copied, nor its presence told
+	secret := indexed(t, fs, filepath.Join(other, "secret.txt"), "private data")
+	configure(t, fs, docs, other, rootConfig{Path: other, Visibility: visibilityPrivate})
+	if code, status := uploadCheck(fs, "/docs", "leak.txt", secret); code != 200 || status != "missing" {
+		t.Errorf("content of a private root: %d %q, want missing", code, status)
+	}
+	if fileExists(filepath.Join(docs, "leak.txt")) {
+		t.Error("content of a private root was copied")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultTableRows is how many rows the table viewer shows without ?rows=
+	defaultTableRows = 1000
+	// maxTableRows caps ?rows=
+	maxTableRows = 50000
+)
+
+// tableDelimiters are the separators a table file may use, most likely first
+var tableDelimiters = []rune{',', '\t', ';', '|'}
+
+// renderTable shows a CSV/TSV file as a table: the first row as columns and
+// up to ?rows= (default 1000) rows after it. The delimiter is guessed from the
+// start of the file unless given as ?delimiter= ("tab" for tabs).
+func renderTable(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	limit := defaultTableRows
+	if v := r.URL.Query().Get("rows"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTableRows {
+			httpError(w, "Invalid rows", 400)
+			return
+		}
+		limit = n
+	}
+	br := bufio.NewReaderSize(p.File, 64*1024)
+	delim := ','
+	switch v := r.URL.Query().Get("delimiter"); {
+	case v == "tab":
+		delim = '\t'
+	case len([]rune(v)) == 1:
+		delim = []rune(v)[0]
+	case v != "":
+		httpError(w, "Invalid delimiter", 400)
+		return
+	case p.Ext == ".tsv":
+		delim = '\t'
+	default:
+		head, _ := br.Peek(16 * 1024)
+		delim = guessDelimiter(head)
+	}
+
+	cr := csv.NewReader(br)
+	cr.Comma = delim
+	cr.FieldsPerRecord = -1 // ragged rows are shown as they are
+	cr.LazyQuotes = true
+	columns, err := cr.Read()
+	if err == io.EOF {
+		columns, err = []string{}, nil
+	}
+	if err != nil {
+		p.File.Seek(0, io.SeekStart)
+		renderText(w, r, p)
+		return
+	}
+	rows := [][]string{}
+	truncated := false
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Not a table after all, e.g. quoting gone wrong: show what was read
+			truncated = true
+			break
+		}
+		if len(rows) == limit {
+			truncated = true
+			break
+		}
+		for i, f := range rec {
+			rec[i] = clipLine(f)
+		}
+		rows = append(rows, rec)
+	}
+	for i, c := range columns {
+		columns[i] = clipLine(strings.TrimPrefix(c, "\ufeff"))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      "table",
+		"columns":   columns,
+		"rows":      rows,
+		"delimiter": string(delim),
+		"truncated": truncated,
+	})
+}
+
+// guessDelimiter picks the delimiter splitting the first records of head into
+// the same number of fields, preferring more fields, and ',' if none does
+func guessDelimiter(head []byte) rune {
+	if i := bytes.LastIndexByte(head, '\n'); i > 0 {
+		head = head[:i] // the last line is probably cut off
+	}
+	best, bestFields := ',', 0
+	for _, d := range tableDelimiters {
+		cr := csv.NewReader(bytes.NewReader(head))
+		cr.Comma = d
+		cr.LazyQuotes = true
+		fields := 0
+		for i := 0; i < 20; i++ {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fields = 0 // the records differ in length
+				break
+			}
+			fields = len(rec)
+		}
+		if fields > 1 && fields > bestFields {
+			best, bestFields = d, fields
+		}
+	}
+	return best
+}
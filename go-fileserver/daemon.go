@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv marks the background copy of the server started by -daemon
+const daemonEnv = "FILESERVER_DAEMON"
+
+// daemonLogFile receives the output of a server started with -daemon
+const daemonLogFile = "server.log"
+
+// writePidFile records the server's process ID in path, refusing to start if
+// it names a server that is still running. The file is removed on SIGINT/SIGTERM.
+func writePidFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("already running with pid %d (%s)", pid, path)
+		}
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		os.Remove(path)
+		log.Printf("Received %v, exiting", s)
+		os.Exit(0)
+	}()
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// daemonize starts the server again in its own session, detached from the
+// terminal, with its output appended to server.log in the data directory, and
+// exits.
+func daemonize() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("-daemon: %v", err)
+	}
+	logPath := statePath(daemonLogFile)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		log.Fatalf("-daemon: %v", err)
+	}
+	out, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("-daemon: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("-daemon: %v", err)
+	}
+	log.Printf("Running in the background with pid %d, logging to %s", cmd.Process.Pid, logPath)
+	os.Exit(0)
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+
+	"golang.org/x/sys/windows"
+)
+
+// daemonize isn't available on Windows, where the server runs as a service instead
+func daemonize() {
+	log.Fatal("-daemon is not supported on Windows, use `go-fileserver service install` instead")
+}
+
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	return windows.GetExitCodeProcess(h, &code) == nil && code == 259 // STILL_ACTIVE
+}
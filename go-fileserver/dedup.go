@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// duplicateGroup is a set of files with identical content
+type duplicateGroup struct {
+	Size        int64    `json:"size"`
+	Hash        string   `json:"hash"`
+	Paths       []string `json:"paths"`
+	Reclaimable int64    `json:"reclaimable"` // bytes freed by linking the group to one copy
+}
+
+// hashFile returns the hex SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findDuplicates groups regular files under dir by size and then by content hash.
+// Only files of at least minSize bytes are considered.
+func findDuplicates(ctx context.Context, dir string, minSize int64) ([]duplicateGroup, error) {
+	bySize := make(map[int64][]string)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() && isInternal(fi.Name()) {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() && fi.Size() >= minSize {
+			bySize[fi.Size()] = append(bySize[fi.Size()], p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []duplicateGroup
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		byHash := make(map[string][]string)
+		for _, p := range paths {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			sum, err := hashFile(p)
+			if err != nil {
+				continue
+			}
+			byHash[sum] = append(byHash[sum], p)
+		}
+		for sum, same := range byHash {
+			if len(same) < 2 {
+				continue
+			}
+			sort.Strings(same)
+			g := duplicateGroup{Size: size, Hash: sum, Paths: same}
+			for _, p := range same[1:] {
+				if !sameFile(same[0], p) {
+					g.Reclaimable += size
+				}
+			}
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Reclaimable > groups[j].Reclaimable })
+	return groups, nil
+}
+
+// sameFile reports whether two paths already refer to the same inode
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
+// replaceWithLink atomically replaces dup with a hardlink to keep
+func replaceWithLink(keep, dup string) error {
+	tmp := filepath.Join(filepath.Dir(dup), "."+filepath.Base(dup)+".dedup-tmp")
+	os.Remove(tmp)
+	if err := os.Link(keep, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// dedupRequest reads the folder and minimum size shared by the duplicate endpoints
+func (fs *FileServer) dedupRequest(w http.ResponseWriter, r *http.Request) (string, int64, bool) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return "", 0, false
+	}
+	path = filepath.FromSlash(path) // Normalize
+	if !fs.inRoots(path) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return "", 0, false
+	}
+	minSize := int64(1)
+	if v := r.URL.Query().Get("minSize"); v != "" {
+		n, err := parseSize(v)
+		if err != nil {
+			writeError(w, err, 400)
+			return "", 0, false
+		}
+		minSize = n
+	}
+	return path, minSize, true
+}
+
+// API: Duplicate finder
+func (fs *FileServer) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	path, minSize, ok := fs.dedupRequest(w, r)
+	if !ok {
+		return
+	}
+	groups, err := findDuplicates(r.Context(), path, minSize)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	var total int64
+	for _, g := range groups {
+		total += g.Reclaimable
+		for i, p := range g.Paths {
+			g.Paths[i] = fs.publicPath(p)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groups":      groups,
+		"reclaimable": total,
+	})
+}
+
+// API: Replace duplicates with hardlinks to a single copy.
+// Runs as a dry run unless dryRun=false is given; requires -dedup and admins.
+func (fs *FileServer) handleDedup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !*dedupOn {
+		httpError(w, "Deduplication is disabled. Start the server with -dedup to enable it.", 403)
+		return
+	}
+	// It rewrites whole trees, whoever owns the files
+	if !requireRole(w, r, roleAdmin) {
+		return
+	}
+	path, minSize, ok := fs.dedupRequest(w, r)
+	if !ok {
+		return
+	}
+	dryRun := true
+	if v, err := strconv.ParseBool(r.URL.Query().Get("dryRun")); err == nil {
+		dryRun = v
+	}
+	if !dryRun && !fs.requireWrite(w, r, path) {
+		return
+	}
+
+	groups, err := findDuplicates(r.Context(), path, minSize)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	var linked int
+	var reclaimed int64
+	errs := []string{}
+	for _, g := range groups {
+		keep := g.Paths[0]
+		for _, dup := range g.Paths[1:] {
+			if sameFile(keep, dup) {
+				continue
+			}
+			if !dryRun {
+				if err := replaceWithLink(keep, dup); err != nil {
+					errs = append(errs, fs.publicPath(dup)+": "+errorMessage(err))
+					continue
+				}
+			}
+			linked++
+			reclaimed += g.Size
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dryRun":    dryRun,
+		"linked":    linked,
+		"reclaimed": reclaimed,
+		"errors":    errs,
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+)
+
+// checkDelete validates one path of a delete request. Folders with contents
+// need recursive.
+func (fs *FileServer) checkDelete(w http.ResponseWriter, p string, recursive bool) bool {
+	if !fs.inRoots(p) {
+		apiError(w, http.StatusForbidden, codeForbidden, "Path is not inside a served folder: "+fs.publicPath(p))
+		return false
+	}
+	if abs, err := filepath.Abs(p); err != nil || abs == fs.rootOf(p) {
+		apiError(w, http.StatusForbidden, codeForbidden, "Cannot delete a served folder")
+		return false
+	}
+	store := fs.storageFor(p)
+	fi, err := lstat(store, p)
+	if err != nil {
+		apiError(w, http.StatusNotFound, codeNotFound, "Not found: "+fs.publicPath(p))
+		return false
+	}
+	if fi.IsDir() && !recursive {
+		entries, err := store.ReadDir(p)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		if len(entries) > 0 {
+			apiError(w, http.StatusConflict, codeNotEmpty, "Folder is not empty, delete it with recursive=true: "+fs.publicPath(p))
+			return false
+		}
+	}
+	return true
+}
+
+// API: DELETE /api/delete?path= deletes a file or an empty folder; folders
+// with contents need recursive=true. Deleted items go to the trash (see
+// /api/trash) unless permanent=true or the trash is off. POST /api/delete
+// takes several paths: {"paths": [...], "recursive": false, "permanent": false}.
+// Every path is checked before anything is deleted. Answers
+// {"success": true, "deleted": [...]}, or an error with the paths deleted
+// before it in "deleted".
+func (fs *FileServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var paths []string
+	var recursive, permanent bool
+	switch r.Method {
+	case http.MethodDelete:
+		if p := r.URL.Query().Get("path"); p != "" {
+			paths = []string{p}
+		}
+		recursive = r.URL.Query().Get("recursive") == "true"
+		permanent = r.URL.Query().Get("permanent") == "true"
+	case http.MethodPost:
+		var req struct {
+			Paths     []string `json:"paths"`
+			Recursive bool     `json:"recursive"`
+			Permanent bool     `json:"permanent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, 400, codeBadRequest, "Invalid JSON body")
+			return
+		}
+		if !fs.resolvePathList(w, req.Paths) {
+			return
+		}
+		paths, recursive, permanent = req.Paths, req.Recursive, req.Permanent
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(paths) == 0 {
+		apiError(w, 400, codeBadRequest, "Missing path")
+		return
+	}
+	if !fs.requireRead(w, r, paths...) || !fs.requireWrite(w, r, paths...) {
+		return
+	}
+	for i, p := range paths {
+		paths[i] = filepath.FromSlash(p)
+		if !fs.checkDelete(w, paths[i], recursive) {
+			return
+		}
+	}
+
+	deleted := []string{}
+	for _, p := range paths {
+		var err error
+		switch {
+		case !permanent:
+			err = fs.remove(p, recursive)
+		default:
+			err = fs.storageFor(p).Remove(p, recursive)
+		}
+		if err != nil {
+			status, code := errorStatus(err, http.StatusInternalServerError)
+			writeErrorJSON(w, status, map[string]interface{}{"error": errorBody(code, errorMessage(err)), "deleted": deleted})
+			return
+		}
+		deleted = append(deleted, fs.publicPath(p))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "deleted": deleted})
+}
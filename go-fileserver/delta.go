@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Delta sync works like rsync. The side holding the old copy of a file sends
+// a signature: the block size and, per block, a weak rolling checksum and a
+// strong hash. The side holding the new copy slides a window over it and
+// answers with a delta: references to blocks the other side already has plus
+// the bytes it lacks. Uploads go signature -> client, delta -> server
+// (/api/delta/patch); downloads the other way round (/api/delta/diff).
+//
+// A delta is binary: the magic "FSD1" followed by operations, all integers
+// big-endian:
+//
+//	'C' uint32 index, uint32 count   copy count blocks starting at block index
+//	'D' uint32 length, data          literal data
+//	'E'                              end of the delta
+const (
+	deltaMagic        = "FSD1"
+	defaultDeltaBlock = 64 << 10
+	minDeltaBlock     = 1 << 10
+	maxDeltaBlock     = 16 << 20
+	maxDeltaLiteral   = 1 << 20
+
+	deltaCopy = 'C'
+	deltaData = 'D'
+	deltaEnd  = 'E'
+)
+
+var errBadDelta = errors.New("malformed delta")
+
+// deltaSignature describes a file as a list of block checksums. Version
+// identifies the exact file it was computed from (size and modification time),
+// so a patch against a file that changed in between is refused.
+type deltaSignature struct {
+	Size      int64        `json:"size"`
+	BlockSize int          `json:"blockSize"`
+	Version   string       `json:"version,omitempty"`
+	Blocks    []deltaBlock `json:"blocks"`
+}
+
+// deltaBlock holds the checksums of one block. Weak is the rsync rolling
+// checksum (see rollingSum), Strong the first 16 bytes of its sha256 in hex.
+type deltaBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// rollingSum is the rsync weak checksum of a window of bytes: a is the sum of
+// the bytes and b the sum of the running values of a, both mod 2^16. It can be
+// moved one byte along in constant time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	var s rollingSum
+	n := uint32(len(window))
+	for i, c := range window {
+		s.a += uint32(c)
+		s.b += (n - uint32(i)) * uint32(c)
+	}
+	s.a &= 0xffff
+	s.b &= 0xffff
+	s.n = n
+	return s
+}
+
+func (s rollingSum) sum() uint32 {
+	return s.a | s.b<<16
+}
+
+// roll drops out from the front of the window and appends in
+func (s *rollingSum) roll(out, in byte) {
+	s.a = (s.a - uint32(out) + uint32(in)) & 0xffff
+	s.b = (s.b - s.n*uint32(out) + s.a) & 0xffff
+}
+
+// shrink drops out from the front of the window, at the end of the data
+func (s *rollingSum) shrink(out byte) {
+	s.a = (s.a - uint32(out)) & 0xffff
+	s.b = (s.b - s.n*uint32(out)) & 0xffff
+	s.n--
+}
+
+func strongSum(block []byte) string {
+	h := sha256.Sum256(block)
+	return hex.EncodeToString(h[:16])
+}
+
+func fileVersion(fi os.FileInfo) string {
+	return strconv.FormatInt(fi.Size(), 10) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+}
+
+// signFile computes the signature of the file at p
+func signFile(p string, blockSize int) (*deltaSignature, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sig := &deltaSignature{Size: fi.Size(), BlockSize: blockSize, Version: fileVersion(fi), Blocks: []deltaBlock{}}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, deltaBlock{Weak: newRollingSum(buf[:n]).sum(), Strong: strongSum(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deltaWriter encodes delta operations, merging runs of consecutive blocks
+type deltaWriter struct {
+	w            *bufio.Writer
+	literal      []byte
+	first, count uint32
+}
+
+func newDeltaWriter(w io.Writer) *deltaWriter {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(deltaMagic)
+	return &deltaWriter{w: bw}
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.count == 0 {
+		return nil
+	}
+	var op [9]byte
+	op[0] = deltaCopy
+	binary.BigEndian.PutUint32(op[1:], d.first)
+	binary.BigEndian.PutUint32(op[5:], d.count)
+	d.count = 0
+	_, err := d.w.Write(op[:])
+	return err
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+	var op [5]byte
+	op[0] = deltaData
+	binary.BigEndian.PutUint32(op[1:], uint32(len(d.literal)))
+	if _, err := d.w.Write(op[:]); err != nil {
+		return err
+	}
+	_, err := d.w.Write(d.literal)
+	d.literal = d.literal[:0]
+	return err
+}
+
+func (d *deltaWriter) copyBlock(index uint32) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	if d.count > 0 && d.first+d.count == index {
+		d.count++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.first, d.count = index, 1
+	return nil
+}
+
+func (d *deltaWriter) addByte(c byte) error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.literal = append(d.literal, c)
+	if len(d.literal) >= maxDeltaLiteral {
+		return d.flushLiteral()
+	}
+	return nil
+}
+
+func (d *deltaWriter) close() error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	d.w.WriteByte(deltaEnd)
+	return d.w.Flush()
+}
+
+// computeDelta writes the delta that turns the file described by sig into the
+// contents of r
+func computeDelta(sig *deltaSignature, r io.Reader, w io.Writer) error {
+	bs := sig.BlockSize
+	table := make(map[uint32][]uint32, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		table[b.Weak] = append(table[b.Weak], uint32(i))
+	}
+	// Only the last block may be shorter than the block size
+	lastLen := bs
+	if len(sig.Blocks) > 0 {
+		if rem := int(sig.Size % int64(bs)); rem != 0 {
+			lastLen = rem
+		}
+	}
+
+	d := newDeltaWriter(w)
+	br := bufio.NewReaderSize(r, 1<<20)
+	window := make([]byte, bs)
+	fill := func() ([]byte, error) {
+		n, err := io.ReadFull(br, window[:bs])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return window[:n], err
+	}
+	win, err := fill()
+	if err != nil {
+		return err
+	}
+	eof := len(win) < bs
+	sum := newRollingSum(win)
+	for len(win) > 0 {
+		if len(win) == bs || (eof && len(win) == lastLen) {
+			if candidates, ok := table[sum.sum()]; ok {
+				strong := strongSum(win)
+				matched := false
+				for _, i := range candidates {
+					if sig.Blocks[i].Strong != strong {
+						continue
+					}
+					if err := d.copyBlock(i); err != nil {
+						return err
+					}
+					matched = true
+					break
+				}
+				if matched {
+					if eof {
+						break
+					}
+					if win, err = fill(); err != nil {
+						return err
+					}
+					eof = len(win) < bs
+					sum = newRollingSum(win)
+					continue
+				}
+			}
+		}
+		out := win[0]
+		if err := d.addByte(out); err != nil {
+			return err
+		}
+		c, err := br.ReadByte()
+		switch {
+		case err == nil:
+			// Keep the window in one buffer: shift when it reaches the end
+			if cap(win) == len(win) {
+				copy(window, win[1:])
+				win = window[:len(win)-1]
+			} else {
+				win = win[1:]
+			}
+			win = append(win, c)
+			sum.roll(out, c)
+		case err == io.EOF:
+			eof = true
+			win = win[1:]
+			sum.shrink(out)
+		default:
+			return err
+		}
+	}
+	return d.close()
+}
+
+// applyDelta rebuilds a file from base, the file the signature was made from,
+// and a delta read from r
+func applyDelta(base io.ReaderAt, baseSize int64, blockSize int, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != deltaMagic {
+		return errBadDelta
+	}
+	var hdr [8]byte
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return errBadDelta
+		}
+		switch op {
+		case deltaCopy:
+			if _, err := io.ReadFull(br, hdr[:8]); err != nil {
+				return errBadDelta
+			}
+			index := int64(binary.BigEndian.Uint32(hdr[:4]))
+			count := int64(binary.BigEndian.Uint32(hdr[4:]))
+			off := index * int64(blockSize)
+			if count == 0 || off >= baseSize {
+				return fmt.Errorf("%v: block %d is past the end of the file", errBadDelta, index)
+			}
+			n := count * int64(blockSize)
+			if off+n > baseSize {
+				n = baseSize - off
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(base, off, n)); err != nil {
+				return err
+			}
+		case deltaData:
+			if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+				return errBadDelta
+			}
+			if _, err := io.CopyN(w, br, int64(binary.BigEndian.Uint32(hdr[:4]))); err != nil {
+				if err == io.EOF {
+					return errBadDelta
+				}
+				return err
+			}
+		case deltaEnd:
+			return nil
+		default:
+			return fmt.Errorf("%v: unknown operation %q", errBadDelta, op)
+		}
+	}
+}
+
+// deltaTarget checks a path given to the delta endpoints and returns its file info
+func (fs *FileServer) deltaTarget(w http.ResponseWriter, r *http.Request) (string, os.FileInfo, bool) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		httpError(w, "Missing path", 400)
+		return "", nil, false
+	}
+	p = filepath.FromSlash(p)
+	if !fs.inRoots(p) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return "", nil, false
+	}
+	if hasInternal(p) {
+		httpError(w, "Forbidden", 403)
+		return "", nil, false
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		httpError(w, "File not found", 404)
+		return "", nil, false
+	}
+	if fi.IsDir() {
+		httpError(w, "Path is a folder", 400)
+		return "", nil, false
+	}
+	return p, fi, true
+}
+
+// API: GET /api/delta/signature?path=&blockSize= returns the block checksums of a file
+func (fs *FileServer) handleDeltaSignature(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, _, ok := fs.deltaTarget(w, r)
+	if !ok {
+		return
+	}
+	if !fs.rawAllowed(r, p) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	blockSize := defaultDeltaBlock
+	if v := r.URL.Query().Get("blockSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minDeltaBlock || n > maxDeltaBlock {
+			httpError(w, fmt.Sprintf("blockSize must be between %d and %d", minDeltaBlock, maxDeltaBlock), 400)
+			return
+		}
+		blockSize = n
+	}
+	sig, err := signFile(p, blockSize)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sig)
+}
+
+// API: POST /api/delta/diff?path= takes the signature of the client's copy and
+// returns the delta that turns it into the server's file
+func (fs *FileServer) handleDeltaDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, _, ok := fs.deltaTarget(w, r)
+	if !ok {
+		return
+	}
+	if !fs.rawAllowed(r, p) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	var sig deltaSignature
+	if err := json.NewDecoder(r.Body).Decode(&sig); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	if sig.BlockSize < minDeltaBlock || sig.BlockSize > maxDeltaBlock || int64(len(sig.Blocks)) != (sig.Size+int64(sig.BlockSize)-1)/int64(sig.BlockSize) {
+		httpError(w, "Invalid signature", 400)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	defer f.Close()
+	// Buffer the delta so errors can still be reported with a status code
+	var buf bytes.Buffer
+	if err := computeDelta(&sig, f, &buf); err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// API: POST /api/delta/patch?path=&blockSize=&version=&sha256= rebuilds a file
+// from its current contents and the delta in the body. blockSize and version
+// are those of the signature the delta was computed against; sha256, if given,
+// is checked against the result before it replaces the file.
+func (fs *FileServer) handleDeltaPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, fi, ok := fs.deltaTarget(w, r)
+	if !ok {
+		return
+	}
+	if !fs.requireWrite(w, r, p) {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("version") != "" && q.Get("version") != fileVersion(fi) {
+		httpError(w, "File changed since the signature was made", http.StatusPreconditionFailed)
+		return
+	}
+	blockSize, err := strconv.Atoi(q.Get("blockSize"))
+	if err != nil || blockSize < minDeltaBlock || blockSize > maxDeltaBlock {
+		blockSize = defaultDeltaBlock
+	}
+	dir := filepath.Dir(p)
+	// The result needs room next to the old file until the rename
+	if err := fs.checkFreeSpace(dir, fi.Size()+r.ContentLength); err != nil {
+		lowDiskError(w)
+		return
+	}
+
+	base, err := os.Open(p)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	defer base.Close()
+	tmp := filepath.Join(dir, "."+filepath.Base(p)+".part")
+	out, err := os.Create(tmp)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	h := sha256.New()
+	err = applyDelta(base, fi.Size(), blockSize, r.Body, io.MultiWriter(out, h))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err == nil {
+		if want := q.Get("sha256"); want != "" && want != sum {
+			err = fmt.Errorf("%v: result has sha256 %s, expected %s", errBadDelta, sum, want)
+		}
+	}
+	if err == nil {
+		err = os.Chmod(tmp, fi.Mode().Perm())
+	}
+	if err == nil {
+		fs.keepVersion(p)
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		code := 500
+		if errors.Is(err, errBadDelta) {
+			code = 400
+		}
+		writeError(w, err, code)
+		return
+	}
+
+	nfi, err := os.Stat(p)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	fs.contents.add(p, sum, nfi)
+	if abs, err := filepath.Abs(p); err == nil {
+		fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(p), "size": nfi.Size(), "sha256": sum, "version": fileVersion(nfi)})
+}
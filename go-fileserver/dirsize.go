@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sizeCacheTTL is how long a computed folder size is reused before walking again
+const sizeCacheTTL = 5 * time.Minute
+
+// dirSize is the recursive size summary of a folder
+type dirSize struct {
+	Bytes   int64 `json:"bytes"`
+	Files   int64 `json:"files"`
+	Folders int64 `json:"folders"`
+}
+
+type sizeEntry struct {
+	size     dirSize
+	computed time.Time
+}
+
+// sizeCache memoizes recursive folder sizes so repeated estimates are cheap
+type sizeCache struct {
+	mu      sync.Mutex
+	entries map[string]sizeEntry
+}
+
+func newSizeCache() *sizeCache {
+	return &sizeCache{entries: make(map[string]sizeEntry)}
+}
+
+// get returns the size of path, walking it only when there is no fresh cache entry
+func (c *sizeCache) get(path string) (dirSize, bool, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && time.Since(e.computed) < sizeCacheTTL {
+		return e.size, true, nil
+	}
+
+	size, err := computeDirSize(path)
+	if err != nil {
+		return dirSize{}, false, err
+	}
+	c.mu.Lock()
+	c.entries[path] = sizeEntry{size: size, computed: time.Now()}
+	c.mu.Unlock()
+	return size, false, nil
+}
+
+// put stores a size computed elsewhere, e.g. while warming
+func (c *sizeCache) put(path string, size dirSize, computed time.Time) {
+	c.mu.Lock()
+	c.entries[path] = sizeEntry{size: size, computed: computed}
+	c.mu.Unlock()
+}
+
+// computeDirSize walks path and totals regular files. Unreadable entries are skipped.
+func computeDirSize(path string) (dirSize, error) {
+	var s dirSize
+	fi, err := os.Stat(path)
+	if err != nil {
+		return s, err
+	}
+	if !fi.IsDir() {
+		return dirSize{Bytes: fi.Size(), Files: 1}, nil
+	}
+	err = filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && p != path {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if isInternal(d.Name()) {
+				return filepath.SkipDir
+			}
+			if p != path {
+				s.Folders++
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				s.Bytes += info.Size()
+				s.Files++
+			}
+		}
+		return nil
+	})
+	return s, err
+}
+
+// API: Folder size estimate (total bytes and file count)
+func (fs *FileServer) handleSize(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.FromSlash(path) // Normalize
+
+	// Very large trees can take longer than a request should; compute as a job instead
+	if r.URL.Query().Get("async") == "true" {
+		j := fs.jobs.start("du", "Size of "+fs.publicPath(path), func(j *job) (interface{}, error) {
+			j.add(0, fs.publicPath(path))
+			size, _, err := fs.sizes.get(path)
+			return size, err
+		})
+		acceptedJob(w, r, j)
+		return
+	}
+
+	var size dirSize
+	var cached bool
+	var err error
+	if fs.sizeIndex != nil {
+		size, cached = fs.sizeIndex.lookup(path)
+	}
+	if !cached {
+		size, cached, err = fs.sizes.get(path)
+		if err != nil {
+			writeError(w, err, 400)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":    fs.publicPath(path),
+		"bytes":   size.Bytes,
+		"files":   size.Files,
+		"folders": size.Folders,
+		"cached":  cached,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// lowDiskCheckEvery is how many uploaded bytes pass between free-space checks
+	lowDiskCheckEvery = 64 << 20
+	// lowDiskPoll is how often the served disks are checked for lowdisk events
+	lowDiskPoll = 5 * time.Minute
+)
+
+// errLowDisk is returned when a write would leave less than -min-free on the disk
+var errLowDisk = errors.New("not enough free disk space")
+
+// errUploadTooLarge is returned when an upload is larger than its root's maxUpload
+var errUploadTooLarge = errors.New("upload larger than the folder allows")
+
+// diskUsage describes the filesystem a path lives on, in bytes
+type diskUsage struct {
+	Total     uint64 `json:"total"`
+	Free      uint64 `json:"free"`
+	Available uint64 `json:"available"` // free space usable by this process
+}
+
+// checkFreeSpace fails with errLowDisk if writing need more bytes into dir
+// would push the available space below the configured minimum.
+func (fs *FileServer) checkFreeSpace(dir string, need int64) error {
+	if fs.minFree <= 0 {
+		return nil
+	}
+	du, err := diskFree(dir)
+	if err != nil {
+		// Unknown filesystem: don't block uploads on it
+		return nil
+	}
+	if need < 0 {
+		need = 0
+	}
+	if int64(du.Available)-need < fs.minFree {
+		return errLowDisk
+	}
+	return nil
+}
+
+// watchDiskFree publishes a lowdisk event when the disk behind a served folder
+// drops below -min-free, once until it recovers
+func (fs *FileServer) watchDiskFree() {
+	low := make(map[string]bool)
+	for {
+		for _, f := range fs.folderList() {
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				continue
+			}
+			du, err := diskFree(abs)
+			if err != nil {
+				continue
+			}
+			isLow := int64(du.Available) < fs.minFree
+			if isLow && !low[abs] {
+				fs.events.publish(event{Type: eventLowDisk, Path: filepath.ToSlash(abs), Folder: true, Data: map[string]string{
+					"available": strconv.FormatUint(du.Available, 10),
+					"total":     strconv.FormatUint(du.Total, 10),
+					"minFree":   strconv.FormatInt(fs.minFree, 10),
+				}})
+			}
+			low[abs] = isLow
+		}
+		time.Sleep(lowDiskPoll)
+	}
+}
+
+// freeSpaceGuard rechecks free space while an upload of unknown size streams
+// in, and stops it once it grows past limit, if set
+type freeSpaceGuard struct {
+	fs    *FileServer
+	r     io.Reader
+	dir   string
+	limit int64
+	since int64
+	read  int64 // bytes read in all
+}
+
+func (g *freeSpaceGuard) Read(p []byte) (int, error) {
+	if g.since >= lowDiskCheckEvery {
+		g.since = 0
+		if err := g.fs.checkFreeSpace(g.dir, 0); err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.r.Read(p)
+	g.since += int64(n)
+	g.read += int64(n)
+	if g.limit > 0 && g.read > g.limit {
+		return 0, errUploadTooLarge
+	}
+	return n, err
+}
+
+// uploadLimit is the most bytes one file uploaded to path may have, from the
+// maxUpload of its root; 0 means no limit
+func (fs *FileServer) uploadLimit(path string) int64 {
+	if rc := fs.rootConfig(path); rc != nil {
+		return rc.uploadLimit
+	}
+	return 0
+}
+
+// API: Free space of the disk behind each served folder
+func (fs *FileServer) handleDiskFree(w http.ResponseWriter, r *http.Request) {
+	roots := []map[string]interface{}{}
+	for _, f := range fs.folderList() {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		entry := map[string]interface{}{"path": fs.publicPath(f), "minFree": fs.minFree}
+		if du, err := diskFree(abs); err != nil {
+			entry["error"] = errorMessage(err)
+		} else {
+			entry["total"] = du.Total
+			entry["free"] = du.Free
+			entry["available"] = du.Available
+			entry["low"] = fs.minFree > 0 && int64(du.Available) < fs.minFree
+		}
+		roots = append(roots, entry)
+	}
+	json.NewEncoder(w).Encode(roots)
+}
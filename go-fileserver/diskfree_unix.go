@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// diskFree reports the size and free space of the filesystem holding path
+func diskFree(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	bs := uint64(st.Bsize)
+	return diskUsage{Total: st.Blocks * bs, Free: st.Bfree * bs, Available: st.Bavail * bs}, nil
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// diskFree reports the size and free space of the filesystem holding path
+func diskFree(path string) (diskUsage, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return diskUsage{}, err
+	}
+	var du diskUsage
+	if err := windows.GetDiskFreeSpaceEx(p, &du.Available, &du.Total, &du.Free); err != nil {
+		return diskUsage{}, err
+	}
+	return du, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// dispositionPolicy decides whether /api/raw lets the browser display a type
+// inline or forces a download. Inline patterns take precedence; types matching
+// neither list are served inline.
+type dispositionPolicy struct {
+	Inline     []string `json:"inline"`
+	Attachment []string `json:"attachment"`
+}
+
+// defaultDisposition forces a download for types a browser would execute
+// scripts in when opened from the app's origin.
+var defaultDisposition = dispositionPolicy{
+	Attachment: []string{
+		"text/html",
+		"application/xhtml+xml",
+		"image/svg+xml",
+		"text/xml",
+		"application/xml",
+		"text/javascript",
+		"application/javascript",
+	},
+}
+
+// mimeMatch matches a content type against an exact type or a "major/*" pattern
+func mimeMatch(pattern, contentType string) bool {
+	pattern = strings.ToLower(pattern)
+	t := baseType(contentType)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == t
+}
+
+func (p dispositionPolicy) inline(contentType string) bool {
+	for _, pat := range p.Inline {
+		if mimeMatch(pat, contentType) {
+			return true
+		}
+	}
+	for _, pat := range p.Attachment {
+		if mimeMatch(pat, contentType) {
+			return false
+		}
+	}
+	return true
+}
+
+// dispositionFor returns the policy for path: the override of its root if the
+// config has one, otherwise the global policy.
+func (fs *FileServer) dispositionFor(path string) dispositionPolicy {
+	if rc := fs.rootConfig(path); rc != nil && rc.Disposition != nil {
+		return *rc.Disposition
+	}
+	if d := fs.cfg().Disposition; d != nil {
+		return *d
+	}
+	return defaultDisposition
+}
+
+// setDisposition sets Content-Disposition for a raw response of the given type
+func (fs *FileServer) setDisposition(w http.ResponseWriter, path, contentType string) {
+	kind := "attachment"
+	if fs.dispositionFor(path).inline(contentType) {
+		kind = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(kind, map[string]string{"filename": filepath.Base(path)}))
+	// Stop browsers from second-guessing the type and rendering it anyway
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// errDropQuota stops an upload that would go over the quota of a drop link
+var errDropQuota = errors.New("the upload quota of this link is used up")
+
+// reserve counts n more bytes against the quota of a drop link, reporting
+// false if that would go over it or the link was revoked meanwhile. A
+// negative n gives bytes of a failed upload back.
+func (s *shares) reserve(id string, n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.m[id]
+	if !ok {
+		return false
+	}
+	if n > 0 && sh.MaxBytes > 0 && sh.Uploaded+n > sh.MaxBytes {
+		return false
+	}
+	sh.Uploaded += n
+	return true
+}
+
+// saveUploaded persists the bytes dropped so far, which reserve only counts
+// in memory
+func (s *shares) saveUploaded(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sh, ok := s.m[id]; ok {
+		if err := db.put(bucketShares, id, sh); err != nil {
+			log.Printf("Shares: counting uploads to %s: %v", id, err)
+		}
+	}
+}
+
+// dropQuotaReader reads an upload to a drop link while it fits the quota
+type dropQuotaReader struct {
+	s    *shares
+	id   string
+	r    io.Reader
+	read int64
+}
+
+func (q *dropQuotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if n > 0 {
+		if !q.s.reserve(q.id, int64(n)) {
+			return 0, errDropQuota
+		}
+		q.read += int64(n)
+	}
+	return n, err
+}
+
+// API: Drop links, made with POST /api/share and "drop": true. GET
+// /s/<token> shows an upload page; POST /s/<token> takes files in multipart
+// "files" fields, like /api/upload, into the shared folder. Dropped files
+// never replace anything (a taken name becomes "name (2).ext"), and nothing in
+// the folder can be listed or downloaded through the link. An upload going
+// over the link's quota is cut off and removed, answering 413.
+func (fs *FileServer) handleDrop(w http.ResponseWriter, r *http.Request, sh *share, token string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		http.ServeFile(w, r, "./static/drop.html")
+		return
+	case http.MethodPost:
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	folder := filepath.FromSlash(sh.Path)
+	store := fs.storageFor(folder)
+	if fi, err := store.Stat(folder); err != nil || !fi.IsDir() || !fs.inRoots(folder) {
+		apiError(w, http.StatusNotFound, codeNotFound, "The folder of this link is gone")
+		return
+	}
+	if err := fs.checkFreeSpace(folder, r.ContentLength); err != nil {
+		lowDiskError(w)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		apiError(w, 400, codeBadRequest, "Not a multipart request")
+		return
+	}
+	defer fs.shares.saveUploaded(sh.ID)
+
+	results := []map[string]interface{}{}
+	failures := 0
+	var stop error // the quota or the disk ran out, so the rest isn't read
+	for stop == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeErrorJSON(w, http.StatusBadRequest, map[string]interface{}{"error": errorBody(codeBadRequest, errorMessage(err)), "files": results})
+			return
+		}
+		if part.FormName() != "files" || part.FileName() == "" {
+			continue
+		}
+		name := filepath.Base(partFileName(part))
+		result := map[string]interface{}{"name": name, "size": 0}
+		results = append(results, result)
+		if name == "." || name == string(filepath.Separator) || isInternal(name) {
+			result["error"] = "invalid file name"
+			failures++
+			continue
+		}
+		name = freeName(store, folder, name)
+		outPath := filepath.Join(folder, name)
+		src := &dropQuotaReader{s: fs.shares, id: sh.ID, r: &freeSpaceGuard{fs: fs, r: part, dir: folder, limit: fs.uploadLimit(folder)}}
+		var sum string
+		if *casMode && store == localDisk {
+			sum, err = fs.casWrite(outPath, src)
+		} else {
+			sum, err = writeUpload(store, outPath, src)
+		}
+		result["size"] = src.read
+		if err != nil {
+			fs.shares.reserve(sh.ID, -src.read)
+			result["size"] = 0
+			result["error"] = errorMessage(err)
+			failures++
+			if err == errDropQuota || err == errLowDisk {
+				stop = err
+			}
+			continue
+		}
+		result["name"] = name
+		if fi, err := store.Stat(outPath); err == nil {
+			fs.contents.add(outPath, sum, fi)
+		}
+		if abs, err := filepath.Abs(outPath); err == nil {
+			fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs), Data: map[string]string{"share": token, "ip": clientIP(r).String()}})
+		}
+	}
+
+	resp := map[string]interface{}{"success": failures == 0, "files": results}
+	if failures > 0 {
+		resp["error"] = errorBody(codeIncomplete, fmt.Sprintf("%d of %d files failed", failures, len(results)))
+	}
+	if stop != nil {
+		status, code := errorStatus(stop, http.StatusInternalServerError)
+		resp["error"] = errorBody(code, stop.Error())
+		writeErrorJSON(w, status, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// maxEditSize is the largest file the editor may save, like the viewer's limit
+const maxEditSize = 50 << 20
+
+// editMu makes the version check and the write of a save one step, so two
+// saves from the same version can't both pass
+var editMu sync.Mutex
+
+// fileETag is the ETag of a file's current version
+func fileETag(fi os.FileInfo) string {
+	return `"` + fileVersion(fi) + `"`
+}
+
+// editConflict answers a save that was based on an outdated version
+func editConflict(w http.ResponseWriter, status int, msg, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	writeErrorJSON(w, status, map[string]interface{}{"error": errorBody(statusCodes[status], msg), "etag": etag})
+}
+
+// API: PUT /api/file?path= saves the body as the file's new content (the
+// viewer's editor). GET /api/file returns the file's ETag; a save must send
+// it as If-Match and is refused with 412 if the file changed since, so
+// concurrent edits aren't silently overwritten. New files are saved without
+// If-Match, or with If-None-Match: * to make sure none was created meanwhile.
+func (fs *FileServer) saveFile(w http.ResponseWriter, r *http.Request, p string) {
+	if !fs.checkPut(w, r, p) {
+		return
+	}
+	if r.ContentLength > maxEditSize {
+		httpError(w, "File is too large to save from the editor", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxEditSize)
+
+	editMu.Lock()
+	defer editMu.Unlock()
+	ifMatch := r.Header.Get("If-Match")
+	fi, exists := statFile(p)
+	switch {
+	case exists && r.Header.Get("If-None-Match") == "*":
+		editConflict(w, http.StatusPreconditionFailed, "The file was created by someone else meanwhile", fileETag(fi))
+		return
+	case exists && ifMatch == "":
+		editConflict(w, http.StatusPreconditionRequired, "Saving an existing file needs If-Match with the ETag it was loaded with", fileETag(fi))
+		return
+	case exists && ifMatch != "*" && ifMatch != fileETag(fi):
+		editConflict(w, http.StatusPreconditionFailed, "The file was changed by someone else since it was loaded", fileETag(fi))
+		return
+	case !exists && ifMatch != "":
+		editConflict(w, http.StatusPreconditionFailed, "The file was deleted since it was loaded", "")
+		return
+	}
+
+	saved, sum, ok := fs.writeBody(w, r, p)
+	if !ok {
+		return
+	}
+	// Keep an edited script executable
+	if exists && !*casMode && saved.Mode().Perm() != fi.Mode().Perm() {
+		if os.Chmod(p, fi.Mode().Perm()) == nil {
+			saved, _ = os.Stat(p)
+		}
+	}
+	etag := fileETag(saved)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(p), "size": saved.Size(), "sha256": sum, "etag": etag})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// emailBatch is the default quiet period before a rule sends its mail, so a
+	// folder upload ends up as one message rather than hundreds
+	emailBatch   = time.Minute
+	emailTimeout = 30 * time.Second
+)
+
+const (
+	defaultEmailSubject = `{{len .Events}} change(s) on the file server{{if .Rule}} ({{.Rule}}){{end}}`
+	defaultEmailBody    = `{{range .Events}}{{.Time.Format "2006-01-02 15:04:05"}}  {{.Type}}  {{.Path}}{{with .Data.url}}  {{$.BaseURL}}{{.}}{{end}}
+{{with .Data.summary}}
+{{.}}
+{{end}}{{end}}`
+)
+
+// smtpConfig is the outgoing mail server
+type smtpConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"` // default 587; 465 means implicit TLS
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	// BaseURL is the public address of this server, for links in messages
+	BaseURL string `json:"baseUrl"`
+}
+
+func (c *smtpConfig) validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("smtp: missing host")
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("smtp: invalid from address %q", c.From)
+	}
+	return nil
+}
+
+// emailRule mails matching events. To, Subject and Body are text/template
+// templates: To is rendered per event (so "{{.Data.recipient}}" reaches the
+// recipient of a share), Subject and Body once per message with .Events, .Rule
+// and .BaseURL.
+type emailRule struct {
+	Name string `json:"name"`
+	eventFilter
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+	// Batch is how long to collect events before mailing, e.g. "10m" (default 1m)
+	Batch string `json:"batch"`
+
+	to      []*template.Template
+	subject *template.Template
+	body    *template.Template
+}
+
+func (r *emailRule) validate() error {
+	name := r.Name
+	if name == "" {
+		name = strings.Join(r.To, ",")
+	}
+	if len(r.To) == 0 {
+		return fmt.Errorf("email rule %s: no recipients", name)
+	}
+	if r.Batch != "" {
+		if d, err := time.ParseDuration(r.Batch); err != nil || d < 0 {
+			return fmt.Errorf("email rule %s: invalid batch %q", name, r.Batch)
+		}
+	}
+	if err := r.eventFilter.validate(); err != nil {
+		return fmt.Errorf("email rule %s: %v", name, err)
+	}
+	r.to = nil
+	for _, t := range r.To {
+		tmpl, err := template.New("to").Parse(t)
+		if err != nil {
+			return fmt.Errorf("email rule %s: %v", name, err)
+		}
+		r.to = append(r.to, tmpl)
+	}
+	var err error
+	if r.subject, err = template.New("subject").Parse(orDefault(r.Subject, defaultEmailSubject)); err != nil {
+		return fmt.Errorf("email rule %s: subject: %v", name, err)
+	}
+	if r.body, err = template.New("body").Parse(orDefault(r.Body, defaultEmailBody)); err != nil {
+		return fmt.Errorf("email rule %s: body: %v", name, err)
+	}
+	return nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// recipients renders the To templates for one event, dropping empty and invalid addresses
+func (r *emailRule) recipients(ev event) []string {
+	var out []string
+	for _, t := range r.to {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, ev); err != nil {
+			continue
+		}
+		for _, a := range strings.Split(buf.String(), ",") {
+			if addr, err := mail.ParseAddress(strings.TrimSpace(a)); err == nil {
+				out = append(out, addr.Address)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// startEmail subscribes the email rules to the event bus
+func (fs *FileServer) startEmail(c *smtpConfig, rules []emailRule) {
+	for i := range rules {
+		rule := &rules[i]
+		batch := emailBatch
+		if rule.Batch != "" {
+			batch, _ = time.ParseDuration(rule.Batch)
+		}
+		fs.subscribeBatched("Email rule "+rule.Name, rule.eventFilter, batch, true, func(events []event) {
+			// One message per distinct set of recipients
+			groups := make(map[string][]event)
+			for _, ev := range events {
+				if to := rule.recipients(ev); len(to) > 0 {
+					key := strings.Join(to, ",")
+					groups[key] = append(groups[key], ev)
+				}
+			}
+			for key, evs := range groups {
+				if err := c.sendRule(rule, strings.Split(key, ","), evs); err != nil {
+					log.Printf("Email rule %s: sending to %s failed: %v", rule.Name, key, err)
+				}
+			}
+		})
+	}
+	fs.watchFiles()
+}
+
+// sendRule renders a rule's templates for events and mails the result
+func (c *smtpConfig) sendRule(rule *emailRule, to []string, events []event) error {
+	data := map[string]interface{}{"Events": events, "Rule": rule.Name, "BaseURL": strings.TrimSuffix(c.BaseURL, "/")}
+	var subject, body bytes.Buffer
+	if err := rule.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := rule.body.Execute(&body, data); err != nil {
+		return err
+	}
+	return c.send(to, strings.TrimSpace(subject.String()), body.String())
+}
+
+// send delivers a plain text message. Port 465 uses implicit TLS; otherwise
+// STARTTLS is used when the server offers it.
+func (c *smtpConfig) send(to []string, subject, body string) error {
+	port := c.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: emailTimeout}
+	if port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && port != 465 {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(c.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMessage(c.From, to, subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildMessage formats a UTF-8 plain text email
+func buildMessage(from string, to []string, subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", newJobID(), fromDomain(from))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+func fromDomain(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			return addr.Address[i+1:]
+		}
+	}
+	return "localhost"
+}
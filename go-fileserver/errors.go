@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Errors are answered as {"error": {"code": "NOT_FOUND", "message": "..."}}
+// by every API, so clients can branch on the code rather than parse the
+// message. Answers that report partial progress, like which files of an
+// upload arrived, carry it in further fields next to "error".
+const (
+	codeBadRequest          = "BAD_REQUEST"           // 400, missing or malformed parameters
+	codeUnauthorized        = "UNAUTHORIZED"          // 401, login required
+	codeBadCredentials      = "BAD_CREDENTIALS"       // 401, wrong user, password or token
+	codeForbidden           = "FORBIDDEN"             // 403
+	codeReadOnly            = "READ_ONLY"             // 403, -readonly
+	codeNotFound            = "NOT_FOUND"             // 404
+	codeMethodNotAllowed    = "METHOD_NOT_ALLOWED"    // 405
+	codeConflict            = "CONFLICT"              // 409 or 412, changed meanwhile
+	codeExists              = "ALREADY_EXISTS"        // 409
+	codeNotEmpty            = "NOT_EMPTY"             // 409, a folder with contents
+	codeBusy                = "BUSY"                  // 409, try again shortly
+	codeLastAdmin           = "LAST_ADMIN"            // 409
+	codeOffsetMismatch      = "OFFSET_MISMATCH"       // 409, a resumable upload is elsewhere
+	codeGone                = "GONE"                  // 410, e.g. an expired link
+	codePreconditionNeeded  = "PRECONDITION_REQUIRED" // 428, an If-Match is missing
+	codeTooLarge            = "TOO_LARGE"             // 413
+	codeQuotaExceeded       = "QUOTA_EXCEEDED"        // 413, a drop link's quota
+	codeUnsupported         = "UNSUPPORTED"           // 415 or 422, a format that can't be handled
+	codeRangeNotSatisfiable = "RANGE_NOT_SATISFIABLE" // 416
+	codeRateLimited         = "RATE_LIMITED"          // 429
+	codeCanceled            = "CANCELED"              // 499, the client went away
+	codeInternal            = "INTERNAL"              // 500
+	codeNotImplemented      = "NOT_IMPLEMENTED"       // 501
+	codeBadGateway          = "BAD_GATEWAY"           // 502, a remote server failed
+	codeUnavailable         = "UNAVAILABLE"           // 503
+	codeTimeout             = "TIMEOUT"               // 504
+	codeInsufficientStorage = "INSUFFICIENT_STORAGE"  // 507, the disk is (nearly) full
+	codeIncomplete          = "INCOMPLETE"            // some items of a batch failed, see theirs
+)
+
+// statusClientClosed is the status logged for requests the client gave up on
+const statusClientClosed = 499
+
+// statusCodes are the codes of errors only known by their HTTP status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:                   codeBadRequest,
+	http.StatusUnauthorized:                 codeUnauthorized,
+	http.StatusForbidden:                    codeForbidden,
+	http.StatusNotFound:                     codeNotFound,
+	http.StatusMethodNotAllowed:             codeMethodNotAllowed,
+	http.StatusConflict:                     codeConflict,
+	http.StatusGone:                         codeGone,
+	http.StatusPreconditionFailed:           codeConflict,
+	http.StatusPreconditionRequired:         codePreconditionNeeded,
+	http.StatusRequestEntityTooLarge:        codeTooLarge,
+	http.StatusUnsupportedMediaType:         codeUnsupported,
+	http.StatusRequestedRangeNotSatisfiable: codeRangeNotSatisfiable,
+	http.StatusUnprocessableEntity:          codeUnsupported,
+	http.StatusTooManyRequests:              codeRateLimited,
+	statusClientClosed:                      codeCanceled,
+	http.StatusInternalServerError:          codeInternal,
+	http.StatusNotImplemented:               codeNotImplemented,
+	http.StatusBadGateway:                   codeBadGateway,
+	http.StatusServiceUnavailable:           codeUnavailable,
+	http.StatusGatewayTimeout:               codeTimeout,
+	http.StatusInsufficientStorage:          codeInsufficientStorage,
+}
+
+// errorBody is the "error" member of an error answer
+func errorBody(code, msg string) map[string]string {
+	return map[string]string{"code": code, "message": msg}
+}
+
+// apiError answers with status and the error envelope
+func apiError(w http.ResponseWriter, status int, code, msg string) {
+	writeErrorJSON(w, status, map[string]interface{}{"error": errorBody(code, msg)})
+}
+
+// writeErrorJSON answers an error with body, which holds the error envelope
+// and whatever else the client needs to carry on
+func writeErrorJSON(w http.ResponseWriter, status int, body map[string]interface{}) {
+	h := w.Header()
+	// Left over from a response that was being prepared, like http.Error does
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// httpError is http.Error with the error envelope, the code following from
+// the status
+func httpError(w http.ResponseWriter, msg string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+	}
+	apiError(w, status, code, msg)
+}
+
+// errorStatus maps err to an HTTP status and code, using status for errors
+// that say nothing more specific
+func errorStatus(err error, status int) (int, string) {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, errNoEntry):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, os.ErrExist):
+		return http.StatusConflict, codeExists
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden, codeForbidden
+	case errors.Is(err, errNotEmpty), errors.Is(err, syscall.ENOTEMPTY):
+		return http.StatusConflict, codeNotEmpty
+	case errors.Is(err, errLowDisk), errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage, codeInsufficientStorage
+	case errors.Is(err, errDropQuota):
+		return http.StatusRequestEntityTooLarge, codeQuotaExceeded
+	case errors.Is(err, errUploadTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	case errors.Is(err, errDailyBudget):
+		return http.StatusTooManyRequests, codeRateLimited
+	case errors.Is(err, context.Canceled):
+		return statusClientClosed, codeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, codeTimeout
+	}
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+	}
+	return status, code
+}
+
+// writeError answers err with the error envelope, mapping errors of the file
+// system to their status and code and others to status
+func writeError(w http.ResponseWriter, err error, status int) {
+	status, code := errorStatus(err, status)
+	apiError(w, status, code, errorMessage(err))
+}
+
+// errorMessage is err as told to clients: errors of the file system name the
+// file but not where it is on the server
+func errorMessage(err error) string {
+	msg := err.Error()
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return strings.Replace(msg, pe.Error(), pe.Op+" "+filepath.Base(pe.Path)+": "+pe.Err.Error(), 1)
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return strings.Replace(msg, le.Error(), le.Op+" "+filepath.Base(le.Old)+" "+filepath.Base(le.New)+": "+le.Err.Error(), 1)
+	}
+	return msg
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	eventCreated  = "created"
+	eventModified = "modified"
+	eventDeleted  = "deleted"
+	eventRenamed  = "renamed"    // renamed or moved away; the new name is reported as created
+	eventUploaded = "uploaded"   // a file written through /api/upload
+	eventShared   = "shared"     // a short link was created
+	eventAccessed = "accessed"   // a short link was opened
+	eventLowDisk  = "lowdisk"    // a served folder's disk dropped below -min-free
+	eventAuth     = "authfailed" // a failed login or forged signature
+	eventReport   = "report"     // a storage report was built
+)
+
+// fileEventTypes are the events that need the filesystem watcher
+var fileEventTypes = []string{eventCreated, eventModified, eventDeleted, eventRenamed}
+
+const (
+	// eventDebounce is the default quiet period before a batch of events is delivered
+	eventDebounce = 2 * time.Second
+	// eventMaxDelay caps how long a constantly changing folder can delay a batch,
+	// as a multiple of the debounce period
+	eventMaxDelay = 10
+	// eventQueue is how many undelivered events a channel buffers
+	eventQueue = 1024
+)
+
+// event is something that happened on the server, delivered to every
+// notification channel (webhooks, ...) that subscribed to the event bus
+type event struct {
+	Type   string            `json:"type"`
+	Path   string            `json:"path,omitempty"` // slash path
+	Folder bool              `json:"folder,omitempty"`
+	Time   time.Time         `json:"time"`
+	Data   map[string]string `json:"data,omitempty"` // details depending on the type
+}
+
+// eventBus fans events out to subscribers. Subscribers are called on the
+// publishing goroutine and must queue anything slow.
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[int]func(event)
+	next int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]func(event))}
+}
+
+// subscribe calls fn with every event published until the returned function
+// is called
+func (b *eventBus) subscribe(fn func(event)) (unsubscribe func()) {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, id)
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) publish(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.subs {
+		fn(ev)
+	}
+}
+
+// subscribeBatched delivers the events matching filter to flush in batches:
+// events are collected until nothing happened for the debounce period (or the
+// maximum delay passed) and merged per path, see coalesceEvent. flush runs on
+// the channel's own goroutine, so a slow receiver doesn't hold up the others.
+// With public, event paths are turned into paths as clients see them (see
+// publicPath) before the filter matches them, as notification channels must
+// not learn where the served folders are on the server.
+func (fs *FileServer) subscribeBatched(name string, filter eventFilter, debounce time.Duration, public bool, flush func([]event)) {
+	in := make(chan event, eventQueue)
+	go batchEvents(in, debounce, flush)
+	fs.events.subscribe(func(ev event) {
+		if public && ev.Path != "" {
+			ev.Path = fs.publicPath(filepath.FromSlash(ev.Path))
+		}
+		if !filter.match(ev) {
+			return
+		}
+		select {
+		case in <- ev:
+		default:
+			log.Printf("%s: queue full, dropping %s event for %s", name, ev.Type, ev.Path)
+		}
+	})
+}
+
+func batchEvents(in <-chan event, debounce time.Duration, flush func([]event)) {
+	var (
+		pending []event
+		index   = make(map[string]int) // path -> position in pending
+		first   time.Time
+		timer   = time.NewTimer(time.Hour)
+	)
+	timer.Stop()
+	for {
+		select {
+		case ev := <-in:
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending = coalesceEvent(pending, index, ev)
+			wait := debounce
+			if max := eventMaxDelay*debounce - time.Since(first); max < wait {
+				wait = max
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			batch := make([]event, 0, len(pending))
+			for _, ev := range pending {
+				if ev.Type != "" {
+					batch = append(batch, ev)
+				}
+			}
+			pending, index = nil, make(map[string]int)
+			if len(batch) > 0 {
+				flush(batch)
+			}
+		}
+	}
+}
+
+// coalesceEvent merges ev into the pending event of the same path: a file
+// created and changed is "created", created and deleted or renamed again (temp
+// files) is dropped, deleted or renamed and re-created is "modified", and an upload is reported as
+// "uploaded" whatever the filesystem saw of it. Other events, such as shares,
+// are kept as is.
+func coalesceEvent(pending []event, index map[string]int, ev event) []event {
+	change := ev.Path != "" && (ev.Type == eventUploaded || containsString(fileEventTypes, ev.Type))
+	i, ok := index[ev.Path]
+	if !ok || !change {
+		if change {
+			index[ev.Path] = len(pending)
+		}
+		return append(pending, ev)
+	}
+	prev := pending[i]
+	switch {
+	case prev.Type == eventUploaded && ev.Type != eventDeleted && ev.Type != eventRenamed:
+		ev = prev
+	case prev.Type == eventCreated && ev.Type == eventModified:
+		ev.Type = eventCreated
+		ev.Folder = prev.Folder
+	case prev.Type == eventCreated && (ev.Type == eventDeleted || ev.Type == eventRenamed):
+		ev.Type = "" // never existed as far as the receiver is concerned
+	case (prev.Type == eventDeleted || prev.Type == eventRenamed) && ev.Type == eventCreated:
+		ev.Type = eventModified
+	}
+	pending[i] = ev
+	return pending
+}
+
+// eventFilter selects events by type and path, as configured for a channel
+type eventFilter struct {
+	// Events lists the event types to deliver; empty means all
+	Events []string `json:"events"`
+	// Paths are globs matched against the event path as clients see it
+	// ("/docs/**/*.pdf"), see subscribeBatched. A pattern without a
+	// slash matches the file name ("*.pdf"); "**" matches any number of folders;
+	// a pattern without wildcards also matches everything below it. Empty means all.
+	Paths []string `json:"paths"`
+}
+
+func (f eventFilter) validate() error {
+	for _, p := range f.Paths {
+		if _, err := path.Match(strings.ReplaceAll(p, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q", p)
+		}
+	}
+	return nil
+}
+
+func (f eventFilter) match(ev event) bool {
+	if len(f.Events) > 0 && !containsString(f.Events, ev.Type) {
+		return false
+	}
+	if len(f.Paths) == 0 {
+		return true
+	}
+	for _, p := range f.Paths {
+		if matchPathGlob(filepath.ToSlash(p), ev.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsFileEvents reports whether the filter can match filesystem changes,
+// i.e. whether the channel needs the watcher running
+func (f eventFilter) wantsFileEvents() bool {
+	if len(f.Events) == 0 {
+		return true
+	}
+	for _, t := range fileEventTypes {
+		if containsString(f.Events, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathGlob matches a slash path against a pattern as described on eventFilter
+func matchPathGlob(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		pattern = strings.TrimSuffix(pattern, "/")
+		return p == pattern || strings.HasPrefix(p, pattern+"/")
+	}
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(p, "/"), "/"))
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// eventStreamTypes are the events /api/events sends: changes to files, whether
+// made through the server or not
+var eventStreamTypes = append([]string{eventUploaded}, fileEventTypes...)
+
+// eventStreamPing is how often an idle event stream sends a comment, so
+// proxies don't close it
+const eventStreamPing = 30 * time.Second
+
+// API: Filesystem changes as server-sent events, for live-updating listings.
+// Each change is an event named by its type (created, modified, deleted,
+// renamed, uploaded) with the event as JSON data: {"type", "path", "folder",
+// "time"}. ?path= narrows the stream to changes at or below a folder and
+// ?events=created,deleted to some types. Changes in folders the client may
+// not see are left out. If the client falls behind, events are dropped and an
+// "overflow" event says the listing should be reloaded.
+func (fs *FileServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var filter eventFilter
+	if v := q.Get("events"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			if !containsString(eventStreamTypes, t) {
+				httpError(w, "Unknown event type: "+t, 400)
+				return
+			}
+			filter.Events = append(filter.Events, t)
+		}
+	} else {
+		filter.Events = eventStreamTypes
+	}
+	var below []string
+	if p := q.Get("path"); p != "" {
+		below = absRoots([]string{p})
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Streaming not supported", 500)
+		return
+	}
+
+	in := make(chan event, eventQueue)
+	var dropped atomic.Bool
+	unsubscribe := fs.events.subscribe(func(ev event) {
+		if !filter.match(ev) {
+			return
+		}
+		select {
+		case in <- ev:
+		default:
+			dropped.Store(true)
+		}
+	})
+	defer unsubscribe()
+	fs.watchFiles()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ping := time.NewTicker(eventStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-in:
+			p := filepath.FromSlash(ev.Path)
+			if below != nil && !under(p, below) || !fs.canRead(r, p) {
+				continue
+			}
+			ev.Path = fs.publicPath(p)
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		if dropped.Swap(false) {
+			fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The server can download URLs into a served folder itself, as a job of kind
+// "fetch", so a big file doesn't have to go through the client's connection.
+// It is enabled by the "fetch" config key. Addresses on the server's own
+// networks are refused unless allowed, so the endpoint can't be used to reach
+// internal services.
+
+// fetchConfig is the "fetch" config key
+type fetchConfig struct {
+	// Allow lists the hosts URLs may be fetched from; "*.example.org" matches
+	// example.org and its subdomains. Empty means any host.
+	Allow []string `json:"allow"`
+	// MaxSize caps the size of one download, e.g. "20G". Empty means no limit
+	// other than -min-free.
+	MaxSize string `json:"maxSize"`
+	// AllowPrivate permits loopback, private and link-local addresses
+	AllowPrivate bool `json:"allowPrivate"`
+}
+
+const (
+	// fetchHeaderTimeout is how long the remote server may take to answer
+	fetchHeaderTimeout = 30 * time.Second
+	fetchMaxRedirects  = 10
+)
+
+var errFetchTooBig = errors.New("download exceeds the size limit")
+
+// fetcher downloads URLs according to a fetchConfig
+type fetcher struct {
+	allow   []string
+	maxSize int64
+	client  *http.Client
+}
+
+func newFetcher(c *fetchConfig) (*fetcher, error) {
+	f := &fetcher{}
+	for _, h := range c.Allow {
+		f.allow = append(f.allow, strings.ToLower(strings.TrimSpace(h)))
+	}
+	if c.MaxSize != "" {
+		n, err := parseSize(c.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("fetch: maxSize: %v", err)
+		}
+		f.maxSize = n
+	}
+	dialer := &net.Dialer{Timeout: fetchHeaderTimeout}
+	if !c.AllowPrivate {
+		// Checked on the resolved address, so DNS names pointing inside are caught too
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("fetch: %s is not a public address", host)
+			}
+			return nil
+		}
+	}
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   fetchHeaderTimeout,
+			ResponseHeaderTimeout: fetchHeaderTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return f.check(req.URL)
+		},
+	}
+	return f, nil
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast())
+}
+
+// check reports whether u may be fetched
+func (f *fetcher) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("only http and https URLs can be fetched")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("URL has no host")
+	}
+	if len(f.allow) == 0 {
+		return nil
+	}
+	for _, a := range f.allow {
+		if host == strings.TrimPrefix(a, "*.") || (strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("fetching from %s is not allowed", host)
+}
+
+// fetchName picks the file name for a download: the one the server suggests,
+// else the last element of the URL path
+func fetchName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if base := path.Base(resp.Request.URL.Path); base != "/" && base != "." {
+		return base
+	}
+	return "download"
+}
+
+// validFileName reports whether name can be used as a plain file name
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && !isInternal(name)
+}
+
+// sizeLimit fails reads once more than max bytes came from r, for downloads
+// whose size wasn't announced or was announced wrongly
+type sizeLimit struct {
+	r   io.Reader
+	max int64
+}
+
+func (l *sizeLimit) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.max -= int64(n); l.max < 0 {
+		return n, errFetchTooBig
+	}
+	return n, err
+}
+
+// fetch downloads u into folder as a job. name and policy decide the file
+// name and what happens if it exists (see placeEntry).
+func (fs *FileServer) fetch(u *url.URL, folder, name, policy string) *job {
+	return fs.jobs.start("fetch", "Fetch "+u.Redacted(), func(j *job) (interface{}, error) {
+		req, err := http.NewRequestWithContext(j.ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := fs.fetcher.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s answered %s", u.Host, resp.Status)
+		}
+		if max := fs.fetcher.maxSize; max > 0 && resp.ContentLength > max {
+			return nil, errFetchTooBig
+		}
+		if err := fs.checkFreeSpace(folder, resp.ContentLength); err != nil {
+			return nil, err
+		}
+		if name == "" {
+			if name = filepath.Base(fetchName(resp)); !validFileName(name) {
+				name = "download"
+			}
+		}
+		target := filepath.Join(folder, name)
+		if fileExists(target) {
+			switch policy {
+			case conflictSkip:
+				return map[string]interface{}{"path": fs.publicPath(target), "skipped": true}, nil
+			case conflictRename:
+				target = filepath.Join(folder, freeName(localDisk, folder, name))
+			case conflictFail:
+				return nil, fmt.Errorf("%s already exists", name)
+			}
+		}
+		j.progress(func() {
+			j.Total = resp.ContentLength
+			j.Current = fs.publicPath(target)
+		})
+
+		var src io.Reader = jobReader{j: j, r: &freeSpaceGuard{fs: fs, r: resp.Body, dir: folder}}
+		if fs.fetcher.maxSize > 0 {
+			src = &sizeLimit{r: src, max: fs.fetcher.maxSize}
+		}
+		var sum string
+		if *casMode {
+			sum, err = fs.casWrite(target, src)
+		} else {
+			tmp := filepath.Join(folder, "."+filepath.Base(target)+".part")
+			if sum, err = writeUpload(localDisk, tmp, src); err == nil {
+				err = os.Rename(tmp, target)
+			}
+			if err != nil {
+				os.Remove(tmp)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			os.Chtimes(target, t, t)
+		}
+		fs.contents.add(target, sum, fi)
+		if abs, err := filepath.Abs(target); err == nil {
+			fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs), Data: map[string]string{"url": u.Redacted()}})
+		}
+		return map[string]interface{}{"path": fs.publicPath(target), "size": fi.Size(), "sha256": sum}, nil
+	})
+}
+
+// API: POST /api/fetch downloads a URL into a folder as a background job.
+// JSON body: {"url": "https://...", "folder": "/target/path", "name": "", "conflict": "rename"}
+func (fs *FileServer) handleFetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fs.fetcher == nil {
+		httpError(w, "Fetching URLs is disabled. Add \"fetch\" to the config file to enable it.", 403)
+		return
+	}
+	var req struct {
+		URL      string `json:"url"`
+		Folder   string `json:"folder"`
+		Name     string `json:"name"`
+		Conflict string `json:"conflict"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		httpError(w, "Invalid URL", 400)
+		return
+	}
+	if err := fs.fetcher.check(u); err != nil {
+		writeError(w, err, 403)
+		return
+	}
+	if req.Name != "" && !validFileName(req.Name) {
+		httpError(w, "Invalid file name", 400)
+		return
+	}
+	if req.Conflict == "" {
+		req.Conflict = conflictRename
+	}
+	if !validConflict(req.Conflict) {
+		httpError(w, "conflict must be fail, skip, overwrite or rename", 400)
+		return
+	}
+	if req.Folder == "" {
+		httpError(w, "Missing folder", 400)
+		return
+	}
+	if !fs.resolvePaths(w, &req.Folder) {
+		return
+	}
+	folder := req.Folder
+	if !fs.inRoots(folder) {
+		httpError(w, "Folder is not inside a served folder", 403)
+		return
+	}
+	if !fs.requireRead(w, r, folder) || !fs.requireWrite(w, r, folder) {
+		return
+	}
+	if fi, err := os.Stat(folder); err != nil || !fi.IsDir() {
+		httpError(w, "Folder not found", 400)
+		return
+	}
+	acceptedJob(w, r, fs.fetch(u, folder, req.Name, req.Conflict))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// copyFile copies a regular file's content and permissions to dst, creating parent folders.
+// The copy is written to a temporary name first so dst never holds partial content.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".part"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	return os.Rename(tmp, dst)
+}
+
+// unshareFile gives the regular file name content of its own if other names
+// link to it, as the copies dedup and -cas merged do, so writing into it
+// leaves them alone. With truncate the content isn't copied over.
+func unshareFile(name string, truncate bool) error {
+	if p, err := filepath.EvalSymlinks(name); err == nil {
+		name = p // replace the file, not a link to it
+	}
+	fi, err := os.Stat(name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	if n, ok := linkCount(fi); ok && n == 1 {
+		return nil
+	}
+	w, err := localDisk.Create(name)
+	if err != nil {
+		return err
+	}
+	if !truncate {
+		if err := copyStored(w, localDisk, name); err != nil {
+			w.(aborter).Abort()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if truncate {
+		return nil
+	}
+	return os.Chtimes(name, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileFilter narrows listings by type, name, extension, size, modification
+// time and hidden (dot) entries. Name, extension and size limits only apply
+// to files so folders stay navigable.
+type fileFilter struct {
+	Type           string   // "file", "folder" or empty for both
+	Name           string   // glob or substring, see matchName
+	Exts           []string // lower-case, with leading dot
+	MinSize        int64
+	MaxSize        int64 // 0 means no limit
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	NoHidden       bool // leave out names starting with a dot
+}
+
+// parseFileFilter reads the filter query parameters
+func parseFileFilter(q url.Values) (*fileFilter, error) {
+	f := &fileFilter{Type: q.Get("type")}
+	if f.Type != "" && f.Type != "file" && f.Type != "folder" {
+		return nil, fmt.Errorf("invalid type: %s", f.Type)
+	}
+	f.Name = q.Get("filter")
+	switch q.Get("hidden") {
+	case "", "true":
+	case "false":
+		f.NoHidden = true
+	default:
+		return nil, fmt.Errorf("invalid hidden: %s", q.Get("hidden"))
+	}
+	for _, e := range strings.Split(q.Get("ext"), ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		f.Exts = append(f.Exts, e)
+	}
+	var err error
+	if v := q.Get("minSize"); v != "" {
+		if f.MinSize, err = parseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("maxSize"); v != "" {
+		if f.MaxSize, err = parseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("modifiedAfter"); v != "" {
+		if f.ModifiedAfter, err = parseTime(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("modifiedBefore"); v != "" {
+		if f.ModifiedBefore, err = parseTime(v); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// active reports whether any filter is set
+func (f *fileFilter) active() bool {
+	return f.Type != "" || f.Name != "" || len(f.Exts) > 0 || f.MinSize > 0 || f.MaxSize > 0 ||
+		!f.ModifiedAfter.IsZero() || !f.ModifiedBefore.IsZero() || f.NoHidden
+}
+
+// match reports whether an entry passes the filter
+func (f *fileFilter) match(name string, fi os.FileInfo) bool {
+	if f.Type == "file" && fi.IsDir() || f.Type == "folder" && !fi.IsDir() {
+		return false
+	}
+	if f.NoHidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && !fi.ModTime().After(f.ModifiedAfter) {
+		return false
+	}
+	if !f.ModifiedBefore.IsZero() && !fi.ModTime().Before(f.ModifiedBefore) {
+		return false
+	}
+	if fi.IsDir() {
+		return true
+	}
+	if !matchName(f.Name, name) {
+		return false
+	}
+	if len(f.Exts) > 0 {
+		lower := strings.ToLower(name)
+		found := false
+		for _, e := range f.Exts {
+			if strings.HasSuffix(lower, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if fi.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && fi.Size() > f.MaxSize {
+		return false
+	}
+	return true
+}
+
+// parseSize accepts plain bytes or a K/M/G/T suffix (powers of 1024), e.g. "1G" or "500MB"
+func parseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseTime accepts RFC 3339, a plain date, Unix seconds, or a duration meaning
+// "that long ago" (e.g. "24h").
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
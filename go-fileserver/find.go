@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// API: GET /api/find?path= streams every file below a folder as a flat list,
+// one JSON object per line (or one path per line with format=text). name
+// matches file names like a search pattern; type, ext, minSize, maxSize,
+// modifiedAfter and modifiedBefore filter like /api/tree. type defaults to
+// file; type=any includes folders.
+func (fs *FileServer) handleFind(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := q.Get("path")
+	if p == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	if !fs.inRoots(filepath.FromSlash(p)) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	if fi, err := os.Stat(filepath.FromSlash(p)); err != nil || !fi.IsDir() {
+		httpError(w, "Folder not found", 404)
+		return
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+	search := searchQuery{Pattern: q.Get("name"), Roots: []string{p}, Filters: map[string]string{"type": "file"}}
+	for _, k := range []string{"type", "ext", "minSize", "maxSize", "modifiedAfter", "modifiedBefore"} {
+		if v := q.Get(k); v != "" {
+			search.Filters[k] = v
+		}
+	}
+	if search.Filters["type"] == "any" {
+		delete(search.Filters, "type")
+	}
+	if _, err := search.filter(); err != nil {
+		writeError(w, err, 400)
+		return
+	}
+
+	if q.Get("format") != "text" {
+		fs.streamSearchNDJSON(w, r, search)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Accel-Buffering", "no")
+	bw := bufio.NewWriter(w)
+	_, err := fs.streamSearch(r.Context(), search, limit, func(res searchResult) error {
+		_, err := bw.WriteString(fs.publicPath(res.Path) + "\n")
+		return err
+	})
+	if err != nil && r.Context().Err() == nil {
+		bw.WriteString("error: " + errorMessage(err) + "\n")
+	}
+	bw.Flush()
+}
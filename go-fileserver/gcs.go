@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint   = "https://storage.googleapis.com"
+	gcsScope      = "https://www.googleapis.com/auth/devstorage.read_write"
+	googleToken   = "https://oauth2.googleapis.com/token"
+	metadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// newGCSClient is the client of a gs:// bucket, using the XML API of Cloud
+// Storage with OAuth tokens from the application default credentials: the
+// file GOOGLE_APPLICATION_CREDENTIALS names (a service account key), the
+// one of "gcloud auth application-default login", or else the metadata
+// server of the instance the server runs on.
+func newGCSClient(bucket string) (objectClient, error) {
+	endpoint, _ := url.Parse(gcsEndpoint)
+	ts, err := newGoogleTokenSource()
+	if err != nil {
+		return nil, fmt.Errorf("gs://%s: %v", bucket, err)
+	}
+	return &s3Client{
+		bucket:    bucket,
+		endpoint:  endpoint,
+		pathStyle: true,
+		meta:      "x-goog-",
+		client:    &http.Client{},
+		sign: func(req *http.Request) error {
+			token, err := ts.token()
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		},
+	}, nil
+}
+
+// googleCredentials is a credentials file of Google Cloud
+type googleCredentials struct {
+	Type string `json:"type"`
+	// service_account
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// googleTokenSource hands out an OAuth access token, fetching a new one
+// shortly before the last expires
+type googleTokenSource struct {
+	creds  *googleCredentials // nil for the metadata server
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	mu      sync.Mutex
+	current string
+	expires time.Time
+}
+
+func newGoogleTokenSource() (*googleTokenSource, error) {
+	ts := &googleTokenSource{client: &http.Client{Timeout: 30 * time.Second}}
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		file = gcloudCredentialsFile()
+		if _, err := os.Stat(file); err != nil {
+			return ts, nil
+		}
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var creds googleCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	switch creds.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(creds.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("%s: no private key", file)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA key", file)
+		}
+		ts.key = rsaKey
+	case "authorized_user":
+	default:
+		return nil, fmt.Errorf("%s: unsupported credentials type %q", file, creds.Type)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = googleToken
+	}
+	ts.creds = &creds
+	return ts, nil
+}
+
+// gcloudCredentialsFile is where "gcloud auth application-default login"
+// keeps its credentials
+func gcloudCredentialsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+func (ts *googleTokenSource) token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.current != "" && time.Now().Before(ts.expires) {
+		return ts.current, nil
+	}
+	var req *http.Request
+	var err error
+	switch {
+	case ts.creds == nil:
+		req, err = http.NewRequest(http.MethodGet, metadataToken, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	case ts.key != nil:
+		var assertion string
+		if assertion, err = ts.assertion(); err == nil {
+			req, err = tokenRequest(ts.creds.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	default:
+		req, err = tokenRequest(ts.creds.TokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {ts.creds.ClientID},
+			"client_secret": {ts.creds.ClientSecret},
+			"refresh_token": {ts.creds.RefreshToken},
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("getting a Google access token: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", errors.New("getting a Google access token: " + firstNonEmpty(result.Error, resp.Status))
+	}
+	ts.current = result.AccessToken
+	ts.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return ts.current, nil
+}
+
+func tokenRequest(uri string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// assertion is the JWT a service account trades for an access token
+func (ts *googleTokenSource) assertion() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.creds.ClientEmail,
+		"scope": gcsScope,
+		"aud":   ts.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
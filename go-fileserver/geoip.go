@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPConfig restricts access by the country of the client address, looked up
+// in a MaxMind (GeoLite2/GeoIP2) country or city database.
+type geoIPConfig struct {
+	Database string   `json:"database"`
+	Allow    []string `json:"allow"` // ISO country codes; if set, only these are let in
+	Deny     []string `json:"deny"`
+	// AllowUnknown lets in public addresses the database has no country for
+	AllowUnknown bool `json:"allowUnknown"`
+}
+
+// geoFilter is the loaded database and rule set
+type geoFilter struct {
+	db           *maxminddb.Reader
+	allow, deny  map[string]bool
+	allowUnknown bool
+
+	logf func(format string, v ...interface{}) // for blocked requests
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, c := range codes {
+		set[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	return set
+}
+
+func newGeoFilter(c *geoIPConfig) (*geoFilter, error) {
+	if c.Database == "" {
+		return nil, fmt.Errorf("geoip: missing database")
+	}
+	db, err := maxminddb.Open(c.Database)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %v", err)
+	}
+	return &geoFilter{db: db, allow: countrySet(c.Allow), deny: countrySet(c.Deny), allowUnknown: c.AllowUnknown, logf: log.Printf}, nil
+}
+
+// country returns the ISO code of ip, or "" if the database doesn't know it
+func (g *geoFilter) country(ip net.IP) string {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// allowed applies the rules to a client address. Loopback and private
+// addresses are always allowed, so the LAN keeps working.
+func (g *geoFilter) allowed(ip net.IP) (bool, string) {
+	if ip == nil {
+		return false, ""
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return true, ""
+	}
+	cc := g.country(ip)
+	if cc == "" {
+		return g.allowUnknown, cc
+	}
+	if g.deny[cc] {
+		return false, cc
+	}
+	return len(g.allow) == 0 || g.allow[cc], cc
+}
+
+// clientIP returns the address of the peer that sent r
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// middleware rejects requests from disallowed countries with 403 and logs them
+func (g *geoFilter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, cc := g.allowed(ip); !ok {
+			if cc == "" {
+				cc = "unknown"
+			}
+			g.logf("GeoIP: blocked %s (%s) %s %s", ip, cc, r.Method, r.URL.Path)
+			httpError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,3 +1,30 @@
-module github.com/brahankv/go-fileserver
-
-go 1.25.5
+module github.com/brahankv/go-fileserver
+
+go 1.25.5
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/graph-gophers/graphql-go v1.5.0
+	github.com/kardianos/service v1.2.2
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/pkg/sftp v1.13.7
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.32.0
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.27.0
+	golang.org/x/sys v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
+
+// The same Walk API that pkg/sftp's client uses from kr/fs v0.1.0
+replace github.com/kr/fs => github.com/kr/fs v0.0.0-20131111012553-2788f0dbd169
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphQLMaxDepth bounds query nesting so a single request can't walk a whole
+// disk through children { children { ... } }
+const graphQLMaxDepth = 12
+
+// graphQLSchema exposes the tree, metadata, search and short links. Sizes are
+// Float because GraphQL's Int is only 32 bits.
+const graphQLSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	# Served folders visible to the requester
+	roots: [Entry!]!
+	# A file or folder inside a served folder, null if it doesn't exist
+	entry(path: String!): Entry
+	# Filename search: pattern is a glob, or a case-insensitive substring without wildcards
+	search(pattern: String!, roots: [String!], filter: Filter, limit: Int): [Entry!]!
+	savedSearches: [SavedSearch!]!
+	shortLinks: [ShortLink!]!
+}
+
+# Same filters as /api/tree
+input Filter {
+	type: String
+	ext: String
+	minSize: String
+	maxSize: String
+	modifiedAfter: String
+	modifiedBefore: String
+}
+
+type Entry {
+	name: String!
+	path: String!
+	# "file" or "folder"
+	type: String!
+	# Bytes; for folders only when the size index knows it
+	size: Float
+	modified: String!
+	mimeType: String
+	# /api/raw URL of a file, signed with -sign-raw
+	rawUrl: String
+	# Folder contents, null for files
+	children(filter: Filter): [Entry!]
+	# Recursive size of a folder, computed (and cached) on demand
+	folderSize: FolderSize
+	# Short links pointing at this file
+	shortLinks: [ShortLink!]!
+}
+
+type FolderSize {
+	bytes: Float!
+	files: Float!
+	folders: Float!
+}
+
+type SavedSearch {
+	name: String!
+	pattern: String!
+	roots: [String!]!
+	results(limit: Int): [Entry!]!
+}
+
+type ShortLink {
+	token: String!
+	url: String!
+	path: String!
+	created: String!
+	expires: String
+}
+`
+
+// gqlRequestKey carries the HTTP request to resolvers, for visibility checks
+type gqlRequestKey struct{}
+
+func gqlRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(gqlRequestKey{}).(*http.Request)
+	return r
+}
+
+// gqlFilter is the Filter input type
+type gqlFilter struct {
+	Type           *string
+	Ext            *string
+	MinSize        *string
+	MaxSize        *string
+	ModifiedAfter  *string
+	ModifiedBefore *string
+}
+
+// parse turns the input into a fileFilter via the /api/tree query parameters
+func (f *gqlFilter) parse() (*fileFilter, error) {
+	q := url.Values{}
+	for k, v := range f.values() {
+		q.Set(k, v)
+	}
+	return parseFileFilter(q)
+}
+
+// values returns the filters that are set, keyed by /api/tree parameter name
+func (f *gqlFilter) values() map[string]string {
+	out := make(map[string]string)
+	if f == nil {
+		return out
+	}
+	for k, v := range map[string]*string{
+		"type": f.Type, "ext": f.Ext, "minSize": f.MinSize, "maxSize": f.MaxSize,
+		"modifiedAfter": f.ModifiedAfter, "modifiedBefore": f.ModifiedBefore,
+	} {
+		if v != nil {
+			out[k] = *v
+		}
+	}
+	return out
+}
+
+type gqlQuery struct {
+	fs *FileServer
+}
+
+func (q *gqlQuery) Roots(ctx context.Context) []*gqlEntry {
+	var out []*gqlEntry
+	for _, f := range q.fs.visibleRoots(gqlRequest(ctx), nil) {
+		if e := q.fs.gqlEntryAt(f); e != nil {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (q *gqlQuery) Entry(ctx context.Context, args struct{ Path string }) *gqlEntry {
+	p := q.fs.localPath(args.Path)
+	if p == "" || !q.fs.inRoots(p) || !q.fs.canRead(gqlRequest(ctx), p) {
+		return nil
+	}
+	return q.fs.gqlEntryAt(p)
+}
+
+func (q *gqlQuery) Search(ctx context.Context, args struct {
+	Pattern string
+	Roots   *[]string
+	Filter  *gqlFilter
+	Limit   *int32
+}) ([]*gqlEntry, error) {
+	sq := searchQuery{Pattern: args.Pattern, Filters: args.Filter.values()}
+	if args.Roots != nil {
+		for _, root := range *args.Roots {
+			if local := q.fs.localPath(root); local != "" && q.fs.inRoots(local) {
+				sq.Roots = append(sq.Roots, local)
+			}
+		}
+		if len(sq.Roots) == 0 {
+			return []*gqlEntry{}, nil
+		}
+	}
+	sq.Roots = q.fs.visibleRoots(gqlRequest(ctx), sq.Roots)
+	limit := 0
+	if args.Limit != nil {
+		limit = int(*args.Limit)
+	}
+	return q.fs.gqlSearch(ctx, sq, limit)
+}
+
+func (q *gqlQuery) SavedSearches(ctx context.Context) []*gqlSavedSearch {
+	var out []*gqlSavedSearch
+	for _, s := range q.fs.saved.list() {
+		if canUseSavedSearch(gqlRequest(ctx), s) {
+			out = append(out, &gqlSavedSearch{fs: q.fs, q: s.searchQuery})
+		}
+	}
+	return out
+}
+
+func (q *gqlQuery) ShortLinks(ctx context.Context) []*gqlShortLink {
+	return q.fs.gqlShortLinks(ctx, "")
+}
+
+// gqlSearch runs sq and resolves the matches to entries
+func (fs *FileServer) gqlSearch(ctx context.Context, sq searchQuery, limit int) ([]*gqlEntry, error) {
+	results, _, err := fs.runSearch(ctx, sq, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := []*gqlEntry{}
+	for _, res := range results {
+		if e := fs.gqlEntryAt(filepath.FromSlash(res.Path)); e != nil {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// gqlShortLinks lists unexpired short links the requester may see, optionally only those for path
+func (fs *FileServer) gqlShortLinks(ctx context.Context, path string) []*gqlShortLink {
+	r := gqlRequest(ctx)
+	fs.shortLinks.mu.Lock()
+	out := []*gqlShortLink{}
+	for t, l := range fs.shortLinks.links {
+		if l.expired() || path != "" && l.Path != path {
+			continue
+		}
+		out = append(out, &gqlShortLink{token: t, link: l})
+	}
+	fs.shortLinks.mu.Unlock()
+	visible := out[:0]
+	for _, l := range out {
+		if fs.canRead(r, filepath.FromSlash(l.link.Path)) {
+			l.link.Path = fs.publicPath(l.link.Path)
+			visible = append(visible, l)
+		}
+	}
+	sort.Slice(visible, func(a, b int) bool { return visible[a].link.Created.Before(visible[b].link.Created) })
+	return visible
+}
+
+// gqlEntry resolves a file or folder
+type gqlEntry struct {
+	fs   *FileServer
+	path string
+	fi   os.FileInfo
+}
+
+func (fs *FileServer) gqlEntryAt(path string) *gqlEntry {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	fi, err := fs.storageFor(abs).Stat(abs)
+	if err != nil {
+		return nil
+	}
+	return &gqlEntry{fs: fs, path: abs, fi: fi}
+}
+
+func (e *gqlEntry) Name() string { return e.fi.Name() }
+func (e *gqlEntry) Path() string { return e.fs.publicPath(e.path) }
+
+func (e *gqlEntry) Type() string {
+	if e.fi.IsDir() {
+		return "folder"
+	}
+	return "file"
+}
+
+func (e *gqlEntry) Size() *float64 {
+	if !e.fi.IsDir() {
+		s := float64(e.fi.Size())
+		return &s
+	}
+	if e.fs.sizeIndex != nil {
+		if size, ok := e.fs.sizeIndex.lookup(e.path); ok {
+			s := float64(size.Bytes)
+			return &s
+		}
+	}
+	return nil
+}
+
+func (e *gqlEntry) Modified() string { return e.fi.ModTime().Format(time.RFC3339) }
+
+func (e *gqlEntry) MimeType() *string {
+	if e.fi.IsDir() {
+		return nil
+	}
+	f, err := e.fs.storageFor(e.path).Open(e.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	ct := detectFileContentType(f, e.path)
+	return &ct
+}
+
+func (e *gqlEntry) RawUrl() *string {
+	if e.fi.IsDir() {
+		return nil
+	}
+	u := e.fs.rawURL(e.path)
+	return &u
+}
+
+func (e *gqlEntry) Children(args struct{ Filter *gqlFilter }) (*[]*gqlEntry, error) {
+	if !e.fi.IsDir() {
+		return nil, nil
+	}
+	filter, err := args.Filter.parse()
+	if err != nil {
+		return nil, err
+	}
+	store := e.fs.storageFor(e.path)
+	entries, err := store.ReadDir(e.path)
+	if err != nil {
+		return nil, err
+	}
+	out := []*gqlEntry{}
+	for _, de := range entries {
+		if isInternal(de.Name()) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil || !filter.match(de.Name(), fi) {
+			continue
+		}
+		if de.Type()&os.ModeSymlink != 0 {
+			if fi, err = store.Stat(filepath.Join(e.path, de.Name())); err != nil {
+				continue
+			}
+		}
+		out = append(out, &gqlEntry{fs: e.fs, path: filepath.Join(e.path, de.Name()), fi: fi})
+	}
+	return &out, nil
+}
+
+func (e *gqlEntry) FolderSize() (*gqlFolderSize, error) {
+	if !e.fi.IsDir() {
+		return nil, nil
+	}
+	if e.fs.sizeIndex != nil {
+		if size, ok := e.fs.sizeIndex.lookup(e.path); ok {
+			return &gqlFolderSize{size}, nil
+		}
+	}
+	size, _, err := e.fs.sizes.get(e.path)
+	if err != nil {
+		return nil, err
+	}
+	return &gqlFolderSize{size}, nil
+}
+
+func (e *gqlEntry) ShortLinks(ctx context.Context) []*gqlShortLink {
+	if e.fi.IsDir() {
+		return []*gqlShortLink{}
+	}
+	return e.fs.gqlShortLinks(ctx, filepath.ToSlash(e.path))
+}
+
+type gqlFolderSize struct {
+	size dirSize
+}
+
+func (s *gqlFolderSize) Bytes() float64   { return float64(s.size.Bytes) }
+func (s *gqlFolderSize) Files() float64   { return float64(s.size.Files) }
+func (s *gqlFolderSize) Folders() float64 { return float64(s.size.Folders) }
+
+type gqlSavedSearch struct {
+	fs *FileServer
+	q  searchQuery
+}
+
+func (s *gqlSavedSearch) Name() string    { return s.q.Name }
+func (s *gqlSavedSearch) Pattern() string { return s.q.Pattern }
+
+func (s *gqlSavedSearch) Roots() []string {
+	if s.q.Roots == nil {
+		return []string{}
+	}
+	return s.q.Roots
+}
+
+func (s *gqlSavedSearch) Results(ctx context.Context, args struct{ Limit *int32 }) ([]*gqlEntry, error) {
+	q := s.q
+	if q.Roots = s.fs.savedRoots(gqlRequest(ctx), s.q); len(q.Roots) == 0 {
+		return []*gqlEntry{}, nil
+	}
+	limit := 0
+	if args.Limit != nil {
+		limit = int(*args.Limit)
+	}
+	return s.fs.gqlSearch(ctx, q, limit)
+}
+
+type gqlShortLink struct {
+	token string
+	link  shortLink
+}
+
+func (l *gqlShortLink) Token() string   { return l.token }
+func (l *gqlShortLink) Url() string     { return "/r/" + l.token }
+func (l *gqlShortLink) Path() string    { return l.link.Path }
+func (l *gqlShortLink) Created() string { return l.link.Created.Format(time.RFC3339) }
+
+func (l *gqlShortLink) Expires() *string {
+	if l.link.Expires.IsZero() {
+		return nil
+	}
+	s := l.link.Expires.Format(time.RFC3339)
+	return &s
+}
+
+// newGraphQLSchema parses the schema against the resolvers
+func newGraphQLSchema(fs *FileServer) *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &gqlQuery{fs: fs}, graphql.MaxDepth(graphQLMaxDepth))
+}
+
+// API: GraphQL. POST {"query", "operationName", "variables"}, or GET ?query=
+func (fs *FileServer) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				httpError(w, "Invalid variables", 400)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid JSON body", 400)
+			return
+		}
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		httpError(w, "Missing query", 400)
+		return
+	}
+	ctx := context.WithValue(r.Context(), gqlRequestKey{}, r)
+	resp := fs.graphql.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
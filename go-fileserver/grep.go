@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxGrepFile is the largest file a content search reads
+	maxGrepFile = 64 * 1024 * 1024
+	// maxGrepLine is the longest line a content search reads; files with
+	// longer ones are searched up to there
+	maxGrepLine = 1024 * 1024
+	// maxGrepShown is how much of a line a match shows
+	maxGrepShown = 500
+	// maxGrepContext caps the context lines around a match
+	maxGrepContext = 10
+)
+
+// grepMatch is a line of a file that matched a content search
+type grepMatch struct {
+	Path   string   `json:"path"`
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// searchContent answers /api/search?mode=content: the lines of the text files
+// matching q that contain text, a case-insensitive substring, or match it as a
+// regular expression with regex=1. context=n (default 2) adds the lines
+// around each match. Binary files and files over 64MB are skipped. With
+// -search-index only the files the index names as candidates are read.
+func (fs *FileServer) searchContent(w http.ResponseWriter, r *http.Request, q searchQuery, text string, limit int) {
+	vals := r.URL.Query()
+	var match func(string) bool
+	var err error
+	regex := vals.Get("regex") == "1" || vals.Get("regex") == "true"
+	if regex {
+		re, err := regexp.Compile(text)
+		if err != nil {
+			httpError(w, "Invalid regex: "+err.Error(), 400)
+			return
+		}
+		match = re.MatchString
+	} else {
+		lower := strings.ToLower(text)
+		match = func(line string) bool { return strings.Contains(strings.ToLower(line), lower) }
+	}
+	around := 2
+	if v := vals.Get("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxGrepContext {
+			httpError(w, "Invalid context", 400)
+			return
+		}
+		around = n
+	}
+
+	var results []grepMatch
+	emit := func(m grepMatch) error {
+		results = append(results, m)
+		return nil
+	}
+	var nw *ndjsonWriter
+	if wantsNDJSON(r) {
+		nw = newNDJSONWriter(w)
+		emit = func(m grepMatch) error {
+			if err := nw.write(m); err != nil {
+				return err
+			}
+			nw.flush()
+			return nil
+		}
+	}
+	found := 0
+	visit := func(p string) error {
+		if fs.hiddenPath(p) {
+			return nil
+		}
+		return grepFile(r.Context(), p, match, around, func(m grepMatch) error {
+			if found >= limit {
+				return errSearchLimit
+			}
+			found++
+			m.Path = fs.publicPath(m.Path)
+			return emit(m)
+		})
+	}
+	var truncated bool
+	var paths []string
+	indexed := false
+	if fs.index != nil && !regex && fs.index.isReady() {
+		// The index narrows the search down to the files that may match
+		paths, indexed, err = fs.index.contentCandidates(r.Context(), q, text)
+	}
+	if indexed {
+		for _, p := range paths {
+			if err = visit(p); err != nil {
+				break
+			}
+		}
+		if err == errSearchLimit {
+			truncated, err = true, nil
+		}
+	} else if err == nil {
+		truncated, err = fs.streamSearch(r.Context(), q, 0, func(res searchResult) error {
+			if res.Size > maxGrepFile {
+				return nil
+			}
+			return visit(filepath.FromSlash(res.Path))
+		})
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	if nw != nil {
+		if err != nil {
+			nw.write(map[string]interface{}{"error": errorBody(codeInternal, errorMessage(err))})
+		}
+		nw.flush()
+		return
+	}
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	if results == nil {
+		results = []grepMatch{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results, "truncated": truncated})
+}
+
+// grepFile hands the lines of the text file p that match to emit, each with
+// up to around lines before and after it
+func grepFile(ctx context.Context, p string, match func(string) bool, around int, emit func(grepMatch) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, 800)
+	n, _ := io.ReadFull(f, head)
+	if looksBinary(head[:n]) {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), maxGrepLine)
+	var before []string
+	var pending []*grepMatch // still collecting lines after them
+	for line := 1; sc.Scan(); line++ {
+		if line%1000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		text := clipLine(sc.Text())
+		for _, m := range pending {
+			m.After = append(m.After, text)
+		}
+		for len(pending) > 0 && len(pending[0].After) == around {
+			if err := emit(*pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+		if match(sc.Text()) {
+			m := &grepMatch{Path: filepath.ToSlash(p), Line: line, Text: text, Before: append([]string(nil), before...)}
+			if around == 0 {
+				if err := emit(*m); err != nil {
+					return err
+				}
+			} else {
+				pending = append(pending, m)
+			}
+		}
+		if around > 0 {
+			if before = append(before, text); len(before) > around {
+				before = before[1:]
+			}
+		}
+	}
+	for _, m := range pending {
+		if err := emit(*m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clipLine shortens a line for showing to at most maxGrepShown bytes
+func clipLine(s string) string {
+	if len(s) <= maxGrepShown {
+		return s
+	}
+	cut := maxGrepShown
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "…"
+}
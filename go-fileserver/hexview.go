@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultHexLength is how many bytes a hex dump shows without ?length=
+	defaultHexLength = 4096
+	// maxHexLength caps ?length=
+	maxHexLength = 64 * 1024
+)
+
+// renderHex shows ?length= bytes (default 4096) of any file from ?offset= as
+// a hex dump like `hexdump -C`, so binaries can be inspected page by page
+// without downloading them
+func renderHex(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	q := r.URL.Query()
+	var offset int64
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			httpError(w, "Invalid offset", 400)
+			return
+		}
+		offset = n
+	}
+	length := defaultHexLength
+	if v := q.Get("length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHexLength {
+			httpError(w, "Invalid length", 400)
+			return
+		}
+		length = n
+	}
+	size := p.Info.Size()
+	if offset > size {
+		offset = size
+	}
+	buf := make([]byte, length)
+	n, err := p.File.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		writeError(w, err, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":    "hex",
+		"content": hexDump(buf[:n], offset),
+		"offset":  offset,
+		"length":  n,
+		"size":    size,
+	})
+}
+
+// hexDump formats data, found at offset base in its file, as lines of 16
+// bytes: the offset, the bytes in hex and the printable ones as ASCII
+func hexDump(data []byte, base int64) string {
+	var sb strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:min(i+16, len(data))]
+		fmt.Fprintf(&sb, "%08x ", base+int64(i))
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				sb.WriteByte(' ')
+			}
+			if j < len(line) {
+				fmt.Fprintf(&sb, " %02x", line[j])
+			} else {
+				sb.WriteString("   ")
+			}
+		}
+		sb.WriteString("  |")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteString("|\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With the "ipfs" config key the server talks to a local IPFS node through its
+// RPC API: served files and folders can be added (and pinned) to IPFS, and
+// content can be pinned and copied into a served folder. Both run as jobs of
+// kind "ipfs".
+
+const defaultIPFSAPI = "http://127.0.0.1:5001"
+
+// ipfsConfig is the "ipfs" config key
+type ipfsConfig struct {
+	// API is the node's RPC address, by default http://127.0.0.1:5001
+	API string `json:"api"`
+	// Gateway is used for the links returned with published content,
+	// e.g. https://ipfs.io
+	Gateway string `json:"gateway"`
+}
+
+// ipfsNode is a client for the RPC API of an IPFS node
+type ipfsNode struct {
+	api     string
+	gateway string
+	client  *http.Client
+}
+
+func newIPFSNode(c *ipfsConfig) (*ipfsNode, error) {
+	api := strings.TrimSuffix(c.API, "/")
+	if api == "" {
+		api = defaultIPFSAPI
+	}
+	if u, err := url.Parse(api); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("ipfs: invalid api %q", c.API)
+	}
+	return &ipfsNode{api: api, gateway: strings.TrimSuffix(c.Gateway, "/"), client: &http.Client{}}, nil
+}
+
+// call posts to an RPC command; the caller closes the body
+func (n *ipfsNode) call(j *job, cmd string, args url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(j.ctx, http.MethodPost, n.api+"/api/v0/"+cmd+"?"+args.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ipfs: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct{ Message string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Message == "" {
+			e.Message = resp.Status
+		}
+		return nil, fmt.Errorf("ipfs %s: %s", cmd, e.Message)
+	}
+	return resp, nil
+}
+
+// add adds the file or folder at p to IPFS and returns its CID
+func (n *ipfsNode) add(j *job, p string, pin bool) (string, error) {
+	var files []string
+	var total int64
+	var count int
+	base := filepath.Dir(p)
+	err := filepath.Walk(p, func(f string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && isInternal(info.Name()) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Mode().IsRegular() {
+			files = append(files, f)
+			if !info.IsDir() {
+				total += info.Size()
+				count++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	// Several paths may be published by one job
+	j.progress(func() {
+		j.Total += total
+		j.ItemsTotal += count
+	})
+
+	// The parts are the files and folders with their path as name, written
+	// while the node reads them
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(func() error {
+			for _, f := range files {
+				rel, _ := filepath.Rel(base, f)
+				h := textproto.MIMEHeader{}
+				info, err := os.Stat(f)
+				if err != nil {
+					return err
+				}
+				disposition := fmt.Sprintf(`form-data; name="file"; filename=%q`, url.QueryEscape(filepath.ToSlash(rel)))
+				h.Set("Content-Disposition", disposition)
+				if info.IsDir() {
+					h.Set("Content-Type", "application/x-directory")
+					if _, err := mw.CreatePart(h); err != nil {
+						return err
+					}
+					continue
+				}
+				h.Set("Content-Type", "application/octet-stream")
+				part, err := mw.CreatePart(h)
+				if err != nil {
+					return err
+				}
+				in, err := os.Open(f)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(part, jobReader{j: j, r: in})
+				in.Close()
+				if err != nil {
+					return err
+				}
+				j.progress(func() { j.ItemsDone++ })
+			}
+			return mw.Close()
+		}())
+	}()
+
+	args := url.Values{"pin": {fmt.Sprint(pin)}, "cid-version": {"1"}, "progress": {"false"}}
+	resp, err := n.call(j, "add", args, pr, mw.FormDataContentType())
+	if err != nil {
+		pr.CloseWithError(err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	// One line per added entry; the one named like the top-level entry is it
+	name := filepath.Base(p)
+	cid := ""
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var line struct{ Name, Hash string }
+		if json.Unmarshal(sc.Bytes(), &line) == nil && line.Name == name {
+			cid = line.Hash
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if cid == "" {
+		return "", fmt.Errorf("ipfs add: no CID returned for %s", name)
+	}
+	return cid, nil
+}
+
+// get copies cid into folder as name (by default the CID), pinning it first
+// if asked to. The entries are checked as any archive unpacked by fs.
+func (n *ipfsNode) get(fs *FileServer, j *job, cid, folder, name string, pin bool) (string, error) {
+	if pin {
+		resp, err := n.call(j, "pin/add", url.Values{"arg": {cid}}, nil, "")
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+	resp, err := n.call(j, "get", url.Values{"arg": {cid}}, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// The archive holds one entry named after the CID. Unpack it next to
+	// the target and move it into place when complete.
+	tmp, err := os.MkdirTemp(folder, ".ipfs-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if _, _, err := fs.extractTar(jobReader{j: j, r: resp.Body}, tmp, conflictOverwrite, nil); err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = cid
+	}
+	target := filepath.Join(folder, freeName(localDisk, folder, name))
+	if err := os.Rename(filepath.Join(tmp, cid), target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// API: POST /api/ipfs/publish adds files or folders to IPFS as a job.
+// JSON body: {"paths": [...], "pin": true}. The job result maps each path to its CID.
+// POST /api/ipfs/fetch copies content into a folder as a job.
+// JSON body: {"cid": "...", "folder": "/target/path", "name": "", "pin": true}
+func (fs *FileServer) handleIPFS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fs.ipfs == nil {
+		httpError(w, "IPFS is disabled. Add \"ipfs\" to the config file to enable it.", 403)
+		return
+	}
+	var req struct {
+		Paths  []string `json:"paths"`
+		Pin    *bool    `json:"pin"`
+		CID    string   `json:"cid"`
+		Folder string   `json:"folder"`
+		Name   string   `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	pin := req.Pin == nil || *req.Pin
+
+	switch strings.TrimPrefix(r.URL.Path, "/api/ipfs/") {
+	case "publish":
+		if len(req.Paths) == 0 {
+			httpError(w, "Missing paths", 400)
+			return
+		}
+		if !fs.resolvePathList(w, req.Paths) {
+			return
+		}
+		// Publishing makes the content public, like changing it
+		if !fs.requireRead(w, r, req.Paths...) || !fs.requireWrite(w, r, req.Paths...) {
+			return
+		}
+		var paths []string
+		for _, p := range req.Paths {
+			p = filepath.FromSlash(p)
+			if !fs.inRoots(p) {
+				httpError(w, "Path is not inside a served folder: "+fs.publicPath(p), 403)
+				return
+			}
+			if _, err := os.Stat(p); err != nil {
+				writeError(w, err, 400)
+				return
+			}
+			paths = append(paths, p)
+		}
+		j := fs.jobs.start("ipfs", fmt.Sprintf("Publish %d item(s) to IPFS", len(paths)), func(j *job) (interface{}, error) {
+			published := make(map[string]interface{})
+			for _, p := range paths {
+				j.add(0, fs.publicPath(p))
+				cid, err := fs.ipfs.add(j, p, pin)
+				if err != nil {
+					return published, err
+				}
+				entry := map[string]string{"cid": cid}
+				if fs.ipfs.gateway != "" {
+					entry["url"] = fs.ipfs.gateway + "/ipfs/" + cid
+				}
+				published[fs.publicPath(p)] = entry
+			}
+			return published, nil
+		})
+		acceptedJob(w, r, j)
+	case "fetch":
+		if req.CID == "" || req.Folder == "" {
+			httpError(w, "Missing cid or folder", 400)
+			return
+		}
+		if strings.ContainsAny(req.CID, "/\\") || (req.Name != "" && !validFileName(req.Name)) {
+			httpError(w, "Invalid cid or name", 400)
+			return
+		}
+		if !fs.resolvePaths(w, &req.Folder) {
+			return
+		}
+		folder := req.Folder
+		if !fs.inRoots(folder) {
+			httpError(w, "Folder is not inside a served folder", 403)
+			return
+		}
+		if !fs.requireRead(w, r, folder) || !fs.requireWrite(w, r, folder) {
+			return
+		}
+		if fi, err := os.Stat(folder); err != nil || !fi.IsDir() {
+			httpError(w, "Folder not found", 400)
+			return
+		}
+		j := fs.jobs.start("ipfs", "Fetch "+req.CID+" from IPFS", func(j *job) (interface{}, error) {
+			target, err := fs.ipfs.get(fs, j, req.CID, folder, req.Name, pin)
+			if err != nil {
+				return nil, err
+			}
+			if abs, err := filepath.Abs(target); err == nil {
+				fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs), Data: map[string]string{"cid": req.CID}})
+			}
+			return map[string]interface{}{"path": fs.publicPath(target), "cid": req.CID}, nil
+		})
+		acceptedJob(w, r, j)
+	default:
+		httpError(w, "Not found", http.StatusNotFound)
+	}
+}
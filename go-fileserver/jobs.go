@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jobRetention is how long finished jobs (and their result files) are kept
+	jobRetention = 24 * time.Hour
+	// jobResultDir holds files produced by jobs, relative to the data directory
+	jobResultDir = "jobs"
+	// jobEventEvery is how often /api/jobs/<id>/events checks a job for changes
+	jobEventEvery = 500 * time.Millisecond
+	// jobRateWindow is the interval over which job throughput is measured
+	jobRateWindow = 2 * time.Second
+)
+
+// Job states
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobPaused   = "paused"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+var errJobCanceled = errors.New("job canceled")
+
+// job is a long-running operation (transfer, archive, extraction, scan, ...)
+// that runs in the background and is polled and controlled via /api/jobs.
+type job struct {
+	ID         string
+	Kind       string
+	Title      string
+	State      string
+	Error      string
+	Current    string
+	Done       int64 // progress, usually in bytes
+	Total      int64
+	ItemsDone  int
+	ItemsTotal int
+	Result     interface{}
+	Created    time.Time
+	Finished   time.Time
+	CreatedBy  string // the user who started the job, see claim
+
+	// resultFile is a file produced by the job, served by /api/jobs/<id>/result
+	resultFile  string
+	resultName  string
+	rate        float64 // units per second over the last jobRateWindow
+	rateDone    int64
+	rateAt      time.Time
+	mu          sync.Mutex
+	resume      *sync.Cond
+	ctx         context.Context
+	cancel      context.CancelFunc
+	pauseWanted bool
+	client      string // the browser of an anonymous visitor who started the job
+	claimed     bool
+}
+
+// jobFunc does the work of a job. It reports progress through j and should call
+// j.checkpoint regularly so the job can be paused and canceled.
+type jobFunc func(j *job) (interface{}, error)
+
+// jobManager keeps the jobs of this process
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobManager() *jobManager {
+	m := &jobManager{jobs: make(map[string]*job)}
+	// Result files of a previous run belong to jobs that no longer exist
+	os.RemoveAll(statePath(jobResultDir))
+	go func() {
+		for range time.Tick(time.Hour) {
+			m.prune()
+		}
+	}()
+	return m
+}
+
+// newJobID returns a random identifier for a background job
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// start runs fn as a new background job
+func (m *jobManager) start(kind, title string, fn jobFunc) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		ID:      newJobID(),
+		Kind:    kind,
+		Title:   title,
+		State:   jobQueued,
+		Created: time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	j.resume = sync.NewCond(&j.mu)
+	m.mu.Lock()
+	m.jobs[j.ID] = j
+	m.mu.Unlock()
+
+	go func() {
+		j.progress(func() {
+			if j.State == jobQueued {
+				j.State = jobRunning
+			}
+		})
+		result, err := fn(j)
+		j.progress(func() {
+			j.Current = ""
+			j.Result = result
+			j.Finished = time.Now()
+			switch {
+			case err == errJobCanceled || (err != nil && ctx.Err() != nil):
+				j.State = jobCanceled
+			case err != nil:
+				j.State = jobFailed
+				j.Error = errorMessage(err)
+			default:
+				j.State = jobDone
+			}
+		})
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Job %s (%s) failed: %v", j.ID, kind, err)
+		}
+	}()
+	return j
+}
+
+func (m *jobManager) get(id string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+// list returns all jobs, oldest first, optionally only those of one kind
+func (m *jobManager) list(kind string) []*job {
+	m.mu.Lock()
+	var jobs []*job
+	for _, j := range m.jobs {
+		if kind == "" || j.Kind == kind {
+			jobs = append(jobs, j)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Created.Before(jobs[b].Created) })
+	return jobs
+}
+
+// remove forgets a finished job and deletes its result file
+func (m *jobManager) remove(j *job) {
+	m.mu.Lock()
+	delete(m.jobs, j.ID)
+	m.mu.Unlock()
+	if j.resultFile != "" {
+		os.Remove(j.resultFile)
+	}
+}
+
+// prune removes jobs that finished more than jobRetention ago
+func (m *jobManager) prune() {
+	for _, j := range m.list("") {
+		if j.finished() && time.Since(j.Finished) > jobRetention {
+			m.remove(j)
+		}
+	}
+}
+
+func (j *job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.State == jobDone || j.State == jobFailed || j.State == jobCanceled
+}
+
+// progress applies fn to the job's fields under its lock
+func (j *job) progress(fn func()) {
+	j.mu.Lock()
+	fn()
+	j.mu.Unlock()
+}
+
+// add counts n more units of progress, with current as the item being worked on
+func (j *job) add(n int64, current string) {
+	j.progress(func() {
+		j.Done += n
+		if current != "" {
+			j.Current = current
+		}
+		if now := time.Now(); j.rateAt.IsZero() {
+			j.rateAt = now
+		} else if d := now.Sub(j.rateAt); d >= jobRateWindow {
+			j.rate = float64(j.Done-j.rateDone) / d.Seconds()
+			j.rateDone, j.rateAt = j.Done, now
+		}
+	})
+}
+
+// checkpoint blocks while the job is paused and reports cancellation
+func (j *job) checkpoint() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.pauseWanted && j.ctx.Err() == nil {
+		j.resume.Wait()
+	}
+	if j.ctx.Err() != nil {
+		return errJobCanceled
+	}
+	return nil
+}
+
+func (j *job) setPaused(p bool) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.State != jobRunning && j.State != jobPaused && j.State != jobQueued {
+		return false
+	}
+	j.pauseWanted = p
+	if p && j.State == jobRunning {
+		j.State = jobPaused
+	}
+	if !p && j.State == jobPaused {
+		j.State = jobRunning
+		j.resume.Broadcast()
+	}
+	return true
+}
+
+func (j *job) stop() {
+	j.cancel()
+	j.mu.Lock()
+	j.resume.Broadcast()
+	j.mu.Unlock()
+}
+
+// snapshot returns the job's public fields in a form that is safe to encode
+func (j *job) snapshot() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := map[string]interface{}{
+		"id":         j.ID,
+		"kind":       j.Kind,
+		"title":      j.Title,
+		"state":      j.State,
+		"current":    j.Current,
+		"done":       j.Done,
+		"total":      j.Total,
+		"itemsDone":  j.ItemsDone,
+		"itemsTotal": j.ItemsTotal,
+		"created":    j.Created,
+	}
+	if j.CreatedBy != "" {
+		s["createdBy"] = j.CreatedBy
+	}
+	if j.Total > 0 {
+		s["percent"] = float64(j.Done) * 100 / float64(j.Total)
+	}
+	if j.State == jobRunning && j.rate > 0 {
+		s["throughput"] = j.rate
+		if j.Total > j.Done {
+			s["eta"] = int64(float64(j.Total-j.Done) / j.rate)
+		}
+	}
+	if j.Error != "" {
+		s["error"] = j.Error
+	}
+	if j.Result != nil {
+		s["result"] = j.Result
+	}
+	if j.resultFile != "" && j.State == jobDone {
+		s["download"] = "/api/jobs/" + j.ID + "/result"
+	}
+	if !j.Finished.IsZero() {
+		s["finished"] = j.Finished
+	}
+	return s
+}
+
+// jobReader reports bytes read from r as progress of j and stops when j is
+// canceled (or waits while it is paused)
+type jobReader struct {
+	j *job
+	r io.Reader
+}
+
+func (jr jobReader) Read(p []byte) (int, error) {
+	if err := jr.j.checkpoint(); err != nil {
+		return 0, err
+	}
+	n, err := jr.r.Read(p)
+	jr.j.add(int64(n), "")
+	return n, err
+}
+
+// claim makes the requester of r the owner of j, unless it already has one:
+// the user, or the browser of an anonymous visitor. Jobs nobody claimed, such
+// as scheduled scans, belong to admins only.
+func (j *job) claim(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.claimed || !authEnabled() {
+		return
+	}
+	j.claimed = true
+	if a := accountOf(r); a != nil {
+		j.CreatedBy = a.Name
+	} else {
+		j.client = clientID(w, r)
+	}
+}
+
+// canManageJob reports whether r may see and control j: admins and whoever
+// started it, everyone without logins
+func canManageJob(r *http.Request, j *job) bool {
+	if !authEnabled() {
+		return true
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if a := accountOf(r); a != nil {
+		return a.has(roleAdmin) || (j.CreatedBy != "" && a.Name == j.CreatedBy)
+	}
+	c, err := r.Cookie(clientCookie)
+	return err == nil && j.client != "" && c.Value == j.client
+}
+
+// acceptedJob answers a request that started a job, which becomes the
+// requester's (see claim)
+func acceptedJob(w http.ResponseWriter, r *http.Request, j *job) {
+	j.claim(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j.snapshot())
+}
+
+// API: Background jobs.
+// GET lists jobs (?kind= filters); GET /<id> polls one; GET /<id>/result downloads
+// its output; POST /<id>/pause, /<id>/resume, /<id>/cancel control it; DELETE /<id>
+// cancels a running job or forgets a finished one. Users only see their own
+// jobs, admins all of them.
+func (fs *FileServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if rest == "" {
+		list := []map[string]interface{}{}
+		for _, j := range fs.jobs.list(r.URL.Query().Get("kind")) {
+			if canManageJob(r, j) {
+				list = append(list, j.snapshot())
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	j := fs.jobs.get(id)
+	if j == nil || !canManageJob(r, j) {
+		httpError(w, "Job not found", 404)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		if j.finished() {
+			fs.jobs.remove(j)
+		} else {
+			j.stop()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	case action == "":
+		json.NewEncoder(w).Encode(j.snapshot())
+	case action == "events":
+		fs.streamJob(w, r, j)
+	case action == "result":
+		if !j.finished() || j.resultFile == "" || !fileExists(j.resultFile) {
+			httpError(w, "Job has no result to download", 404)
+			return
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": j.resultName}))
+		http.ServeFile(w, r, j.resultFile)
+	case r.Method != http.MethodPost:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		ok := true
+		switch action {
+		case "pause":
+			ok = j.setPaused(true)
+		case "resume":
+			ok = j.setPaused(false)
+		case "cancel":
+			ok = !j.finished()
+			j.stop()
+		default:
+			httpError(w, "Unknown action: "+action, 400)
+			return
+		}
+		if !ok {
+			httpError(w, "Job is already finished", 409)
+			return
+		}
+		json.NewEncoder(w).Encode(j.snapshot())
+	}
+}
+
+// API: Live job progress as server-sent events. A "progress" event with the job
+// snapshot is sent whenever it changes, and a final "done" event when it finishes.
+func (fs *FileServer) streamJob(w http.ResponseWriter, r *http.Request, j *job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Streaming not supported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	tick := time.NewTicker(jobEventEvery)
+	defer tick.Stop()
+	var last []byte
+	for {
+		snap := j.snapshot()
+		data, _ := json.Marshal(snap)
+		done := j.finished()
+		if !bytes.Equal(data, last) || done {
+			event := "progress"
+			if done {
+				event = "done"
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			flusher.Flush()
+			last = data
+		}
+		if done {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// In kiosk mode (-kiosk <folder>) visitors who are not logged in only get an
+// upload page. Their uploads always go to the kiosk folder and never replace
+// existing files; the tree, viewer and downloads are closed to them.
+
+// kioskGuest reports whether r is an anonymous visitor in kiosk mode
+func kioskGuest(r *http.Request) bool {
+	return *kiosk != "" && !authenticated(r)
+}
+
+// kioskPath reports whether p is open to guests: the upload page, the upload
+// endpoint, share links and logging in
+func kioskPath(p string) bool {
+	switch {
+	case p == "/", p == "/index.html", p == "/login", p == "/static/style.css", p == "/api/upload",
+		p == "/api/login", p == "/api/me", p == "/api/logout",
+		strings.HasPrefix(p, sharePrefix):
+		return true
+	}
+	return false
+}
+
+// kioskMiddleware confines guests to the kioskPath endpoints. It runs inside
+// authMiddleware, so logged-in users are known by then.
+func kioskMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !kioskGuest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case !kioskPath(r.URL.Path):
+			httpError(w, "Forbidden", http.StatusForbidden)
+		case r.URL.Path == "/" || r.URL.Path == "/index.html":
+			http.ServeFile(w, r, "./static/kiosk.html")
+		case r.URL.Path == "/login":
+			http.ServeFile(w, r, "./static/login.html")
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// freeName returns base, or "name (2).ext", "name (3).ext", ... if base is
+// taken in dir of store
+func freeName(store Storage, dir, base string) string {
+	taken := func(name string) bool {
+		_, err := lstat(store, filepath.Join(dir, name))
+		return err == nil
+	}
+	if !taken(base) {
+		return base
+	}
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 2; ; i++ {
+		if name := fmt.Sprintf("%s (%d)%s", stem, i, ext); !taken(name) {
+			return name
+		}
+	}
+}
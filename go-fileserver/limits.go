@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With the "clientLimits" config key, one client address can only run a few
+// downloads and uploads at a time and transfer so many bytes a day, so a
+// single greedy client on a shared link can't take the whole server. IPv6
+// clients are counted per /64, which is what one client usually gets.
+
+// clientLimitsConfig is the "clientLimits" config key. Zero means no limit.
+type clientLimitsConfig struct {
+	// Downloads and Uploads cap the simultaneous transfers of one client
+	Downloads int `json:"downloads"`
+	Uploads   int `json:"uploads"`
+	// DailyBytes caps what one client downloads and uploads per day, e.g. "20G"
+	DailyBytes string `json:"dailyBytes"`
+}
+
+const (
+	transferDownload = "download"
+	transferUpload   = "upload"
+)
+
+var errDailyBudget = errors.New("daily transfer budget used up")
+
+// clientUsage is what one client address is doing and has done today
+type clientUsage struct {
+	downloads, uploads int
+	day                string
+	bytes              int64
+}
+
+// clientLimiter enforces a clientLimitsConfig
+type clientLimiter struct {
+	downloads, uploads int
+	daily              int64
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+	pruned  string // the day idle clients were last dropped
+
+	logf func(format string, v ...interface{}) // for refused requests
+}
+
+func newClientLimiter(c *clientLimitsConfig) (*clientLimiter, error) {
+	if c.Downloads < 0 || c.Uploads < 0 {
+		return nil, fmt.Errorf("clientLimits: downloads and uploads can't be negative")
+	}
+	l := &clientLimiter{downloads: c.Downloads, uploads: c.Uploads, clients: make(map[string]*clientUsage), logf: log.Printf}
+	if c.DailyBytes != "" {
+		n, err := parseSize(c.DailyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("clientLimits: dailyBytes: %v", err)
+		}
+		l.daily = n
+	}
+	return l, nil
+}
+
+// transferKind tells whether r downloads or uploads file contents, or is
+// neither and therefore not limited
+func transferKind(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case p == "/api/raw" && r.Method == http.MethodPut,
+		p == "/api/upload",
+		p == "/api/delta/patch",
+		p == "/api/sync/file" && r.Method == http.MethodPut,
+		strings.HasPrefix(p, "/api/uploads/") && r.Method == http.MethodPatch,
+		strings.HasPrefix(p, upPrefix),
+		strings.HasPrefix(p, sharePrefix) && r.Method == http.MethodPost:
+		return transferUpload
+	case p == "/api/raw",
+		p == "/api/download",
+		p == "/api/download/batch",
+		p == "/api/delta/diff",
+		strings.HasPrefix(p, "/r/"),
+		strings.HasPrefix(p, sharePrefix),
+		strings.HasPrefix(p, browsePrefix),
+		strings.HasPrefix(p, "/api/jobs/") && strings.HasSuffix(p, "/result"):
+		return transferDownload
+	}
+	return ""
+}
+
+// clientKey is the address a client is counted by
+func clientKey(r *http.Request) string {
+	ip := clientIP(r)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return ip.String()
+}
+
+// usage returns the entry of key for today. The caller holds l.mu.
+func (l *clientLimiter) usage(key string) *clientUsage {
+	today := time.Now().Format("2006-01-02")
+	if l.pruned != today {
+		for k, u := range l.clients {
+			if u.downloads == 0 && u.uploads == 0 {
+				delete(l.clients, k)
+			}
+		}
+		l.pruned = today
+	}
+	u := l.clients[key]
+	if u == nil {
+		u = &clientUsage{day: today}
+		l.clients[key] = u
+	}
+	if u.day != today {
+		u.day, u.bytes = today, 0
+	}
+	return u
+}
+
+// acquire starts a transfer of kind for key, or says why it can't start now
+func (l *clientLimiter) acquire(key, kind string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usage(key)
+	if l.daily > 0 && u.bytes >= l.daily {
+		return errDailyBudget
+	}
+	switch {
+	case kind == transferDownload && l.downloads > 0 && u.downloads >= l.downloads:
+		return fmt.Errorf("too many simultaneous downloads (at most %d)", l.downloads)
+	case kind == transferUpload && l.uploads > 0 && u.uploads >= l.uploads:
+		return fmt.Errorf("too many simultaneous uploads (at most %d)", l.uploads)
+	}
+	if kind == transferDownload {
+		u.downloads++
+	} else {
+		u.uploads++
+	}
+	return nil
+}
+
+func (l *clientLimiter) release(key, kind string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.clients[key]
+	if kind == transferDownload {
+		u.downloads--
+	} else {
+		u.uploads--
+	}
+}
+
+// spend counts n transferred bytes against key's budget and fails once it is
+// used up
+func (l *clientLimiter) spend(key string, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.usage(key)
+	u.bytes += int64(n)
+	if u.bytes > l.daily {
+		return errDailyBudget
+	}
+	return nil
+}
+
+// budgetWriter stops a download when the client's budget runs out
+type budgetWriter struct {
+	http.ResponseWriter
+	l   *clientLimiter
+	key string
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err == nil {
+		err = w.l.spend(w.key, n)
+	}
+	return n, err
+}
+
+func (w *budgetWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *budgetWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// budgetReader stops an upload when the client's budget runs out
+type budgetReader struct {
+	io.ReadCloser
+	l   *clientLimiter
+	key string
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if e := r.l.spend(r.key, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// budgetConn counts what goes both ways over a connection of another
+// protocol, such as an SFTP session, against the client's budget
+type budgetConn struct {
+	net.Conn
+	l   *clientLimiter
+	key string
+}
+
+func (c *budgetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if e := c.l.spend(c.key, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+func (c *budgetConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err == nil {
+		err = c.l.spend(c.key, n)
+	}
+	return n, err
+}
+
+// admitConn applies the limits to a connection of another protocol before
+// anything is read from it: for as long as it lasts, it takes one of the
+// client's downloads, and what it carries counts against the daily budget.
+// done gives the download back.
+func (l *clientLimiter) admitConn(c net.Conn) (conn net.Conn, done func(), err error) {
+	key := clientKey(&http.Request{RemoteAddr: c.RemoteAddr().String()})
+	if err := l.acquire(key, transferDownload); err != nil {
+		return nil, nil, err
+	}
+	if l.daily > 0 {
+		c = &budgetConn{Conn: c, l: l, key: key}
+	}
+	return c, func() { l.release(key, transferDownload) }, nil
+}
+
+// untilTomorrow is how long until the daily budgets start over
+func untilTomorrow() time.Duration {
+	now := time.Now()
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// middleware answers transfers over a client's limits with 429 and counts
+// the bytes of the others
+func (l *clientLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := transferKind(r)
+		if kind == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := clientKey(r)
+		if err := l.acquire(key, kind); err != nil {
+			retry := time.Second * 5
+			if err == errDailyBudget {
+				retry = untilTomorrow()
+			}
+			l.logf("Limits: refused %s %s %s: %v", key, r.Method, r.URL.Path, err)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			writeError(w, err, http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(key, kind)
+		if l.daily > 0 {
+			w = &budgetWriter{ResponseWriter: w, l: l, key: key}
+			r.Body = &budgetReader{ReadCloser: r.Body, l: l, key: key}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// -port-fallback values
+const (
+	portFallbackNext = "next" // try the following ports, then any free one
+	portFallbackAny  = "any"  // let the system pick a free port
+	// portFallbackTries is how many ports after -port "next" tries
+	portFallbackTries = 20
+)
+
+// listen opens the server's TCP port on host, all interfaces if empty. If it
+// can't be opened, usually because it is taken, fallback decides whether
+// another one is used instead.
+func listen(host, port, fallback string) (net.Listener, error) {
+	if fallback != "" && fallback != portFallbackNext && fallback != portFallbackAny {
+		return nil, fmt.Errorf("-port-fallback: want next or any, not %q", fallback)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err == nil || fallback == "" {
+		return ln, err
+	}
+	log.Printf("Port %s: %v", port, err)
+	if n, perr := strconv.Atoi(port); perr == nil && fallback == portFallbackNext {
+		for p := n + 1; p <= n+portFallbackTries && p <= 65535; p++ {
+			if ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p))); err == nil {
+				return ln, nil
+			}
+		}
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, "0"))
+}
+
+// serverURLs are the addresses the server can be reached at on this machine
+// and, for other devices, on its local networks. A server bound to one
+// address is only reachable there.
+func serverURLs(scheme, host, port string) []string {
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{scheme + "://" + net.JoinHostPort(host, port) + "/"}
+	}
+	urls := []string{scheme + "://localhost:" + port + "/"}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return urls
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		urls = append(urls, scheme+"://"+net.JoinHostPort(ipnet.IP.String(), port)+"/")
+	}
+	return urls
+}
+
+// announce logs where the server is listening, with -qr shows the address
+// for other devices as a QR code, and with -open opens it in the browser
+func announce(scheme string, ln net.Listener) {
+	actual := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if actual != *port {
+		log.Printf("Using port %s instead", actual)
+	}
+	urls := serverURLs(scheme, *bindTo, actual)
+	for _, u := range urls {
+		log.Printf("Serving on %s", u)
+	}
+	if *qrCode {
+		// A phone wants the LAN address, not localhost
+		u := urls[0]
+		if len(urls) > 1 {
+			u = urls[1]
+		}
+		q, err := qrcode.New(u, qrcode.Low)
+		if err != nil {
+			log.Printf("QR code: %v", err)
+		} else {
+			fmt.Fprint(os.Stdout, q.ToSmallString(false))
+		}
+	}
+	if *openUI {
+		if err := openBrowser(urls[0]); err != nil {
+			log.Printf("Open browser: %v", err)
+		}
+	}
+}
+
+// openBrowser opens u in the default browser of the desktop session
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	case "darwin":
+		cmd = exec.Command("open", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// wantsText reports whether a listing should be plain text rather than JSON:
+// with ?format=text, or when text/plain is the first type the client accepts
+// (curl -H 'Accept: text/plain').
+func wantsText(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "text"
+	}
+	first, _, _ := strings.Cut(r.Header.Get("Accept"), ",")
+	mt, _, err := mime.ParseMediaType(strings.TrimSpace(first))
+	return err == nil && mt == "text/plain"
+}
+
+// formatSize renders a byte count like "1.5M"
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v := float64(n)
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		v /= 1024
+		if v < 1024 || unit == "T" {
+			if v < 10 {
+				return fmt.Sprintf("%.1f%s", v, unit)
+			}
+			return fmt.Sprintf("%.0f%s", v, unit)
+		}
+	}
+	return ""
+}
+
+// writeTextListing writes tree entries as aligned "name  size  modified" lines.
+// Folders end in "/" and show a size only when the size index knows it.
+func writeTextListing(w http.ResponseWriter, entries []map[string]interface{}) {
+	type line struct{ name, size, modified string }
+	lines := make([]line, 0, len(entries))
+	width := 0
+	for _, e := range entries {
+		l := line{name: fmt.Sprint(e["name"]), size: "-"}
+		if e["type"] == "folder" {
+			l.name += "/"
+		}
+		if size, ok := e["size"].(int64); ok {
+			l.size = formatSize(size)
+		}
+		if mod, ok := e["modified"].(int64); ok {
+			l.modified = time.Unix(mod, 0).Format("2006-01-02 15:04")
+		}
+		if n := utf8.RuneCountInString(l.name); n > width {
+			width = n
+		}
+		lines = append(lines, l)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, l := range lines {
+		fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("%-*s  %6s  %s", width, l.name, l.size, l.modified), " "))
+	}
+}
+
+// treeSorts are the orders /api/tree can list a folder in
+var treeSorts = map[string]bool{"name": true, "size": true, "mtime": true}
+
+// sortTreeItems orders tree entries by name (case-insensitively), size or
+// modification time, ties broken by name. Entries without a size, such as
+// folders without -size-index, count as empty.
+func sortTreeItems(items []map[string]interface{}, by string, desc bool) {
+	num := func(v interface{}) int64 {
+		n, _ := v.(int64)
+		return n
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case "size":
+			if x, y := num(a["size"]), num(b["size"]); x != y {
+				return x < y
+			}
+		case "mtime":
+			if x, y := num(a["modified"]), num(b["modified"]); x != y {
+				return x < y
+			}
+		}
+		x, y := fmt.Sprint(a["name"]), fmt.Sprint(b["name"])
+		if lx, ly := strings.ToLower(x), strings.ToLower(y); lx != ly {
+			return lx < ly
+		}
+		return x < y
+	})
+}
+
+// treePage is the part of a folder listing that /api/tree?offset=&limit= asks
+// for. Without either parameter it is the whole folder, sent as a plain array.
+type treePage struct {
+	offset, limit int // limit < 0 for no limit
+	paged         bool
+}
+
+func parseTreePage(q url.Values) (treePage, error) {
+	p := treePage{limit: -1, paged: q.Has("offset") || q.Has("limit")}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid offset: %s", v)
+		}
+		p.offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid limit: %s", v)
+		}
+		p.limit = n
+	}
+	return p, nil
+}
+
+// has reports whether the i-th entry of the folder is on the page
+func (p treePage) has(i int) bool {
+	return i >= p.offset && (p.limit < 0 || i < p.offset+p.limit)
+}
+
+// done reports whether the page is complete once i entries have been seen
+func (p treePage) done(i int) bool {
+	return p.limit >= 0 && i >= p.offset+p.limit
+}
+
+// treeWriter writes tree entries one at a time as a JSON array, or for a page
+// as {"entries": [...], "total": n, "offset": n, "limit": n}, so entries go
+// out as they are described rather than once the whole listing is built
+type treeWriter struct {
+	w     io.Writer
+	page  treePage
+	count int
+}
+
+func newTreeWriter(w http.ResponseWriter, page treePage) *treeWriter {
+	w.Header().Set("Content-Type", "application/json")
+	if page.paged {
+		io.WriteString(w, `{"entries":[`)
+	} else {
+		io.WriteString(w, "[")
+	}
+	return &treeWriter{w: w, page: page}
+}
+
+func (tw *treeWriter) write(item map[string]interface{}) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if tw.count > 0 {
+		b = append([]byte{','}, b...)
+	}
+	tw.count++
+	_, err = tw.w.Write(b)
+	return err
+}
+
+// close ends the listing of a folder with total entries. The limit is left
+// out of a page asked for without one.
+func (tw *treeWriter) close(total int) {
+	if !tw.page.paged {
+		io.WriteString(tw.w, "]\n")
+		return
+	}
+	fmt.Fprintf(tw.w, `],"total":%d,"offset":%d`, total, tw.page.offset)
+	if tw.page.limit >= 0 {
+		fmt.Fprintf(tw.w, `,"limit":%d`, tw.page.limit)
+	}
+	io.WriteString(tw.w, "}\n")
+}
+
+// wantsMeta reports whether tree entries should carry all metadata (size,
+// modification time, permissions, symlink target): with ?meta=1
+func wantsMeta(r *http.Request) bool {
+	v := r.URL.Query().Get("meta")
+	return v == "1" || v == "true"
+}
+
+// wantsNDJSON reports whether a listing should be streamed as newline-delimited
+// JSON, one object per entry: with ?format=ndjson or Accept: application/x-ndjson.
+func wantsNDJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "ndjson"
+	}
+	first, _, _ := strings.Cut(r.Header.Get("Accept"), ",")
+	mt, _, err := mime.ParseMediaType(strings.TrimSpace(first))
+	return err == nil && mt == "application/x-ndjson"
+}
+
+// ndjsonWriter streams one JSON object per line. Lines are sent to the client
+// whenever flush is called, so consumers can start on them right away.
+type ndjsonWriter struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+	return &ndjsonWriter{enc: json.NewEncoder(w), flusher: flusher}
+}
+
+func (nw *ndjsonWriter) write(v interface{}) error {
+	return nw.enc.Encode(v)
+}
+
+func (nw *ndjsonWriter) flush() {
+	if nw.flusher != nil {
+		nw.flusher.Flush()
+	}
+}
+
+// streamSearchNDJSON streams the matches of q as they are found. Without an
+// explicit ?limit= the search is not capped; it stops when the client goes away.
+// An error after streaming has begun is sent as a final {"error": ...} line.
+func (fs *FileServer) streamSearchNDJSON(w http.ResponseWriter, r *http.Request, q searchQuery) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+	if _, err := q.filter(); err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	nw := newNDJSONWriter(w)
+	_, err := fs.streamSearch(r.Context(), q, limit, func(res searchResult) error {
+		res.Path = fs.publicPath(res.Path)
+		if err := nw.write(res); err != nil {
+			return err
+		}
+		nw.flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		nw.write(map[string]interface{}{"error": errorBody(codeInternal, errorMessage(err))})
+	}
+	nw.flush()
+}
+
+// ndjsonBatch is how many directory entries streamTree reads and sends at a time
+const ndjsonBatch = 256
+
+// streamTree streams the entries of dir on page as NDJSON. The folder is read
+// in batches, in directory order rather than sorted, so entries of huge folders
+// start arriving immediately.
+func (fs *FileServer) streamTree(w http.ResponseWriter, r *http.Request, dir string, filter *fileFilter, page treePage) {
+	store := fs.storageFor(dir)
+	f, err := store.Open(dir)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		httpError(w, "Not a folder", 400)
+		return
+	}
+	rd, ok := f.(dirReader)
+	if !ok {
+		rd = &readAllDir{s: store, name: dir}
+	}
+	meta := wantsMeta(r)
+	nw := newNDJSONWriter(w)
+	index := 0
+	for r.Context().Err() == nil && !page.done(index) {
+		entries, err := rd.ReadDir(ndjsonBatch)
+		for _, e := range entries {
+			if page.done(index) {
+				break
+			}
+			if !page.has(index) {
+				if fs.treeVisible(dir, e, filter) {
+					index++
+				}
+				continue
+			}
+			if item := fs.treeItem(dir, e, filter, true, meta); item != nil {
+				nw.write(item)
+				index++
+			}
+		}
+		nw.flush()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			nw.write(map[string]interface{}{"error": errorBody(codeInternal, errorMessage(err))})
+			return
+		}
+	}
+}
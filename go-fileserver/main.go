@@ -1,56 +1,326 @@
 package main
 
 import (
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
 )
 
 var (
 	port    = flag.String("port", "30006", "Port to run the server on")
+	bindTo  = flag.String("host", "", "Address to listen on, e.g. 127.0.0.1 (default: all interfaces)")
 	folders = flag.String("folders", "", "Comma-separated list of folders to serve")
+	dataDir = flag.String("data-dir", ".fileserver", "Directory for server state (caches, indexes)")
+	sizeIdx = flag.Bool("size-index", false, "Keep a persistent, fsnotify-updated index of folder sizes")
+	srchIdx = flag.Bool("search-index", false, "Keep a persistent, fsnotify-updated index of file names and text for fast searches")
+	cfgFile = flag.String("config", "", "Path to a JSON, YAML or TOML config file (roots, TLS, auth, smart folders, ...); flags given override it")
+	dedupOn = flag.Bool("dedup", false, "Allow /api/dedup to replace duplicate files with hardlinks")
+	casMode = flag.Bool("cas", false, "Store uploads once by content hash, with the tree holding hardlinks to them")
+	lowDisk = flag.String("min-free", "1G", "Refuse uploads that would leave less free disk space than this (0 disables)")
+	signRaw = flag.Bool("sign-raw", false, "Only serve /api/raw to logged-in users or with a signed, expiring URL (hotlink protection)")
+	rawTTL  = flag.Duration("sign-raw-ttl", time.Hour, "How long signed /api/raw URLs stay valid")
+	warmUp  = flag.Bool("warm", false, "Walk all folders at startup to pre-populate caches")
+	authUP  = flag.String("auth", "", "Require HTTP basic auth with this user:password")
+	authTok = flag.String("token", "", "Require this token, sent as \"Authorization: Bearer <token>\" or ?token=")
+	authLg  = flag.String("auth-log", "", "Append authentication failures to this file in a fail2ban-friendly format")
+	tlsCert = flag.String("tls-cert", "", "TLS certificate file; enables HTTPS together with -tls-key")
+	tlsKey  = flag.String("tls-key", "", "TLS private key file")
+	httpRed = flag.String("http-redirect", "", "With TLS, also listen on this address (e.g. :80) and redirect to HTTPS")
+	hstsAge = flag.Duration("hsts-max-age", 0, "With TLS, send Strict-Transport-Security with this max-age (e.g. 8760h, 0 disables)")
+	sftpPt  = flag.String("sftp-port", "", "Also serve the folders over SFTP on this port (e.g. 2022)")
+	acmeDom = flag.String("autocert-domain", "", "Serve HTTPS with Let's Encrypt certificates for these comma-separated domains")
+	acmeMl  = flag.String("autocert-email", "", "Contact address for the Let's Encrypt account (optional)")
+	kiosk   = flag.String("kiosk", "", "Upload-only kiosk mode: visitors who aren't logged in can only upload into this folder")
+	scrubIv = flag.Duration("scrub-interval", 0, "Re-hash all files against the checksum manifest this often (e.g. 24h, 0 disables)")
+	rptEach = flag.String("report", "", "Build a storage summary report daily or weekly and send it to the notification channels")
+	rptAt   = flag.String("report-at", "08:00", "Local time of day (HH:MM) scheduled reports are built; weekly ones on Mondays")
+	daemon  = flag.Bool("daemon", false, "Unix: detach from the terminal and keep running in the background, logging to server.log in -data-dir")
+	pidFile = flag.String("pidfile", "", "Write the process ID to this file (and refuse to start if that server is still running)")
+	syncOn  = flag.Bool("sync", false, "Keep a journal of file changes for sync clients (/api/sync)")
+	portFb  = flag.String("port-fallback", "", "If -port can't be opened, use the next free one (next) or any free one (any)")
+	qrCode  = flag.Bool("qr", false, "Print the server's LAN address as a QR code at startup")
+	openUI  = flag.Bool("open", false, "Open the web UI in the default browser at startup")
+	roMode  = flag.Bool("readonly", false, "Serve for browsing only: refuse uploads and every other change to files")
+	trashOn = flag.Bool("trash", true, "Move deleted files to a .trash folder in their served folder, from where /api/trash restores them")
+	trashAg = flag.Duration("trash-max-age", 30*24*time.Hour, "Remove items from the trash after this long (0 keeps them until purged)")
+	versNum = flag.Int("versions", 10, "Keep this many earlier versions of a file when it is overwritten, in a .versions folder in its served folder (0 disables)")
+	versAge = flag.Duration("versions-max-age", 0, "Remove kept versions after this long (0 keeps them until -versions newer ones replace them)")
 )
 
 type FileServer struct {
-	FolderList []string
+	state      atomic.Pointer[servedState] // replaced as a whole by reload
+	sizes      *sizeCache
+	sizeIndex  *sizeIndex   // nil unless -size-index is set
+	index      *searchIndex // nil unless -search-index is set
+	saved      *savedSearches
+	previews   *previewRegistry
+	contents   *contentIndex
+	scrub      *scrubber
+	reports    *reporter
+	minFree    int64
+	jobs       *jobManager
+	uploads    *uploadSessions
+	progress   *uploadTracker
+	clipboard  *clipboards
+	shortLinks *shortLinks
+	shares     *shares
+	signingKey []byte
+	warmers    []warmer
+	graphql    *graphql.Schema
+	events     *eventBus
+	journal    *syncJournal   // nil unless -sync is set
+	fetcher    *fetcher       // nil unless fetching is configured
+	ipfs       *ipfsNode      // nil unless an IPFS node is configured
+	geo        *geoFilter     // nil unless GeoIP rules are configured
+	limits     *clientLimiter // nil unless client limits are configured
+	watchMu    sync.Mutex
+	watched    map[string]bool // roots being watched, nil until watchFiles
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash":
+			runHashCommand(os.Args[2:])
+			return
+		case "export":
+			runExportCommand(os.Args[2:])
+			return
+		case "import":
+			runImportCommand(os.Args[2:])
+			return
+		case "service":
+			runServiceCommand(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
-	if *folders == "" {
-		log.Fatal("No folders provided. Use -folders to specify folders.")
-	}
-	// Parse folders
-	folderList := strings.Split(*folders, ",")
-	var cleanFolders []string
-	for _, f := range folderList {
-		trimmed := strings.TrimSpace(f)
-		if trimmed != "" {
-			if _, err := os.Stat(trimmed); os.IsNotExist(err) {
-				log.Fatalf("Folder does not exist: %s", trimmed)
-			}
-			log.Println("Folder: %s", trimmed)
-			cleanFolders = append(cleanFolders, trimmed)
+	if *daemon && os.Getenv(daemonEnv) == "" {
+		daemonize()
+	}
+	serve()
+}
+
+// serve runs the server configured by the command line flags
+func serve() {
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("-pidfile: %v", err)
 		}
 	}
+	cfg, err := loadConfig(*cfgFile)
+	if err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	if err := cfg.applyFlags(); err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	state, err := openFolders(*folders, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbPath := cfg.Database
+	if dbPath == "" {
+		dbPath = statePath(storeFile)
+	}
+	if db, err = openStore(dbPath); err != nil {
+		log.Fatalf("Store: %v", err)
+	}
+	if err := loadAccounts(); err != nil {
+		log.Fatalf("Users: %v", err)
+	}
 
 	server := &FileServer{
-		FolderList: cleanFolders,
+		sizes:      newSizeCache(),
+		saved:      loadSavedSearches(),
+		previews:   newPreviewRegistry(),
+		contents:   loadContentIndex(),
+		jobs:       newJobManager(),
+		uploads:    newUploadSessions(),
+		progress:   newUploadTracker(),
+		clipboard:  newClipboards(),
+		shortLinks: loadShortLinks(),
+		shares:     loadShares(),
+		events:     newEventBus(),
+	}
+	server.state.Store(state)
+	if err := server.previews.configure(cfg.Previewers); err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	if err := registerMimeTypes(cfg.MimeTypes); err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	if *casMode {
+		server.startCASGC()
+	}
+	if *trashOn && *trashAg > 0 {
+		server.startTrashPurge(*trashAg)
+	}
+	if *versNum > 0 && *versAge > 0 {
+		server.startVersionPrune(*versAge)
+	}
+	if server.minFree, err = parseSize(*lowDisk); err != nil {
+		log.Fatalf("-min-free: %v", err)
+	}
+	if err := setCredentials(*authUP, *authTok); err != nil {
+		log.Fatal(err)
+	}
+	if err := openAuthLog(*authLg); err != nil {
+		log.Fatalf("Auth log: %v", err)
+	}
+	if server.signingKey, err = loadSigningKey(); err != nil {
+		log.Fatalf("Signing key: %v", err)
+	}
+	server.scrub = newScrubber(server)
+	server.reports = newReporter(server)
+	server.graphql = newGraphQLSchema(server)
+	if len(cfg.Webhooks) > 0 {
+		server.startWebhooks(cfg.Webhooks)
+	}
+	if cfg.MQTT != nil {
+		server.startMQTT(cfg.MQTT)
+	}
+	if len(cfg.EmailRules) > 0 {
+		server.startEmail(cfg.SMTP, cfg.EmailRules)
+	}
+	if len(cfg.Chat) > 0 {
+		server.startChat(cfg.Chat)
+	}
+	if server.minFree > 0 {
+		go server.watchDiskFree()
+	}
+	if cfg.Fetch != nil {
+		if server.fetcher, err = newFetcher(cfg.Fetch); err != nil {
+			log.Fatalf("Config: %v", err)
+		}
+	}
+	if cfg.IPFS != nil {
+		if server.ipfs, err = newIPFSNode(cfg.IPFS); err != nil {
+			log.Fatalf("Config: %v", err)
+		}
+	}
+	if *syncOn {
+		server.startSync()
+	}
+	if *scrubIv > 0 {
+		server.scrub.schedule(*scrubIv)
 	}
+	if *rptEach != "" {
+		if *rptEach != reportDaily && *rptEach != reportWeekly {
+			log.Fatalf("-report: want daily or weekly, not %q", *rptEach)
+		}
+		hour, min, err := parseReportAt(*rptAt)
+		if err != nil {
+			log.Fatalf("-report-at: %v", err)
+		}
+		server.reports.schedule(*rptEach, hour, min)
+	}
+	if *sizeIdx {
+		idx, err := newSizeIndex(state.folders, server.jobs, server.publicPath)
+		if err != nil {
+			log.Fatalf("Size index: %v", err)
+		}
+		server.sizeIndex = idx
+	}
+	if *srchIdx {
+		idx, err := newSearchIndex(state.folders, server.jobs, server.publicPath)
+		if err != nil {
+			log.Fatalf("Search index: %v", err)
+		}
+		server.index = idx
+	}
+	if *warmUp {
+		server.warm()
+	}
+	server.reloadOnSignal()
 
 	// APIs
+	http.HandleFunc("/api/login", server.handleLogin)
+	http.HandleFunc("/api/logout", server.handleLogin)
+	http.HandleFunc("/api/me", server.handleLogin)
+	http.HandleFunc("/api/admin/users", server.handleAdminUsers)
+	http.HandleFunc("/api/admin/users/", server.handleAdminUsers)
+	http.HandleFunc("/api/admin/reload", server.handleReload)
 	http.HandleFunc("/api/tree", server.handleTree)
+	http.HandleFunc("/api/tree/recursive", server.handleTreeRecursive)
 	http.HandleFunc("/api/file", server.handleFileView)
-	http.HandleFunc("/api/raw", server.handleRawFile) 
+	http.HandleFunc("/api/raw", server.handleRawFile)
+	http.HandleFunc("/api/raw/sign", server.handleSignRaw)
+	http.HandleFunc("/api/thumb", server.handleThumb)
+	http.HandleFunc("/api/tail", server.handleTail)
 	http.HandleFunc("/api/upload", server.handleUpload)
+	http.HandleFunc("/api/upload/check", server.handleUploadCheck)
+	http.HandleFunc("/api/upload/progress", server.handleUploadProgress)
+	http.HandleFunc("/api/uploads", server.handleUploads)
+	http.HandleFunc("/api/uploads/", server.handleUploads)
+	http.HandleFunc("/api/delete", server.handleDelete)
+	http.HandleFunc("/api/trash", server.handleTrash)
+	http.HandleFunc("/api/trash/", server.handleTrash)
+	http.HandleFunc("/api/versions", server.handleVersions)
+	http.HandleFunc("/api/versions/", server.handleVersions)
+	http.HandleFunc("/api/mkdir", server.handleMkdir)
+	http.HandleFunc("/api/delta/signature", server.handleDeltaSignature)
+	http.HandleFunc("/api/delta/diff", server.handleDeltaDiff)
+	http.HandleFunc("/api/delta/patch", server.handleDeltaPatch)
+	http.HandleFunc("/api/sync/list", server.handleSyncList)
+	http.HandleFunc("/api/sync/changes", server.handleSyncChanges)
+	http.HandleFunc("/api/sync/diff", server.handleSyncDiff)
+	http.HandleFunc("/api/sync/file", server.handleSyncFile)
+	http.HandleFunc("/api/torrent", server.handleTorrent)
+	http.HandleFunc("/api/fetch", server.handleFetch)
+	http.HandleFunc("/api/ipfs/", server.handleIPFS)
 	http.HandleFunc("/api/download", server.handleDownload)
+	http.HandleFunc("/api/download/batch", server.handleDownloadBatch)
+	http.HandleFunc("/api/size", server.handleSize)
+	http.HandleFunc("/api/find", server.handleFind)
+	http.HandleFunc("/api/search", server.handleSearch)
+	http.HandleFunc("/api/search/saved", server.handleSavedSearch)
+	http.HandleFunc("/api/search/saved/", server.handleSavedSearch)
+	http.HandleFunc("/api/duplicates", server.handleDuplicates)
+	http.HandleFunc("/api/dedup", server.handleDedup)
+	http.HandleFunc("/api/scrub", server.handleScrub)
+	http.HandleFunc("/api/report", server.handleReport)
+	http.HandleFunc("/api/diskfree", server.handleDiskFree)
+	http.HandleFunc("/api/transfer", server.handleTransfer)
+	http.HandleFunc("/api/move", server.handleMove)
+	http.HandleFunc("/api/copy", server.handleCopy)
+	http.HandleFunc("/api/clipboard", server.handleClipboard)
+	http.HandleFunc("/api/clipboard/paste", server.handleClipboard)
+	http.HandleFunc("/api/extract", server.handleExtract)
+	http.HandleFunc("/api/manifest", server.handleManifest)
+	http.HandleFunc("/api/warm", server.handleWarm)
+	http.HandleFunc("/api/events", server.handleEvents)
+	http.HandleFunc("/api/jobs", server.handleJobs)
+	http.HandleFunc("/api/jobs/", server.handleJobs)
+	http.HandleFunc("/api/shortlinks", server.handleShortLinks)
+	http.HandleFunc("/api/shortlinks/", server.handleShortLinks)
+	http.HandleFunc("/r/", server.handleShortLink)
+	http.HandleFunc("/api/share", server.handleShare)
+	http.HandleFunc("/api/share/", server.handleShare)
+	http.HandleFunc(sharePrefix, server.handleShareLink)
+	http.HandleFunc("/sandbox", server.handleSandbox)
+	http.HandleFunc("/graphql", server.handleGraphQL)
+	http.HandleFunc(browsePrefix, server.handleBrowse)
+	http.HandleFunc(upPrefix, server.handleUp)
+	http.HandleFunc(davPrefix, server.handleDAV)
 
 	// Serve static files (UI)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
@@ -58,8 +328,92 @@ func main() {
 		http.ServeFile(w, r, "./static/index.html")
 	})
 
-	log.Printf("Serving on :%s", *port)
-	if err := http.ListenAndServe(":"+*port, nil); err != nil {
+	var handler http.Handler = server.jailMiddleware(server.visibilityMiddleware(http.DefaultServeMux))
+	if *kiosk != "" {
+		if *roMode {
+			log.Fatal("-kiosk and -readonly can't be combined")
+		}
+		if fi, err := os.Stat(*kiosk); err != nil || !fi.IsDir() {
+			log.Fatalf("Kiosk folder does not exist: %s", *kiosk)
+		}
+		if !server.inRoots(*kiosk) {
+			log.Fatalf("Kiosk folder is not inside a served folder: %s", *kiosk)
+		}
+		// Inside authMiddleware, which tells guests from logged-in users
+		handler = kioskMiddleware(handler)
+	}
+	handler = server.authMiddleware(handler)
+	if len(cfg.Sites) > 0 {
+		handler = sitesMiddleware(cfg.Sites, handler)
+	}
+	if cfg.ClientLimits != nil {
+		limits, err := newClientLimiter(cfg.ClientLimits)
+		if err != nil {
+			log.Fatalf("Config: %v", err)
+		}
+		limits.logf = server.notef
+		server.limits = limits
+		handler = limits.middleware(handler)
+	}
+	if cfg.GeoIP != nil {
+		geo, err := newGeoFilter(cfg.GeoIP)
+		if err != nil {
+			log.Fatalf("Config: %v", err)
+		}
+		geo.logf = server.notef
+		server.geo = geo
+		handler = geo.middleware(handler)
+	}
+
+	if *sftpPt != "" {
+		go func() {
+			if err := server.serveSFTP(":" + *sftpPt); err != nil {
+				log.Fatalf("SFTP: %v", err)
+			}
+		}()
+	}
+
+	ln, err := listen(*bindTo, *port, *portFb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *acmeDom != "" {
+		if *tlsCert != "" || *tlsKey != "" {
+			log.Fatal("-autocert-domain can't be combined with -tls-cert and -tls-key")
+		}
+		m, err := autocertManager(*acmeDom, *acmeMl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *hstsAge > 0 {
+			handler = hsts(*hstsAge, handler)
+		}
+		if *httpRed != "" {
+			// Answers Let's Encrypt's HTTP challenges, redirects the rest
+			go serveHTTPRedirect(*httpRed, m.HTTPHandler(redirectToHTTPS(strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))))
+		}
+		announce("https", ln)
+		if err := serveAutocert(ln, m, handler); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		if *hstsAge > 0 {
+			handler = hsts(*hstsAge, handler)
+		}
+		if *httpRed != "" {
+			go serveHTTPRedirect(*httpRed, redirectToHTTPS(strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)))
+		}
+		announce("https", ln)
+		if err := http.ServeTLS(ln, handler, *tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	announce("http", ln)
+	if err := http.Serve(ln, handler); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -67,75 +421,262 @@ func main() {
 // API: Tree view
 func (fs *FileServer) handleTree(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
+	if strings.HasPrefix(path, smartPrefix) {
+		fs.listSmartFolder(w, r, path)
+		return
+	}
 	if path != "" {
 		path = filepath.FromSlash(path) // Normalize incoming path
 	}
+	if archive, name, ok := splitArchivePath(path); ok {
+		fs.listArchiveFolder(w, r, archive, name)
+		return
+	}
 
 	// Handle root/dots. Check against separator for Windows compatibility (where / becomes \)
-	if path == "" || path == "." || path == string(filepath.Separator) { 
+	if path == "" || path == "." || path == string(filepath.Separator) {
 		// List root folders
-		var out []map[string]string
-		for _, f := range fs.FolderList {
+		var out []map[string]interface{}
+		for _, f := range fs.visibleRoots(r, nil) {
 			absPath, _ := filepath.Abs(f)
-			// Send forward slashes to frontend
-			out = append(out, map[string]string{"name": filepath.Base(f), "type": "folder", "path": filepath.ToSlash(absPath)})
+			// Roots are addressed by name, their location stays on the server
+			out = append(out, map[string]interface{}{"name": fs.rootName(absPath), "type": "folder", "path": fs.publicPath(absPath)})
+		}
+		out = append(out, fs.smartFolderEntries()...)
+		if wantsText(r) {
+			writeTextListing(w, out)
+			return
+		}
+		if wantsNDJSON(r) {
+			nw := newNDJSONWriter(w)
+			for _, item := range out {
+				nw.write(item)
+			}
+			return
 		}
 		json.NewEncoder(w).Encode(out)
 		return
 	}
 	
-	entries, err := os.ReadDir(path)
+	filter, err := parseFileFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	if fs.hidesDotFiles(path) {
+		filter.NoHidden = true
+	}
+	sortBy, order := r.URL.Query().Get("sort"), r.URL.Query().Get("order")
+	if sortBy != "" && !treeSorts[sortBy] || order != "" && order != "asc" && order != "desc" {
+		httpError(w, "Invalid sort or order", 400)
+		return
+	}
+	page, err := parseTreePage(r.URL.Query())
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+
+	if wantsNDJSON(r) {
+		fs.streamTree(w, r, path, filter, page)
+		return
+	}
+	entries, err := fs.storageFor(path).ReadDir(path)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		writeError(w, err, 400)
+		return
+	}
+	text := wantsText(r)
+	meta := wantsMeta(r)
+	details := text || sortBy == "size" || sortBy == "mtime"
+	if !text && sortBy == "" && order != "desc" {
+		// In name order, as os.ReadDir has them, only the entries on the
+		// page are described, and each is sent as soon as it is
+		tw := newTreeWriter(w, page)
+		total := 0
+		for _, entry := range entries {
+			if !page.has(total) {
+				if fs.treeVisible(path, entry, filter) {
+					total++
+				}
+				continue
+			}
+			if item := fs.treeItem(path, entry, filter, details, meta); item != nil {
+				tw.write(item)
+				total++
+			}
+		}
+		tw.close(total)
 		return
 	}
-	var out []map[string]string
+	var out []map[string]interface{}
 	for _, entry := range entries {
-		t := "file"
-		if entry.IsDir() {
-			t = "folder"
-		}
-		fullPath := filepath.Join(path, entry.Name())
-		out = append(out, map[string]string{
-			"name": entry.Name(),
-			"type": t,
-			"path": filepath.ToSlash(fullPath), // Normalize outgoing path
-		})
+		if item := fs.treeItem(path, entry, filter, details, meta); item != nil {
+			out = append(out, item)
+		}
+	}
+	if sortBy != "" || order == "desc" {
+		sortTreeItems(out, sortBy, order == "desc")
+	}
+	total := len(out)
+	if page.offset < len(out) {
+		out = out[page.offset:]
+	} else {
+		out = nil
+	}
+	if page.limit >= 0 && page.limit < len(out) {
+		out = out[:page.limit]
 	}
-	json.NewEncoder(w).Encode(out)
+	if text {
+		writeTextListing(w, out)
+		return
+	}
+	tw := newTreeWriter(w, page)
+	for _, item := range out {
+		tw.write(item)
+	}
+	tw.close(total)
+}
+
+// treeVisible reports whether entry is listed by /api/tree with filter, for
+// counting entries without describing them
+func (fs *FileServer) treeVisible(dir string, entry os.DirEntry, filter *fileFilter) bool {
+	if isInternal(entry.Name()) {
+		return false
+	}
+	if !filter.active() {
+		return true
+	}
+	info, err := fs.entryInfo(dir, entry)
+	return err == nil && filter.match(entry.Name(), info)
+}
+
+// entryInfo returns the FileInfo of a directory entry: for a symlink, that of
+// what it points to unless it is dangling
+func (fs *FileServer) entryInfo(dir string, entry os.DirEntry) (os.FileInfo, error) {
+	info, err := entry.Info()
+	if err == nil && entry.Type()&os.ModeSymlink != 0 {
+		p := filepath.Join(dir, entry.Name())
+		if ti, err := fs.storageFor(p).Stat(p); err == nil {
+			return ti, nil
+		}
+	}
+	return info, err
+}
+
+// treeItem describes one directory entry for /api/tree, or returns nil if it is
+// hidden or filtered out. With details, files get their size and all entries
+// their modification time; with meta also permissions and symlink targets.
+func (fs *FileServer) treeItem(dir string, entry os.DirEntry, filter *fileFilter, details, meta bool) map[string]interface{} {
+	if isInternal(entry.Name()) {
+		return nil
+	}
+	link := entry.Type()&os.ModeSymlink != 0
+	var info os.FileInfo
+	if filter.active() || details || meta || link {
+		// Type, size and time of what a link points to
+		var err error
+		info, err = fs.entryInfo(dir, entry)
+		if err != nil || !filter.match(entry.Name(), info) {
+			return nil
+		}
+	}
+	isDir := entry.IsDir()
+	if info != nil {
+		isDir = info.IsDir()
+	}
+	t := "file"
+	if isDir {
+		t = "folder"
+	}
+	fullPath := filepath.Join(dir, entry.Name())
+	item := map[string]interface{}{
+		"name": entry.Name(),
+		"type": t,
+		"path": fs.publicPath(fullPath), // as the client addresses it
+	}
+	if isDir && fs.sizeIndex != nil {
+		if size, ok := fs.sizeIndex.lookup(fullPath); ok {
+			item["size"] = size.Bytes
+		}
+	}
+	if meta && link {
+		if ls, ok := fs.storageFor(fullPath).(linkStorage); ok {
+			if target, err := ls.Readlink(fullPath); err == nil {
+				// Absolute targets are shown as paths in the roots, if they are
+				if !filepath.IsAbs(target) {
+					item["symlink"] = filepath.ToSlash(target)
+				} else if fs.rootOf(target) != "" {
+					item["symlink"] = fs.publicPath(target)
+				}
+			}
+		}
+	}
+	if details || meta {
+		item["modified"] = info.ModTime().Unix()
+		if !isDir {
+			item["size"] = info.Size()
+		}
+	}
+	if meta {
+		item["permissions"] = info.Mode().String()
+	}
+	return item
 }
 
 // API: File view
 func (fs *FileServer) handleFileView(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 	if path == "" {
-		http.Error(w, "Missing path", 400)
+		httpError(w, "Missing path", 400)
 		return
 	}
 	path = filepath.FromSlash(path) // Normalize
-	
-	f, err := os.Open(path)
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+	archive, entry, inArchive := splitArchivePath(path)
+	if r.Method == http.MethodPut {
+		if inArchive {
+			httpError(w, "Files inside archives can't be changed", http.StatusMethodNotAllowed)
+			return
+		}
+		fs.saveFile(w, r, path)
 		return
 	}
-	defer f.Close()
+	if !fs.rawAllowed(r, path) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+
+	var f File
+	var err error
+	if inArchive {
+		// Viewed from a copy, as renderers need to seek
+		if !fs.requireInRoots(w, archive) || !fs.requireLocalDisk(w, "files in archives", archive) {
+			return
+		}
+		tmp, _, err := openArchiveEntry(r.Context(), archive, entry)
+		if err != nil {
+			writeError(w, err, 400)
+			return
+		}
+		defer closeTemp(tmp)
+		f = tmp
+	} else {
+		f, err = fs.storageFor(path).Open(path)
+		if err != nil {
+			writeError(w, err, 400)
+			return
+		}
+		defer f.Close()
+	}
 
 	// Get file info
 	fi, err := f.Stat()
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		writeError(w, err, 400)
 		return
 	}
 
-	// 1. Large File Check (>50MB)
-	if fi.Size() > 50*1024*1024 {
-		json.NewEncoder(w).Encode(map[string]string{
-			"type": "error",
-			"content": "File is too large to view (over 50MB). Please download it.",
-		})
-		return
-	}
+	w.Header().Set("ETag", fileETag(fi)) // sent back when saving from the editor
 
 	// Read first 800 bytes to detect content type
 	head := make([]byte, 800)
@@ -143,126 +684,168 @@ func (fs *FileServer) handleFileView(w http.ResponseWriter, r *http.Request) {
 	head = head[:n]
 	f.Seek(0, 0) // Reset to beginning
 
-	isBinary := false
-	for _, b := range head {
-		if b == 0 {
-			isBinary = true
-			break
-		}
-		if b < 0x09 || (b > 0x0D && b < 0x20) {
-			isBinary = true
-			break
-		}
-	}
-
-	ext := strings.ToLower(filepath.Ext(path))
-	lang := extToLang(ext)
-
-	// PDF Handling
-	if ext == ".pdf" {
-		json.NewEncoder(w).Encode(map[string]string{
-			"type": "pdf",
-			// Send raw URL with query param. Ensure path is ToSlash if needed? 
-			// Actually here we are constructing a URL. Using ToSlash is safer for URL query params too if we want consistency,
-			// but converting back to FromSlash in handleRawFile handles it.
-			"content": "/api/raw?path=" + r.URL.Query().Get("path"), 
-		})
-		return
+	p := &previewFile{
+		Path:       path,
+		File:       f,
+		Info:       fi,
+		Head:       head,
+		Ext:        strings.ToLower(filepath.Ext(path)),
+		Mime:       detectContentType(head, path),
+		Sniffed:    http.DetectContentType(head),
+		IsBinary:   looksBinary(head),
+		RawURL:     fs.rawURL(path),
+		SandboxURL: fs.sandboxURL(path),
 	}
-	
-	// Markdown Handling
-	if ext == ".md" || ext == ".markdown" {
-		data, err := io.ReadAll(f)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+	name := fs.previews.lookupName(p)
+	if view := r.URL.Query().Get("view"); view != "" {
+		// The viewer asked for a renderer, e.g. hex for a text file
+		if _, ok := fs.previews.renderers[view]; !ok {
+			httpError(w, "Unknown view: "+view, 400)
 			return
 		}
+		name = view
+	}
+
+	// Large File Check (>50MB), except for renderers reading only part of the file
+	if fi.Size() > 50*1024*1024 && !fs.previews.unlimited[name] {
 		json.NewEncoder(w).Encode(map[string]string{
-			"type": "markdown",
-			"content": string(data),
+			"type": "error",
+			"content": "File is too large to view (over 50MB). Please download it.",
 		})
 		return
 	}
 
-	if isBinary {
-		mimeType := mime.TypeByExtension(ext)
-		if strings.HasPrefix(mimeType, "image/") {
-			data, err := io.ReadAll(f)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
-			}
-			b64 := base64.StdEncoding.EncodeToString(data)
-			json.NewEncoder(w).Encode(map[string]string{
-				"type": "image",
-				"content": "data:" + mimeType + ";base64," + b64,
-				"mime": mimeType,
-			})
-			return
-		} else {
-			json.NewEncoder(w).Encode(map[string]string{
-				"type": "binary",
-				"content": "[Binary file will not be displayed]",
-				"language": "",
-			})
-			return
-		}
-	}
+	// Hand off to the renderer registered for this extension/MIME type
+	fs.previews.renderers[name](w, r, p)
+}
 
-	// Text file: Limit read to 1MB
-	const maxRead = 1 * 1024 * 1024
-	limitReader := io.LimitReader(f, maxRead)
-	data, err := io.ReadAll(limitReader)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	
-	content := string(data)
-	if fi.Size() > int64(maxRead) {
-		content += "\n\n... [File truncated because it is too large] ..."
+// looksBinary reports whether the first bytes of a file hold control
+// characters that don't occur in text
+func looksBinary(head []byte) bool {
+	for _, b := range head {
+		if b == 0 {
+			return true
+		}
+		if b < 0x09 || (b > 0x0D && b < 0x20) {
+			return true
+		}
 	}
-
-	json.NewEncoder(w).Encode(map[string]string{
-		"type": "text",
-		"content": content,
-		"language": lang,
-	})
+	return false
 }
 
-// API: Raw File Access (for PDFs, Images via URL, etc)
+// API: Raw File Access (for PDFs, Images via URL, etc). PUT stores the body as the file.
 func (fs *FileServer) handleRawFile(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 	if path == "" {
-		http.Error(w, "Missing path", 400)
+		httpError(w, "Missing path", 400)
 		return
 	}
 	path = filepath.FromSlash(path) // Normalize
-	http.ServeFile(w, r, path)
+	if r.Method == http.MethodPut {
+		fs.putFile(w, r, path)
+		return
+	}
+	// Also reached from short links, which don't pass the middleware's check
+	if !fs.requireInRoots(w, path) {
+		return
+	}
+	if !fs.rawAllowed(r, path) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	if archive, name, ok := splitArchivePath(path); ok {
+		fs.serveArchiveEntry(w, r, archive, name, false)
+		return
+	}
+	f, fi, ok := fs.openStoredFile(w, path)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	fs.setDisposition(w, path, setContentType(w, f, path))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
 }
 
 // API: Upload
 func (fs *FileServer) handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Read folder from URL query (sent by frontend now)
 	folder := r.URL.Query().Get("folder")
+	guest := kioskGuest(r)
+	if guest {
+		folder = *kiosk
+	}
 	if folder == "" {
 		// Fallback for tools that might still use form value (though streaming requires it early)
 		// but with MultipartReader, we can't easily get form values before files if they are mixed.
 		// So we enforce URL param for streaming.
-		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "Missing folder param"})
+		httpError(w, "Missing folder param", 400)
 		return
 	}
 	folder = filepath.FromSlash(folder)
+	if !guest && !fs.requireWrite(w, r, folder) {
+		return
+	}
+
+	// With an id the server's progress can be followed on /api/upload/progress
+	if id := r.URL.Query().Get("id"); id != "" {
+		if !uploadIDPattern.MatchString(id) {
+			httpError(w, "Invalid id", 400)
+			return
+		}
+		p := fs.progress.track(id, fs.publicPath(folder), 0, r.ContentLength)
+		r.Body = io.NopCloser(progressReader{r: r.Body, t: fs.progress, p: p})
+		defer fs.progress.finish(id)
+	}
+
+	// Content-Length is an upper bound for the whole batch; chunked uploads are checked while streaming
+	if err := fs.checkFreeSpace(folder, r.ContentLength); err != nil {
+		lowDiskError(w)
+		return
+	}
+
+	// A tar (or tar.gz) body is unpacked into the folder as it streams in
+	store := fs.storageFor(folder)
+	if isTarUpload(r) {
+		if guest {
+			httpError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if store != localDisk {
+			apiError(w, http.StatusNotImplemented, codeNotImplemented, "Archives can't be unpacked into object stores")
+			return
+		}
+		fs.uploadTar(w, r, folder)
+		return
+	}
+
+	// extract=true unpacks uploaded archives into the folder instead of storing them
+	extract := r.URL.Query().Get("extract") == "true" && !guest
+	if extract && store != localDisk {
+		apiError(w, http.StatusNotImplemented, codeNotImplemented, "Archives can't be unpacked into object stores")
+		return
+	}
+	policy, ok := conflictPolicy(w, r)
+	if !ok {
+		return
+	}
+	var extracted int
+	skipped := []string{}
+	// One result per file, so a client can tell which files to send again
+	results := []map[string]interface{}{}
+	failures := 0
+	lowDisk := false
+	// paths fields name the files with their folders, in file order
+	var paths []string
 
 	// Use MultipartReader for streaming
 	reader, err := r.MultipartReader()
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "Not a multipart request"})
+		httpError(w, "Not a multipart request", 400)
 		return
 	}
 
@@ -272,66 +855,278 @@ func (fs *FileServer) handleUpload(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		if err != nil {
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+			// The body broke off; the results say what arrived
+			writeErrorJSON(w, http.StatusBadRequest, map[string]interface{}{"error": errorBody(codeBadRequest, errorMessage(err)), "files": results})
 			return
 		}
 
-		// Only process file fields (form field name 'files')
-		if part.FormName() == "files" && part.FileName() != "" {
-			filename := part.FileName()
-			
-			// Use relative path from query param if available (fix for folder structure)
-			// This overrides the potentially stripped filename from the multipart header
-			if rel := r.URL.Query().Get("relativePath"); rel != "" {
-				filename = rel
-			}
-
-			// Handle nested paths (from folder uploads)
-			// filename might contain slashes if sent as relative path
-			outPath := filepath.Join(folder, filename)
-
-			// Ensure parent dir exists
-			if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
-				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+		if part.FormName() == "paths" {
+			b, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				writeErrorJSON(w, http.StatusBadRequest, map[string]interface{}{"error": errorBody(codeBadRequest, errorMessage(err)), "files": results})
 				return
 			}
+			paths = append(paths, string(b))
+			continue
+		}
+
+		// Only process file fields (form field name 'files')
+		if part.FormName() != "files" || part.FileName() == "" {
+			continue
+		}
+		filename := partFileName(part)
+		if guest {
+			filename = filepath.Base(filename)
+		} else if i := len(results); i < len(paths) && paths[i] != "" {
+			filename = filepath.FromSlash(paths[i])
+		} else if rel := r.URL.Query().Get("relativePath"); rel != "" && i == 0 {
+			// Single file uploads may name the path in the query
+			filename = filepath.FromSlash(rel)
+		}
+		result := map[string]interface{}{"name": filepath.ToSlash(filename), "size": 0}
+		results = append(results, result)
+		fail := func(err error) {
+			result["error"] = errorMessage(err)
+			failures++
+		}
 
-			out, err := os.Create(outPath)
+		// Handle nested paths (from folder uploads)
+		// filename might contain slashes if sent as relative path
+		outPath := filepath.Join(folder, filename)
+		if rel, err := filepath.Rel(folder, outPath); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || hasInternal(rel) || !fs.inRoots(outPath) {
+			fail(fmt.Errorf("invalid file name"))
+			continue
+		}
+		if guest {
+			// Guests never replace each other's submissions
+			outPath = filepath.Join(folder, freeName(store, folder, filepath.Base(outPath)))
+		}
+		if extract && archiveKind(filename) != "" {
+			n, sk, err := fs.extractUpload(part, filename, filepath.Dir(outPath), policy)
+			extracted += n
+			skipped = append(skipped, sk...)
+			result["extracted"] = n
 			if err != nil {
-				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
-				return
+				fail(err)
+				if lowDisk = err == errLowDisk; lowDisk {
+					break
+				}
 			}
-			
-			// Stream directly from part to file
-			_, err = io.Copy(out, part)
+			continue
+		}
+
+		// Ensure parent dir exists
+		if err := store.Mkdir(filepath.Dir(outPath)); err != nil {
+			fail(err)
+			continue
+		}
+
+		if !guest {
+			fs.keepVersion(outPath)
+		}
+		var sum string
+		src := &freeSpaceGuard{fs: fs, r: part, dir: folder, limit: fs.uploadLimit(folder)}
+		cas := *casMode && store == localDisk
+		if cas {
+			sum, err = fs.casWrite(outPath, src)
+		} else {
+			sum, err = writeUpload(store, outPath, src)
+		}
+		result["size"] = src.read
+		if err == errLowDisk {
+			lowDisk = true
+			fail(err)
+			break
+		}
+		if err != nil {
+			fail(err)
+			continue
+		}
+		result["path"] = fs.publicPath(outPath)
+		result["sha256"] = sum
+		if fi, err := store.Stat(outPath); err == nil {
+			fs.contents.add(outPath, sum, fi)
+		}
+		if abs, err := filepath.Abs(outPath); err == nil {
+			fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs)})
+		}
+	}
+
+	resp := map[string]interface{}{"success": failures == 0, "files": results}
+	if failures > 0 {
+		resp["error"] = errorBody(codeIncomplete, fmt.Sprintf("%d of %d files failed", failures, len(results)))
+	}
+	if extract {
+		resp["extracted"] = extracted
+		resp["skipped"] = skipped
+	}
+	if lowDisk {
+		// The files after the one that filled the disk weren't read
+		resp["error"] = errorBody(codeInsufficientStorage, errLowDisk.Error())
+		writeErrorJSON(w, http.StatusInsufficientStorage, resp)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// lowDiskError rejects an upload because the disk is (nearly) full
+func lowDiskError(w http.ResponseWriter) {
+	apiError(w, http.StatusInsufficientStorage, codeInsufficientStorage, errLowDisk.Error())
+}
+
+// partFileName is the file name of a multipart part with the folders browsers
+// send for folder uploads, which part.FileName leaves out
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return part.FileName()
+	}
+	return filepath.FromSlash(params["filename"])
+}
+
+// writeUpload streams r into path of s and returns the SHA-256 of the content
+func writeUpload(s Storage, path string, r io.Reader) (string, error) {
+	out, err := s.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Stream directly from part to file, hashing on the way for the content index
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), r); err != nil {
+		// Keep what was there before rather than a partial file
+		if a, ok := out.(aborter); ok {
+			a.Abort()
+		} else {
 			out.Close()
-			
-			if err != nil {
-				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
-				return
-			}
 		}
+		return "", err
 	}
-	
-	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // API: Download
 func (fs *FileServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		fs.handleDownloadArchive(w, r)
+		return
+	}
 	path := r.URL.Query().Get("path")
 	if path == "" {
-		http.Error(w, "Missing path", 400)
+		httpError(w, "Missing path", 400)
 		return
 	}
 	path = filepath.FromSlash(path) // Normalize
+	if !fs.rawAllowed(r, path) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	if archive, name, ok := splitArchivePath(path); ok {
+		fs.serveArchiveEntry(w, r, archive, name, true)
+		return
+	}
+	if fi, err := fs.storageFor(path).Stat(path); err == nil && fi.IsDir() {
+		fs.downloadFolder(w, r, path)
+		return
+	}
+	f, fi, ok := fs.openStoredFile(w, path)
+	if !ok {
+		return
+	}
+	defer f.Close()
 	fname := filepath.Base(path)
 	w.Header().Set("Content-Disposition", "attachment; filename="+fname)
-	mimeType := mime.TypeByExtension(filepath.Ext(fname))
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	setContentType(w, f, path)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// API: POST /api/download/batch downloads several selected paths, e.g. from
+// different folders, as one archive. Same body as POST /api/download.
+func (fs *FileServer) handleDownloadBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fs.handleDownloadArchive(w, r)
+}
+
+// API: Download several paths as one archive (POST with JSON body, avoids URL length limits)
+func (fs *FileServer) handleDownloadArchive(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Paths  []string `json:"paths"`
+		Format string   `json:"format"`
+		Async  bool     `json:"async"` // build the archive as a job instead of streaming it
+		Hidden *bool    `json:"hidden"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	if len(req.Paths) == 0 {
+		httpError(w, "Missing paths", 400)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "zip"
+	}
+	format, ok := archiveFormats[req.Format]
+	if !ok {
+		httpError(w, "Unsupported format: "+req.Format, 400)
+		return
+	}
+
+	noHidden := req.Hidden != nil && !*req.Hidden
+
+	// Validate everything up front, errors can't be reported once streaming starts
+	var paths []string
+	if !fs.resolvePathList(w, req.Paths) || !fs.requireRead(w, r, req.Paths...) || !fs.requireInRoots(w, req.Paths...) || !fs.requireLocal(w, r, req.Paths...) {
+		return
+	}
+	for _, p := range req.Paths {
+		p = filepath.FromSlash(p)
+		// One signature covers one path, so several take a logged-in user
+		if !fs.rawAllowed(r, p) {
+			httpError(w, "Missing or expired signature", 403)
+			return
+		}
+		if _, err := os.Stat(p); err != nil {
+			writeError(w, err, 400)
+			return
+		}
+		if fs.hidesDotFiles(p) {
+			noHidden = true
+		}
+		paths = append(paths, p)
+	}
+
+	if req.Async {
+		name := archiveName(paths, req.Format)
+		j := fs.jobs.start("archive", "Create "+name, func(j *job) (interface{}, error) {
+			return fs.buildArchive(j, paths, req.Format, name, noHidden)
+		})
+		acceptedJob(w, r, j)
+		return
+	}
+
+	aw, err := newArchiveWriter(w, req.Format)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+archiveName(paths, req.Format))
+	w.Header().Set("Content-Type", format[1])
+	for i, name := range archiveNames(paths) {
+		if err := addToArchive(aw, paths[i], name, nil, noHidden); err != nil {
+			fs.notef("Archive download aborted: %v", err)
+			return
+		}
+	}
+	if err := aw.Close(); err != nil {
+		fs.notef("Archive download aborted: %v", err)
 	}
-	w.Header().Set("Content-Type", mimeType)
-	http.ServeFile(w, r, path)
 }
 
 // extToLang maps file extensions to highlight.js language classes
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Checksum manifests list the SHA-256 of the files in a folder in the format of
+// sha256sum (SHA256SUMS), so mirrors of the served data can be verified with
+// `sha256sum -c`. They are kept in the data directory, one per folder, and
+// regenerated when a file in the folder is newer than the manifest.
+
+// manifestDir is where manifests are stored, relative to the data directory
+const manifestDir = "manifests"
+
+// manifestPath returns where the manifest of dir is stored
+func manifestPath(dir string) string {
+	abs, _ := filepath.Abs(dir)
+	abs = strings.TrimPrefix(abs, filepath.VolumeName(abs))
+	return filepath.Join(statePath(manifestDir), abs, "SHA256SUMS")
+}
+
+// manifestFresh reports whether the stored manifest is newer than dir and every file in it
+func manifestFresh(dir string) bool {
+	mi, err := os.Stat(manifestPath(dir))
+	if err != nil {
+		return false
+	}
+	di, err := os.Stat(dir)
+	if err != nil || di.ModTime().After(mi.ModTime()) {
+		return false
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && e.Type().IsRegular() && info.ModTime().After(mi.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildManifest hashes the regular files directly in dir, sorted by name
+func buildManifest(dir string, hash func(string) (string, error)) ([]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		sum, err := hash(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, name)
+	}
+	return buf.Bytes(), nil
+}
+
+// dirManifest returns the manifest of dir, regenerating and storing it when stale
+func dirManifest(dir string, hash func(string) (string, error)) ([]byte, error) {
+	if manifestFresh(dir) {
+		return os.ReadFile(manifestPath(dir))
+	}
+	data, err := buildManifest(dir, hash)
+	if err != nil {
+		return nil, err
+	}
+	out := manifestPath(dir)
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return nil, err
+	}
+	return data, os.WriteFile(out, data, 0644)
+}
+
+// treeManifest combines the manifests of dir and all folders below it, with
+// paths relative to dir. fn is called for each folder as it is done.
+func treeManifest(dir string, hash func(string) (string, error), fn func(string)) ([]byte, error) {
+	var buf bytes.Buffer
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if isInternal(fi.Name()) {
+			return filepath.SkipDir
+		}
+		data, err := dirManifest(p, hash)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if line == "" {
+				continue
+			}
+			if rel != "." {
+				// "<hash>  <name>" becomes "<hash>  <rel>/<name>"
+				line = line[:66] + filepath.ToSlash(rel) + "/" + line[66:]
+			}
+			buf.WriteString(line)
+		}
+		if fn != nil {
+			fn(p)
+		}
+		return nil
+	})
+	return buf.Bytes(), err
+}
+
+// runHashCommand implements `go-fileserver hash -root <folder>`, which writes
+// the manifests of every folder below root ahead of time.
+func runHashCommand(args []string) {
+	cmd := flag.NewFlagSet("hash", flag.ExitOnError)
+	root := cmd.String("root", "", "Folder to generate SHA256SUMS manifests for")
+	dir := cmd.String("data-dir", *dataDir, "Directory for server state, where manifests are stored")
+	cmd.Parse(args)
+	if *root == "" {
+		log.Fatal("Usage: go-fileserver hash -root <folder> [-data-dir <dir>]")
+	}
+	*dataDir = *dir
+	var folders int
+	_, err := treeManifest(*root, hashFile, func(p string) {
+		folders++
+		log.Printf("Hashed %s", p)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote manifests for %d folders to %s", folders, statePath(manifestDir))
+}
+
+// API: SHA256SUMS manifest of a folder (recursive=true includes subfolders)
+func (fs *FileServer) handleManifest(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.FromSlash(path) // Normalize
+	if !fs.inRoots(path) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	var data []byte
+	var err error
+	if r.URL.Query().Get("recursive") == "true" {
+		data, err = treeManifest(path, fs.contents.hashOf, nil)
+	} else {
+		data, err = dirManifest(path, fs.contents.hashOf)
+	}
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="SHA256SUMS"`)
+	w.Write(data)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is the number of leading bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// defaultMimeTypes fills gaps in Go's built-in table on systems without
+// /etc/mime.types (e.g. the alpine Docker image). The config can override them.
+var defaultMimeTypes = map[string]string{
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".json": "application/json",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tar":  "application/x-tar",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".heic": "image/heic",
+	".ico":  "image/x-icon",
+	".bmp":  "image/bmp",
+	".tiff": "image/tiff",
+}
+
+// registerMimeTypes adds the default table and the config overrides to the mime package
+func registerMimeTypes(custom map[string]string) error {
+	for ext, t := range defaultMimeTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, t)
+		}
+	}
+	for ext, t := range custom {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if err := mime.AddExtensionType(strings.ToLower(ext), t); err != nil {
+			return fmt.Errorf("mime type for %s: %v", ext, err)
+		}
+	}
+	return nil
+}
+
+// detectContentType combines the extension lookup with magic-byte sniffing of head.
+// Extension-less files get the sniffed type, and files whose bytes clearly say
+// image/audio/video/pdf win over a misleading extension.
+func detectContentType(head []byte, name string) string {
+	byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	sniffed := http.DetectContentType(head)
+	if byExt == "" {
+		return sniffed
+	}
+	if hasSignature(sniffed) && baseType(sniffed) != baseType(byExt) {
+		return sniffed
+	}
+	return byExt
+}
+
+// detectFileContentType sniffs the start of f and rewinds it
+func detectFileContentType(f io.ReadSeeker, name string) string {
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	f.Seek(0, io.SeekStart)
+	return detectContentType(head[:n], name)
+}
+
+// hasSignature reports whether a sniffed type comes from a real magic number
+// rather than a generic text/binary guess.
+func hasSignature(t string) bool {
+	t = baseType(t)
+	return strings.HasPrefix(t, "image/") ||
+		strings.HasPrefix(t, "audio/") ||
+		strings.HasPrefix(t, "video/") ||
+		t == "application/pdf"
+}
+
+// baseType strips parameters such as "; charset=utf-8"
+func baseType(t string) string {
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = t[:i]
+	}
+	return strings.TrimSpace(strings.ToLower(t))
+}
+
+// setContentType sets a sniffed Content-Type header for the open file f of
+// path and returns it.
+func setContentType(w http.ResponseWriter, f io.ReadSeeker, path string) string {
+	ct := detectFileContentType(f, path)
+	w.Header().Set("Content-Type", ct)
+	return ct
+}
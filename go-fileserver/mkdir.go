@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+)
+
+// API: POST /api/mkdir?path= creates a folder, with any missing parents.
+// Answers {"success": true, "path": ...}, or an error with code ALREADY_EXISTS
+// (409) if something is already there.
+func (fs *FileServer) handleMkdir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		apiError(w, 400, codeBadRequest, "Missing path")
+		return
+	}
+	p = filepath.FromSlash(p)
+	if !fs.inRoots(p) {
+		apiError(w, http.StatusForbidden, codeForbidden, "Path is not inside a served folder: "+fs.publicPath(p))
+		return
+	}
+	if !fs.requireWrite(w, r, p) {
+		return
+	}
+	store := fs.storageFor(p)
+	if fi, err := store.Stat(p); err == nil {
+		what := "A file"
+		if fi.IsDir() {
+			what = "A folder"
+		}
+		apiError(w, http.StatusConflict, codeExists, what+" with this name already exists: "+fs.publicPath(p))
+		return
+	}
+	if err := store.Mkdir(p); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(p)})
+}
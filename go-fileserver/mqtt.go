@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// mqttDebounce merges bursts of events for the same file (e.g. the many
+	// writes of an upload) into one message
+	mqttDebounce     = time.Second
+	mqttDefaultTopic = "fileserver"
+)
+
+// mqttConfig publishes events to an MQTT broker, one JSON message per event on
+// <topic>/<event type>
+type mqttConfig struct {
+	Broker   string `json:"broker"` // tcp://host:1883, ssl://host:8883 or ws://host/mqtt
+	Topic    string `json:"topic"`
+	ClientID string `json:"clientId"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	QoS      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+	eventFilter
+}
+
+func (c *mqttConfig) validate() error {
+	u, err := url.Parse(c.Broker)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("mqtt: invalid broker %q", c.Broker)
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("mqtt: qos must be 0, 1 or 2")
+	}
+	return c.eventFilter.validate()
+}
+
+// startMQTT connects to the broker in the background (reconnecting as needed)
+// and publishes matching events
+func (fs *FileServer) startMQTT(c *mqttConfig) {
+	topic := c.Topic
+	if topic == "" {
+		topic = mqttDefaultTopic
+	}
+	clientID := c.ClientID
+	if clientID == "" {
+		clientID = "fileserver-" + newJobID()
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(clientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(mqtt.Client) { log.Printf("MQTT: connected to %s", c.Broker) }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { log.Printf("MQTT: connection lost: %v", err) })
+	client := mqtt.NewClient(opts)
+	client.Connect()
+
+	fs.subscribeBatched("MQTT", c.eventFilter, mqttDebounce, true, func(events []event) {
+		for _, ev := range events {
+			payload, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			client.Publish(topic+"/"+ev.Type, c.QoS, c.Retain, payload)
+		}
+	})
+	fs.watchFiles()
+}
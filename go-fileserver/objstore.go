@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A served folder can be a bucket, or a folder in one, of an object store:
+// s3://bucket/prefix, gs://bucket/prefix or azblob://container/prefix. It is
+// served at the path /<scheme>/<bucket>/<prefix>, e.g. /s3/bucket/prefix, and
+// its files are read and written through the object store's HTTP API. Object
+// stores have no folders: a folder is what the keys below a "prefix/" share,
+// and an empty one is kept by an empty object named "prefix/".
+
+// objectInfo describes an object in a bucket
+type objectInfo struct {
+	key      string
+	size     int64
+	modified time.Time
+}
+
+// objectClient is the HTTP API of one bucket. Keys are relative to the
+// bucket; a missing object is os.ErrNotExist.
+type objectClient interface {
+	// list returns up to limit (0 for all) objects below prefix and, unless
+	// recursive, the prefixes of deeper ones up to the next "/"
+	list(prefix string, recursive bool, limit int) ([]objectInfo, []string, error)
+	head(key string) (objectInfo, error)
+	// get reads n bytes of an object from off, to the end if n < 0
+	get(key string, off, n int64) (io.ReadCloser, error)
+	put(key string, r io.Reader, size int64) error
+	delete(key string) error
+	copy(from, to string) error
+}
+
+// objectSchemes are the URL schemes of object stores and their clients
+var objectSchemes = map[string]func(bucket string) (objectClient, error){
+	"s3":     newS3Client,
+	"gs":     newGCSClient,
+	"azblob": newAzureClient,
+}
+
+// isObjectURL reports whether a served folder is given as an object store URL
+func isObjectURL(folder string) bool {
+	scheme, _, ok := strings.Cut(folder, "://")
+	return ok && objectSchemes[scheme] != nil
+}
+
+// objectStorage is a Storage in a bucket of an object store
+type objectStorage struct {
+	url    string // as given, e.g. s3://bucket/prefix
+	mount  string // the server path it is served at
+	prefix string // of its keys, "" or ending in "/"
+	c      objectClient
+}
+
+// openObjectRoot connects to the bucket of an object store URL, checking
+// that it can be listed
+func openObjectRoot(folder string) (*objectStorage, error) {
+	u, err := url.Parse(folder)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid object store URL %q", folder)
+	}
+	c, err := objectSchemes[u.Scheme](u.Host)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	mount, err := filepath.Abs(filepath.FromSlash(path.Join("/", u.Scheme, u.Host, prefix)))
+	if err != nil {
+		return nil, err
+	}
+	s := &objectStorage{url: folder, mount: mount, prefix: prefix, c: c}
+	if _, _, err := c.list(prefix, false, 1); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// key returns the key of name, "" for the folder served itself
+func (s *objectStorage) key(name string) (string, error) {
+	rel, err := filepath.Rel(s.mount, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return s.prefix + filepath.ToSlash(rel), nil
+}
+
+// dirPrefix returns the prefix of the keys in the folder with key
+func (s *objectStorage) dirPrefix(key string) string {
+	if key == "" {
+		return s.prefix
+	}
+	return key + "/"
+}
+
+// objectEntry is both the os.FileInfo and the os.DirEntry of an object or
+// folder
+type objectEntry struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+// folderTime is the time of folders, which object stores keep none of
+var folderTime = time.Unix(0, 0)
+
+func (e *objectEntry) Name() string       { return e.name }
+func (e *objectEntry) Size() int64        { return e.size }
+func (e *objectEntry) ModTime() time.Time { return e.modified }
+func (e *objectEntry) IsDir() bool        { return e.dir }
+func (e *objectEntry) Sys() interface{}   { return nil }
+func (e *objectEntry) Type() os.FileMode  { return e.Mode().Type() }
+
+func (e *objectEntry) Mode() os.FileMode {
+	if e.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (e *objectEntry) Info() (os.FileInfo, error) { return e, nil }
+
+func (s *objectStorage) Stat(name string) (os.FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return &objectEntry{name: filepath.Base(s.mount), modified: folderTime, dir: true}, nil
+	}
+	o, err := s.c.head(key)
+	if err == nil {
+		return &objectEntry{name: path.Base(key), size: o.size, modified: o.modified}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	objects, prefixes, err := s.c.list(key+"/", false, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &objectEntry{name: path.Base(key), modified: folderTime, dir: true}, nil
+}
+
+func (s *objectStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.dirPrefix(key)
+	objects, prefixes, err := s.c.list(prefix, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" && len(objects) == 0 && len(prefixes) == 0 {
+		if fi, err := s.Stat(name); err == nil && !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for _, p := range prefixes {
+		entries = append(entries, &objectEntry{name: path.Base(p), modified: folderTime, dir: true})
+	}
+	for _, o := range objects {
+		if o.key == prefix {
+			continue // the folder's marker
+		}
+		entries = append(entries, &objectEntry{name: path.Base(o.key), size: o.size, modified: o.modified})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// objectFile is an open object or folder. Reads go through a GET from the
+// current offset, kept open while reading on; ReadAt gets the range asked for.
+type objectFile struct {
+	s    *objectStorage
+	key  string
+	info *objectEntry
+	off  int64
+	body io.ReadCloser
+}
+
+func (s *objectStorage) Open(name string) (File, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{s: s, key: key, info: fi.(*objectEntry)}, nil
+}
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, errors.New("is a directory")
+	}
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.s.c.get(f.key, f.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *objectFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.info.dir {
+		return 0, errors.New("is a directory")
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), f.info.size-off)
+	body, err := f.s.c.get(f.key, off, n)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	read, err := io.ReadFull(body, p[:n])
+	if err == nil && read < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	if offset != f.off && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *objectFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *objectFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+// objectWriter collects what is written in a temporary file, uploading it on
+// Close as object stores want the size of what they are sent
+type objectWriter struct {
+	s   *objectStorage
+	key string
+	tmp *os.File
+}
+
+func (s *objectStorage) Create(name string) (io.WriteCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, &os.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+	}
+	tmp, err := os.CreateTemp("", "object-*")
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{s: s, key: key, tmp: tmp}, nil
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) { return w.tmp.Write(p) }
+
+func (w *objectWriter) Abort() { closeTemp(w.tmp) }
+
+func (w *objectWriter) Close() error {
+	defer closeTemp(w.tmp)
+	fi, err := w.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.s.c.put(w.key, w.tmp, fi.Size())
+}
+
+func (s *objectStorage) Mkdir(name string) error {
+	key, err := s.key(name)
+	if err != nil || key == "" {
+		return err
+	}
+	fi, err := s.Stat(name)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.c.put(key+"/", strings.NewReader(""), 0)
+}
+
+func (s *objectStorage) Remove(name string, recursive bool) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	fi, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	if !fi.IsDir() {
+		return s.c.delete(key)
+	}
+	prefix := s.dirPrefix(key)
+	objects, _, err := s.c.list(prefix, true, 0)
+	if err != nil {
+		return err
+	}
+	if !recursive && (len(objects) > 1 || len(objects) == 1 && objects[0].key != prefix) {
+		return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	for _, o := range objects {
+		if err := s.c.delete(o.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename copies what is below from to to and deletes it, object stores having
+// no rename. Unlike on a disk, an existing to isn't replaced.
+func (s *objectStorage) Rename(from, to string) error {
+	fromKey, err := s.key(from)
+	if err != nil {
+		return err
+	}
+	toKey, err := s.key(to)
+	if err != nil {
+		return err
+	}
+	if fromKey == "" || toKey == "" {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrPermission}
+	}
+	if _, err := s.Stat(to); err == nil {
+		return &os.PathError{Op: "rename", Path: to, Err: os.ErrExist}
+	}
+	fi, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if err := s.c.copy(fromKey, toKey); err != nil {
+			return err
+		}
+		return s.c.delete(fromKey)
+	}
+	objects, _, err := s.c.list(fromKey+"/", true, 0)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		target := toKey + strings.TrimPrefix(o.key, fromKey)
+		if err := s.c.copy(o.key, target); err != nil {
+			return err
+		}
+		if err := s.c.delete(o.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch fails: object stores don't report changes
+func (s *objectStorage) Watch(dir string, fn func(event)) error {
+	return fmt.Errorf("changes in %s can't be watched", s.url)
+}
+
+// objectHTTPError is the error of a failed object store request, mapping 404
+// to os.ErrNotExist and 403 to os.ErrPermission
+func objectHTTPError(op, key string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err := fmt.Errorf("%s", resp.Status)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = os.ErrNotExist
+	case http.StatusForbidden:
+		err = os.ErrPermission
+	}
+	if msg := xmlErrorMessage(body); msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	return &os.PathError{Op: op, Path: key, Err: err}
+}
+
+// xmlErrorMessage is the message of an XML error answer of S3, GCS or Azure
+func xmlErrorMessage(body []byte) string {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) != nil || e.Code == "" {
+		return ""
+	}
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + strings.SplitN(e.Message, "\n", 2)[0]
+}
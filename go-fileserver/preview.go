@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// maxTextPreview is how much of a text file the viewer shows
+	maxTextPreview = 1 * 1024 * 1024
+	// commandPreviewTimeout bounds external preview commands from the config
+	commandPreviewTimeout = 10 * time.Second
+)
+
+// previewFile is the opened file handed to a preview renderer
+type previewFile struct {
+	Path       string
+	File       File
+	Info       os.FileInfo
+	Head       []byte // first bytes of the file, used for sniffing
+	Ext        string // lower-case extension with dot
+	Mime       string // best guess from extension and content, see detectContentType
+	Sniffed    string // type detected from the content alone
+	IsBinary   bool
+	RawURL     string // /api/raw URL for the file, signed if required
+	SandboxURL string // /sandbox URL rendering the file as an isolated page
+}
+
+// previewRenderer writes the /api/file JSON response for a file
+type previewRenderer func(w http.ResponseWriter, r *http.Request, p *previewFile)
+
+// previewRegistry maps extensions and MIME types to named renderers
+type previewRegistry struct {
+	renderers map[string]previewRenderer
+	byExt     map[string]string
+	byMime    map[string]string // exact type or "major/*"
+	unlimited map[string]bool   // renderers that don't read the whole file, so no size limit applies
+}
+
+func newPreviewRegistry() *previewRegistry {
+	reg := &previewRegistry{
+		renderers: make(map[string]previewRenderer),
+		byExt:     make(map[string]string),
+		byMime:    make(map[string]string),
+		unlimited: make(map[string]bool),
+	}
+	reg.register("text", renderText)
+	reg.register("binary", renderBinary)
+	reg.register("markdown", renderMarkdown, ".md", ".markdown")
+	reg.register("pdf", renderPDF, ".pdf")
+	reg.register("image", renderImage)
+	reg.register("html", renderHTML)
+	reg.register("table", renderTable, ".csv", ".tsv")
+	reg.register("video", renderMedia("video"))
+	reg.register("audio", renderMedia("audio"))
+	reg.register("hex", renderHex)
+	reg.register("archive", renderArchive, ".zip", ".tar", ".tgz", ".gz")
+	reg.unlimited["text"] = true // reads at most maxTextPreview
+	reg.unlimited["binary"] = true
+	reg.unlimited["hex"] = true
+	reg.unlimited["image"] = true
+	reg.unlimited["video"] = true
+	reg.unlimited["audio"] = true
+	reg.unlimited["archive"] = true
+	reg.mapMime("application/pdf", "pdf")
+	reg.mapMime("image/*", "image")
+	reg.mapMime("video/*", "video")
+	reg.mapMime("audio/*", "audio")
+	return reg
+}
+
+// register adds (or replaces) a renderer and maps the given extensions to it
+func (reg *previewRegistry) register(name string, fn previewRenderer, exts ...string) {
+	reg.renderers[name] = fn
+	for _, e := range exts {
+		reg.mapExt(e, name)
+	}
+}
+
+func (reg *previewRegistry) mapExt(ext, name string) {
+	reg.byExt[strings.ToLower(ext)] = name
+}
+
+func (reg *previewRegistry) mapMime(mimeType, name string) {
+	reg.byMime[strings.ToLower(mimeType)] = name
+}
+
+// lookup picks the renderer for a file. A type sniffed from a magic number
+// (image, PDF, ...) is the primary signal, so misnamed and extension-less files
+// render correctly. Otherwise the extension decides, then for binary files the
+// extension-derived MIME type, falling back to the plain text or binary renderer.
+func (reg *previewRegistry) lookup(p *previewFile) previewRenderer {
+	return reg.renderers[reg.lookupName(p)]
+}
+
+// lookupName is lookup returning the name of the renderer
+func (reg *previewRegistry) lookupName(p *previewFile) string {
+	if hasSignature(p.Sniffed) {
+		if name := reg.lookupMime(p.Sniffed); name != "" {
+			return name
+		}
+	}
+	if name, ok := reg.byExt[p.Ext]; ok {
+		return name
+	}
+	if p.IsBinary {
+		if name := reg.lookupMime(p.Mime); name != "" {
+			return name
+		}
+		return "binary"
+	}
+	return "text"
+}
+
+// lookupMime finds the renderer for an exact type or its "major/*" pattern
+func (reg *previewRegistry) lookupMime(contentType string) string {
+	mt := baseType(contentType)
+	if name, ok := reg.byMime[mt]; ok {
+		return name
+	}
+	if i := strings.Index(mt, "/"); i > 0 {
+		if name, ok := reg.byMime[mt[:i]+"/*"]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// previewerConfig maps extensions/MIME types to a built-in renderer, or defines
+// a new renderer that runs an external command and shows its output.
+type previewerConfig struct {
+	Name     string   `json:"name"`
+	Ext      []string `json:"ext"`
+	Mime     []string `json:"mime"`
+	Renderer string   `json:"renderer,omitempty"` // existing renderer to use
+	Command  []string `json:"command,omitempty"`  // "{path}" is replaced by the file path
+	Type     string   `json:"type,omitempty"`     // response type for command output (default "text")
+	Language string   `json:"language,omitempty"` // highlight.js language for command output
+}
+
+// configure applies previewers from the config file
+func (reg *previewRegistry) configure(cfgs []previewerConfig) error {
+	for _, c := range cfgs {
+		name := c.Renderer
+		if len(c.Command) > 0 {
+			if c.Name == "" {
+				return fmt.Errorf("command previewer without a name")
+			}
+			name = c.Name
+			reg.register(name, commandRenderer(c))
+		}
+		if _, ok := reg.renderers[name]; !ok {
+			return fmt.Errorf("unknown previewer renderer: %q", name)
+		}
+		for _, e := range c.Ext {
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			reg.mapExt(e, name)
+		}
+		for _, m := range c.Mime {
+			reg.mapMime(m, name)
+		}
+	}
+	return nil
+}
+
+// renderText shows the first 1MB of a text file, or with ?offset=, ?lines= or
+// ?tail= a page of it, see renderTextPage
+func renderText(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	q := r.URL.Query()
+	if q.Has("offset") || q.Has("lines") || q.Has("tail") {
+		renderTextPage(w, r, p)
+		return
+	}
+	// Text file: Limit read to 1MB
+	data, err := io.ReadAll(io.LimitReader(p.File, maxTextPreview))
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+
+	content := string(data)
+	truncated := p.Info.Size() > int64(maxTextPreview)
+	next := len(data)
+	if truncated {
+		content += "\n\n... [File truncated because it is too large] ..."
+		// The next page starts with the line cut off here
+		if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+			next = i + 1
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      "text",
+		"content":   content,
+		"language":  extToLang(p.Ext),
+		"truncated": truncated, // the editor only offers complete files
+		"size":      p.Info.Size(),
+		"next":      next,
+	})
+}
+
+// renderBinary shows binary files as a hex dump of their start, see renderHex
+func renderBinary(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	renderHex(w, r, p)
+}
+
+func renderMarkdown(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	data, err := io.ReadAll(p.File)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":    "markdown",
+		"content": string(data),
+	})
+}
+
+func renderPDF(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"type": "pdf",
+		// The viewer loads the PDF itself from the raw endpoint
+		"content": p.RawURL,
+	})
+}
+
+// renderImage has the viewer load the image from the raw endpoint, telling
+// its size when it can be read from the header: as shown, i.e. turned as
+// the EXIF orientation of a JPEG says
+func renderImage(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	out := map[string]interface{}{
+		"type":    "image",
+		"content": p.RawURL,
+		"mime":    p.Mime,
+	}
+	if cfg, format, err := image.DecodeConfig(p.File); err == nil {
+		width, height := cfg.Width, cfg.Height
+		if format == "jpeg" {
+			p.File.Seek(0, io.SeekStart)
+			if jpegOrientation(p.File) >= 5 {
+				width, height = height, width
+			}
+		}
+		out["width"], out["height"] = width, height
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// renderMedia has the viewer play video or audio files from the raw endpoint,
+// which serves ranges so players can seek without loading the whole file
+func renderMedia(kind string) previewRenderer {
+	return func(w http.ResponseWriter, r *http.Request, p *previewFile) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"type":    kind,
+			"content": p.RawURL,
+			"mime":    baseType(p.Mime),
+		})
+	}
+}
+
+// commandRenderer runs an external converter and shows its (size-limited) output
+func commandRenderer(c previewerConfig) previewRenderer {
+	typ := c.Type
+	if typ == "" {
+		typ = "text"
+	}
+	return func(w http.ResponseWriter, r *http.Request, p *previewFile) {
+		ctx, cancel := context.WithTimeout(r.Context(), commandPreviewTimeout)
+		defer cancel()
+		args := make([]string, len(c.Command))
+		for i, a := range c.Command {
+			args[i] = strings.ReplaceAll(a, "{path}", p.Path)
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		data, _ := io.ReadAll(io.LimitReader(out, maxTextPreview))
+		io.Copy(io.Discard, out)
+		if err := cmd.Wait(); err != nil {
+			json.NewEncoder(w).Encode(map[string]string{
+				"type":    "error",
+				"content": c.Name + " previewer failed: " + errorMessage(err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"type":     typ,
+			"content":  string(data),
+			"language": c.Language,
+		})
+	}
+}
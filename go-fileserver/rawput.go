@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// upPrefix takes PUT uploads addressed by root name, e.g. /up/files/logs/today.log
+// for the served folder named "files". `curl -T app.log http://host/up/files/logs/`
+// appends the file name itself.
+const upPrefix = "/up/"
+
+// API: PUT /up/<root>/<path> stores the request body as a file
+func (fs *FileServer) handleUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, upPrefix))
+	name, rest, _ := strings.Cut(strings.TrimPrefix(rel, "/"), "/")
+	root := fs.browseRoot(r, name)
+	if root == "" || rest == "" || strings.HasSuffix(r.URL.Path, "/") {
+		httpError(w, "Want /up/<root>/<path to file>", 400)
+		return
+	}
+	fs.putFile(w, r, filepath.Join(root, filepath.FromSlash(rest)))
+}
+
+// putFile writes the request body to p, replacing an existing file only once
+// the body arrived completely. Answers 201 for a new file, 200 for a replaced one.
+func (fs *FileServer) putFile(w http.ResponseWriter, r *http.Request, p string) {
+	if !fs.checkPut(w, r, p) {
+		return
+	}
+	_, existed := statFile(p)
+	fi, sum, ok := fs.writeBody(w, r, p)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !existed {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(p), "size": fi.Size(), "sha256": sum})
+}
+
+// checkPut answers the request with an error unless it may write the file p
+func (fs *FileServer) checkPut(w http.ResponseWriter, r *http.Request, p string) bool {
+	if !fs.inRoots(p) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return false
+	}
+	if hasInternal(p) {
+		httpError(w, "Forbidden", 403)
+		return false
+	}
+	if !fs.requireRead(w, r, p) || !fs.requireWrite(w, r, p) {
+		return false
+	}
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		httpError(w, "Path is a folder", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// statFile returns the info of p if it is an existing regular file
+func statFile(p string) (os.FileInfo, bool) {
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, false
+	}
+	return fi, true
+}
+
+// writeBody stores the request body as the file p, through a temporary file,
+// and announces the upload. On failure it answers the request and ok is false.
+func (fs *FileServer) writeBody(w http.ResponseWriter, r *http.Request, p string) (fi os.FileInfo, sum string, ok bool) {
+	dir := filepath.Dir(p)
+	if err := fs.checkFreeSpace(dir, r.ContentLength); err != nil {
+		lowDiskError(w)
+		return nil, "", false
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		writeError(w, err, 500)
+		return nil, "", false
+	}
+
+	fs.keepVersion(p)
+	src := &freeSpaceGuard{fs: fs, r: r.Body, dir: dir, limit: fs.uploadLimit(dir)}
+	var err error
+	if *casMode {
+		sum, err = fs.casWrite(p, src)
+	} else {
+		// Written to a fresh temporary file that replaces p once complete
+		sum, err = writeUpload(localDisk, p, src)
+	}
+	if err == errLowDisk {
+		lowDiskError(w)
+		return nil, "", false
+	}
+	if err != nil {
+		writeError(w, err, 500)
+		return nil, "", false
+	}
+	if fi, err = os.Stat(p); err != nil {
+		writeError(w, err, 500)
+		return nil, "", false
+	}
+	fs.contents.add(p, sum, fi)
+	if abs, err := filepath.Abs(p); err == nil {
+		fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs)})
+	}
+	return fi, sum, true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// put stores body through PUT url and returns the status code
+func put(fs *FileServer, url, body string) int {
+	w := httptest.NewRecorder()
+	fs.handleUp(w, httptest.NewRequest("PUT", url, strings.NewReader(body)))
+	return w.Code
+}
+
+func TestPutStaysInRoot(t *testing.T) {
+	fs, docs, _, outside := testServer(t)
+	victim := filepath.Join(outside, "victim.txt")
+	if err := os.WriteFile(victim, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A link planted where a predictable temporary file would go
+	if err := os.Symlink(victim, filepath.Join(docs, ".new.txt.part")); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := put(fs, "/up/docs/new.txt", "hello"); code != 201 {
+		t.Fatalf("new file = %d, want 201", code)
+	}
+	if code := put(fs, "/up/docs/new.txt", "again"); code != 200 {
+		t.Errorf("replaced file = %d, want 200", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(docs, "new.txt")); string(data) != "again" {
+		t.Errorf("file holds %q", data)
+	}
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/up/docs/out/x.txt", 403},
+		{"/up/docs/out-file", 403},
+		{"/up/docs/" + casDirName + "/x", 403},
+		{"/up/docs/sub/", 400},
+		{"/up/docs/sub", 409},
+		{"/up/nowhere/x.txt", 400},
+		{"/up/docs/../../outside/x.txt", 400},
+	}
+	for _, tt := range tests {
+		if code := put(fs, tt.url, "evil"); code != tt.status {
+			t.Errorf("%s = %d, want %d", tt.url, code, tt.status)
+		}
+	}
+
+	if data, _ := os.ReadFile(victim); string(data) != "keep" {
+		t.Errorf("file outside holds %q", data)
+	}
+	if fileExists(filepath.Join(outside, "x.txt")) {
+		t.Error("a file was written outside")
+	}
+	parts, _ := filepath.Glob(filepath.Join(docs, ".*.part"))
+	if len(parts) != 1 {
+		t.Errorf("temporary files left behind: %v", parts)
+	}
+}
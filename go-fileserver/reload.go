@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// servedState is what a reload of the config replaces: the served folders
+// and the settings that apply to them. Requests load it once and go on with
+// what they got, so a reload doesn't disturb those in flight.
+type servedState struct {
+	folders  []string
+	config   *Config
+	storages map[string]Storage // by served folder, the local disk when absent
+	names    map[string]string  // root names by absolute path, see rootName
+}
+
+// folderList is the served folders as given, see rootOf for their absolute paths
+func (fs *FileServer) folderList() []string {
+	return fs.state.Load().folders
+}
+
+// cfg is the current config
+func (fs *FileServer) cfg() *Config {
+	return fs.state.Load().config
+}
+
+// Log levels of the "logLevel" config key
+const (
+	logInfo = "info" // everything, the default
+	logWarn = "warn" // problems only, without the notes of notef
+)
+
+func validLogLevel(level string) error {
+	switch level {
+	case "", logInfo, logWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown log level: %s", level)
+}
+
+// notef logs a routine note, such as a refused or broken-off request,
+// unless the log level is warn. The level is that of the current config, so
+// a reload changes it right away.
+func (fs *FileServer) notef(format string, v ...interface{}) {
+	if fs.cfg().LogLevel != logWarn {
+		log.Printf(format, v...)
+	}
+}
+
+// openFolders opens the comma-separated folders of -folders, mounting
+// object stores, and pairs them with cfg. Roots of cfg naming an object
+// store are matched to where it is mounted. A folder given as name=path is
+// served under that name, others under their alias or base name.
+func openFolders(list string, cfg *Config) (*servedState, error) {
+	if list == "" {
+		return nil, fmt.Errorf("No folders provided. Use -folders or roots in the -config file to specify folders.")
+	}
+	st := &servedState{config: cfg, storages: make(map[string]Storage), names: make(map[string]string)}
+	given := make(map[string]string) // names from -folders by folder as listed
+	for _, f := range strings.Split(list, ",") {
+		trimmed := strings.TrimSpace(f)
+		if name, p, ok := strings.Cut(trimmed, "="); ok && !strings.ContainsAny(name, `/\:`) {
+			if err := validRootName(name); err != nil {
+				return nil, fmt.Errorf("Folder %s: %v", p, err)
+			}
+			trimmed = strings.TrimSpace(p)
+			given[trimmed] = name
+		}
+		if isObjectURL(trimmed) {
+			s, err := openObjectRoot(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("Folder %s: %v", trimmed, err)
+			}
+			st.folders = append(st.folders, s.mount)
+			st.storages[s.mount] = s
+			if name, ok := given[trimmed]; ok {
+				given[s.mount] = name
+			}
+			for i := range cfg.Roots {
+				if cfg.Roots[i].Path == trimmed {
+					cfg.Roots[i].Path = s.mount
+				}
+			}
+			continue
+		}
+		if trimmed != "" {
+			if _, err := os.Stat(trimmed); os.IsNotExist(err) {
+				return nil, fmt.Errorf("Folder does not exist: %s", trimmed)
+			}
+			st.folders = append(st.folders, trimmed)
+		}
+	}
+	taken := make(map[string]string)
+	for _, f := range st.folders {
+		shown := f
+		if s, ok := st.storages[f].(*objectStorage); ok {
+			shown = s.url
+		}
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, fmt.Errorf("Folder %s: %v", shown, err)
+		}
+		name, ok := given[f]
+		if !ok {
+			name = filepath.Base(abs)
+			for _, rc := range cfg.Roots {
+				if rc.Path == abs && rc.Alias != "" {
+					name = rc.Alias
+				}
+			}
+			if validRootName(name) != nil {
+				return nil, fmt.Errorf("Folder %s needs a name, give it as name=%s", shown, shown)
+			}
+		}
+		if other, dup := taken[name]; dup {
+			return nil, fmt.Errorf("Folders %s and %s are both named %s, give one another name as name=path", other, shown, name)
+		}
+		log.Printf("Folder: %s, served as /%s", shown, name)
+		taken[name] = shown
+		st.names[abs] = name
+	}
+	return st, nil
+}
+
+// reloadMu makes reloads run one at a time
+var reloadMu sync.Mutex
+
+// reload reads the config file again and applies what can change while the
+// server runs: the served folders and their settings, the global settings
+// read per request (access, hidden files, disposition, smart folders,
+// trackers, log level), the -auth and -token credentials and the auth log,
+// which is reopened so it can be rotated. Flags given on the command line
+// still override the file. Everything else, like the listen address, TLS and
+// the notification channels, takes a restart. On errors nothing changes.
+//
+// All of it is swapped in atomically (the served state, credentials and auth
+// log); the flags keep their values from startup, as requests may be
+// reading them.
+func (fs *FileServer) reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+	// Everything is checked and opened first, then applied together
+	values, err := cfg.flagValues()
+	if err != nil {
+		return err
+	}
+	creds, err := parseCredentials(flagValue(values, "auth"), flagValue(values, "token"))
+	if err != nil {
+		return err
+	}
+	state, err := openFolders(flagValue(values, "folders"), cfg)
+	if err != nil {
+		return err
+	}
+	logFile, err := createAuthLog(flagValue(values, "auth-log"))
+	if err != nil {
+		return fmt.Errorf("Auth log: %v", err)
+	}
+	credentials.Store(creds)
+	useAuthLog(logFile)
+	old := fs.state.Swap(state)
+	var added []string
+	for _, f := range state.folders {
+		if !containsString(old.folders, f) {
+			added = append(added, f)
+		}
+	}
+	if len(added) > 0 {
+		if fs.index != nil {
+			fs.index.scanRoots(added, fs.jobs, fs.publicPath)
+		}
+		if fs.sizeIndex != nil {
+			fs.sizeIndex.scanRoots(added, fs.jobs, fs.publicPath)
+		}
+	}
+	fs.watchAddedRoots()
+	log.Printf("Config reloaded: %d folders", len(state.folders))
+	return nil
+}
+
+// reloadOnSignal reloads the config on SIGHUP, like many daemons do
+func (fs *FileServer) reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := fs.reload(); err != nil {
+				log.Printf("Config reload: %v", err)
+			}
+		}
+	}()
+}
+
+// API: POST /api/admin/reload reloads the config file like SIGHUP does, for
+// admins. Answers {"success": true, "folders": [...]}, or 400 with what is
+// wrong with the file, in which case the running config stays.
+func (fs *FileServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, roleAdmin) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := fs.reload(); err != nil {
+		log.Printf("Config reload: %v", err)
+		apiError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	var folders []string
+	for _, f := range fs.folderList() {
+		folders = append(folders, fs.publicPath(f))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "folders": folders})
+}
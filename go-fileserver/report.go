@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storageReportKey = "storage-report"
+	// reportTopFiles is how many of the biggest new files a report lists per root
+	reportTopFiles = 10
+	// reportSummaryFiles is how many of them make it into the notification text
+	reportSummaryFiles = 3
+)
+
+// Report periods
+const (
+	reportDaily  = "daily"
+	reportWeekly = "weekly"
+	reportManual = "manual" // requested through the API
+)
+
+// storageReport summarizes the served roots at the end of a period
+type storageReport struct {
+	Period string       `json:"period"`
+	From   time.Time    `json:"from"`
+	To     time.Time    `json:"to"`
+	Job    string       `json:"job,omitempty"` // ID in /api/jobs
+	Roots  []rootReport `json:"roots"`
+}
+
+type rootReport struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	Files int64  `json:"files"`
+	// Growth is the change in bytes since the previous report, null for the first
+	Growth *int64 `json:"growth"`
+	// NewFiles and NewBytes count the files created or changed during the period
+	NewFiles int64        `json:"newFiles"`
+	NewBytes int64        `json:"newBytes"`
+	Biggest  []reportFile `json:"biggest"` // largest new files
+	// Disk is the filesystem the root lives on; Used is its fill level in percent
+	Disk    *diskUsage `json:"disk,omitempty"`
+	Used    float64    `json:"used"`
+	LowDisk bool       `json:"lowDisk"` // below -min-free
+	Errors  int        `json:"errors,omitempty"`
+}
+
+type reportFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// reporter builds storage reports on a schedule or on request
+type reporter struct {
+	fs      *FileServer
+	mu      sync.Mutex
+	running bool
+	last    *storageReport
+}
+
+func newReporter(fs *FileServer) *reporter {
+	rp := &reporter{fs: fs}
+	var last storageReport
+	if err := loadState(storageReportKey, &last); err != nil {
+		log.Printf("Report: ignoring unreadable state: %v", err)
+	} else if !last.To.IsZero() {
+		rp.last = &last
+	}
+	return rp
+}
+
+// parseReportAt parses a "HH:MM" time of day
+func parseReportAt(s string) (hour, min int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// nextReportTime is the next hour:min after now, on a Monday for weekly reports
+func nextReportTime(now time.Time, period string, hour, min int) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, min, 0, 0, now.Location())
+	for !t.After(now) || (period == reportWeekly && t.Weekday() != time.Monday) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// schedule builds a report every day or week at hour:min local time
+func (rp *reporter) schedule(period string, hour, min int) {
+	go func() {
+		for {
+			time.Sleep(time.Until(nextReportTime(time.Now(), period, hour, min)))
+			rp.start(period)
+		}
+	}()
+}
+
+// start builds a report in the background unless one is already running
+func (rp *reporter) start(period string) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.running {
+		return false
+	}
+	rp.running = true
+	rep := &storageReport{Period: period, To: time.Now()}
+	switch {
+	case rp.last != nil:
+		rep.From = rp.last.To
+	case period == reportWeekly:
+		rep.From = rep.To.AddDate(0, 0, -7)
+	default:
+		rep.From = rep.To.AddDate(0, 0, -1)
+	}
+	prev := rp.last
+	j := rp.fs.jobs.start("report", "Storage report", func(j *job) (interface{}, error) {
+		err := rp.run(j, rep, prev)
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		rp.running = false
+		if err != nil {
+			return nil, err
+		}
+		rp.last = rep
+		if err := saveState(storageReportKey, rep); err != nil {
+			log.Printf("Report: saving failed: %v", err)
+		}
+		rp.fs.events.publish(event{Type: eventReport, Time: rep.To, Data: map[string]string{
+			"period":  rep.Period,
+			"summary": rep.summary(),
+			"url":     "/api/report",
+		}})
+		return nil, nil
+	})
+	rep.Job = j.ID
+	return true
+}
+
+func (rp *reporter) run(j *job, rep *storageReport, prev *storageReport) error {
+	previous := make(map[string]int64)
+	if prev != nil {
+		for _, r := range prev.Roots {
+			previous[r.Path] = r.Bytes
+		}
+	}
+	for _, root := range rp.fs.folderList() {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rr := rootReport{Path: rp.fs.publicPath(abs), Biggest: []reportFile{}}
+		err = filepath.WalkDir(abs, func(p string, d os.DirEntry, err error) error {
+			if cerr := j.checkpoint(); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				rr.Errors++
+				return nil
+			}
+			if d.IsDir() {
+				if isInternal(d.Name()) {
+					return filepath.SkipDir
+				}
+				j.add(0, rp.fs.publicPath(p))
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				rr.Errors++
+				return nil
+			}
+			rr.Files++
+			rr.Bytes += fi.Size()
+			if fi.ModTime().After(rep.From) && !fi.ModTime().After(rep.To) {
+				rr.NewFiles++
+				rr.NewBytes += fi.Size()
+				rr.Biggest = addBiggest(rr.Biggest, reportFile{Path: rp.fs.publicPath(p), Size: fi.Size(), Modified: fi.ModTime()})
+			}
+			return nil
+		})
+		if err == errJobCanceled {
+			return err
+		}
+		if b, ok := previous[rr.Path]; ok {
+			growth := rr.Bytes - b
+			rr.Growth = &growth
+		}
+		if du, err := diskFree(abs); err == nil {
+			rr.Disk = &du
+			if du.Total > 0 {
+				rr.Used = float64(du.Total-du.Free) * 100 / float64(du.Total)
+			}
+			rr.LowDisk = rp.fs.minFree > 0 && int64(du.Available) < rp.fs.minFree
+		}
+		rep.Roots = append(rep.Roots, rr)
+	}
+	return nil
+}
+
+// addBiggest inserts f into list, which is sorted by descending size and
+// capped at reportTopFiles entries
+func addBiggest(list []reportFile, f reportFile) []reportFile {
+	if len(list) == reportTopFiles && f.Size <= list[len(list)-1].Size {
+		return list
+	}
+	i := sort.Search(len(list), func(i int) bool { return list[i].Size < f.Size })
+	list = append(list, reportFile{})
+	copy(list[i+1:], list[i:])
+	list[i] = f
+	if len(list) > reportTopFiles {
+		list = list[:reportTopFiles]
+	}
+	return list
+}
+
+// summary renders the report as plain text for notifications
+func (rep *storageReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Storage report (%s, %s to %s)\n", rep.Period, rep.From.Format("2006-01-02 15:04"), rep.To.Format("2006-01-02 15:04"))
+	for _, r := range rep.Roots {
+		fmt.Fprintf(&b, "%s: %s in %d files", r.Path, formatSize(r.Bytes), r.Files)
+		if r.Growth != nil {
+			sign := "+"
+			g := *r.Growth
+			if g < 0 {
+				sign, g = "-", -g
+			}
+			fmt.Fprintf(&b, " (%s%s)", sign, formatSize(g))
+		}
+		fmt.Fprintf(&b, ", %d new or changed files (%s)", r.NewFiles, formatSize(r.NewBytes))
+		if r.Disk != nil {
+			fmt.Fprintf(&b, ", disk %.0f%% used, %s available", r.Used, formatSize(int64(r.Disk.Available)))
+			if r.LowDisk {
+				b.WriteString(" (LOW)")
+			}
+		}
+		b.WriteString("\n")
+		for i, f := range r.Biggest {
+			if i == reportSummaryFiles {
+				break
+			}
+			fmt.Fprintf(&b, "  %s  %s\n", formatSize(f.Size), f.Path)
+		}
+	}
+	return b.String()
+}
+
+// API: Storage report. GET returns the last report (as text with
+// ?format=text), POST builds a new one covering the time since the last.
+func (fs *FileServer) handleReport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fs.reports.mu.Lock()
+		last := fs.reports.last
+		fs.reports.mu.Unlock()
+		if wantsText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if last != nil {
+				fmt.Fprint(w, last.summary())
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"report": last})
+	case http.MethodPost:
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		started := fs.reports.start(reportManual)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": started, "alreadyRunning": !started})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
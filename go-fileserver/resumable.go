@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Resumable uploads send a file in chunks, so a dropped connection only loses
+// the chunk in flight. A session is created with the target path and size,
+// chunks are appended at the offset the server reports, and the file is moved
+// into place when the last byte arrived. Sessions are kept in the store and
+// their data in the data directory, so uploads also survive a restart.
+
+const (
+	// uploadSessionDir holds the data of unfinished uploads, relative to the data directory
+	uploadSessionDir = "uploads"
+	// uploadSessionTTL is how long an upload may go without a chunk before it is dropped
+	uploadSessionTTL = 24 * time.Hour
+	// uploadOffsetHeader carries the offset of a chunk and the bytes received so far
+	uploadOffsetHeader = "Upload-Offset"
+)
+
+// uploadSession is a resumable upload as stored in the store. How much has
+// arrived is the size of its data file.
+type uploadSession struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"` // the target file, slash separated
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+func (s *uploadSession) dataPath() string {
+	return statePath(filepath.Join(uploadSessionDir, s.ID))
+}
+
+// received is how many bytes of the upload arrived and when the last did
+func (s *uploadSession) received() (int64, time.Time) {
+	fi, err := os.Stat(s.dataPath())
+	if err != nil {
+		return 0, s.Created
+	}
+	return fi.Size(), fi.ModTime()
+}
+
+// uploadSessions are the resumable uploads in progress
+type uploadSessions struct {
+	mu   sync.Mutex
+	busy map[string]bool // sessions a chunk is being written to
+}
+
+func newUploadSessions() *uploadSessions {
+	u := &uploadSessions{busy: make(map[string]bool)}
+	u.prune()
+	go func() {
+		for range time.Tick(time.Hour) {
+			u.prune()
+		}
+	}()
+	return u
+}
+
+// prune drops sessions that got no chunk for uploadSessionTTL, and data files
+// whose session is gone
+func (u *uploadSessions) prune() {
+	keep := make(map[string]bool)
+	var stale []*uploadSession
+	err := db.each(bucketUploads, func(id string, data []byte) error {
+		var s uploadSession
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if _, last := s.received(); time.Since(last) > uploadSessionTTL {
+			stale = append(stale, &s)
+		} else {
+			keep[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Uploads: %v", err)
+		return
+	}
+	for _, s := range stale {
+		log.Printf("Uploads: dropping abandoned upload of %s", s.Path)
+		u.remove(s)
+	}
+	entries, _ := os.ReadDir(statePath(uploadSessionDir))
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			os.Remove(filepath.Join(statePath(uploadSessionDir), e.Name()))
+		}
+	}
+}
+
+func (u *uploadSessions) get(id string) (*uploadSession, bool) {
+	var s uploadSession
+	ok, err := db.get(bucketUploads, id, &s)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return &s, true
+}
+
+func (u *uploadSessions) remove(s *uploadSession) {
+	db.delete(bucketUploads, s.ID)
+	os.Remove(s.dataPath())
+}
+
+// lock claims s for one chunk at a time
+func (u *uploadSessions) lock(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *uploadSessions) unlock(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+// uploadStatus answers with the state of s
+func (fs *FileServer) uploadStatus(w http.ResponseWriter, status int, s *uploadSession) {
+	offset, _ := s.received()
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": s.ID, "path": fs.publicPath(s.Path), "size": s.Size, "offset": offset})
+}
+
+// API: POST /api/uploads starts a resumable upload. JSON body:
+// {"path": "/folder/file", "size": 123, "overwrite": false}; answers 201 with
+// {"id": ..., "offset": 0}. GET /api/uploads/<id> tells the offset to continue
+// at, also in the Upload-Offset header. PATCH /api/uploads/<id> with an
+// Upload-Offset header appends the body as the next chunk; a wrong offset gets
+// 409 with the right one. The chunk that completes the upload answers with
+// "complete": true and the file's sha256. DELETE /api/uploads/<id> gives up.
+func (fs *FileServer) handleUploads(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/uploads"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fs.createUpload(w, r)
+		return
+	}
+	s, ok := fs.uploads.get(id)
+	if !ok {
+		apiError(w, http.StatusNotFound, codeNotFound, "No such upload, it finished or was dropped")
+		return
+	}
+	target := filepath.FromSlash(s.Path)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !fs.requireRead(w, r, target) || !fs.requireWrite(w, r, target) {
+			return
+		}
+		fs.uploadStatus(w, http.StatusOK, s)
+	case http.MethodPatch:
+		fs.uploadChunk(w, r, s)
+	case http.MethodDelete:
+		if !fs.requireRead(w, r, target) || !fs.requireWrite(w, r, target) {
+			return
+		}
+		if !fs.uploads.lock(s.ID) {
+			apiError(w, http.StatusConflict, codeBusy, "A chunk is being written")
+			return
+		}
+		defer fs.uploads.unlock(s.ID)
+		fs.uploads.remove(s)
+		fs.progress.finish(s.ID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (fs *FileServer) createUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path      string `json:"path"`
+		Size      int64  `json:"size"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, 400, codeBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Path == "" || req.Size < 0 {
+		apiError(w, 400, codeBadRequest, "Missing path or invalid size")
+		return
+	}
+	if !fs.resolvePaths(w, &req.Path) {
+		return
+	}
+	target := req.Path
+	if !fs.checkPut(w, r, target) {
+		return
+	}
+	if _, exists := statFile(target); exists && !req.Overwrite {
+		apiError(w, http.StatusConflict, codeExists, "File exists, upload it with overwrite: true to replace it")
+		return
+	}
+	if limit := fs.uploadLimit(target); limit > 0 && req.Size > limit {
+		writeError(w, errUploadTooLarge, 400)
+		return
+	}
+	if fs.checkFreeSpace(filepath.Dir(target), req.Size) != nil || fs.checkFreeSpace(*dataDir, req.Size) != nil {
+		lowDiskError(w)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := &uploadSession{ID: hex.EncodeToString(b), Path: filepath.ToSlash(target), Size: req.Size, Created: time.Now()}
+	if err := os.MkdirAll(statePath(uploadSessionDir), 0755); err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	f, err := os.Create(s.dataPath())
+	if err == nil {
+		f.Close()
+		err = db.put(bucketUploads, s.ID, s)
+	}
+	if err != nil {
+		os.Remove(s.dataPath())
+		writeError(w, err, 500)
+		return
+	}
+	fs.uploadStatus(w, http.StatusCreated, s)
+}
+
+// uploadChunk appends the request body to s and completes the upload when
+// it has all bytes. What arrived of a broken chunk is kept.
+func (fs *FileServer) uploadChunk(w http.ResponseWriter, r *http.Request, s *uploadSession) {
+	target := filepath.FromSlash(s.Path)
+	if !fs.checkPut(w, r, target) {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		apiError(w, 400, codeBadRequest, "Missing or invalid "+uploadOffsetHeader+" header")
+		return
+	}
+	if !fs.uploads.lock(s.ID) {
+		apiError(w, http.StatusConflict, codeBusy, "Another chunk of this upload is being written")
+		return
+	}
+	defer fs.uploads.unlock(s.ID)
+
+	f, err := os.OpenFile(s.dataPath(), os.O_WRONLY, 0)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		writeError(w, err, 500)
+		return
+	}
+	if offset != have {
+		f.Close()
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(have, 10))
+		writeErrorJSON(w, http.StatusConflict, map[string]interface{}{"error": errorBody(codeOffsetMismatch, "The upload continues at another offset"), "offset": have})
+		return
+	}
+
+	p := fs.progress.track(s.ID, fs.publicPath(s.Path), have, s.Size)
+	complete := false
+	defer func() {
+		// Between chunks the session tells the progress
+		if !complete {
+			fs.progress.drop(s.ID)
+		}
+	}()
+	src := &freeSpaceGuard{fs: fs, r: progressReader{r: r.Body, t: fs.progress, p: p}, dir: *dataDir}
+	n, err := io.Copy(f, io.LimitReader(src, s.Size-have))
+	if err == nil {
+		// Anything past the announced size is a client error
+		var extra [1]byte
+		if m, _ := r.Body.Read(extra[:]); m > 0 {
+			f.Truncate(have)
+			f.Close()
+			apiError(w, 400, codeBadRequest, "Chunk goes past the size of the upload")
+			return
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == errLowDisk {
+		lowDiskError(w)
+		return
+	}
+	if err != nil {
+		// The client resumes from what arrived
+		log.Printf("Uploads: chunk of %s broke off after %d bytes: %v", s.Path, n, err)
+		return
+	}
+	if have+n < s.Size {
+		fs.uploadStatus(w, http.StatusOK, s)
+		return
+	}
+
+	_, existed := statFile(target)
+	sum, err := fs.finishUpload(s, target)
+	if err == errLowDisk {
+		lowDiskError(w)
+		return
+	}
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	complete = true
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	if !existed {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "complete": true, "path": fs.publicPath(s.Path), "size": s.Size, "sha256": sum})
+}
+
+// finishUpload moves the data of a complete upload to target and announces it
+func (fs *FileServer) finishUpload(s *uploadSession, target string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.Open(s.dataPath())
+	if err != nil {
+		return "", err
+	}
+	fs.keepVersion(target)
+	var sum string
+	if *casMode {
+		sum, err = fs.casWrite(target, f)
+		f.Close()
+	} else {
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		sum = hex.EncodeToString(h.Sum(nil))
+		if err == nil {
+			err = os.Rename(s.dataPath(), target)
+			if errors.Is(err, syscall.EXDEV) {
+				// The data directory is on another filesystem
+				if err = fs.checkFreeSpace(filepath.Dir(target), s.Size); err == nil {
+					err = copyFile(s.dataPath(), target)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	fs.uploads.remove(s)
+	fs.progress.finish(s.ID)
+	if fi, err := os.Stat(target); err == nil {
+		fs.contents.add(target, sum, fi)
+	}
+	if abs, err := filepath.Abs(target); err == nil {
+		fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(abs)})
+	}
+	return sum, nil
+}
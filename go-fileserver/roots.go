@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rootOf returns the served folder containing path, or "" if it is outside all of them
+func (fs *FileServer) rootOf(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for _, f := range fs.folderList() {
+		root, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		if abs == root || strings.HasPrefix(abs, root+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return ""
+}
+
+// rootName is the name a served folder is served under: the name given in
+// -folders, its alias from the config, else its base name. Clients see paths
+// as "/<root name>/<path in the root>", see publicPath.
+func (fs *FileServer) rootName(root string) string {
+	if name, ok := fs.state.Load().names[root]; ok {
+		return name
+	}
+	return filepath.Base(root)
+}
+
+// validRootName checks a name for a served folder: it becomes the first
+// element of paths, so it can't be empty, "." or "..", nor contain slashes
+// or colons (which also keeps it apart from smart folders)
+func validRootName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+// rootByName returns the served folder with the given name (see rootName),
+// or "" if there is none
+func (fs *FileServer) rootByName(name string) string {
+	for root, n := range fs.state.Load().names {
+		if n == name {
+			return root
+		}
+	}
+	return ""
+}
+
+// publicPath is how clients see a path: "/<root name>/<path in the root>",
+// so the layout of the server's disks stays hidden. Paths outside the served
+// folders are returned as they are.
+func (fs *FileServer) publicPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.ToSlash(p)
+	}
+	root := fs.rootOf(abs)
+	if root == "" {
+		return filepath.ToSlash(p)
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == "." {
+		return "/" + fs.rootName(root)
+	}
+	return "/" + fs.rootName(root) + "/" + filepath.ToSlash(rel)
+}
+
+// localPath turns a path as clients see it (see publicPath) into the path on
+// the server. The leading slash is optional and ".." can't leave the root.
+// Returns "" if the path doesn't start with the name of a served folder.
+func (fs *FileServer) localPath(p string) string {
+	name, rest, _ := strings.Cut(strings.TrimLeft(filepath.ToSlash(p), "/"), "/")
+	root := fs.rootByName(name)
+	if root == "" {
+		return ""
+	}
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+rest)))
+}
+
+// realPath is the absolute path with all symlinks followed. Of a path that
+// doesn't exist yet, the deepest existing parent is resolved and the rest
+// appended. A link to something missing stands for its target, as writing
+// to the link would create that.
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if target, lerr := os.Readlink(abs); lerr == nil && os.IsNotExist(err) {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(abs), target)
+			}
+			abs = filepath.Clean(target)
+			continue
+		}
+		parent := filepath.Dir(abs)
+		if !os.IsNotExist(err) || parent == abs {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(abs), rest)
+		abs = parent
+	}
+}
+
+// inRoots reports whether path may be used by a request: it must be inside a
+// served folder both as written and with symlinks followed, so a link can't
+// lead out of the served folders, and not inside server bookkeeping.
+// rootOf alone is for finding the folder of a path already checked.
+func (fs *FileServer) inRoots(path string) bool {
+	if fs.rootOf(path) == "" || hasInternal(path) {
+		return false
+	}
+	real, err := realPath(path)
+	if err != nil || hasInternal(real) {
+		return false
+	}
+	for _, f := range fs.folderList() {
+		root, err := realPath(f)
+		if err != nil {
+			continue
+		}
+		if real == root || strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireInRoots answers 403 and returns false if a path is outside the
+// served folders (see inRoots)
+func (fs *FileServer) requireInRoots(w http.ResponseWriter, paths ...string) bool {
+	for _, p := range paths {
+		if !fs.inRoots(filepath.FromSlash(p)) {
+			httpError(w, "Path is not inside a served folder: "+fs.publicPath(p), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// resolvePaths turns the paths a client sent into paths on the server (see
+// localPath), answering 404 and returning false if one names no served folder
+func (fs *FileServer) resolvePaths(w http.ResponseWriter, paths ...*string) bool {
+	for _, p := range paths {
+		local := fs.localPath(*p)
+		if local == "" {
+			httpError(w, "Not found: "+*p, http.StatusNotFound)
+			return false
+		}
+		*p = local
+	}
+	return true
+}
+
+// resolvePathList is resolvePaths for a list, which is changed in place
+func (fs *FileServer) resolvePathList(w http.ResponseWriter, paths []string) bool {
+	for i := range paths {
+		if !fs.resolvePaths(w, &paths[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathParams are the query parameters that name paths
+var pathParams = []string{"path", "folder", "root"}
+
+// isPathParam reports whether the value v of the query parameter key names
+// a path, as it does unless empty or one of the exceptions
+func isPathParam(r *http.Request, key, v string) bool {
+	switch {
+	case v == "":
+		return false
+	case key == "folder" && r.URL.Path == "/api/sync/file":
+		// folder=true of /api/sync/file
+		return false
+	case r.URL.Path == "/api/tree" && (v == "." || v == "/" || strings.HasPrefix(v, smartPrefix)):
+		// The tree's list of roots and smart folders
+		return false
+	}
+	return true
+}
+
+// jailMiddleware turns the paths that requests name in the query string into
+// paths on the server (see localPath), confines them to the served folders
+// and keeps them out of object stores where the endpoint needs the local
+// disk (see requireLocal); endpoints taking paths in a JSON body or the URL
+// path translate and check them themselves.
+func (fs *FileServer) jailMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		for _, key := range pathParams {
+			for i, v := range q[key] {
+				if !isPathParam(r, key, v) {
+					continue
+				}
+				if !fs.resolvePaths(w, &q[key][i]) || !fs.requireInRoots(w, q[key][i]) || !fs.requireLocal(w, r, q[key][i]) {
+					return
+				}
+			}
+		}
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// casDirName is the per-root blob store used in content-addressable mode
+const casDirName = ".cas"
+
+// isInternal reports whether a directory entry is server bookkeeping that
+// must not show up in listings, searches or archives.
+func isInternal(name string) bool {
+	return name == casDirName || name == trashDirName || name == versionsDirName
+}
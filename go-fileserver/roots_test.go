@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRoots serves two folders, docs and other, next to a folder outside
+// them. Inside docs are links out of it, to other and into bookkeeping.
+func testRoots(t *testing.T) (fs *FileServer, docs, other, outside string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs = filepath.Join(base, "docs")
+	other = filepath.Join(base, "other")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(docs, "sub"), filepath.Join(docs, casDirName), other, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(docs, "a.txt"), filepath.Join(other, "b.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"out":      outside,
+		"out-file": filepath.Join(outside, "secret.txt"),
+		"out-rel":  filepath.Join("..", "outside"),
+		"dangling": filepath.Join(outside, "new.txt"),
+		"dang-rel": filepath.Join("..", "outside", "new.txt"),
+		"dang-in":  filepath.Join("sub", "new.txt"),
+		"to-other": other,
+		"to-sub":   "sub",
+		"to-cas":   casDirName,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(docs, name)); err != nil {
+			t.Skipf("no symlinks here: %v", err)
+		}
+	}
+	state, err := openFolders(docs+","+other, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = &FileServer{}
+	fs.state.Store(state)
+	return fs, docs, other, outside
+}
+
+// testServer is testRoots with a store of its own and what the handlers
+// keep in it
+func testServer(t *testing.T) (fs *FileServer, docs, other, outside string) {
+	t.Helper()
+	fs, docs, other, outside = testRoots(t)
+	// Away from any .fileserver folder the store would import
+	t.Chdir(t.TempDir())
+	s, err := openStore(filepath.Join(t.TempDir(), "fileserver.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = s
+	t.Cleanup(func() {
+		db = old
+		s.bolt.Close()
+	})
+	fs.events = newEventBus()
+	fs.contents = loadContentIndex()
+	fs.shares = loadShares()
+	fs.shortLinks = loadShortLinks()
+	fs.saved = loadSavedSearches()
+	fs.signingKey = []byte("test key")
+	return fs, docs, other, outside
+}
+
+// configure serves docs and other with the root settings given
+func configure(t *testing.T, fs *FileServer, docs, other string, roots ...rootConfig) {
+	t.Helper()
+	state, err := openFolders(docs+","+other, &Config{Roots: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.state.Store(state)
+}
+
+// withLogins turns logging in on for the test, with the -auth credentials u:p
+func withLogins(t *testing.T) {
+	t.Helper()
+	if err := setCredentials("u:p", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setCredentials("", "") })
+}
+
+// as returns r as sent by the user name with role
+func as(r *http.Request, name, role string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accountKey{}, &account{Name: name, Role: role}))
+}
+
+func TestInRoots(t *testing.T) {
+	fs, docs, other, outside := testRoots(t)
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{docs, true},
+		{filepath.Join(docs, "a.txt"), true},
+		{filepath.Join(docs, "missing", "new.txt"), true},
+		{filepath.Join(docs, "to-sub", "x"), true},
+		{filepath.Join(docs, "to-other", "b.txt"), true},
+		{filepath.Join(other, "b.txt"), true},
+		{outside, false},
+		{filepath.Join(outside, "secret.txt"), false},
+		{filepath.Join(docs, "..", "outside", "secret.txt"), false},
+		{filepath.Join(docs, "out"), false},
+		{filepath.Join(docs, "out", "secret.txt"), false},
+		{filepath.Join(docs, "out", "new.txt"), false},
+		{filepath.Join(docs, "out-file"), false},
+		{filepath.Join(docs, "out-rel", "secret.txt"), false},
+		{filepath.Join(docs, "dangling"), false},
+		{filepath.Join(docs, "dang-rel"), false},
+		{filepath.Join(docs, "dang-in"), true},
+		{filepath.Join(docs, casDirName), false},
+		{filepath.Join(docs, casDirName, "blob"), false},
+		{filepath.Join(docs, "to-cas", "blob"), false},
+		{filepath.Dir(docs), false},
+	}
+	for _, tt := range tests {
+		if got := fs.inRoots(tt.path); got != tt.want {
+			t.Errorf("inRoots(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	fs, docs, other, _ := testRoots(t)
+	tests := []struct {
+		path, want string
+	}{
+		{"/docs", docs},
+		{"/docs/a.txt", filepath.Join(docs, "a.txt")},
+		{"docs/a.txt", filepath.Join(docs, "a.txt")},
+		{"//docs//sub/", filepath.Join(docs, "sub")},
+		{"/other/b.txt", filepath.Join(other, "b.txt")},
+		{"/docs/..", docs},
+		{"/docs/../other/b.txt", filepath.Join(docs, "other", "b.txt")},
+		{"/docs/../../outside/secret.txt", filepath.Join(docs, "outside", "secret.txt")},
+		{"/docs/sub/../../../etc/passwd", filepath.Join(docs, "etc", "passwd")},
+		{"/docs/./a.txt", filepath.Join(docs, "a.txt")},
+		{"/..", ""},
+		{"/../docs/a.txt", ""},
+		{"/outside/secret.txt", ""},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := fs.localPath(tt.path); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestJailMiddleware(t *testing.T) {
+	fs, docs, other, _ := testRoots(t)
+	var got string
+	h := fs.jailMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("path")
+	}))
+	tests := []struct {
+		query  string
+		status int
+		path   string // what the handler sees
+	}{
+		{"path=/docs/a.txt", 200, filepath.Join(docs, "a.txt")},
+		{"path=/other/b.txt", 200, filepath.Join(other, "b.txt")},
+		{"path=/docs/../../outside/secret.txt", 200, filepath.Join(docs, "outside", "secret.txt")},
+		{"path=%2Fdocs%2F..%2F..%2Foutside%2Fsecret.txt", 200, filepath.Join(docs, "outside", "secret.txt")},
+		{"path=/docs/%2e%2e/%2e%2e/outside", 200, filepath.Join(docs, "outside")},
+		{"path=%2F..%2Foutside%2Fsecret.txt", 404, ""},
+		{"path=/docs/to-other/b.txt", 200, filepath.Join(docs, "to-other", "b.txt")},
+		{"path=/docs/out/secret.txt", 403, ""},
+		{"path=/docs/out%2Fsecret.txt", 403, ""},
+		{"path=/docs/out-file", 403, ""},
+		{"path=/docs/out-rel/secret.txt", 403, ""},
+		{"path=/docs/dangling", 403, ""},
+		{"path=/docs/dang-rel", 403, ""},
+		{"path=/docs/.cas/blob", 403, ""},
+		{"folder=/docs/out", 403, ""},
+		{"root=/docs/out", 403, ""},
+		{"path=/docs/a.txt&path=/docs/out/secret.txt", 403, ""},
+		{"path=/outside/secret.txt", 404, ""},
+	}
+	for _, tt := range tests {
+		got = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/file?"+tt.query, nil))
+		if w.Code != tt.status || got != tt.path {
+			t.Errorf("%s: got %d with path %q, want %d with %q", tt.query, w.Code, got, tt.status, tt.path)
+		}
+	}
+}
+
+// A link into another root is only as open as that root
+func TestLinkedRootAccess(t *testing.T) {
+	fs, docs, other, _ := testRoots(t)
+	own, linked := filepath.Join(docs, "a.txt"), filepath.Join(docs, "to-other", "b.txt")
+	anon := httptest.NewRequest("GET", "/api/file", nil)
+
+	configure(t, fs, docs, other, rootConfig{Path: other, Visibility: visibilityPrivate})
+	if fs.visibleTo(anon, linked) || fs.canRead(anon, linked) {
+		t.Error("a link into a private root is visible to anonymous visitors")
+	}
+	if !fs.visibleTo(anon, own) {
+		t.Error("a file of the public root is hidden")
+	}
+
+	configure(t, fs, docs, other, rootConfig{Path: other, ReadOnly: true})
+	if !fs.readOnly(linked) || fs.canWrite(anon, linked) {
+		t.Error("a link into a read-only root is writable")
+	}
+	if fs.readOnly(own) || !fs.canWrite(anon, own) {
+		t.Error("a file of the writable root is read-only")
+	}
+
+	configure(t, fs, docs, other, rootConfig{Path: docs, Access: accessPublicRead})
+	if fs.publicRead(linked) {
+		t.Error("a link from a public-read root into another counts as public-read")
+	}
+	if !fs.publicRead(own) {
+		t.Error("a file of the public-read root isn't public-read")
+	}
+
+	configure(t, fs, docs, other, rootConfig{Path: other, Access: accessPublicRead})
+	if fs.canWrite(anon, linked) {
+		t.Error("a link into a public-read root is writable by anonymous visitors")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client talks to a bucket through the S3 REST API, which the XML API of
+// Google Cloud Storage follows too
+type s3Client struct {
+	bucket    string
+	endpoint  *url.URL
+	pathStyle bool // the bucket in the path rather than the host name
+	// meta is the prefix of the provider's own headers, x-amz- or x-goog-
+	meta   string
+	sign   func(req *http.Request) error
+	client *http.Client
+}
+
+// awsCredentials are the keys requests to S3 are signed with
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newS3Client is the client of an s3:// bucket. Credentials, region and
+// endpoint are taken from the environment like the AWS tools do:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or the
+// profile AWS_PROFILE (else "default") of ~/.aws/credentials; AWS_REGION or
+// the profile's region in ~/.aws/config; AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL for S3 compatible stores like MinIO.
+func newS3Client(bucket string) (objectClient, error) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	creds := awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey == "" {
+		file := awsFile("AWS_SHARED_CREDENTIALS_FILE", "credentials")
+		section := readINISection(file, profile)
+		creds = awsCredentials{section["aws_access_key_id"], section["aws_secret_access_key"], section["aws_session_token"]}
+		if creds.accessKey == "" || creds.secretKey == "" {
+			return nil, fmt.Errorf("s3://%s: no AWS credentials in the environment or %s", bucket, file)
+		}
+	}
+	config := readINISection(awsFile("AWS_CONFIG_FILE", "config"), "profile "+profile)
+	if profile == "default" {
+		config = readINISection(awsFile("AWS_CONFIG_FILE", "config"), "default")
+	}
+	region := firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), config["region"], "us-east-1")
+
+	c := &s3Client{bucket: bucket, meta: "x-amz-", client: &http.Client{}}
+	if endpoint := firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), config["endpoint_url"]); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		c.endpoint, c.pathStyle = u, true
+	} else {
+		c.endpoint = &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+		// Names with dots don't match the certificate as host names
+		c.pathStyle = strings.Contains(bucket, ".")
+	}
+	c.sign = func(req *http.Request) error {
+		signV4(req, creds, region, "s3", time.Now())
+		return nil
+	}
+	return c, nil
+}
+
+// awsFile is a file of the AWS tools, named by env or in ~/.aws
+func awsFile(env, name string) string {
+	if p := os.Getenv(env); p != "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".aws", name)
+}
+
+// readINISection returns the keys of a section of an INI file, none if the
+// file or section is missing
+func readINISection(file, section string) map[string]string {
+	keys := make(map[string]string)
+	f, err := os.Open(file)
+	if err != nil {
+		return keys
+	}
+	defer f.Close()
+	in := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == section
+		case in:
+			if k, v, ok := strings.Cut(line, "="); ok {
+				keys[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return keys
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// s3Escape URI-encodes s as the S3 signature wants it, keeping "/" if asked
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters sorted and escaped, as they are signed
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signV4 signs req with AWS Signature Version 4. The body isn't hashed, so
+// it can be streamed.
+func signV4(req *http.Request, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if req.Body == nil || req.Body == http.NoBody {
+		payloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + creds.secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// request sends a signed request for key, "" for the bucket
+func (c *s3Client) request(method, key string, q url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *c.endpoint
+	p := "/" + key
+	if c.pathStyle {
+		p = "/" + c.bucket + p
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + p
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + s3Escape(p, true)
+	u.RawQuery = s3Query(q)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	if err := c.sign(req); err != nil {
+		return nil, err
+	}
+	return c.client.Do(req)
+}
+
+func (c *s3Client) list(prefix string, recursive bool, limit int) ([]objectInfo, []string, error) {
+	var objects []objectInfo
+	var prefixes []string
+	q := url.Values{"prefix": {prefix}}
+	if !recursive {
+		q.Set("delimiter", "/")
+	}
+	if limit > 0 {
+		q.Set("max-keys", strconv.Itoa(limit))
+	}
+	for {
+		resp, err := c.request(http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, nil, objectHTTPError("list", c.bucket+"/"+prefix, resp)
+		}
+		var result struct {
+			IsTruncated bool
+			NextMarker  string
+			Contents    []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			CommonPrefixes []struct{ Prefix string }
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("list %s/%s: %v", c.bucket, prefix, err)
+		}
+		last := ""
+		for _, o := range result.Contents {
+			objects = append(objects, objectInfo{key: o.Key, size: o.Size, modified: o.LastModified})
+			last = max(last, o.Key)
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+			last = max(last, p.Prefix)
+		}
+		if !result.IsTruncated || limit > 0 {
+			return objects, prefixes, nil
+		}
+		q.Set("marker", firstNonEmpty(result.NextMarker, last))
+	}
+}
+
+func (c *s3Client) head(key string) (objectInfo, error) {
+	resp, err := c.request(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectInfo{}, objectHTTPError("stat", key, resp)
+	}
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return objectInfo{key: key, size: resp.ContentLength, modified: modified}, nil
+}
+
+func (c *s3Client) get(key string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if n < 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	} else {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	}
+	resp, err := c.request(http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && off == 0) {
+		defer resp.Body.Close()
+		return nil, objectHTTPError("read", key, resp)
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) put(key string, r io.Reader, size int64) error {
+	resp, err := c.request(http.MethodPut, key, nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectHTTPError("write", key, resp)
+	}
+	return nil
+}
+
+func (c *s3Client) delete(key string) error {
+	resp, err := c.request(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return objectHTTPError("remove", key, resp)
+	}
+	return nil
+}
+
+func (c *s3Client) copy(from, to string) error {
+	header := http.Header{}
+	header.Set(c.meta+"copy-source", c.bucket+"/"+s3Escape(from, true))
+	resp, err := c.request(http.MethodPut, to, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A copy failing late is answered with 200 and an error in the body
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK || xmlErrorMessage(body) != "" {
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		return objectHTTPError("copy", from, resp)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sandboxCSP is sent with every /sandbox response. The sandbox directive gives
+// the document an opaque origin, so even when opened directly it can't read the
+// app's cookies or call the API; scripts, forms and network access are off and
+// only inline styles and data: images and fonts are allowed.
+const sandboxCSP = "sandbox; default-src 'none'; style-src 'unsafe-inline'; img-src data:; font-src data:; form-action 'none'; frame-ancestors 'self'"
+
+// sandboxURL returns the /sandbox URL that renders path as an isolated page,
+// signed like its /api/raw URL
+func (fs *FileServer) sandboxURL(path string) string {
+	return "/sandbox" + strings.TrimPrefix(fs.rawURL(path), "/api/raw")
+}
+
+// renderHTML shows an HTML file as a page in a sandboxed iframe. It isn't mapped
+// to any extension by default; enable it with a previewer in the config.
+func renderHTML(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":    "html",
+		"content": p.SandboxURL,
+	})
+}
+
+// API: HTML file rendered as an isolated page, for the viewer's sandboxed iframe
+func (fs *FileServer) handleSandbox(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.FromSlash(path)
+	if !fs.inRoots(path) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	if !fs.rawAllowed(r, path) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	var f *os.File
+	var err error
+	var modified time.Time
+	if archive, entry, ok := splitArchivePath(path); ok {
+		if !fs.inRoots(archive) {
+			httpError(w, "Path is not inside a served folder", 403)
+			return
+		}
+		var e archiveEntry
+		if f, e, err = openArchiveEntry(r.Context(), archive, entry); err != nil {
+			httpError(w, "File not found", 404)
+			return
+		}
+		defer closeTemp(f)
+		modified = e.Modified
+	} else {
+		if f, err = os.Open(path); err != nil {
+			httpError(w, "File not found", 404)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			httpError(w, "Not a file", 400)
+			return
+		}
+		modified = fi.ModTime()
+	}
+	ct := detectFileContentType(f, path)
+	if !mimeMatch("text/html", ct) && !mimeMatch("application/xhtml+xml", ct) {
+		httpError(w, "Not an HTML file", 415)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Security-Policy", sandboxCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.ServeContent(w, r, filepath.Base(path), modified, f)
+}
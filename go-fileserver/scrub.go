@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	scrubManifestKey = "scrub-manifest"
+	scrubReportKey   = "scrub-report"
+)
+
+// scrubReport is the outcome of one integrity scrub
+type scrubReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Running  bool      `json:"running"`
+	Canceled bool      `json:"canceled,omitempty"`
+	Job      string    `json:"job,omitempty"` // ID in /api/jobs
+	Checked  int       `json:"checked"`
+	Added    int       `json:"added"`
+	// Corrupted files have different content but the same size and mtime,
+	// i.e. they changed without anyone writing to them.
+	Corrupted []string `json:"corrupted"`
+	Modified  []string `json:"modified"` // changed with a new mtime/size; manifest updated
+	Missing   []string `json:"missing"`  // in the manifest but gone from disk
+	Errors    []string `json:"errors"`
+}
+
+// scrubber re-hashes every file under the served roots and compares it with the
+// checksum manifest from the previous run.
+type scrubber struct {
+	fs       *FileServer
+	mu       sync.Mutex
+	running  bool
+	last     *scrubReport
+	manifest map[string]contentEntry
+}
+
+func newScrubber(fs *FileServer) *scrubber {
+	s := &scrubber{fs: fs, manifest: make(map[string]contentEntry)}
+	if err := loadState(scrubManifestKey, &s.manifest); err != nil {
+		log.Printf("Scrub: ignoring unreadable manifest: %v", err)
+		s.manifest = make(map[string]contentEntry)
+	}
+	var last scrubReport
+	if err := loadState(scrubReportKey, &last); err == nil && !last.Started.IsZero() {
+		last.Running = false
+		s.last = &last
+	}
+	return s
+}
+
+// schedule runs a scrub every interval
+func (s *scrubber) schedule(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			s.start()
+		}
+	}()
+}
+
+// start begins a scrub in the background unless one is already running
+func (s *scrubber) start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	rep := &scrubReport{Started: time.Now(), Running: true}
+	s.last = rep
+	j := s.fs.jobs.start("scrub", "Integrity scrub", func(j *job) (interface{}, error) {
+		return nil, s.run(j, rep)
+	})
+	rep.Job = j.ID
+	return true
+}
+
+func (s *scrubber) run(j *job, rep *scrubReport) error {
+	seen := make(map[string]bool)
+	canceled := false
+	for _, root := range s.fs.folderList() {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		err = filepath.Walk(abs, func(p string, fi os.FileInfo, err error) error {
+			if cerr := j.checkpoint(); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				s.update(func() { rep.Errors = append(rep.Errors, errorMessage(err)) })
+				return nil
+			}
+			if fi.IsDir() {
+				if isInternal(fi.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			seen[p] = true
+			j.add(0, s.fs.publicPath(p))
+			sum, err := hashFile(p)
+			if err != nil {
+				s.update(func() { rep.Errors = append(rep.Errors, errorMessage(err)) })
+				return nil
+			}
+			now := contentEntry{Hash: sum, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+			s.update(func() {
+				rep.Checked++
+				old, ok := s.manifest[p]
+				switch {
+				case !ok:
+					rep.Added++
+				case old.Hash == sum:
+				case old.current(fi):
+					rep.Corrupted = append(rep.Corrupted, s.fs.publicPath(p))
+					log.Printf("Scrub: CORRUPTED %s (content changed, size and mtime did not)", p)
+					// Keep the good checksum so the file is reported again until fixed
+					return
+				default:
+					rep.Modified = append(rep.Modified, s.fs.publicPath(p))
+				}
+				s.manifest[p] = now
+			})
+			j.progress(func() { j.ItemsDone++ })
+			return nil
+		})
+		if err == errJobCanceled {
+			canceled = true
+			break
+		}
+	}
+
+	s.update(func() {
+		rep.Canceled = canceled
+		for p := range s.manifest {
+			// An interrupted scrub hasn't seen everything, so nothing counts as missing
+			if !seen[p] && !canceled {
+				rep.Missing = append(rep.Missing, s.fs.publicPath(p))
+				delete(s.manifest, p)
+			}
+		}
+		rep.Finished = time.Now()
+		rep.Running = false
+		s.running = false
+		if err := saveState(scrubManifestKey, s.manifest); err != nil {
+			log.Printf("Scrub: saving manifest failed: %v", err)
+		}
+		saveState(scrubReportKey, rep)
+	})
+	log.Printf("Scrub: checked %d files, %d corrupted, %d modified, %d missing, %d new",
+		rep.Checked, len(rep.Corrupted), len(rep.Modified), len(rep.Missing), rep.Added)
+	if canceled {
+		return errJobCanceled
+	}
+	return nil
+}
+
+func (s *scrubber) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// API: Integrity scrub. GET returns the last report, POST starts a scrub now.
+func (fs *FileServer) handleScrub(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fs.scrub.mu.Lock()
+		defer fs.scrub.mu.Unlock()
+		if fs.scrub.last == nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"report": nil})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"report": fs.scrub.last})
+	case http.MethodPost:
+		if !requireRole(w, r, roleAdmin) {
+			return
+		}
+		started := fs.scrub.start()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": started, "alreadyRunning": !started})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultSearchLimit caps the number of results a search returns
+	defaultSearchLimit = 1000
+)
+
+var errSearchLimit = errors.New("search result limit reached")
+
+// searchQuery describes a filename search: a pattern, the roots to walk and
+// optional filters using the same parameters as /api/tree.
+type searchQuery struct {
+	Name    string            `json:"name,omitempty"`
+	Pattern string            `json:"pattern"`
+	Roots   []string          `json:"roots,omitempty"`
+	Filters map[string]string `json:"filters,omitempty"`
+}
+
+// searchResult is one match returned by runSearch
+type searchResult struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+// publicResults turns the paths of results into paths as clients see them
+// (see publicPath), in place
+func (fs *FileServer) publicResults(results []searchResult) []searchResult {
+	for i := range results {
+		results[i].Path = fs.publicPath(results[i].Path)
+	}
+	return results
+}
+
+// filter parses the query's filters
+func (q searchQuery) filter() (*fileFilter, error) {
+	vals := url.Values{}
+	for k, v := range q.Filters {
+		vals.Set(k, v)
+	}
+	return parseFileFilter(vals)
+}
+
+// matchName reports whether name matches pattern: a glob if the pattern contains
+// glob characters, otherwise a case-insensitive substring.
+func matchName(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name))
+		return ok
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+}
+
+// runSearch walks the query roots (all served folders when none are given) and
+// collects up to limit matches. The walk stops early when ctx is cancelled.
+func (fs *FileServer) runSearch(ctx context.Context, q searchQuery, limit int) ([]searchResult, bool, error) {
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	var results []searchResult
+	truncated, err := fs.streamSearch(ctx, q, limit, func(res searchResult) error {
+		results = append(results, res)
+		return nil
+	})
+	return results, truncated, err
+}
+
+// streamSearch walks the query roots like runSearch and hands each match to
+// emit as soon as it is found. A limit of 0 means no limit.
+func (fs *FileServer) streamSearch(ctx context.Context, q searchQuery, limit int, emit func(searchResult) error) (bool, error) {
+	filter, err := q.filter()
+	if err != nil {
+		return false, err
+	}
+	roots := q.Roots
+	if len(roots) == 0 {
+		roots = fs.folderList()
+	}
+
+	found := 0
+	for _, root := range roots {
+		root = filepath.FromSlash(root)
+		// Object stores would take a request per folder
+		if !fs.inRoots(root) || fs.storageFor(root) != localDisk {
+			continue
+		}
+		noHidden := fs.hidesDotFiles(root)
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil || p == root {
+				return nil
+			}
+			if fi.IsDir() && (isInternal(fi.Name()) || noHidden && strings.HasPrefix(fi.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			if noHidden && strings.HasPrefix(fi.Name(), ".") {
+				return nil
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				// Described by what it points to, but not followed
+				if ti, err := os.Stat(p); err == nil {
+					fi = ti
+				}
+			}
+			if !matchName(q.Pattern, fi.Name()) || !filter.match(fi.Name(), fi) {
+				return nil
+			}
+			t := "file"
+			if fi.IsDir() {
+				t = "folder"
+			}
+			err = emit(searchResult{
+				Name:     fi.Name(),
+				Path:     filepath.ToSlash(p),
+				Type:     t,
+				Size:     fi.Size(),
+				Modified: fi.ModTime().Unix(),
+			})
+			if err != nil {
+				return err
+			}
+			if found++; limit > 0 && found >= limit {
+				return errSearchLimit
+			}
+			return nil
+		})
+		if err == errSearchLimit {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// maxSearchLimit is the most results /api/search returns at once
+const maxSearchLimit = 10000
+
+// API: GET /api/search?q= searches file and folder names below the served
+// folders, or below the folders given with root= (repeatable). q is a glob
+// if it contains wildcards, otherwise a case-insensitive substring. limit
+// caps the results (default 1000); the filters of /api/tree apply too. The
+// walk stops when the client goes away. With mode=content the contents of
+// text files are searched instead, see searchContent.
+func (fs *FileServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+	mode := vals.Get("mode")
+	if mode != "" && mode != "name" && mode != "content" {
+		httpError(w, "Invalid mode", 400)
+		return
+	}
+	q := searchQuery{Pattern: vals.Get("q"), Filters: map[string]string{}}
+	if q.Pattern == "" {
+		httpError(w, "Missing q", 400)
+		return
+	}
+	for _, k := range []string{"type", "ext", "minSize", "maxSize", "modifiedAfter", "modifiedBefore"} {
+		if v := vals.Get(k); v != "" {
+			q.Filters[k] = v
+		}
+	}
+	if mode == "content" {
+		// q is the text to look for; name picks the files
+		q.Pattern = vals.Get("name")
+		q.Filters["type"] = "file"
+	}
+	if _, err := q.filter(); err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	for _, root := range vals["root"] {
+		if !fs.requireInRoots(w, root) || !fs.requireRead(w, r, root) {
+			return
+		}
+		q.Roots = append(q.Roots, root)
+	}
+	q.Roots = fs.visibleRoots(r, q.Roots)
+	if len(q.Roots) == 0 {
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []searchResult{}, "truncated": false})
+		return
+	}
+	limit := defaultSearchLimit
+	if v := vals.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxSearchLimit {
+			httpError(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+	if mode == "content" {
+		fs.searchContent(w, r, q, vals.Get("q"), limit)
+		return
+	}
+	if fs.index != nil && fs.index.isReady() {
+		results, truncated, err := fs.index.searchNames(q, limit)
+		if err != nil {
+			writeError(w, err, 400)
+			return
+		}
+		shown := results[:0]
+		for _, res := range results {
+			if !fs.hiddenPath(filepath.FromSlash(res.Path)) {
+				shown = append(shown, res)
+			}
+		}
+		results = fs.publicResults(shown)
+		if wantsNDJSON(r) {
+			nw := newNDJSONWriter(w)
+			for _, res := range results {
+				nw.write(res)
+			}
+			nw.flush()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results, "truncated": truncated})
+		return
+	}
+	if wantsNDJSON(r) {
+		fs.streamSearchNDJSON(w, r, q)
+		return
+	}
+	results, truncated, err := fs.runSearch(r.Context(), q, limit)
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	if results == nil {
+		results = []searchResult{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": fs.publicResults(results), "truncated": truncated})
+}
+
+// savedSearch is a named query with the account that saved it
+type savedSearch struct {
+	searchQuery
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+// canUseSavedSearch reports whether r may run, replace and remove s: admins
+// and whoever saved it, everyone without logins
+func canUseSavedSearch(r *http.Request, s savedSearch) bool {
+	if !authEnabled() {
+		return true
+	}
+	a := accountOf(r)
+	return a != nil && (a.has(roleAdmin) || a.Name == s.CreatedBy)
+}
+
+// savedRoots resolves the roots of a saved query for r: those still served
+// that r may read, or all readable ones if it names none. It returns nil if
+// none are left.
+func (fs *FileServer) savedRoots(r *http.Request, q searchQuery) []string {
+	var roots []string
+	for _, root := range q.Roots {
+		// Roots that are no longer served are left out
+		if local := fs.localPath(root); local != "" {
+			roots = append(roots, local)
+		}
+	}
+	if len(q.Roots) > 0 && len(roots) == 0 {
+		return nil
+	}
+	return fs.visibleRoots(r, roots)
+}
+
+// savedSearches persists named queries in the store, one record each
+type savedSearches struct {
+	mu      sync.Mutex
+	queries map[string]savedSearch
+}
+
+func loadSavedSearches() *savedSearches {
+	s := &savedSearches{queries: make(map[string]savedSearch)}
+	err := db.each(bucketSearches, func(name string, data []byte) error {
+		var q savedSearch
+		if err := json.Unmarshal(data, &q); err != nil {
+			return err
+		}
+		s.queries[name] = q
+		return nil
+	})
+	if err != nil {
+		log.Printf("Saved searches: ignoring unreadable state: %v", err)
+	}
+	return s
+}
+
+func (s *savedSearches) get(name string) (savedSearch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queries[name]
+	return q, ok
+}
+
+func (s *savedSearches) list() []savedSearch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]savedSearch, 0, len(s.queries))
+	for _, q := range s.queries {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *savedSearches) put(q savedSearch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := db.put(bucketSearches, q.Name, q); err != nil {
+		return err
+	}
+	s.queries[q.Name] = q
+	return nil
+}
+
+func (s *savedSearches) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := db.delete(bucketSearches, name); err != nil {
+		return err
+	}
+	delete(s.queries, name)
+	return nil
+}
+
+// API: Saved searches, each kept for the account that saved it
+// GET lists them, POST saves one, GET /<name> runs it and DELETE /<name> removes it.
+func (fs *FileServer) handleSavedSearch(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/search/saved"), "/")
+	if r.Method != http.MethodGet && !requireRole(w, r, roleReadOnly) {
+		return
+	}
+
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list := []savedSearch{}
+			for _, s := range fs.saved.list() {
+				if canUseSavedSearch(r, s) {
+					list = append(list, s)
+				}
+			}
+			json.NewEncoder(w).Encode(list)
+		case http.MethodPost:
+			var q savedSearch
+			if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+				httpError(w, "Invalid JSON body", 400)
+				return
+			}
+			if q.Name == "" || strings.Contains(q.Name, "/") {
+				httpError(w, "Invalid name", 400)
+				return
+			}
+			if _, err := q.filter(); err != nil {
+				writeError(w, err, 400)
+				return
+			}
+			// Stored as the client sent them, resolved when the search runs
+			roots := append([]string(nil), q.Roots...)
+			if !fs.resolvePathList(w, roots) || !fs.requireInRoots(w, roots...) || !fs.requireRead(w, r, roots...) || !fs.requireLocal(w, r, roots...) {
+				return
+			}
+			if old, ok := fs.saved.get(q.Name); ok && !canUseSavedSearch(r, old) {
+				apiError(w, http.StatusConflict, codeConflict, "Another account has a saved search named "+q.Name)
+				return
+			}
+			q.CreatedBy = ""
+			if a := accountOf(r); a != nil {
+				q.CreatedBy = a.Name
+			}
+			if err := fs.saved.put(q); err != nil {
+				writeError(w, err, 500)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		default:
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q, ok := fs.saved.get(name)
+		if !ok || !canUseSavedSearch(r, q) {
+			httpError(w, "Saved search not found", 404)
+			return
+		}
+		run := q.searchQuery
+		run.Roots = fs.savedRoots(r, q.searchQuery)
+		if len(run.Roots) == 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"query": q, "results": []searchResult{}, "truncated": false})
+			return
+		}
+		if wantsNDJSON(r) {
+			fs.streamSearchNDJSON(w, r, run)
+			return
+		}
+		results, truncated, err := fs.runSearch(r.Context(), run, defaultSearchLimit)
+		if err != nil {
+			writeError(w, err, 400)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"query":     q,
+			"results":   fs.publicResults(results),
+			"truncated": truncated,
+		})
+	case http.MethodDelete:
+		if q, ok := fs.saved.get(name); !ok || !canUseSavedSearch(r, q) {
+			httpError(w, "Saved search not found", 404)
+			return
+		}
+		if err := fs.saved.remove(name); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// callSaved calls the saved searches API as the account name with role,
+// anonymously if name is empty
+func callSaved(fs *FileServer, method, url, body, name, role string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, url, strings.NewReader(body))
+	} else {
+		r = httptest.NewRequest(method, url, nil)
+	}
+	if name != "" {
+		r = as(r, name, role)
+	}
+	w := httptest.NewRecorder()
+	fs.handleSavedSearch(w, r)
+	return w
+}
+
+// Saved searches belong to the account that saved them
+func TestSavedSearchOwner(t *testing.T) {
+	fs, _, _, _ := testServer(t)
+	withLogins(t)
+	const logs = `{"name":"logs","pattern":"a.txt","roots":["/docs"]}`
+
+	if w := callSaved(fs, "POST", "/api/search/saved", logs, "", ""); w.Code != 401 {
+		t.Errorf("anonymous save = %d, want 401", w.Code)
+	}
+	if w := callSaved(fs, "POST", "/api/search/saved", logs, "alice", roleReadWrite); w.Code != 200 {
+		t.Fatalf("save = %d: %s", w.Code, w.Body)
+	}
+
+	names := func(name, role string) []string {
+		var list []savedSearch
+		json.NewDecoder(callSaved(fs, "GET", "/api/search/saved", "", name, role).Body).Decode(&list)
+		var out []string
+		for _, s := range list {
+			out = append(out, s.Name)
+		}
+		return out
+	}
+	if got := names("alice", roleReadOnly); len(got) != 1 || got[0] != "logs" {
+		t.Errorf("alice sees %v", got)
+	}
+	if got := names("root", roleAdmin); len(got) != 1 {
+		t.Errorf("admin sees %v", got)
+	}
+	if got := names("bob", roleReadWrite); len(got) != 0 {
+		t.Errorf("bob sees %v", got)
+	}
+
+	if w := callSaved(fs, "GET", "/api/search/saved/logs", "", "bob", roleReadWrite); w.Code != 404 {
+		t.Errorf("bob running = %d, want 404", w.Code)
+	}
+	if w := callSaved(fs, "DELETE", "/api/search/saved/logs", "", "bob", roleReadWrite); w.Code != 404 {
+		t.Errorf("bob removing = %d, want 404", w.Code)
+	}
+	if w := callSaved(fs, "POST", "/api/search/saved", logs, "bob", roleReadWrite); w.Code != 409 {
+		t.Errorf("bob replacing = %d, want 409", w.Code)
+	}
+
+	var run struct {
+		Query   savedSearch    `json:"query"`
+		Results []searchResult `json:"results"`
+	}
+	w := callSaved(fs, "GET", "/api/search/saved/logs", "", "alice", roleReadOnly)
+	json.NewDecoder(w.Body).Decode(&run)
+	if w.Code != 200 || len(run.Results) != 1 || run.Results[0].Path != "/docs/a.txt" || run.Query.CreatedBy != "alice" {
+		t.Errorf("alice running = %d, %+v", w.Code, run)
+	}
+	if w := callSaved(fs, "DELETE", "/api/search/saved/logs", "", "alice", roleReadOnly); w.Code != 200 {
+		t.Errorf("alice removing = %d, want 200", w.Code)
+	}
+}
+
+// A saved search whose folders are no longer served finds nothing, rather
+// than searching every folder
+func TestSavedSearchGoneRoots(t *testing.T) {
+	fs, _, _, _ := testServer(t)
+	if err := fs.saved.put(savedSearch{searchQuery: searchQuery{Name: "old", Pattern: "b.txt", Roots: []string{"/gone"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var run struct {
+		Results []searchResult `json:"results"`
+	}
+	w := callSaved(fs, "GET", "/api/search/saved/old", "", "", "")
+	json.NewDecoder(w.Body).Decode(&run)
+	if w.Code != 200 || len(run.Results) != 0 {
+		t.Errorf("search of a folder gone = %d, %v", w.Code, run.Results)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// searchIndexKey is the state document the search index is persisted to
+	searchIndexKey = "search-index"
+	// searchIndexDebounce batches filesystem events before folders are re-read
+	searchIndexDebounce = 2 * time.Second
+	// searchIndexSaveEvery is how often a changed index is written back to disk
+	searchIndexSaveEvery = time.Minute
+	// maxIndexedTerm is the longest word indexed. Files with longer ones are
+	// always searched by reading them.
+	maxIndexedTerm = 64
+)
+
+// indexedFile is what the search index knows about a file or folder
+type indexedFile struct {
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"mtime"` // UnixNano
+	Dir     bool     `json:"dir,omitempty"`
+	Text    bool     `json:"text,omitempty"` // a text file whose words are indexed
+	Long    bool     `json:"long,omitempty"` // has words longer than maxIndexedTerm
+	Terms   []string `json:"terms,omitempty"`
+}
+
+// current reports whether the entry still describes the file on disk
+func (f *indexedFile) current(fi os.FileInfo) bool {
+	return f.Dir == fi.IsDir() && f.Size == fi.Size() && f.ModTime == fi.ModTime().UnixNano()
+}
+
+// indexedInfo presents an index entry as an os.FileInfo for fileFilter
+type indexedInfo struct {
+	name string
+	f    *indexedFile
+}
+
+func (i indexedInfo) Name() string       { return i.name }
+func (i indexedInfo) Size() int64        { return i.f.Size }
+func (i indexedInfo) ModTime() time.Time { return time.Unix(0, i.f.ModTime) }
+func (i indexedInfo) IsDir() bool        { return i.f.Dir }
+func (i indexedInfo) Sys() interface{}   { return nil }
+func (i indexedInfo) Mode() os.FileMode {
+	if i.f.Dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// searchIndex keeps the names of all files under the served roots and the
+// words in their text, so /api/search can answer without walking. Like the
+// size index it is loaded from disk at startup, brought up to date by a
+// background scan (which only reads files whose size or mtime changed) and
+// then kept current with fsnotify events.
+type searchIndex struct {
+	mu       sync.RWMutex
+	files    map[string]*indexedFile
+	postings map[string]map[string]bool // word -> paths of the files containing it
+	ready    bool                       // the first scan finished
+	changed  bool
+
+	watcher *fsnotify.Watcher
+	dirtyMu sync.Mutex
+	dirty   map[string]bool
+}
+
+func newSearchIndex(roots []string, jobs *jobManager, label func(string) string) (*searchIndex, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	x := &searchIndex{
+		files:    make(map[string]*indexedFile),
+		postings: make(map[string]map[string]bool),
+		watcher:  w,
+		dirty:    make(map[string]bool),
+	}
+	if err := loadState(searchIndexKey, &x.files); err != nil {
+		log.Printf("Search index: ignoring unreadable state: %v", err)
+		x.files = make(map[string]*indexedFile)
+	}
+	for p, f := range x.files {
+		x.link(p, f)
+	}
+
+	go x.watch()
+	x.scanRoots(roots, jobs, label)
+	go func() {
+		for range time.Tick(searchIndexSaveEvery) {
+			x.save()
+		}
+	}()
+	return x, nil
+}
+
+// scanRoots brings the index up to date for roots in a background job, at
+// startup and for folders a reload adds. label names a root in the job.
+func (x *searchIndex) scanRoots(roots []string, jobs *jobManager, label func(string) string) {
+	jobs.start("index", "Search index", func(j *job) (interface{}, error) {
+		j.progress(func() { j.ItemsTotal = len(roots) })
+		for _, root := range roots {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				continue
+			}
+			j.add(0, label(abs))
+			start := time.Now()
+			seen := make(map[string]bool)
+			x.scan(abs, seen)
+			x.forget(abs, seen)
+			log.Printf("Search index: %s scanned in %s (%d entries)", abs, time.Since(start).Round(time.Millisecond), len(seen))
+			j.progress(func() { j.ItemsDone++ })
+		}
+		x.mu.Lock()
+		x.ready = true
+		x.mu.Unlock()
+		x.save()
+		return nil, nil
+	})
+}
+
+// isReady reports whether the index covers the served folders yet
+func (x *searchIndex) isReady() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.ready
+}
+
+// link adds the words of f to the postings; the caller holds mu or owns x
+func (x *searchIndex) link(p string, f *indexedFile) {
+	for _, t := range f.Terms {
+		if x.postings[t] == nil {
+			x.postings[t] = make(map[string]bool)
+		}
+		x.postings[t][p] = true
+	}
+}
+
+// unlink removes p from the index; the caller holds mu
+func (x *searchIndex) unlink(p string) {
+	f, ok := x.files[p]
+	if !ok {
+		return
+	}
+	for _, t := range f.Terms {
+		delete(x.postings[t], p)
+		if len(x.postings[t]) == 0 {
+			delete(x.postings, t)
+		}
+	}
+	delete(x.files, p)
+	x.changed = true
+}
+
+// update indexes p unless the entry for it is still current
+func (x *searchIndex) update(p string, fi os.FileInfo) {
+	x.mu.RLock()
+	old, ok := x.files[p]
+	x.mu.RUnlock()
+	if ok && old.current(fi) {
+		return
+	}
+	f := &indexedFile{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Dir: fi.IsDir()}
+	if fi.Mode().IsRegular() && fi.Size() <= maxGrepFile {
+		f.Terms, f.Text, f.Long = readTerms(p)
+	}
+	x.mu.Lock()
+	x.unlink(p)
+	x.files[p] = f
+	x.link(p, f)
+	x.changed = true
+	x.mu.Unlock()
+}
+
+// scan indexes dir and everything below it, adding watches along the way and
+// noting the paths it saw
+func (x *searchIndex) scan(dir string, seen map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	if err := x.watcher.Add(dir); err != nil {
+		log.Printf("Search index: cannot watch %s: %v", dir, err)
+	}
+	for _, e := range entries {
+		if isInternal(e.Name()) {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		seen[p] = true
+		x.update(p, fi)
+		if e.IsDir() {
+			x.scan(p, seen)
+		}
+	}
+}
+
+// forget drops the entries below dir that weren't seen
+func (x *searchIndex) forget(dir string, seen map[string]bool) {
+	prefix := dir + string(filepath.Separator)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for p := range x.files {
+		if strings.HasPrefix(p, prefix) && !seen[p] {
+			x.unlink(p)
+		}
+	}
+}
+
+// watch collects fsnotify events and re-reads the affected folders in batches
+func (x *searchIndex) watch() {
+	tick := time.NewTicker(searchIndexDebounce)
+	defer tick.Stop()
+	for {
+		select {
+		case ev, ok := <-x.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			x.dirtyMu.Lock()
+			x.dirty[filepath.Dir(ev.Name)] = true
+			x.dirtyMu.Unlock()
+		case err, ok := <-x.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Search index: watcher error: %v", err)
+		case <-tick.C:
+			x.dirtyMu.Lock()
+			dirty := x.dirty
+			x.dirty = make(map[string]bool)
+			x.dirtyMu.Unlock()
+			for dir := range dirty {
+				x.refresh(dir)
+			}
+		}
+	}
+}
+
+// refresh re-reads one folder: changed files are indexed again, new folders
+// scanned and what is gone is dropped, with everything below it
+func (x *searchIndex) refresh(dir string) {
+	if hasInternal(dir) {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Folder is gone; its parent gets its own event
+		return
+	}
+	present := make(map[string]bool)
+	for _, e := range entries {
+		if isInternal(e.Name()) {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		present[p] = true
+		x.mu.RLock()
+		_, known := x.files[p]
+		x.mu.RUnlock()
+		x.update(p, fi)
+		if e.IsDir() && !known {
+			x.scan(p, make(map[string]bool))
+		}
+	}
+	prefix := dir + string(filepath.Separator)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for p := range x.files {
+		if strings.HasPrefix(p, prefix) && !present[ancestorBelow(dir, p)] {
+			x.unlink(p)
+		}
+	}
+}
+
+// save writes the index to the store if it changed since the last save
+func (x *searchIndex) save() {
+	x.mu.Lock()
+	if !x.changed {
+		x.mu.Unlock()
+		return
+	}
+	x.changed = false
+	err := saveState(searchIndexKey, x.files)
+	x.mu.Unlock()
+	if err != nil {
+		log.Printf("Search index: save failed: %v", err)
+	}
+}
+
+// readTerms returns the distinct words of the text file p. text is false for
+// binary files, long true if it has words too long to index.
+func readTerms(p string) (terms []string, text, long bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, false, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil || looksBinary(data[:min(len(data), 800)]) {
+		return nil, false, false
+	}
+	seen := make(map[string]bool)
+	for _, t := range splitTerms(string(data)) {
+		if len(t) > maxIndexedTerm {
+			long = true
+			continue
+		}
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms, true, long
+}
+
+// splitTerms lower-cases s and cuts it into words of letters and digits
+func splitTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// under reports whether p is one of roots or inside one
+func under(p string, roots []string) bool {
+	for _, root := range roots {
+		if p == root || strings.HasPrefix(p, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// absRoots turns the roots of a query into absolute paths
+func absRoots(roots []string) []string {
+	var out []string
+	for _, r := range roots {
+		if abs, err := filepath.Abs(filepath.FromSlash(r)); err == nil {
+			out = append(out, abs)
+		}
+	}
+	return out
+}
+
+// searchNames answers a file name search from the index, sorted by path
+func (x *searchIndex) searchNames(q searchQuery, limit int) ([]searchResult, bool, error) {
+	filter, err := q.filter()
+	if err != nil {
+		return nil, false, err
+	}
+	roots := absRoots(q.Roots)
+	x.mu.RLock()
+	var paths []string
+	for p, f := range x.files {
+		name := filepath.Base(p)
+		if under(p, roots) && matchName(q.Pattern, name) && filter.match(name, indexedInfo{name, f}) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	truncated := len(paths) > limit
+	if truncated {
+		paths = paths[:limit]
+	}
+	results := make([]searchResult, 0, len(paths))
+	for _, p := range paths {
+		f := x.files[p]
+		t := "file"
+		if f.Dir {
+			t = "folder"
+		}
+		results = append(results, searchResult{Name: filepath.Base(p), Path: filepath.ToSlash(p), Type: t, Size: f.Size, Modified: f.ModTime / int64(time.Second)})
+	}
+	x.mu.RUnlock()
+	return results, truncated, nil
+}
+
+// contentCandidates returns the text files that may contain text: those with,
+// for every word of it, an indexed word containing that word (the words at
+// its ends may be cut off), plus those with words too long to index. Sorted
+// by path. ok is false if text has no words to look up.
+func (x *searchIndex) contentCandidates(ctx context.Context, q searchQuery, text string) (paths []string, ok bool, err error) {
+	words := splitTerms(text)
+	if len(words) == 0 {
+		return nil, false, nil
+	}
+	for _, w := range words {
+		if len(w) > maxIndexedTerm {
+			return nil, false, nil
+		}
+	}
+	filter, err := q.filter()
+	if err != nil {
+		return nil, false, err
+	}
+	roots := absRoots(q.Roots)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var found map[string]bool
+	for _, w := range words {
+		hits := make(map[string]bool)
+		for t, ps := range x.postings {
+			if !strings.Contains(t, w) {
+				continue
+			}
+			for p := range ps {
+				if found == nil || found[p] {
+					hits[p] = true
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, true, ctx.Err()
+		}
+		found = hits
+	}
+	for p, f := range x.files {
+		if f.Long {
+			found[p] = true
+		}
+	}
+	for p := range found {
+		name := filepath.Base(p)
+		if under(p, roots) && matchName(q.Pattern, name) && filter.match(name, indexedInfo{name, x.files[p]}) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, true, nil
+}
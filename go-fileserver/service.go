@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/kardianos/service"
+)
+
+const defaultServiceName = "go-fileserver"
+
+// serviceProgram runs the server under the system service manager (Windows
+// SCM, systemd, launchd, ...)
+type serviceProgram struct{}
+
+func (serviceProgram) Start(s service.Service) error {
+	go serve()
+	return nil
+}
+
+func (serviceProgram) Stop(s service.Service) error {
+	return nil
+}
+
+// serviceLogWriter sends log output to the service logger, i.e. the Windows
+// event log
+type serviceLogWriter struct {
+	logger service.Logger
+}
+
+func (w serviceLogWriter) Write(p []byte) (int, error) {
+	return len(p), w.logger.Info(strings.TrimRight(string(p), "\n"))
+}
+
+// runServiceCommand implements `go-fileserver service <action> [-name <name>] [-- <server flags>]`.
+// install registers a service that runs the server with the given flags from
+// the current directory; uninstall, start, stop, restart and status manage it.
+// run is what the service manager invokes.
+func runServiceCommand(args []string) {
+	usage := "Usage: go-fileserver service install|uninstall|start|stop|restart|status|run [-name <name>] [-- <server flags>]"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+	action := args[0]
+	cmd := flag.NewFlagSet("service", flag.ExitOnError)
+	name := cmd.String("name", defaultServiceName, "Service name, to install several servers")
+	dir := cmd.String("dir", "", "Working directory of the service (default: the current directory)")
+	cmd.Parse(args[1:])
+	serverArgs := cmd.Args()
+	// Check the server flags now rather than when the service fails to start
+	flag.CommandLine.Parse(serverArgs)
+
+	workDir := *dir
+	if workDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		workDir = wd
+	}
+	cfg := &service.Config{
+		Name:             *name,
+		DisplayName:      "Go File Server (" + *name + ")",
+		Description:      "Serves " + *folders + " over HTTP",
+		Arguments:        append([]string{"service", "run", "-name", *name, "-dir", workDir, "--"}, serverArgs...),
+		WorkingDirectory: workDir,
+	}
+	svc, err := service.New(serviceProgram{}, cfg)
+	if err != nil {
+		log.Fatalf("Service: %v", err)
+	}
+
+	switch action {
+	case "run":
+		// The Windows service manager starts services in the system directory
+		if err := os.Chdir(workDir); err != nil {
+			log.Fatalf("Service: %v", err)
+		}
+		if runtime.GOOS == "windows" && !service.Interactive() {
+			if logger, err := svc.Logger(nil); err == nil {
+				log.SetFlags(0)
+				log.SetOutput(serviceLogWriter{logger})
+			}
+		}
+		if err := svc.Run(); err != nil {
+			log.Fatalf("Service: %v", err)
+		}
+	case "status":
+		status, err := svc.Status()
+		if err != nil {
+			log.Fatalf("Service %s: %v", *name, err)
+		}
+		switch status {
+		case service.StatusRunning:
+			fmt.Println("running")
+		case service.StatusStopped:
+			fmt.Println("stopped")
+		default:
+			fmt.Println("unknown")
+		}
+	case "install":
+		if *folders == "" && *cfgFile == "" {
+			log.Fatal("Service: no folders provided. Pass the server flags after --, e.g. -- -folders /srv/files or -- -config /etc/fileserver.yaml")
+		}
+		fallthrough
+	default:
+		if err := service.Control(svc, action); err != nil {
+			log.Fatalf("Service %s: %v", *name, err)
+		}
+		log.Printf("Service %s: %s done", *name, action)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// clientCookie identifies a browser across requests for per-client state such as the clipboard
+const clientCookie = "fileserver_client"
+
+// clientID returns the ID of the requesting browser, issuing a new one if it has none
+func clientID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(clientCookie); err == nil && len(c.Value) == 16 {
+		return c.Value
+	}
+	id := newJobID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     clientCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(365 * 24 * time.Hour),
+	})
+	return id
+}
+
+// authenticated reports whether the request belongs to a logged-in user
+// (see auth.go)
+func authenticated(r *http.Request) bool {
+	return accountOf(r) != nil
+}
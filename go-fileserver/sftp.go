@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// With -sftp-port the served folders are also reachable over SFTP (version 3,
+// as spoken by OpenSSH's sftp, WinSCP, FileZilla and IDEs), in the same tree
+// as WebDAV: / lists the served folders by name. Users log in with the same
+// credentials as over HTTP, an -auth user or stored account with its
+// password, or any name with the -token as password; without any of them
+// everyone is let in. What they may see and change is checked as for HTTP
+// requests.
+
+// sftpHostKeyFile holds the server's SSH host key
+const sftpHostKeyFile = "sftp_host_key"
+
+// loadSFTPHostKey reads the SSH host key, creating one on first use so
+// clients don't see the key change across restarts
+func loadSFTPHostKey() (ssh.Signer, error) {
+	path := statePath(sftpHostKeyFile)
+	if data, err := os.ReadFile(path); err == nil {
+		return ssh.ParsePrivateKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "fileserver")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// sftpRequest stands in for an HTTP request from the SFTP client at remote,
+// logged in as a (nil if anonymous), for the checks shared with HTTP
+func sftpRequest(remote net.Addr, a *account) *http.Request {
+	r := &http.Request{Method: "SFTP", URL: &url.URL{Path: "/"}, Header: http.Header{}, RemoteAddr: remote.String()}
+	if a != nil {
+		r = r.WithContext(context.WithValue(context.Background(), accountKey{}, a))
+	}
+	return r
+}
+
+// serveSFTP listens on addr and serves SFTP sessions
+func (fs *FileServer) serveSFTP(addr string) error {
+	key, err := loadSFTPHostKey()
+	if err != nil {
+		return fmt.Errorf("host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		NoClientAuth: true,
+		NoClientAuthCallback: func(c ssh.ConnMetadata) (*ssh.Permissions, error) {
+			if authEnabled() {
+				return nil, errors.New("login required")
+			}
+			return nil, nil
+		},
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			a, reason := passwordAccount(c.User(), string(password))
+			if token := credentials.Load().token; a == nil && token != "" && secretEqual(string(password), token) {
+				a = ownerAccount("token")
+			}
+			if a == nil {
+				fs.logAuthFailure(sftpRequest(c.RemoteAddr(), nil), c.User(), reason)
+				return nil, errors.New(reason)
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"user": a.Name, "role": a.Role}}, nil
+		},
+	}
+	config.AddHostKey(key)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving SFTP on %s (host key %s)", ln.Addr(), ssh.FingerprintSHA256(key.PublicKey()))
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		// The rules for HTTP clients apply before the handshake
+		if fs.geo != nil {
+			ip := clientIP(sftpRequest(c.RemoteAddr(), nil))
+			if ok, cc := fs.geo.allowed(ip); !ok {
+				if cc == "" {
+					cc = "unknown"
+				}
+				fs.notef("GeoIP: blocked %s (%s) SFTP", ip, cc)
+				c.Close()
+				continue
+			}
+		}
+		done := func() {}
+		if fs.limits != nil {
+			limited, release, err := fs.limits.admitConn(c)
+			if err != nil {
+				fs.notef("Limits: refused %s SFTP: %v", c.RemoteAddr(), err)
+				c.Close()
+				continue
+			}
+			c, done = limited, release
+		}
+		go func() {
+			defer done()
+			fs.serveSFTPConn(c, config)
+		}()
+	}
+}
+
+// serveSFTPConn runs the SSH connection c, starting an SFTP session for every
+// channel that asks for the sftp subsystem
+func (fs *FileServer) serveSFTPConn(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var a *account
+	if p := conn.Permissions; p != nil && p.Extensions["user"] != "" {
+		a = &account{Name: p.Extensions["user"], Role: p.Extensions["role"]}
+	}
+	r := sftpRequest(conn.RemoteAddr(), a)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the subsystem name as an SSH string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						sftp.NewRequestServer(ch, fs.sftpHandlers(r)).Serve()
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// sftpHandlers answer the requests of an SFTP session through the Storage of
+// the served folders, naming files as davFS does for the request standing in
+// for the session
+type sftpHandlers struct {
+	fs  *FileServer
+	dav davFS
+}
+
+// errSFTPFolder answers reading or writing a folder as a file
+var errSFTPFolder = errors.New("is a folder")
+
+// sftpHandlers returns the handlers of an SFTP session of r
+func (fs *FileServer) sftpHandlers(r *http.Request) sftp.Handlers {
+	h := sftpHandlers{fs: fs, dav: davFS{fs: fs, r: r}}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+// sftpError is err as told to SFTP clients, without the path on the server
+func sftpError(err error) error {
+	switch {
+	case err == nil, err == sftp.ErrSSHFxOpUnsupported, err == sftp.ErrSSHFxNoSuchFile:
+		return err
+	case errors.Is(err, os.ErrNotExist):
+		return sftp.ErrSSHFxNoSuchFile
+	case errors.Is(err, os.ErrPermission):
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return errors.New(errorMessage(err))
+}
+
+// writable resolves name for a change, which the session must be allowed
+func (h sftpHandlers) writable(name string) (string, error) {
+	full, err := h.dav.resolveInRoot(name)
+	if err == nil && !h.fs.canWrite(h.dav.r, full) {
+		err = os.ErrPermission
+	}
+	return full, err
+}
+
+func (h sftpHandlers) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	full, err := h.dav.resolve(req.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if full == "" {
+		return nil, errSFTPFolder
+	}
+	f, err := h.fs.storageFor(full).Open(full)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		f.Close()
+		return nil, errSFTPFolder
+	}
+	return f, nil
+}
+
+func (h sftpHandlers) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	return h.open(req)
+}
+
+// OpenFile opens a file for reading and writing
+func (h sftpHandlers) OpenFile(req *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.open(req)
+}
+
+// open opens the file of req for writing, as its flags ask
+func (h sftpHandlers) open(req *sftp.Request) (*sftpFile, error) {
+	full, err := h.writable(req.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	pflags := req.Pflags()
+	store := h.fs.storageFor(full)
+	fi, err := lstat(store, full)
+	switch {
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, sftpError(err)
+	case err != nil && !pflags.Creat:
+		return nil, sftp.ErrSSHFxNoSuchFile
+	case err == nil && pflags.Excl:
+		return nil, sftpError(os.ErrExist)
+	case err == nil && fi.IsDir():
+		return nil, errSFTPFolder
+	}
+	exists := err == nil
+	if exists && pflags.Trunc {
+		h.fs.keepVersion(full)
+	}
+
+	f := &sftpFile{fs: h.fs, full: full}
+	if store == localDisk {
+		// Writing into a hardlink would change every file dedup and -cas
+		// merged with it
+		if err := unshareFile(full, pflags.Trunc); err != nil {
+			return nil, sftpError(err)
+		}
+		flag := os.O_RDWR | os.O_CREATE
+		if pflags.Trunc {
+			flag |= os.O_TRUNC
+		}
+		if f.File, err = os.OpenFile(full, flag, 0644); err != nil {
+			return nil, sftpError(err)
+		}
+		return f, nil
+	}
+
+	// Objects can only be replaced as a whole, so the writes go to a copy
+	// that replaces the object once closed
+	if f.File, err = os.CreateTemp("", "sftp-*"); err != nil {
+		return nil, sftpError(err)
+	}
+	f.store = store
+	if exists && !pflags.Trunc {
+		err := copyStored(f.File, store, full)
+		if err != nil {
+			closeTemp(f.File)
+			return nil, sftpError(err)
+		}
+	} else {
+		f.written.Store(true)
+	}
+	return f, nil
+}
+
+// copyStored copies the content of the file name of store to w
+func copyStored(w io.Writer, store Storage, name string) error {
+	in, err := store.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(w, in)
+	return err
+}
+
+// sftpFile is a file open for writing over SFTP: the file itself on the
+// local disk, a copy of it for object stores. Once closed after a write it is
+// announced as uploaded.
+type sftpFile struct {
+	*os.File
+	fs      *FileServer
+	full    string
+	store   Storage // the copy's, nil for the file itself
+	written atomic.Bool
+	failed  atomic.Bool
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	f.written.Store(true)
+	return f.File.WriteAt(p, off)
+}
+
+// TransferError is told when the session ends with the file open, which
+// then isn't stored or announced
+func (f *sftpFile) TransferError(err error) {
+	f.failed.Store(true)
+}
+
+func (f *sftpFile) Close() error {
+	var err error
+	if f.store == nil {
+		err = f.File.Close()
+	} else {
+		defer closeTemp(f.File)
+		if !f.failed.Load() && f.written.Load() {
+			err = f.save()
+		}
+	}
+	if err != nil {
+		return sftpError(err)
+	}
+	if !f.failed.Load() && f.written.Load() {
+		f.fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(f.full)})
+	}
+	return nil
+}
+
+// save stores the copy of an object
+func (f *sftpFile) save() error {
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := f.store.Create(f.full)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f.File); err != nil {
+		if a, ok := w.(aborter); ok {
+			a.Abort()
+		}
+		return err
+	}
+	return w.Close()
+}
+
+func (h sftpHandlers) Filecmd(req *sftp.Request) error {
+	full, err := h.writable(req.Filepath)
+	if err != nil {
+		return sftpError(err)
+	}
+	store := h.fs.storageFor(full)
+	switch req.Method {
+	case "Mkdir":
+		err = sftpMkdir(store, full)
+	case "Remove", "Rmdir":
+		var fi os.FileInfo
+		if fi, err = lstat(store, full); err == nil && fi.IsDir() != (req.Method == "Rmdir") {
+			err = errors.New("wrong kind of file")
+		}
+		if err == nil {
+			err = h.fs.remove(full, false)
+		}
+	case "Rename":
+		var to string
+		if to, err = h.writable(req.Target); err != nil {
+			break
+		}
+		if h.fs.storageFor(to) != store {
+			err = errors.New("cannot move between the local disk and object stores or between buckets")
+		} else if _, serr := lstat(store, to); serr == nil {
+			err = os.ErrExist
+		} else {
+			err = store.Rename(full, to)
+		}
+	case "Setstat":
+		err = sftpSetstat(req, store, full)
+	default:
+		// Links and extensions
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return sftpError(err)
+}
+
+// sftpMkdir creates the folder name, whose parent must exist
+func sftpMkdir(store Storage, name string) error {
+	if _, err := lstat(store, name); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	parent, err := store.Stat(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return os.ErrNotExist
+	}
+	return store.Mkdir(name)
+}
+
+// sftpSetstat sets what the client sent of the size, permissions and times
+// of name. Owners can't be changed, nor anything of objects.
+func sftpSetstat(req *sftp.Request, store Storage, name string) error {
+	flags, attrs := req.AttrFlags(), req.Attributes()
+	if !flags.Size && !flags.Permissions && !flags.Acmodtime {
+		return nil
+	}
+	if store != localDisk {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	// A hardlink shares them with every file dedup and -cas merged with it
+	if err := unshareFile(name, flags.Size && attrs.Size == 0); err != nil {
+		return err
+	}
+	if flags.Size {
+		if err := os.Truncate(name, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(name, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		return os.Chtimes(name, attrs.AccessTime(), attrs.ModTime())
+	}
+	return nil
+}
+
+func (h sftpHandlers) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	full, err := h.dav.resolve(req.Filepath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	switch req.Method {
+	case "List":
+		if full == "" {
+			return h.roots(), nil
+		}
+		infos, err := h.list(full)
+		return infos, sftpError(err)
+	case "Stat":
+		if full == "" {
+			return sftpList{davDirInfo{name: "/"}}, nil
+		}
+		fi, err := h.fs.storageFor(full).Stat(full)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpList{fi}, nil
+	}
+	// Readlink: links aren't followed but where they lead
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// roots lists the served folders the session may see
+func (h sftpHandlers) roots() sftpList {
+	var infos sftpList
+	for _, f := range h.fs.visibleRoots(h.dav.r, nil) {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		fi, err := h.fs.storageFor(abs).Stat(abs)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, davDirInfo{name: h.fs.rootName(abs), modTime: fi.ModTime()})
+	}
+	return infos
+}
+
+// list lists the folder dir, without server bookkeeping nor, where hidden,
+// dot files
+func (h sftpHandlers) list(dir string) (sftpList, error) {
+	entries, err := h.fs.storageFor(dir).ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	noHidden := h.fs.hidesDotFiles(dir)
+	var infos sftpList
+	for _, e := range entries {
+		if isInternal(e.Name()) || noHidden && strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			infos = append(infos, fi)
+		}
+	}
+	return infos, nil
+}
+
+// sftpList is a folder listing, or the file a stat asked for
+type sftpList []os.FileInfo
+
+func (l sftpList) ListAt(out []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	return copy(out, l[off:]), nil
+}
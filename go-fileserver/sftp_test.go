@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// testSFTP serves testRoots over SFTP to the returned client, for an
+// anonymous session
+func testSFTP(t *testing.T) (c *sftp.Client, fs *FileServer, docs string) {
+	t.Helper()
+	fs, docs, _, _ = testRoots(t)
+	fs.events = newEventBus()
+	server, client := net.Pipe()
+	go sftp.NewRequestServer(server, fs.sftpHandlers(sftpRequest(server.RemoteAddr(), nil))).Serve()
+	c, err := sftp.NewClientPipe(client, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, fs, docs
+}
+
+func TestSFTPList(t *testing.T) {
+	c, _, _ := testSFTP(t)
+	infos, err := c.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			t.Errorf("root %s isn't a folder", fi.Name())
+		}
+		names = append(names, fi.Name())
+	}
+	if got := strings.Join(names, ","); got != "docs,other" {
+		t.Errorf("roots = %s, want docs,other", got)
+	}
+
+	infos, err = c.ReadDir("/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if got := strings.Join(names, ","); !strings.Contains(","+got+",", ",a.txt,") || strings.Contains(got, casDirName) {
+		t.Errorf("/docs lists %s, want a.txt and no %s", got, casDirName)
+	}
+
+	if fi, err := c.Stat("/other/b.txt"); err != nil || fi.Size() != 1 {
+		t.Errorf("stat /other/b.txt = %v, %v", fi, err)
+	}
+	if _, err := c.Stat("/docs/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat /docs/missing: %v, want not found", err)
+	}
+	if _, err := c.Stat("/outside"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat /outside: %v, want not found", err)
+	}
+}
+
+func TestSFTPReadWrite(t *testing.T) {
+	c, fs, docs := testSFTP(t)
+	var mu sync.Mutex
+	var uploaded []string
+	defer fs.events.subscribe(func(ev event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ev.Type == eventUploaded {
+			uploaded = append(uploaded, ev.Path)
+		}
+	})()
+
+	f, err := c.Create("/docs/sub/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	full := filepath.Join(docs, "sub", "new.txt")
+	if data, _ := os.ReadFile(full); string(data) != "hello world" {
+		t.Errorf("file holds %q", data)
+	}
+	mu.Lock()
+	if len(uploaded) != 1 || uploaded[0] != filepath.ToSlash(full) {
+		t.Errorf("uploaded events %v, want %s", uploaded, full)
+	}
+	mu.Unlock()
+
+	// Writing at an offset keeps the rest
+	f, err = c.OpenFile("/docs/sub/new.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = c.Open("/docs/sub/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "hello World" {
+		t.Errorf("read %q, %v", data, err)
+	}
+
+	if _, err := c.OpenFile("/docs/sub/new.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL); err == nil {
+		t.Error("exclusive create of an existing file succeeded")
+	}
+	if _, err := c.Open("/docs/sub"); err == nil {
+		t.Error("a folder opened as a file")
+	}
+}
+
+func TestSFTPChanges(t *testing.T) {
+	c, _, docs := testSFTP(t)
+	if err := c.Mkdir("/docs/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mkdir("/docs/new"); err == nil {
+		t.Error("mkdir of an existing folder succeeded")
+	}
+	if err := c.Mkdir("/docs/missing/new"); err == nil {
+		t.Error("mkdir without a parent succeeded")
+	}
+	if err := c.Rename("/docs/a.txt", "/docs/new/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(docs, "new", "a.txt")) || fileExists(filepath.Join(docs, "a.txt")) {
+		t.Error("rename didn't move the file")
+	}
+	if err := c.Rename("/docs/new/a.txt", "/docs/dang-in"); err == nil {
+		t.Error("rename over an existing name succeeded")
+	}
+	if err := c.RemoveDirectory("/docs/new"); err == nil {
+		t.Error("rmdir of a folder with contents succeeded")
+	}
+	if err := c.Remove("/docs/new/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveDirectory("/docs/new"); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(filepath.Join(docs, "new")) {
+		t.Error("folder still there after rmdir")
+	}
+}
+
+func TestSFTPDenied(t *testing.T) {
+	c, _, docs := testSFTP(t)
+	denied := map[string]error{
+		"remove a root":     c.RemoveDirectory("/docs"),
+		"rename a root":     c.Rename("/docs", "/docs2"),
+		"move out of roots": c.Rename("/docs/a.txt", "/docs/out/a.txt"),
+		"create in a link out": func() error {
+			_, err := c.Create("/docs/out/new.txt")
+			return err
+		}(),
+		"create at a dangling link": func() error {
+			_, err := c.Create("/docs/dangling")
+			return err
+		}(),
+		"create in the content store": func() error {
+			_, err := c.Create("/docs/" + casDirName + "/blob")
+			return err
+		}(),
+	}
+	for what, err := range denied {
+		if !errors.Is(err, os.ErrPermission) {
+			t.Errorf("%s: %v, want permission denied", what, err)
+		}
+	}
+	if err := c.Mkdir("/new"); err == nil {
+		t.Error("mkdir in / succeeded")
+	}
+	if _, err := c.Open("/docs/out/secret.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("read through a link out: %v, want permission denied", err)
+	}
+
+	*roMode = true
+	defer func() { *roMode = false }()
+	if _, err := c.Create("/docs/new.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("create under -readonly: %v, want permission denied", err)
+	}
+	if err := c.Remove("/docs/a.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("remove under -readonly: %v, want permission denied", err)
+	}
+	if !fileExists(filepath.Join(docs, "a.txt")) {
+		t.Error("file removed under -readonly")
+	}
+}
+
+func TestSFTPErrorsHidePaths(t *testing.T) {
+	c, _, docs := testSFTP(t)
+	errs := []error{
+		c.Truncate("/docs/sub", 0),
+		c.Rename("/docs/sub", "/docs/a.txt/sub"),
+		c.Symlink("/docs/a.txt", "/docs/link"),
+	}
+	for _, err := range errs {
+		if err == nil {
+			t.Error("no error")
+		} else if strings.Contains(err.Error(), filepath.Dir(docs)) {
+			t.Errorf("error names the server path: %v", err)
+		}
+	}
+}
+
+// Writing into a file over SFTP or WebDAV leaves the files dedup or -cas
+// linked to it alone
+func TestWriteUnsharesHardlinks(t *testing.T) {
+	c, fs, docs := testSFTP(t)
+	a, twin := filepath.Join(docs, "a.txt"), filepath.Join(docs, "twin.txt")
+	if err := os.WriteFile(a, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, twin); err != nil {
+		t.Skipf("no hardlinks here: %v", err)
+	}
+	relink := func() {
+		os.Remove(twin)
+		if err := os.Link(a, twin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(how, want string) {
+		t.Helper()
+		if data, _ := os.ReadFile(a); string(data) != want {
+			t.Errorf("%s: file holds %q, want %q", how, data, want)
+		}
+		if data, _ := os.ReadFile(twin); string(data) != "hello" {
+			t.Errorf("%s: the linked file changed to %q", how, data)
+		}
+	}
+
+	f, err := c.OpenFile("/docs/a.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("J"), 0)
+	f.Close()
+	check("SFTP write at an offset", "Jello")
+
+	os.WriteFile(a, []byte("hello"), 0644)
+	relink()
+	if err := c.Truncate("/docs/a.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+	check("SFTP truncate", "he")
+
+	os.WriteFile(a, []byte("hello"), 0644)
+	relink()
+	if err := c.Chmod("/docs/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(twin); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("chmod changed the linked file: %v, %v", fi, err)
+	}
+	check("SFTP chmod", "hello")
+
+	relink()
+	dav := davFS{fs: fs, r: httptest.NewRequest("PUT", "/dav/docs/a.txt", nil)}
+	df, err := dav.OpenFile(context.Background(), "/docs/a.txt", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	df.Seek(4, io.SeekStart)
+	df.Write([]byte("!"))
+	df.Close()
+	check("WebDAV write", "hell!")
+}
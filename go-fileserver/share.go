@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sharePrefix serves share links, /s/<token> for the shared file or folder
+// and /s/<token>/<path> for what is inside a shared folder
+const sharePrefix = "/s/"
+
+// shareDrop is the kind of share that takes uploads into a folder instead
+// of serving it
+const shareDrop = "drop"
+
+// A share is a link to a file or folder for people without an account. Its
+// token is the share's ID followed by a signature of it, so guessed or
+// altered tokens are turned away before the store is consulted.
+type share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Kind         string    `json:"kind,omitempty"` // "" to download, shareDrop to upload
+	Created      time.Time `json:"created"`
+	CreatedBy    string    `json:"createdBy,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"` // 0 for no limit
+	Downloads    int       `json:"downloads"`
+	MaxBytes     int64     `json:"maxBytes,omitempty"` // upload quota of a drop, 0 for none
+	Uploaded     int64     `json:"uploaded,omitempty"` // bytes dropped so far
+}
+
+func (s *share) expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+func (s *share) exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// shares is the share table, persisted in the store
+type shares struct {
+	mu sync.Mutex
+	m  map[string]*share // by ID
+}
+
+func loadShares() *shares {
+	s := &shares{m: make(map[string]*share)}
+	var expired []string
+	err := db.each(bucketShares, func(id string, data []byte) error {
+		var sh share
+		if err := json.Unmarshal(data, &sh); err != nil {
+			return err
+		}
+		if sh.expired() {
+			expired = append(expired, id)
+		} else {
+			s.m[id] = &sh
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Shares: ignoring unreadable state: %v", err)
+	}
+	for _, id := range expired {
+		db.delete(bucketShares, id)
+	}
+	return s
+}
+
+// shareSignature is the HMAC that makes up the second half of a share token
+func (fs *FileServer) shareSignature(id string) string {
+	mac := hmac.New(sha256.New, fs.signingKey)
+	mac.Write([]byte("share\n" + id))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (fs *FileServer) shareToken(id string) string {
+	return id + fs.shareSignature(id)
+}
+
+// lookupShare returns a copy of the share a token stands for, nil if the
+// token is forged or the share was revoked
+func (fs *FileServer) lookupShare(token string) *share {
+	if len(token) != 32 {
+		return nil
+	}
+	id := token[:16]
+	if !hmac.Equal([]byte(token[16:]), []byte(fs.shareSignature(id))) {
+		return nil
+	}
+	fs.shares.mu.Lock()
+	defer fs.shares.mu.Unlock()
+	sh, ok := fs.shares.m[id]
+	if !ok {
+		return nil
+	}
+	c := *sh
+	return &c
+}
+
+// create stores a new share under a fresh ID
+func (s *shares) create(sh *share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh.ID = newJobID()
+	for s.m[sh.ID] != nil {
+		sh.ID = newJobID()
+	}
+	if err := db.put(bucketShares, sh.ID, sh); err != nil {
+		return err
+	}
+	s.m[sh.ID] = sh
+	return nil
+}
+
+// countDownload takes one of the downloads a share allows, reporting false
+// once they are used up
+func (s *shares) countDownload(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.m[id]
+	if !ok || sh.exhausted() {
+		return false
+	}
+	sh.Downloads++
+	if err := db.put(bucketShares, id, sh); err != nil {
+		log.Printf("Shares: counting a download of %s: %v", id, err)
+	}
+	return true
+}
+
+// remove deletes a share, reporting whether it existed
+func (s *shares) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[id]; !ok {
+		return false, nil
+	}
+	if err := db.delete(bucketShares, id); err != nil {
+		return true, err
+	}
+	delete(s.m, id)
+	return true, nil
+}
+
+// canManageShare reports whether r may see and revoke sh: admins and
+// whoever created it, everyone without logins
+func canManageShare(r *http.Request, sh *share) bool {
+	if !authEnabled() {
+		return true
+	}
+	a := accountOf(r)
+	return a != nil && (a.has(roleAdmin) || a.Name == sh.CreatedBy)
+}
+
+func (fs *FileServer) shareInfo(sh *share) map[string]interface{} {
+	t := fs.shareToken(sh.ID)
+	info := map[string]interface{}{
+		"token":     t,
+		"url":       sharePrefix + t,
+		"path":      fs.publicPath(sh.Path),
+		"created":   sh.Created,
+		"createdBy": sh.CreatedBy,
+		"expires":   sh.Expires,
+		"password":  sh.PasswordHash != "",
+	}
+	if sh.Kind == shareDrop {
+		info["kind"] = shareDrop
+		info["maxBytes"] = sh.MaxBytes
+		info["uploaded"] = sh.Uploaded
+	} else {
+		info["kind"] = "download"
+		info["maxDownloads"] = sh.MaxDownloads
+		info["downloads"] = sh.Downloads
+	}
+	return info
+}
+
+// API: Share links for people without an account. GET /api/share lists them
+// (everyone's for admins, otherwise one's own). POST /api/share with {"path",
+// "expires", "password", "maxDownloads"} creates one for a file or folder:
+// expires is a duration such as "72h", empty for none, and maxDownloads 0 for
+// no limit. With "drop": true and an optional "maxSize" such as "2G" it
+// creates a drop link instead, taking uploads into a folder up to that quota
+// (see handleDrop). It answers {"token", "url", ...}; the link is served at
+// /s/<token> without logging in. DELETE /api/share/<token> revokes it.
+func (fs *FileServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, roleReadOnly) {
+		return
+	}
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/share"), "/")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && token == "":
+		fs.shares.mu.Lock()
+		list := []map[string]interface{}{}
+		for _, sh := range fs.shares.m {
+			if !sh.expired() && canManageShare(r, sh) {
+				list = append(list, fs.shareInfo(sh))
+			}
+		}
+		fs.shares.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool {
+			return list[i]["created"].(time.Time).After(list[j]["created"].(time.Time))
+		})
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && token == "":
+		var req struct {
+			Path         string `json:"path"`
+			Expires      string `json:"expires"`
+			Password     string `json:"password"`
+			MaxDownloads int    `json:"maxDownloads"`
+			Drop         bool   `json:"drop"`
+			MaxSize      string `json:"maxSize"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, 400, codeBadRequest, "Invalid JSON body")
+			return
+		}
+		if req.Path == "" || req.MaxDownloads < 0 {
+			apiError(w, 400, codeBadRequest, "Missing path or invalid maxDownloads")
+			return
+		}
+		if !fs.resolvePaths(w, &req.Path) {
+			return
+		}
+		p := req.Path
+		if !fs.requireInRoots(w, req.Path) || !fs.requireRead(w, r, req.Path) {
+			return
+		}
+		fi, err := fs.storageFor(p).Stat(p)
+		if err != nil {
+			apiError(w, http.StatusNotFound, codeNotFound, "Not found: "+fs.publicPath(p))
+			return
+		}
+		if req.Drop && (!fi.IsDir() || req.MaxDownloads > 0) {
+			apiError(w, 400, codeBadRequest, "Drop links need a folder and take no maxDownloads")
+			return
+		}
+		// Whoever has a drop link adds files to the folder
+		if req.Drop && !fs.requireWrite(w, r, req.Path) {
+			return
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			apiError(w, 400, codeBadRequest, err.Error())
+			return
+		}
+		sh := &share{Path: filepath.ToSlash(abs), Created: time.Now().UTC(), MaxDownloads: req.MaxDownloads}
+		if a := accountOf(r); a != nil {
+			sh.CreatedBy = a.Name
+		}
+		if req.Drop {
+			sh.Kind = shareDrop
+			if req.MaxSize != "" {
+				if sh.MaxBytes, err = parseSize(req.MaxSize); err != nil || sh.MaxBytes == 0 {
+					apiError(w, 400, codeBadRequest, "Invalid maxSize: "+req.MaxSize)
+					return
+				}
+			}
+		}
+		if req.Expires != "" {
+			d, err := time.ParseDuration(req.Expires)
+			if err != nil || d <= 0 {
+				apiError(w, 400, codeBadRequest, "Invalid expires duration: "+req.Expires)
+				return
+			}
+			sh.Expires = sh.Created.Add(d)
+		}
+		if req.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+			if err != nil {
+				apiError(w, 400, codeBadRequest, err.Error())
+				return
+			}
+			sh.PasswordHash = string(hash)
+		}
+		if err := fs.shares.create(sh); err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		info := fs.shareInfo(sh)
+		ev := event{Type: eventShared, Path: sh.Path, Data: map[string]string{"token": info["token"].(string), "url": info["url"].(string)}}
+		if !sh.Expires.IsZero() {
+			ev.Data["expires"] = sh.Expires.Format(time.RFC3339)
+		}
+		fs.events.publish(ev)
+		json.NewEncoder(w).Encode(info)
+	case r.Method == http.MethodDelete && token != "":
+		sh := fs.lookupShare(token)
+		if sh == nil || !canManageShare(r, sh) {
+			apiError(w, http.StatusNotFound, codeNotFound, "Share not found")
+			return
+		}
+		if _, err := fs.shares.remove(sh.ID); err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sharePasswordPage asks for the password of a share link
+const sharePasswordPage = `<!DOCTYPE html>
+<html>
+<head><title>Password required</title><meta name="viewport" content="width=device-width, initial-scale=1"></head>
+<body>
+<h1>Password required</h1>
+<p>%s</p>
+<form method="post">
+<input type="password" name="password" autofocus required>
+<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`
+
+// shareCookie is the cookie that remembers the password of a share was given,
+// an HMAC over the share and its password hash so changing either ends it
+func (fs *FileServer) shareCookie(sh *share) (name, value string) {
+	mac := hmac.New(sha256.New, fs.signingKey)
+	mac.Write([]byte("share-password\n" + sh.ID + "\n" + sh.PasswordHash))
+	return "share_" + sh.ID, hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareUnlocked checks the password of a share, given in an X-Share-Password
+// header, a posted form or earlier (then remembered in a cookie). Without it,
+// it answers 401 with a password form and returns false.
+func (fs *FileServer) shareUnlocked(w http.ResponseWriter, r *http.Request, sh *share, token string) bool {
+	if sh.PasswordHash == "" {
+		return true
+	}
+	name, value := fs.shareCookie(sh)
+	if c, err := r.Cookie(name); err == nil && secretEqual(c.Value, value) {
+		return true
+	}
+	password := r.Header.Get("X-Share-Password")
+	// Only a password form, not an upload to a drop link, is read here
+	form := password == "" && r.Method == http.MethodPost &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	if form {
+		password = r.PostFormValue("password")
+	}
+	msg := "This link is protected by a password."
+	if password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(sh.PasswordHash), []byte(password)) == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     name,
+				Value:    value,
+				Path:     sharePrefix + token,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			if form {
+				// Back to a GET, so reloading doesn't post the password again
+				http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+				return false
+			}
+			return true
+		}
+		fs.logAuthFailure(r, "", "bad-share-password")
+		msg = "Wrong password, please try again."
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, sharePasswordPage, html.EscapeString(msg))
+	return false
+}
+
+// Share links: /s/<token> serves a shared file, or lists a shared folder
+// like /browse/ with its files below it. ?download=zip (or tar, tar.gz)
+// downloads a shared folder as an archive. Drop links take uploads
+// instead (see handleDrop). No login is needed, but the share's password,
+// expiry and download limit apply.
+func (fs *FileServer) handleShareLink(w http.ResponseWriter, r *http.Request) {
+	token, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, sharePrefix), "/")
+	sh := fs.lookupShare(token)
+	if sh == nil {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if sh.expired() {
+		httpError(w, "This link has expired", http.StatusGone)
+		return
+	}
+	if sh.exhausted() {
+		httpError(w, "This link has reached its download limit", http.StatusGone)
+		return
+	}
+	if !fs.shareUnlocked(w, r, sh, token) {
+		return
+	}
+	if sh.Kind == shareDrop {
+		if rest != "" {
+			httpError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		fs.handleDrop(w, r, sh, token)
+		return
+	}
+	rel := path.Clean("/" + rest)
+	full := filepath.Join(filepath.FromSlash(sh.Path), filepath.FromSlash(rel))
+	store := fs.storageFor(full)
+	fi, err := store.Stat(full)
+	if err != nil || !fs.inRoots(full) || rel != "/" && !fs.isDirPath(sh.Path) || fs.hiddenPolicy(full) == hiddenDeny && fs.isDotPath(full) {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	// Links inside a shared folder mustn't lead out of it
+	if rel != "/" {
+		real, err := realPath(full)
+		base, berr := realPath(filepath.FromSlash(sh.Path))
+		if err != nil || berr != nil || !under(real, []string{base}) {
+			httpError(w, "Not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Count the start of a download, not each range request of a video player
+	counts := r.Method == http.MethodGet && (!fi.IsDir() || r.URL.Query().Get("download") != "")
+	if rng := r.Header.Get("Range"); counts && (rng == "" || strings.HasPrefix(rng, "bytes=0-")) {
+		if !fs.shares.countDownload(sh.ID) {
+			httpError(w, "This link has reached its download limit", http.StatusGone)
+			return
+		}
+		fs.events.publish(event{Type: eventAccessed, Path: filepath.ToSlash(full), Data: map[string]string{"share": token, "ip": clientIP(r).String()}})
+	}
+
+	if !fi.IsDir() {
+		f, err := store.Open(full)
+		if err != nil {
+			httpError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		ct := detectFileContentType(f, full)
+		w.Header().Set("Content-Type", ct)
+		fs.setDisposition(w, full, ct)
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return
+	}
+	if r.URL.Query().Get("download") != "" {
+		q := r.URL.Query()
+		q.Set("format", q.Get("download"))
+		r.URL.RawQuery = q.Encode()
+		fs.downloadFolder(w, r, full)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	names, infos, err := readIndex(store, full, fs.hidesDotFiles(full))
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	dir := rel
+	if dir != "/" {
+		dir += "/"
+	}
+	writeIndex(w, dir, names, func(n string) (string, os.FileInfo) { return "", infos[n] })
+}
+
+// isDirPath reports whether p is a folder
+func (fs *FileServer) isDirPath(p string) bool {
+	p = filepath.FromSlash(p)
+	fi, err := fs.storageFor(p).Stat(p)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A folder share serves what is inside the folder and nothing it links to
+func TestShareLinkStaysInFolder(t *testing.T) {
+	fs, docs, _, _ := testServer(t)
+	sh := &share{Path: docs, Created: time.Now()}
+	if err := fs.shares.create(sh); err != nil {
+		t.Fatal(err)
+	}
+	token := fs.shareToken(sh.ID)
+	tests := []struct {
+		rest   string
+		status int
+	}{
+		{"/a.txt", 200},
+		{"/sub/", 200},
+		{"/to-sub/", 200},
+		{"/to-other/b.txt", 404},
+		{"/out/secret.txt", 404},
+		{"/out-file", 404},
+		{"/../../outside/secret.txt", 404},
+		{"/%2e%2e/%2e%2e/outside/secret.txt", 404},
+		{"/" + casDirName + "/", 404},
+		{"/missing.txt", 404},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		fs.handleShareLink(w, httptest.NewRequest("GET", sharePrefix+token+tt.rest, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s = %d, want %d", tt.rest, w.Code, tt.status)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	fs.handleShareLink(w, httptest.NewRequest("GET", sharePrefix+token[:31]+"x/a.txt", nil))
+	if w.Code != 404 {
+		t.Errorf("forged token = %d, want 404", w.Code)
+	}
+}
+
+func TestCanManageShare(t *testing.T) {
+	sh := &share{Path: "/docs", CreatedBy: "alice"}
+	r := httptest.NewRequest("DELETE", "/api/share/x", nil)
+	if !canManageShare(r, sh) {
+		t.Error("without logins a share can't be managed")
+	}
+	withLogins(t)
+	tests := []struct {
+		name, role string
+		want       bool
+	}{
+		{"", "", false},
+		{"bob", roleReadWrite, false},
+		{"alice", roleReadOnly, true},
+		{"root", roleAdmin, true},
+	}
+	for _, tt := range tests {
+		r := r
+		if tt.name != "" {
+			r = as(r, tt.name, tt.role)
+		}
+		if got := canManageShare(r, sh); got != tt.want {
+			t.Errorf("%q managing alice's share: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shortLinkLen is the number of characters in a generated token
+	shortLinkLen      = 16
+	shortLinkAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// shortLink maps a token to a file served by /r/<token>
+type shortLink struct {
+	Path      string    `json:"path"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+}
+
+func (l shortLink) expired() bool {
+	return !l.Expires.IsZero() && time.Now().After(l.Expires)
+}
+
+// shortLinks is the token table, persisted in the store
+type shortLinks struct {
+	mu    sync.Mutex
+	links map[string]shortLink
+}
+
+func loadShortLinks() *shortLinks {
+	s := &shortLinks{links: make(map[string]shortLink)}
+	var expired []string
+	err := db.each(bucketShortLinks, func(token string, data []byte) error {
+		var l shortLink
+		if err := json.Unmarshal(data, &l); err != nil {
+			return err
+		}
+		if l.expired() {
+			expired = append(expired, token)
+		} else {
+			s.links[token] = l
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Short links: ignoring unreadable state: %v", err)
+	}
+	for _, token := range expired {
+		db.delete(bucketShortLinks, token)
+	}
+	return s
+}
+
+func (s *shortLinks) lookup(token string) (shortLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[token]
+	if !ok || l.expired() {
+		return shortLink{}, false
+	}
+	return l, true
+}
+
+// create stores a link under a new random token
+func (s *shortLinks) create(l shortLink) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var token string
+	for token == "" || s.links[token] != (shortLink{}) {
+		b := make([]byte, shortLinkLen)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(shortLinkAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			b[i] = shortLinkAlphabet[n.Int64()]
+		}
+		token = string(b)
+	}
+	if err := db.put(bucketShortLinks, token, l); err != nil {
+		return "", err
+	}
+	s.links[token] = l
+	return token, nil
+}
+
+// remove deletes a link, reporting whether it existed
+func (s *shortLinks) remove(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.links[token]; !ok {
+		return false, nil
+	}
+	if err := db.delete(bucketShortLinks, token); err != nil {
+		return true, err
+	}
+	delete(s.links, token)
+	return true, nil
+}
+
+// canManageShortLink reports whether r may remove l: admins, whoever created
+// it and those who may change the file
+func (fs *FileServer) canManageShortLink(r *http.Request, l shortLink) bool {
+	if a := accountOf(r); a != nil && (a.has(roleAdmin) || a.Name == l.CreatedBy) {
+		return true
+	}
+	return fs.canWrite(r, filepath.FromSlash(l.Path))
+}
+
+// API: Short links. GET lists those to files the requester may see, POST
+// {path, expires} creates one (expires is a duration such as "24h", empty for
+// none), DELETE /<token> removes it.
+func (fs *FileServer) handleShortLinks(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/shortlinks"), "/")
+	switch {
+	case r.Method == http.MethodGet && token == "":
+		fs.shortLinks.mu.Lock()
+		list := []map[string]interface{}{}
+		for t, l := range fs.shortLinks.links {
+			if !l.expired() && fs.canRead(r, filepath.FromSlash(l.Path)) {
+				entry := map[string]interface{}{"token": t, "url": "/r/" + t, "path": fs.publicPath(l.Path), "created": l.Created, "expires": l.Expires}
+				if l.CreatedBy != "" {
+					entry["createdBy"] = l.CreatedBy
+				}
+				list = append(list, entry)
+			}
+		}
+		fs.shortLinks.mu.Unlock()
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && token == "":
+		var req struct {
+			Path      string `json:"path"`
+			Expires   string `json:"expires"`
+			Recipient string `json:"recipient"` // optional, passed on to notifications
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid JSON body", 400)
+			return
+		}
+		if req.Path == "" {
+			httpError(w, "Missing path", 400)
+			return
+		}
+		if !fs.resolvePaths(w, &req.Path) {
+			return
+		}
+		p := req.Path
+		if !fs.requireRead(w, r, p) {
+			return
+		}
+		if !fs.inRoots(p) {
+			httpError(w, "Path is not inside a served folder", 403)
+			return
+		}
+		l := shortLink{Path: filepath.ToSlash(p), Created: time.Now()}
+		if a := accountOf(r); a != nil {
+			l.CreatedBy = a.Name
+		}
+		if req.Expires != "" {
+			d, err := time.ParseDuration(req.Expires)
+			if err != nil || d <= 0 {
+				httpError(w, "Invalid expires duration: "+req.Expires, 400)
+				return
+			}
+			l.Expires = l.Created.Add(d)
+		}
+		t, err := fs.shortLinks.create(l)
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		ev := event{Type: eventShared, Path: l.Path, Data: map[string]string{"token": t, "url": "/r/" + t}}
+		if !l.Expires.IsZero() {
+			ev.Data["expires"] = l.Expires.Format(time.RFC3339)
+		}
+		if req.Recipient != "" {
+			ev.Data["recipient"] = req.Recipient
+		}
+		fs.events.publish(ev)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": t, "url": "/r/" + t, "path": fs.publicPath(l.Path), "expires": l.Expires})
+	case r.Method == http.MethodDelete && token != "":
+		fs.shortLinks.mu.Lock()
+		l, ok := fs.shortLinks.links[token]
+		fs.shortLinks.mu.Unlock()
+		if !ok || !fs.canRead(r, filepath.FromSlash(l.Path)) {
+			httpError(w, "Short link not found", 404)
+			return
+		}
+		if !fs.canManageShortLink(r, l) {
+			if authenticated(r) {
+				apiError(w, http.StatusForbidden, codeForbidden, "Only its creator, admins and those who may change the file can remove this short link")
+				return
+			}
+			authChallenge(w)
+			httpError(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		ok, err := fs.shortLinks.remove(token)
+		if !ok {
+			httpError(w, "Short link not found", 404)
+			return
+		}
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Short link redirector: /r/<token> serves the linked file exactly like /api/raw,
+// so it is subject to the same checks.
+func (fs *FileServer) handleShortLink(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/r/")
+	l, ok := fs.shortLinks.lookup(token)
+	if !ok || !fs.inRoots(filepath.FromSlash(l.Path)) {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	// A short link only names the file: the caller needs the same access
+	// as for /api/raw. The path is the one on the server, as jailMiddleware
+	// leaves it.
+	p := filepath.FromSlash(l.Path)
+	if !fs.requireRead(w, r, p) {
+		return
+	}
+	// Count the start of a download, not each range request of a video player
+	if rng := r.Header.Get("Range"); r.Method == http.MethodGet && (rng == "" || strings.HasPrefix(rng, "bytes=0-")) {
+		fs.events.publish(event{Type: eventAccessed, Path: l.Path, Data: map[string]string{"token": token, "ip": clientIP(r).String()}})
+	}
+	q := r.URL.Query()
+	q.Set("path", p)
+	r2 := r.Clone(r.Context())
+	r2.URL.RawQuery = q.Encode()
+	fs.handleRawFile(w, r2)
+}
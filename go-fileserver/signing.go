@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// signingKeyFile holds the secret used to sign raw file URLs
+const signingKeyFile = "signing.key"
+
+// loadSigningKey reads the URL signing secret, creating one on first use so
+// signed links stay valid across restarts.
+func loadSigningKey() ([]byte, error) {
+	path := statePath(signingKeyFile)
+	if data, err := os.ReadFile(path); err == nil {
+		return hex.DecodeString(string(data))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600)
+}
+
+// rawSignature is the HMAC over a path, as clients see it, and its expiry time
+func (fs *FileServer) rawSignature(path string, exp int64) string {
+	mac := hmac.New(sha256.New, fs.signingKey)
+	mac.Write([]byte(fs.publicPath(path) + "\n" + strconv.FormatInt(exp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rawURL returns the /api/raw URL for path, signed when -sign-raw is on
+func (fs *FileServer) rawURL(path string) string {
+	q := fs.rawSigned(path)
+	q.Set("path", fs.publicPath(path))
+	return "/api/raw?" + q.Encode()
+}
+
+// rawSigned returns the exp and sig parameters for path when -sign-raw is on
+func (fs *FileServer) rawSigned(path string) url.Values {
+	q := url.Values{}
+	if *signRaw {
+		exp := time.Now().Add(*rawTTL).Unix()
+		q.Set("exp", strconv.FormatInt(exp, 10))
+		q.Set("sig", fs.rawSignature(path, exp))
+	}
+	return q
+}
+
+// rawAllowed reports whether the content of path may be served to r, by
+// /api/raw and every other endpoint handing out file content: always without
+// -sign-raw, otherwise only for a logged-in user or with a valid, unexpired
+// signature.
+func (fs *FileServer) rawAllowed(r *http.Request, path string) bool {
+	if !*signRaw || authenticated(r) {
+		return true
+	}
+	switch reason := fs.validSignature(r, path); reason {
+	case "":
+		return true
+	case "expired":
+		// Expired links are normal and not worth banning for
+	default:
+		fs.logAuthFailure(r, "", reason)
+	}
+	return false
+}
+
+// validSignature checks the exp and sig parameters of r against path,
+// returning "" if they are valid or else why not
+func (fs *FileServer) validSignature(r *http.Request, path string) string {
+	q := r.URL.Query()
+	if q.Get("sig") == "" {
+		return "missing-signature"
+	}
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "expired"
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(fs.rawSignature(path, exp))) {
+		return "bad-signature"
+	}
+	return ""
+}
+
+// API: Signed raw URL for a file, valid for -sign-raw-ttl. Only for who
+// may read the file; its exp and sig are accepted by all content endpoints.
+func (fs *FileServer) handleSignRaw(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.FromSlash(path) // Normalize
+	if !fs.inRoots(path) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	if !fs.canRead(r, path) {
+		if authenticated(r) {
+			httpError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		authChallenge(w)
+		httpError(w, "Login required to read "+fs.publicPath(path), http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"url": fs.rawURL(path)})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// siteConfig publishes a folder as a plain static website, on a URL prefix of
+// this server, on its own virtual host, or both
+type siteConfig struct {
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"` // e.g. "/docs/"
+	Host   string `json:"host"`   // e.g. "docs.example.com"
+}
+
+// reservedPrefixes belong to the file browser and can't be used by sites
+var reservedPrefixes = []string{"/api/", "/static/", "/r/", "/sandbox/", browsePrefix, upPrefix}
+
+func (s *siteConfig) validate() error {
+	if s.Path == "" {
+		return fmt.Errorf("site without a path")
+	}
+	if fi, err := os.Stat(s.Path); err != nil || !fi.IsDir() {
+		return fmt.Errorf("site %s: not a folder", s.Path)
+	}
+	if s.Prefix == "" && s.Host == "" {
+		return fmt.Errorf("site %s: needs a prefix or a host", s.Path)
+	}
+	if s.Prefix == "" {
+		return nil
+	}
+	p := strings.Trim(path.Clean("/"+s.Prefix), "/")
+	if p == "" {
+		if s.Host == "" {
+			return fmt.Errorf("site %s: prefix / needs a host", s.Path)
+		}
+		// The whole virtual host
+		s.Prefix = ""
+		return nil
+	}
+	s.Prefix = "/" + p + "/"
+	if s.Host == "" {
+		for _, rp := range reservedPrefixes {
+			if strings.HasPrefix(s.Prefix, rp) || strings.HasPrefix(rp, s.Prefix) {
+				return fmt.Errorf("site %s: prefix %s is used by the file browser", s.Path, s.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the part of the request path inside the site, if r is for it
+func (s *siteConfig) match(r *http.Request) (string, bool) {
+	if s.Host != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !strings.EqualFold(host, s.Host) {
+			return "", false
+		}
+	}
+	if s.Prefix == "" {
+		return r.URL.Path, true
+	}
+	base := strings.TrimSuffix(s.Prefix, "/")
+	if r.URL.Path != base && !strings.HasPrefix(r.URL.Path, s.Prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(r.URL.Path, base), true
+}
+
+// serve answers a request for rel (a slash path inside the site): folders
+// serve their index.html, and "/page" falls back to "page.html" for clean URLs.
+func (s *siteConfig) serve(w http.ResponseWriter, r *http.Request, rel string) {
+	if rel == "" {
+		// "/docs" -> "/docs/", so relative links in the index resolve
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	rel = path.Clean(rel)
+	for _, seg := range strings.Split(rel, "/") {
+		// Dotfiles (.git, .env, .cas, ...) are never published
+		if strings.HasPrefix(seg, ".") {
+			s.notFound(w, r)
+			return
+		}
+	}
+	full := filepath.Join(s.Path, filepath.FromSlash(rel))
+	fi, err := os.Stat(full)
+	switch {
+	case err == nil && fi.IsDir():
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		full = filepath.Join(full, "index.html")
+		fi, err = os.Stat(full)
+	case err != nil && filepath.Ext(full) == "":
+		full += ".html"
+		fi, err = os.Stat(full)
+	}
+	if err != nil || !fi.Mode().IsRegular() {
+		s.notFound(w, r)
+		return
+	}
+	serveSiteFile(w, r, full, http.StatusOK)
+}
+
+// notFound serves the site's own 404.html if it has one
+func (s *siteConfig) notFound(w http.ResponseWriter, r *http.Request) {
+	page := filepath.Join(s.Path, "404.html")
+	if fileExists(page) {
+		serveSiteFile(w, r, page, http.StatusNotFound)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func serveSiteFile(w http.ResponseWriter, r *http.Request, path string, status int) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", detectFileContentType(f, path))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, f)
+		}
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// sitesMiddleware serves requests for configured static sites and passes
+// everything else on to the file browser
+func sitesMiddleware(sites []siteConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range sites {
+			if rel, ok := sites[i].match(r); ok {
+				if r.Method != http.MethodGet && r.Method != http.MethodHead {
+					http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				sites[i].serve(w, r, rel)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// sizeIndexKey is the state document the directory sizes are persisted to
+	sizeIndexKey = "dirsizes"
+	// sizeIndexDebounce batches filesystem events before sizes are recomputed
+	sizeIndexDebounce = 2 * time.Second
+	// sizeIndexSaveEvery is how often a changed index is written back to disk
+	sizeIndexSaveEvery = time.Minute
+)
+
+// sizeNode holds the sizes of one directory: its direct children and the recursive total
+type sizeNode struct {
+	Direct dirSize `json:"direct"`
+	Total  dirSize `json:"total"`
+}
+
+func (s *dirSize) add(o dirSize) {
+	s.Bytes += o.Bytes
+	s.Files += o.Files
+	s.Folders += o.Folders
+}
+
+func (s dirSize) sub(o dirSize) dirSize {
+	return dirSize{Bytes: s.Bytes - o.Bytes, Files: s.Files - o.Files, Folders: s.Folders - o.Folders}
+}
+
+// sizeIndex keeps the recursive size of every directory under the served roots.
+// It is loaded from disk at startup, rebuilt in the background and then kept
+// current with fsnotify events, so folder sizes are available without walking.
+type sizeIndex struct {
+	mu      sync.RWMutex
+	dirs    map[string]*sizeNode
+	changed bool
+
+	watcher *fsnotify.Watcher
+	dirtyMu sync.Mutex
+	dirty   map[string]bool
+}
+
+func newSizeIndex(roots []string, jobs *jobManager, label func(string) string) (*sizeIndex, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	x := &sizeIndex{
+		dirs:    make(map[string]*sizeNode),
+		watcher: w,
+		dirty:   make(map[string]bool),
+	}
+	if err := loadState(sizeIndexKey, &x.dirs); err != nil {
+		log.Printf("Size index: ignoring unreadable state: %v", err)
+		x.dirs = make(map[string]*sizeNode)
+	}
+
+	go x.watch()
+	x.scanRoots(roots, jobs, label)
+	go func() {
+		for range time.Tick(sizeIndexSaveEvery) {
+			x.save()
+		}
+	}()
+	return x, nil
+}
+
+// scanRoots rebuilds the index for roots in a background job, at startup and
+// for folders a reload adds. label names a root in the job.
+func (x *sizeIndex) scanRoots(roots []string, jobs *jobManager, label func(string) string) {
+	jobs.start("index", "Folder size index", func(j *job) (interface{}, error) {
+		j.progress(func() { j.ItemsTotal = len(roots) })
+		for _, root := range roots {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				continue
+			}
+			j.add(0, label(abs))
+			start := time.Now()
+			total := x.scan(abs)
+			log.Printf("Size index: %s scanned in %s (%d files, %d bytes)", abs, time.Since(start).Round(time.Millisecond), total.Files, total.Bytes)
+			j.progress(func() { j.ItemsDone++ })
+		}
+		x.save()
+		return nil, nil
+	})
+}
+
+// lookup returns the recursive size of dir if it is indexed
+func (x *sizeIndex) lookup(dir string) (dirSize, bool) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dirSize{}, false
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	n, ok := x.dirs[abs]
+	if !ok {
+		return dirSize{}, false
+	}
+	return n.Total, true
+}
+
+// scan indexes dir and everything below it, adding watches along the way
+func (x *sizeIndex) scan(dir string) dirSize {
+	var direct, total dirSize
+	entries, err := os.ReadDir(dir)
+	if err == nil {
+		if err := x.watcher.Add(dir); err != nil {
+			log.Printf("Size index: cannot watch %s: %v", dir, err)
+		}
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if isInternal(e.Name()) {
+				continue
+			}
+			direct.Folders++
+			total.add(x.scan(filepath.Join(dir, e.Name())))
+			continue
+		}
+		if e.Type().IsRegular() {
+			if info, err := e.Info(); err == nil {
+				direct.Bytes += info.Size()
+				direct.Files++
+			}
+		}
+	}
+	total.add(direct)
+
+	x.mu.Lock()
+	x.dirs[dir] = &sizeNode{Direct: direct, Total: total}
+	x.changed = true
+	x.mu.Unlock()
+	return total
+}
+
+// watch collects fsnotify events and refreshes the affected directories in batches
+func (x *sizeIndex) watch() {
+	tick := time.NewTicker(sizeIndexDebounce)
+	defer tick.Stop()
+	for {
+		select {
+		case ev, ok := <-x.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			x.dirtyMu.Lock()
+			x.dirty[filepath.Dir(ev.Name)] = true
+			x.dirtyMu.Unlock()
+		case err, ok := <-x.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Size index: watcher error: %v", err)
+		case <-tick.C:
+			x.dirtyMu.Lock()
+			dirty := x.dirty
+			x.dirty = make(map[string]bool)
+			x.dirtyMu.Unlock()
+			for dir := range dirty {
+				x.refresh(dir)
+			}
+		}
+	}
+}
+
+// refresh recomputes the direct contents of one indexed directory and
+// propagates the difference to all of its indexed ancestors.
+func (x *sizeIndex) refresh(dir string) {
+	x.mu.RLock()
+	_, known := x.dirs[dir]
+	x.mu.RUnlock()
+	if !known {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Directory is gone; its parent gets its own event
+		return
+	}
+
+	var direct, total dirSize
+	present := make(map[string]bool)
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			if isInternal(e.Name()) {
+				continue
+			}
+			direct.Folders++
+			present[p] = true
+			x.mu.RLock()
+			n, ok := x.dirs[p]
+			x.mu.RUnlock()
+			if ok {
+				total.add(n.Total)
+			} else {
+				total.add(x.scan(p))
+			}
+			continue
+		}
+		if e.Type().IsRegular() {
+			if info, err := e.Info(); err == nil {
+				direct.Bytes += info.Size()
+				direct.Files++
+			}
+		}
+	}
+	total.add(direct)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for p := range x.dirs {
+		if strings.HasPrefix(p, prefix) && !present[p] && !present[ancestorBelow(dir, p)] {
+			delete(x.dirs, p)
+		}
+	}
+	node := x.dirs[dir]
+	delta := total.sub(node.Total)
+	node.Direct = direct
+	node.Total = total
+	for p := filepath.Dir(dir); p != dir; dir, p = p, filepath.Dir(p) {
+		parent, ok := x.dirs[p]
+		if !ok {
+			break
+		}
+		parent.Total.add(delta)
+	}
+	x.changed = true
+}
+
+// ancestorBelow returns the direct child of dir that contains p
+func ancestorBelow(dir, p string) string {
+	rel := strings.TrimPrefix(p, dir+string(filepath.Separator))
+	if i := strings.IndexRune(rel, filepath.Separator); i >= 0 {
+		rel = rel[:i]
+	}
+	return filepath.Join(dir, rel)
+}
+
+// save writes the index to the store if it changed since the last save
+func (x *sizeIndex) save() {
+	x.mu.Lock()
+	if !x.changed {
+		x.mu.Unlock()
+		return
+	}
+	x.changed = false
+	err := saveState(sizeIndexKey, x.dirs)
+	x.mu.Unlock()
+	if err != nil {
+		log.Printf("Size index: save failed: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// smartPrefix marks tree paths that refer to a smart folder rather than a directory
+const smartPrefix = "smart:"
+
+// smartFolderEntries returns the tree entries for the configured smart folders
+func (fs *FileServer) smartFolderEntries() []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, sf := range fs.cfg().SmartFolders {
+		out = append(out, map[string]interface{}{
+			"name":    sf.Name,
+			"type":    "folder",
+			"path":    smartPrefix + sf.Name,
+			"virtual": true,
+		})
+	}
+	return out
+}
+
+// listSmartFolder materializes a smart folder by running its query
+func (fs *FileServer) listSmartFolder(w http.ResponseWriter, r *http.Request, path string) {
+	name := strings.TrimPrefix(path, smartPrefix)
+	for _, sf := range fs.cfg().SmartFolders {
+		if sf.Name != name {
+			continue
+		}
+		q := sf.searchQuery
+		q.Roots = fs.visibleRoots(r, q.Roots)
+		if len(q.Roots) == 0 {
+			// None readable, which mustn't mean all of them
+			if !wantsNDJSON(r) {
+				json.NewEncoder(w).Encode([]map[string]interface{}{})
+			}
+			return
+		}
+		if wantsNDJSON(r) {
+			fs.streamSearchNDJSON(w, r, q)
+			return
+		}
+		results, _, err := fs.runSearch(r.Context(), q, sf.Limit)
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		out := []map[string]interface{}{}
+		for _, res := range results {
+			out = append(out, map[string]interface{}{
+				"name": res.Name,
+				"type": res.Type,
+				"path": fs.publicPath(res.Path),
+			})
+		}
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	httpError(w, "Smart folder not found", 404)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// statePath returns the location of a server state file inside the data directory
+func statePath(name string) string {
+	return filepath.Join(*dataDir, name)
+}
+
+// loadState decodes the state document key from the store into v. A missing
+// document is not an error.
+func loadState(key string, v interface{}) error {
+	_, err := db.get(bucketState, key, v)
+	return err
+}
+
+// saveState replaces the state document key with the JSON encoding of v
+func saveState(key string, v interface{}) error {
+	return db.put(bucketState, key, v)
+}
+
+// loadJSONFile reads a JSON file into v. A missing file is not an error.
+func loadJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where the files of a served folder are kept. The core handlers
+// (tree, view, raw, download, upload, mkdir, delete and move), /browse/,
+// share links, GraphQL and SFTP go through it rather than the os package, so a
+// served folder needn't be on the local disk. Names are server paths as the handlers see them: absolute, with the
+// OS separator. What is built on a local file system by nature (trash,
+// versions, CAS, WebDAV, sync) uses the disk directly.
+type Storage interface {
+	Open(name string) (File, error)
+	// Create opens a file for writing. An existing file is replaced once the
+	// writer is closed; the writer may implement aborter to give up instead.
+	Create(name string) (io.WriteCloser, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	// Mkdir creates a folder and any missing parents, like os.MkdirAll
+	Mkdir(name string) error
+	// Remove deletes a file or folder; folders with contents need recursive
+	Remove(name string, recursive bool) error
+	Rename(from, to string) error
+	// Watch calls fn with the changes below dir as they happen
+	Watch(dir string, fn func(event)) error
+}
+
+// File is an open file of a Storage, readable from any offset
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// aborter is implemented by writers of Create that can be discarded, leaving
+// the file as it was
+type aborter interface {
+	Abort()
+}
+
+// linkStorage is implemented by storages with symbolic links
+type linkStorage interface {
+	Readlink(name string) (string, error)
+	Lstat(name string) (os.FileInfo, error)
+}
+
+// lstat describes name itself rather than what it links to, where s has links
+func lstat(s Storage, name string) (os.FileInfo, error) {
+	if ls, ok := s.(linkStorage); ok {
+		return ls.Lstat(name)
+	}
+	return s.Stat(name)
+}
+
+// localStorage keeps files on the local disk
+type localStorage struct{}
+
+// localDisk is the storage of every served folder not configured otherwise
+var localDisk Storage = localStorage{}
+
+func (localStorage) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err // not a File holding a nil *os.File
+	}
+	return f, nil
+}
+
+// Create writes to a temporary file next to name, which replaces name when
+// closed. Writing into the existing file would change every hardlink to it,
+// such as the copies dedup and -cas merged.
+func (localStorage) Create(name string) (io.WriteCloser, error) {
+	dir, base := filepath.Split(name)
+	f, err := os.CreateTemp(dir, "."+base+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f.Chmod(mode)
+	return &replacingFile{File: f, name: name}, nil
+}
+
+// replacingFile is a file of localStorage.Create
+type replacingFile struct {
+	*os.File
+	name string
+}
+
+func (f *replacingFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.name); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (f *replacingFile) Abort() {
+	closeTemp(f.File)
+}
+
+func (localStorage) ReadDir(name string) ([]os.DirEntry, error) { return os.ReadDir(name) }
+func (localStorage) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (localStorage) Mkdir(name string) error                    { return os.MkdirAll(name, 0755) }
+func (localStorage) Rename(from, to string) error               { return os.Rename(from, to) }
+func (localStorage) Readlink(name string) (string, error)       { return os.Readlink(name) }
+func (localStorage) Lstat(name string) (os.FileInfo, error)     { return os.Lstat(name) }
+
+func (localStorage) Remove(name string, recursive bool) error {
+	if recursive {
+		return os.RemoveAll(name)
+	}
+	return os.Remove(name)
+}
+
+// openStoredFile opens the file path from its storage, answering the
+// request if it can't be served
+func (fs *FileServer) openStoredFile(w http.ResponseWriter, path string) (File, os.FileInfo, bool) {
+	f, err := fs.storageFor(path).Open(path)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		writeError(w, err, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if fi.IsDir() {
+		f.Close()
+		apiError(w, http.StatusBadRequest, codeBadRequest, "Not a file: "+fs.publicPath(path))
+		return nil, nil, false
+	}
+	return f, fi, true
+}
+
+// dirReader reads a folder a batch at a time, like *os.File does
+type dirReader interface {
+	ReadDir(n int) ([]os.DirEntry, error)
+}
+
+// readAllDir is a dirReader for storages that read folders at once
+type readAllDir struct {
+	s    Storage
+	name string
+	done bool
+}
+
+func (d *readAllDir) ReadDir(int) ([]os.DirEntry, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	d.done = true
+	entries, err := d.s.ReadDir(d.name)
+	if err != nil {
+		return nil, err
+	}
+	return entries, io.EOF
+}
+
+// storageAPIs are the endpoints, by method and path, that work through the
+// storage of the paths they are given; the others only work on the local
+// disk. HEAD counts as GET.
+var storageAPIs = map[string]bool{
+	"GET /api/tree":      true,
+	"GET /api/file":      true,
+	"GET /api/raw":       true,
+	"GET /api/download":  true,
+	"GET /api/events":    true,
+	"POST /api/upload":   true,
+	"POST /api/mkdir":    true,
+	"DELETE /api/delete": true,
+	"POST /api/delete":   true,
+	"POST /api/move":     true,
+}
+
+// requireLocal answers 501 and returns false if r is for an endpoint working
+// on the local disk only and a path is elsewhere
+func (fs *FileServer) requireLocal(w http.ResponseWriter, r *http.Request, paths ...string) bool {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if storageAPIs[method+" "+r.URL.Path] {
+		return true
+	}
+	return fs.requireLocalDisk(w, r.URL.Path, paths...)
+}
+
+// requireLocalDisk answers 501 and returns false if a path is not on the
+// local disk, for what (an endpoint or a feature of one) that works on the
+// local disk only
+func (fs *FileServer) requireLocalDisk(w http.ResponseWriter, what string, paths ...string) bool {
+	for _, p := range paths {
+		if fs.storageFor(filepath.FromSlash(p)) != localDisk {
+			apiError(w, http.StatusNotImplemented, codeNotImplemented, "Not supported in object stores: "+what)
+			return false
+		}
+	}
+	return true
+}
+
+// storageFor returns the storage of the served folder containing p
+func (fs *FileServer) storageFor(p string) Storage {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return localDisk
+	}
+	if s, ok := fs.state.Load().storages[fs.rootOf(abs)]; ok {
+		return s
+	}
+	return localDisk
+}
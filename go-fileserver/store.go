@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The metadata store is an embedded bbolt database, by default fileserver.db in
+// the data directory (config key "database"). Records such as short links and
+// saved searches live in one bucket per kind, keyed by their name; caches that
+// are read and written as a whole (content index, folder sizes, reports) are
+// single JSON documents in the state bucket. The schema is versioned and
+// brought up to date by the migrations below when the store is opened.
+
+const (
+	storeFile = "fileserver.db"
+
+	bucketMeta       = "meta"
+	bucketState      = "state"
+	bucketShortLinks = "shortlinks"
+	bucketSearches   = "searches"
+	bucketJournal    = "journal"
+	bucketTorrents   = "torrents"
+	bucketUploads    = "uploads"
+	bucketUsers      = "users"
+	bucketSessions   = "sessions"
+	bucketShares     = "shares"
+)
+
+// storeMigrations upgrade the schema one version at a time. Only ever append.
+var storeMigrations = []func(tx *bolt.Tx) error{
+	migrateJSONState,                           // 1: buckets, and the JSON state files of earlier versions
+	createBuckets(bucketJournal),               // 2: sync journal
+	createBuckets(bucketTorrents),              // 3: torrent piece hashes
+	createBuckets(bucketUploads),               // 4: resumable upload sessions
+	createBuckets(bucketUsers, bucketSessions), // 5: user accounts and their logins
+	createBuckets(bucketShares),                // 6: share links
+}
+
+// db is the open metadata store
+var db *store
+
+type store struct {
+	bolt *bolt.DB
+	path string
+}
+
+// openStore opens (creating if needed) and migrates the store at path
+func openStore(path string) (*store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is locked, is another server using it?", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &store{bolt: b, path: path}
+	if err := s.migrate(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) migrate() error {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(bucketMeta))
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get([]byte("version")); v != nil {
+			version, _ = strconv.Atoi(string(v))
+		}
+		if version > len(storeMigrations) {
+			return fmt.Errorf("%s has schema version %d, newer than this server supports (%d)", s.path, version, len(storeMigrations))
+		}
+		for i := version; i < len(storeMigrations); i++ {
+			if err := storeMigrations[i](tx); err != nil {
+				return fmt.Errorf("migration %d: %v", i+1, err)
+			}
+			log.Printf("Store: migrated %s to schema version %d", s.path, i+1)
+		}
+		return meta.Put([]byte("version"), []byte(strconv.Itoa(len(storeMigrations))))
+	})
+}
+
+// get decodes the record key of bucket into v; ok is false if there is none
+func (s *store) get(bucket, key string, v interface{}) (ok bool, err error) {
+	err = s.bolt.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(bucket)).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, v)
+	})
+	return ok, err
+}
+
+// put stores v as the record key of bucket
+func (s *store) put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+	})
+}
+
+func (s *store) delete(bucket, key string) error {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+// each calls fn with every record of bucket, in key order
+func (s *store) each(bucket string, fn func(key string, data []byte) error) error {
+	return s.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// createBuckets is a migration adding buckets
+func createBuckets(names ...string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrateJSONState creates the buckets and imports the JSON files earlier
+// versions kept in the data directory. The files are left in place.
+func migrateJSONState(tx *bolt.Tx) error {
+	for _, name := range []string{bucketState, bucketShortLinks, bucketSearches} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	// Documents move as they are
+	for key, file := range map[string]string{
+		contentIndexKey:  "content-index.json",
+		scrubManifestKey: "scrub-manifest.json",
+		scrubReportKey:   "scrub-report.json",
+		sizeIndexKey:     "dirsizes.json",
+		storageReportKey: "storage-report.json",
+	} {
+		data, err := os.ReadFile(statePath(file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketState)).Put([]byte(key), data); err != nil {
+			return err
+		}
+		log.Printf("Store: imported %s", statePath(file))
+	}
+	// Maps of records are split into one record each
+	for bucket, file := range map[string]string{
+		bucketShortLinks: "shortlinks.json",
+		bucketSearches:   "saved-searches.json",
+	} {
+		var records map[string]json.RawMessage
+		if err := loadJSONFile(statePath(file), &records); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for k, v := range records {
+			if err := tx.Bucket([]byte(bucket)).Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		if records != nil {
+			log.Printf("Store: imported %d records from %s", len(records), statePath(file))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// With -sync the server keeps a journal of changes below the served folders
+// so sync clients can mirror a folder: list it once, then ask for the changes
+// since the cursor they last saw. Files are identified by a version (size and
+// modification time, see fileVersion); writes and deletes name the version the
+// client last synced, and a file that changed on the server in between is not
+// overwritten: the upload is kept next to it as "name (conflicted copy).ext".
+const (
+	// syncJournalMax is how many changes the journal keeps. Clients whose
+	// cursor is older must list the folder again.
+	syncJournalMax = 100000
+	// syncDebounce batches journal writes
+	syncDebounce = 500 * time.Millisecond
+	// syncMaxWait caps how long /api/sync/changes waits for a change
+	syncMaxWait = 5 * time.Minute
+	// defaultSyncLimit is how many changes one /api/sync/changes call returns
+	defaultSyncLimit = 1000
+)
+
+// Change types in the journal
+const (
+	syncChanged = "changed"
+	syncDeleted = "deleted"
+)
+
+// syncChange is a journal entry, or a change returned to a client with the
+// current state of the file
+type syncChange struct {
+	Seq      uint64 `json:"seq"`
+	Type     string `json:"type"`
+	Path     string `json:"path"` // slash path
+	Folder   bool   `json:"folder,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Modified int64  `json:"modified,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// syncEntry describes a file in a listing or a diff
+type syncEntry struct {
+	Path     string `json:"path"`
+	Folder   bool   `json:"folder,omitempty"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+	Version  string `json:"version,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// syncJournal records filesystem changes in the journal bucket, keyed by
+// sequence number
+type syncJournal struct {
+	mu      sync.Mutex
+	last    uint64
+	changed chan struct{} // closed and replaced whenever changes are recorded
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// startSync opens the journal and starts recording changes
+func (fs *FileServer) startSync() {
+	j := &syncJournal{changed: make(chan struct{})}
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte(bucketJournal)).Cursor().Last(); k != nil {
+			j.last = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Sync: %v", err)
+	}
+	fs.journal = j
+	fs.subscribeBatched("Sync", eventFilter{Events: append([]string{eventUploaded}, fileEventTypes...)}, syncDebounce, false, j.record)
+	fs.watchFiles()
+}
+
+func (j *syncJournal) record(batch []event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketJournal))
+		seq := j.last
+		for _, ev := range batch {
+			c := syncChange{Type: syncChanged, Path: ev.Path, Folder: ev.Folder}
+			if ev.Type == eventDeleted || ev.Type == eventRenamed {
+				c.Type = syncDeleted
+			}
+			seq++
+			c.Seq = seq
+			data, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(seqKey(seq), data); err != nil {
+				return err
+			}
+		}
+		// Forget the oldest changes
+		cur := b.Cursor()
+		for k, _ := cur.First(); k != nil && binary.BigEndian.Uint64(k)+syncJournalMax <= seq; k, _ = cur.Next() {
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+		}
+		j.last = seq
+		return nil
+	})
+	if err != nil {
+		log.Printf("Sync: cannot record changes: %v", err)
+		return
+	}
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// cursor returns the sequence number of the last change, and a channel closed
+// when the next changes are recorded
+func (j *syncJournal) cursor() (uint64, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.last, j.changed
+}
+
+// since returns up to limit changes after cursor below prefix. reset is true
+// when the journal no longer reaches back to cursor.
+func (j *syncJournal) since(cursor uint64, prefix string, limit int) (changes []syncChange, next uint64, more, reset bool, err error) {
+	next = cursor
+	err = db.bolt.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte(bucketJournal)).Cursor()
+		if first, _ := cur.First(); first != nil && binary.BigEndian.Uint64(first) > cursor+1 {
+			reset = true
+			return nil
+		}
+		for k, v := cur.Seek(seqKey(cursor + 1)); k != nil; k, v = cur.Next() {
+			if len(changes) == limit {
+				more = true
+				return nil
+			}
+			var c syncChange
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			next = c.Seq
+			if c.Path == prefix || strings.HasPrefix(c.Path, strings.TrimSuffix(prefix, "/")+"/") {
+				changes = append(changes, c)
+			}
+		}
+		return nil
+	})
+	return changes, next, more, reset, err
+}
+
+// syncRoot resolves the root parameter: a served folder or a folder below one
+func (fs *FileServer) syncRoot(w http.ResponseWriter, r *http.Request, root string) (string, bool) {
+	if fs.journal == nil {
+		httpError(w, "Sync is disabled. Start the server with -sync to enable it.", 403)
+		return "", false
+	}
+	if root == "" {
+		httpError(w, "Missing root", 400)
+		return "", false
+	}
+	root = filepath.FromSlash(root)
+	if !fs.inRoots(root) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return "", false
+	}
+	if !fs.requireRead(w, r, root) || !fs.requireLocal(w, r, root) {
+		return "", false
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		writeError(w, err, 400)
+		return "", false
+	}
+	return abs, true
+}
+
+// fileEntry describes the file at p as it is now, with the path as clients see it
+func (fs *FileServer) fileEntry(p string, fi os.FileInfo) syncEntry {
+	e := syncEntry{Path: fs.publicPath(p), Folder: fi.IsDir(), Modified: fi.ModTime().Unix()}
+	if !fi.IsDir() {
+		e.Size = fi.Size()
+		e.Version = fileVersion(fi)
+	}
+	return e
+}
+
+// API: GET /api/sync/list?root= lists everything below a folder with the
+// journal cursor to ask for changes from
+func (fs *FileServer) handleSyncList(w http.ResponseWriter, r *http.Request) {
+	root, ok := fs.syncRoot(w, r, r.URL.Query().Get("root"))
+	if !ok {
+		return
+	}
+	hash := r.URL.Query().Get("hash") == "true"
+	// Take the cursor first: changes during the walk are delivered again
+	cursor, _ := fs.journal.cursor()
+	entries := []syncEntry{}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		if err != nil || p == root {
+			return nil
+		}
+		if isInternal(fi.Name()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		e := fs.fileEntry(p, fi)
+		if hash && !fi.IsDir() {
+			e.SHA256, _ = fs.contents.hashOf(p)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"root": fs.publicPath(root), "cursor": cursor, "files": entries})
+}
+
+// API: GET /api/sync/changes?root=&cursor=&limit=&wait= returns the changes
+// below a folder since cursor, waiting up to wait seconds for one if there are none
+func (fs *FileServer) handleSyncChanges(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	root, ok := fs.syncRoot(w, r, q.Get("root"))
+	if !ok {
+		return
+	}
+	cursor, err := strconv.ParseUint(q.Get("cursor"), 10, 64)
+	if err != nil {
+		httpError(w, "Invalid cursor", 400)
+		return
+	}
+	limit := defaultSyncLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	wait := time.Duration(0)
+	if s, err := strconv.Atoi(q.Get("wait")); err == nil && s > 0 {
+		wait = time.Duration(s) * time.Second
+		if wait > syncMaxWait {
+			wait = syncMaxWait
+		}
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	prefix := filepath.ToSlash(root)
+	for {
+		last, changed := fs.journal.cursor()
+		if cursor > last {
+			// A cursor from another server or a replaced store
+			writeSyncChanges(w, nil, last, false, true)
+			return
+		}
+		changes, next, more, reset, err := fs.journal.since(cursor, prefix, limit)
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		if len(changes) > 0 || more || reset || wait == 0 {
+			writeSyncChanges(w, fs.currentChanges(changes), next, more, reset)
+			return
+		}
+		cursor = next
+		select {
+		case <-changed:
+		case <-deadline.C:
+			writeSyncChanges(w, nil, cursor, false, false)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// currentChanges merges the changes per path and fills in the current state of
+// each file; a changed file that is gone by now is reported as deleted. The
+// paths become paths as clients see them.
+func (fs *FileServer) currentChanges(changes []syncChange) []syncChange {
+	last := make(map[string]int)
+	for i, c := range changes {
+		last[c.Path] = i
+	}
+	out := []syncChange{}
+	for i, c := range changes {
+		if last[c.Path] != i {
+			continue
+		}
+		if c.Type == syncChanged {
+			if fi, err := os.Stat(filepath.FromSlash(c.Path)); err == nil {
+				e := fs.fileEntry(c.Path, fi)
+				c.Folder, c.Size, c.Modified, c.Version = e.Folder, e.Size, e.Modified, e.Version
+			} else {
+				c.Type = syncDeleted
+			}
+		}
+		c.Path = fs.publicPath(c.Path)
+		out = append(out, c)
+	}
+	return out
+}
+
+func writeSyncChanges(w http.ResponseWriter, changes []syncChange, cursor uint64, more, reset bool) {
+	if changes == nil {
+		changes = []syncChange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes, "cursor": cursor, "more": more, "reset": reset})
+}
+
+// API: POST /api/sync/diff compares a client's listing of a folder with the
+// server's. Body: {"root": "/path", "files": [{"path", "size", "modified", "sha256"}]}
+func (fs *FileServer) handleSyncDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Root  string      `json:"root"`
+		Files []syncEntry `json:"files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	local := req.Root
+	if local != "" && !fs.resolvePaths(w, &local) {
+		return
+	}
+	root, ok := fs.syncRoot(w, r, local)
+	if !ok {
+		return
+	}
+	prefix := filepath.ToSlash(root) + "/"
+	result := map[string][]syncEntry{"same": {}, "changed": {}, "missing": {}, "serverOnly": {}}
+	seen := make(map[string]bool)
+	for _, c := range req.Files {
+		p := filepath.ToSlash(fs.localPath(c.Path))
+		if !strings.HasPrefix(p, prefix) || hasInternal(p) {
+			httpError(w, fmt.Sprintf("%s is not inside %s", c.Path, req.Root), 400)
+			return
+		}
+		seen[p] = true
+		fi, err := os.Stat(filepath.FromSlash(p))
+		if err != nil {
+			result["missing"] = append(result["missing"], c)
+			continue
+		}
+		e := fs.fileEntry(p, fi)
+		same := e.Folder == c.Folder
+		switch {
+		case !same || e.Folder:
+		case c.SHA256 != "":
+			sum, err := fs.contents.hashOf(filepath.FromSlash(p))
+			same = err == nil && sum == c.SHA256
+			e.SHA256 = sum
+		case c.Version != "":
+			same = c.Version == e.Version
+		default:
+			same = c.Size == e.Size && c.Modified == e.Modified
+		}
+		if same {
+			result["same"] = append(result["same"], e)
+		} else {
+			result["changed"] = append(result["changed"], e)
+		}
+	}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return nil
+		}
+		if isInternal(fi.Name()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if (fi.IsDir() || fi.Mode().IsRegular()) && !seen[filepath.ToSlash(p)] {
+			result["serverOnly"] = append(result["serverOnly"], fs.fileEntry(p, fi))
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	cursor, _ := fs.journal.cursor()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cursor": cursor, "same": result["same"], "changed": result["changed"], "missing": result["missing"], "serverOnly": result["serverOnly"]})
+}
+
+// conflictName returns a free "name (conflicted copy).ext" next to p
+func conflictName(p string) string {
+	dir, base := filepath.Split(p)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	name := stem + " (conflicted copy)" + ext
+	for i := 2; fileExists(filepath.Join(dir, name)); i++ {
+		name = fmt.Sprintf("%s (conflicted copy %d)%s", stem, i, ext)
+	}
+	return filepath.Join(dir, name)
+}
+
+// API: /api/sync/file?path=&base=
+// PUT uploads a file the client changed since it synced version base (empty:
+// the client has never seen it). If the server's file changed in between, the
+// upload is stored as a conflicted copy instead. With folder=true it creates a
+// folder. DELETE removes a file that is still at version base, or an empty folder.
+func (fs *FileServer) handleSyncFile(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("path") == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	p := filepath.FromSlash(q.Get("path"))
+	abs, ok := fs.syncRoot(w, r, p)
+	if !ok {
+		return
+	}
+	if abs == fs.rootOf(p) {
+		httpError(w, "Cannot replace a served folder", 403)
+		return
+	}
+	base := q.Get("base")
+	switch r.Method {
+	case http.MethodPut:
+		if q.Get("folder") == "true" {
+			if !fs.requireWrite(w, r, p) {
+				return
+			}
+			if err := os.MkdirAll(p, 0755); err != nil {
+				writeError(w, err, 500)
+				return
+			}
+			// The watcher can miss folders created below a new one
+			fs.events.publish(event{Type: eventCreated, Path: filepath.ToSlash(abs), Folder: true})
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(p)})
+			return
+		}
+		if !fs.checkPut(w, r, p) {
+			return
+		}
+		target, conflict := p, false
+		if fi, exists := statFile(p); exists && fileVersion(fi) != base {
+			// Identical content is no conflict
+			sum, err := fs.contents.hashOf(p)
+			if want := q.Get("sha256"); want != "" && err == nil && sum == want {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(p), "size": fi.Size(), "sha256": sum, "version": fileVersion(fi)})
+				return
+			}
+			target, conflict = conflictName(p), true
+		}
+		fi, sum, ok := fs.writeBody(w, r, target)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(target), "size": fi.Size(), "sha256": sum, "version": fileVersion(fi), "conflict": conflict})
+	case http.MethodDelete:
+		if hasInternal(p) {
+			httpError(w, "Forbidden", 403)
+			return
+		}
+		if !fs.requireWrite(w, r, p) {
+			return
+		}
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+			return
+		}
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		if !fi.IsDir() && fileVersion(fi) != base {
+			writeErrorJSON(w, http.StatusConflict, map[string]interface{}{"error": errorBody(codeConflict, "The file changed since"), "conflict": true, "version": fileVersion(fi)})
+			return
+		}
+		if err := fs.remove(p, false); err != nil {
+			writeError(w, err, http.StatusConflict)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
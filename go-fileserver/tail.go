@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// defaultTailLines is how many existing lines /api/tail starts with
+	defaultTailLines = 10
+	// tailPoll is how often a followed file is checked without a change
+	// notification, for filesystems that don't send them
+	tailPoll = 2 * time.Second
+)
+
+// API: GET /api/tail?path=/var/log/app.log&lines=10
+// Follows a file like tail -f, as server-sent events: the last lines (default
+// 10, 0 for none) and then every line appended, each as a message event with
+// the line as data. When the file is replaced, as by log rotation, the rest of
+// the old file is sent and then a "rotated" event, after which the new file
+// is followed from its start; a file cut short sends "truncated" and is read
+// again from its start. Changes are noticed through filesystem notifications,
+// and every 2 seconds without them.
+func (fs *FileServer) handleTail(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.Clean(filepath.FromSlash(path))
+	if !fs.rawAllowed(r, path) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	lines := defaultTailLines
+	if v := r.URL.Query().Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxPageLines {
+			httpError(w, "Invalid lines", 400)
+			return
+		}
+		lines = n
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		httpError(w, "File not found", 404)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		httpError(w, "Not a file", 400)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		f.Close()
+		httpError(w, "Streaming not supported", 500)
+		return
+	}
+	t := &tailer{w: w, path: path, name: fs.publicPath(path), f: f, offset: fi.Size()}
+	defer func() { t.f.Close() }()
+	if lines > 0 {
+		t.offset = tailStart(f, fi.Size(), lines)
+	}
+
+	// The folder is watched rather than the file, to see it being replaced
+	var changes <-chan fsnotify.Event
+	if watcher, err := fsnotify.NewWatcher(); err == nil {
+		defer watcher.Close()
+		if watcher.Add(filepath.Dir(path)) == nil {
+			changes = watcher.Events
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	t.check()
+	flusher.Flush()
+
+	poll := time.NewTicker(tailPoll)
+	defer poll.Stop()
+	ping := time.NewTicker(eventStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			if filepath.Clean(ev.Name) != path {
+				continue
+			}
+			t.check()
+		case <-poll.C:
+			t.check()
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// tailer is a file being followed for /api/tail
+type tailer struct {
+	w       io.Writer
+	path    string
+	name    string // path as the client sees it
+	f       *os.File
+	offset  int64  // how far f has been read
+	pending []byte // the start of a line still being written
+}
+
+// check sends what was appended to the file, and notices it being replaced
+// or cut short
+func (t *tailer) check() {
+	t.readMore()
+	cur, err := os.Stat(t.path)
+	if err != nil {
+		return // moved away and not yet replaced
+	}
+	old, err := t.f.Stat()
+	if err != nil {
+		return
+	}
+	switch {
+	case !os.SameFile(cur, old):
+		f, err := os.Open(t.path)
+		if err != nil {
+			return
+		}
+		t.flushPending()
+		t.f.Close()
+		t.f, t.offset = f, 0
+		t.event("rotated")
+		t.readMore()
+	case old.Size() < t.offset:
+		t.pending = nil
+		t.offset = 0
+		t.event("truncated")
+		t.readMore()
+	}
+}
+
+// readMore sends the complete lines appended since the last read
+func (t *tailer) readMore() {
+	buf := make([]byte, textPageChunk)
+	for {
+		n, err := t.f.ReadAt(buf, t.offset)
+		t.offset += int64(n)
+		t.pending = append(t.pending, buf[:n]...)
+		for {
+			i := bytes.IndexByte(t.pending, '\n')
+			if i < 0 {
+				break
+			}
+			t.line(t.pending[:i])
+			t.pending = t.pending[i+1:]
+		}
+		if len(t.pending) > maxGrepLine {
+			t.flushPending()
+		}
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+// flushPending sends an unfinished line as it is
+func (t *tailer) flushPending() {
+	if len(t.pending) > 0 {
+		t.line(t.pending)
+		t.pending = nil
+	}
+}
+
+func (t *tailer) line(b []byte) {
+	// A carriage return would end the data field
+	b = bytes.ReplaceAll(b, []byte("\r"), nil)
+	fmt.Fprintf(t.w, "data: %s\n\n", b)
+}
+
+func (t *tailer) event(name string) {
+	data, _ := json.Marshal(map[string]string{"path": t.name})
+	fmt.Fprintf(t.w, "event: %s\ndata: %s\n\n", name, data)
+}
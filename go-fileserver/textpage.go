@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultPageLines is how many lines a page of a text file has without ?lines=
+	defaultPageLines = 1000
+	// maxPageLines caps ?lines= and ?tail=
+	maxPageLines = 100000
+	// textPageChunk is how much of a file is read at a time looking for lines
+	textPageChunk = 64 * 1024
+)
+
+// renderTextPage shows ?lines= lines (default 1000) of a text file from the
+// line at or after byte ?offset=, or with ?tail=n its last n lines, so files
+// of any size can be paged through. A page holds at most 1MB. The answer has
+// the page's offset and the one of the next page, next, which is size at the
+// end of the file.
+func renderTextPage(w http.ResponseWriter, r *http.Request, p *previewFile) {
+	q := r.URL.Query()
+	size := p.Info.Size()
+	lines := defaultPageLines
+	if v := q.Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLines {
+			httpError(w, "Invalid lines", 400)
+			return
+		}
+		lines = n
+	}
+	var start int64
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLines {
+			httpError(w, "Invalid tail", 400)
+			return
+		}
+		lines = n
+		start = tailStart(p.File, size, n)
+	} else if v := q.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			httpError(w, "Invalid offset", 400)
+			return
+		}
+		start = lineStart(p.File, min(n, size))
+	}
+
+	buf := make([]byte, min(int64(maxTextPreview), size-start))
+	n, err := p.File.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		writeError(w, err, 500)
+		return
+	}
+	buf = buf[:n]
+	end, count := len(buf), 0
+	for i, c := range buf {
+		if c == '\n' {
+			if count++; count == lines {
+				end = i + 1
+				break
+			}
+		}
+	}
+	// A page cut short by the size limit ends with its last complete line
+	if count < lines && start+int64(n) < size {
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			end = i + 1
+		}
+	}
+	next := start + int64(end)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      "text",
+		"content":   string(buf[:end]),
+		"language":  extToLang(p.Ext),
+		"truncated": start > 0 || next < size,
+		"offset":    start,
+		"next":      next,
+		"size":      size,
+	})
+}
+
+// lineStart returns off if a line starts there, else where the next one
+// does, looking up to maxTextPreview bytes ahead
+func lineStart(f io.ReaderAt, off int64) int64 {
+	if off == 0 {
+		return 0
+	}
+	buf := make([]byte, textPageChunk)
+	for pos := off - 1; pos < off+maxTextPreview; pos += int64(len(buf)) {
+		n, err := f.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1
+		}
+		if err != nil {
+			return pos + int64(n) // the end of the file
+		}
+	}
+	return off
+}
+
+// tailStart returns where the last n lines of a file of size bytes start,
+// looking up to maxTextPreview bytes back
+func tailStart(f io.ReaderAt, size int64, n int) int64 {
+	limit := max(0, size-maxTextPreview)
+	buf := make([]byte, textPageChunk)
+	seen := 0
+	for pos := size; pos > limit; {
+		from := max(limit, pos-int64(len(buf)))
+		m, err := f.ReadAt(buf[:pos-from], from)
+		if err != nil && err != io.EOF {
+			return lineStart(f, limit)
+		}
+		for i := m - 1; i >= 0; i-- {
+			// A newline at the very end ends the last line rather than starting one
+			if buf[i] != '\n' || from+int64(i) == size-1 {
+				continue
+			}
+			if seen++; seen == n {
+				return from + int64(i) + 1
+			}
+		}
+		pos = from
+	}
+	return lineStart(f, limit)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// defaultThumbSize is the longer side of a thumbnail without ?size=
+	defaultThumbSize = 256
+	minThumbSize     = 16
+	maxThumbSize     = 1024
+	// maxThumbPixels is the largest image thumbnails are made of, as decoding
+	// takes 4 bytes per pixel
+	maxThumbPixels = 100 * 1000 * 1000
+)
+
+// errNotImage is returned for files thumbnails can't be made of
+var errNotImage = errors.New("not an image")
+
+// thumbSlots limits how many thumbnails are made at once
+var thumbSlots = make(chan struct{}, runtime.NumCPU())
+
+// API: GET /api/thumb?path=/path/to/image.jpg&size=256
+// A JPEG (PNG for images with transparency) no larger than size pixels
+// (16 to 1024) on either side, for listing folders of photos without loading
+// them. JPEG, PNG, GIF, WebP, BMP and TIFF images can be shrunk, and JPEGs are
+// turned as their EXIF orientation says. Thumbnails are cached in
+// thumbs/ in -data-dir, keyed by the file's path, size and modification time.
+func (fs *FileServer) handleThumb(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.FromSlash(path)
+	size := defaultThumbSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minThumbSize || n > maxThumbSize {
+			httpError(w, "Invalid size", 400)
+			return
+		}
+		size = n
+	}
+	if !fs.rawAllowed(r, path) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	fi, err := os.Stat(abs)
+	if err != nil || fi.IsDir() {
+		httpError(w, "File not found", 404)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", abs, fi.Size(), fi.ModTime().UnixNano(), size)))
+	key := hex.EncodeToString(sum[:])
+	dir := filepath.Join(statePath("thumbs"), key[:2])
+	cached := ""
+	for _, ext := range []string{".jpg", ".png"} {
+		if _, err := os.Stat(filepath.Join(dir, key+ext)); err == nil {
+			cached = filepath.Join(dir, key+ext)
+		}
+	}
+	if cached == "" {
+		select {
+		case thumbSlots <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		cached, err = makeThumb(r.Context(), abs, dir, key, size)
+		<-thumbSlots
+		if err == errNotImage {
+			httpError(w, "Not an image that can be shrunk", 415)
+			return
+		}
+		if err != nil {
+			writeError(w, err, 422)
+			return
+		}
+	}
+
+	f, err := os.Open(cached)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	defer f.Close()
+	ct := "image/jpeg"
+	if filepath.Ext(cached) == ".png" {
+		ct = "image/png"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("ETag", `"`+key[:32]+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// makeThumb shrinks the image at path to fit size and stores it in dir as
+// key.jpg, or key.png if it has transparency. It returns the file written.
+func makeThumb(ctx context.Context, path, dir, key string, size int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", errNotImage
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxThumbPixels {
+		return "", fmt.Errorf("image too large for a thumbnail: %dx%d", cfg.Width, cfg.Height)
+	}
+	orientation := 1
+	if format == "jpeg" {
+		f.Seek(0, io.SeekStart)
+		orientation = jpegOrientation(f)
+	}
+	f.Seek(0, io.SeekStart)
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return "", err
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	b := src.Bounds()
+	tw, th := b.Dx(), b.Dy()
+	if tw > size || th > size {
+		if tw >= th {
+			tw, th = size, max(1, th*size/tw)
+		} else {
+			tw, th = max(1, tw*size/th), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	dst = orient(dst, orientation)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	ext := ".jpg"
+	if !dst.Opaque() {
+		ext = ".png"
+	}
+	tmp, err := os.CreateTemp(dir, "thumb-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if ext == ".png" {
+		err = png.Encode(tmp, dst)
+	} else {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: 82})
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(dir, key+ext)
+	return out, os.Rename(tmp.Name(), out)
+}
+
+// orient turns img upright as EXIF orientation o (1 to 8) says
+func orient(img *image.RGBA, o int) *image.RGBA {
+	if o < 2 || o > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down, mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // turned left, needs turning right
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // turned right, needs turning left
+				dx, dy = y, w-1-x
+			}
+			si, di := img.PixOffset(x, y), out.PixOffset(dx, dy)
+			copy(out.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return out
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG file, 1 (upright)
+// if it has none
+func jpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+	for {
+		var m [4]byte
+		if _, err := io.ReadFull(br, m[:]); err != nil || m[0] != 0xFF {
+			return 1
+		}
+		n := int(binary.BigEndian.Uint16(m[2:])) - 2
+		// EXIF comes before the image data starts
+		if m[1] == 0xDA || n < 0 {
+			return 1
+		}
+		if m[1] != 0xE1 {
+			if _, err := br.Discard(n); err != nil {
+				return 1
+			}
+			continue
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return 1
+		}
+		if o := exifOrientation(seg); o != 0 {
+			return o
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from an APP1 segment, 0 if it
+// isn't there
+func exifOrientation(seg []byte) int {
+	if len(seg) < 14 || string(seg[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := seg[6:]
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	off := int(bo.Uint32(tiff[4:8]))
+	if off < 8 || off+2 > len(tiff) {
+		return 0
+	}
+	count := int(bo.Uint16(tiff[off:]))
+	for i := 0; i < count; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(bo.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
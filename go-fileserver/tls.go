@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// hsts adds a Strict-Transport-Security header to every response
+func hsts(maxAge time.Duration, next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS answers plain HTTP requests with a permanent redirect to the
+// same URL on the HTTPS port
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveHTTPRedirect listens on addr and serves h, the redirect to HTTPS
+func serveHTTPRedirect(addr string, h http.Handler) {
+	log.Printf("Redirecting HTTP on %s to HTTPS", addr)
+	if err := http.ListenAndServe(addr, h); err != nil {
+		log.Fatalf("HTTP redirect: %v", err)
+	}
+}
+
+// autocertManager gets certificates for the comma-separated domains from
+// Let's Encrypt and renews them, keeping them in the data directory. Let's
+// Encrypt has to reach the server on port 443 (TLS-ALPN challenge) or on
+// port 80 through its HTTPHandler (HTTP challenge).
+func autocertManager(domains, email string) (*autocert.Manager, error) {
+	var hosts []string
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			hosts = append(hosts, d)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("-autocert-domain: no domain given")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(statePath("autocert")),
+		Email:      email,
+	}, nil
+}
+
+// serveAutocert serves handler over HTTPS on ln with certificates from m
+func serveAutocert(ln net.Listener, m *autocert.Manager, handler http.Handler) error {
+	return http.Serve(tls.NewListener(ln, m.TLSConfig()), handler)
+}
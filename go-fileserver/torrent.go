@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Large files can be offered as torrents with the server as web seed (BEP 19):
+// BitTorrent clients download pieces from /api/raw and from each other, so a
+// popular file doesn't have to come from this server in full for everyone.
+// Piece hashes take a full read of the file and are kept in the store until
+// the file changes.
+const (
+	// torrentSyncMax is the largest file hashed while the request waits; bigger
+	// ones are hashed by a job of kind "torrent"
+	torrentSyncMax  = 256 << 20
+	minTorrentPiece = 256 << 10
+	maxTorrentPiece = 16 << 20
+	// torrentPieces is roughly how many pieces a torrent is split into
+	torrentPieces = 1500
+)
+
+// torrentInfo is the cached info dictionary of a file, valid for one version
+type torrentInfo struct {
+	Version string `json:"version"`
+	Info    []byte `json:"info"` // bencoded
+}
+
+func (t torrentInfo) infoHash() string {
+	h := sha1.Sum(t.Info)
+	return hex.EncodeToString(h[:])
+}
+
+// bencode appends the bencoding of v, which is made of strings, integers,
+// lists and maps, to buf
+func bencode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range v {
+			bencode(buf, s)
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, e := range v {
+			bencode(buf, e)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencode(buf, k)
+			bencode(buf, v[k])
+		}
+		buf.WriteByte('e')
+	case json.RawMessage:
+		// Already bencoded
+		buf.Write(v)
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// torrentPieceSize picks a power of two piece length for a file of size bytes
+func torrentPieceSize(size int64) int64 {
+	piece := int64(minTorrentPiece)
+	for piece < maxTorrentPiece && size/piece > torrentPieces {
+		piece *= 2
+	}
+	return piece
+}
+
+// hashTorrent builds the info dictionary of the file at p. progress is called
+// with each piece's length.
+func hashTorrent(p string, progress func(n int64) error) (*torrentInfo, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	piece := torrentPieceSize(fi.Size())
+	var pieces bytes.Buffer
+	buf := make([]byte, piece)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			h := sha1.Sum(buf[:n])
+			pieces.Write(h[:])
+			if err := progress(int64(n)); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var info bytes.Buffer
+	bencode(&info, map[string]interface{}{
+		"name":         filepath.Base(p),
+		"length":       fi.Size(),
+		"piece length": piece,
+		"pieces":       pieces.Bytes(),
+	})
+	return &torrentInfo{Version: fileVersion(fi), Info: info.Bytes()}, nil
+}
+
+// cachedTorrent returns the stored info dictionary of p if it is current
+func cachedTorrent(p string, fi os.FileInfo) (*torrentInfo, bool) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, false
+	}
+	var t torrentInfo
+	if ok, err := db.get(bucketTorrents, abs, &t); err != nil || !ok || t.Version != fileVersion(fi) {
+		return nil, false
+	}
+	return &t, true
+}
+
+func storeTorrent(p string, t *torrentInfo) error {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	return db.put(bucketTorrents, abs, t)
+}
+
+// webSeedURL is the absolute /api/raw URL of p as seen by the client of r
+func (fs *FileServer) webSeedURL(r *http.Request, p string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + fs.rawURL(p)
+}
+
+// torrentFile bencodes a .torrent with the given web seed
+func (fs *FileServer) torrentFile(t *torrentInfo, seed string) []byte {
+	meta := map[string]interface{}{
+		"info":          json.RawMessage(t.Info),
+		"url-list":      []string{seed},
+		"created by":    "go-fileserver",
+		"creation date": time.Now().Unix(),
+	}
+	if trackers := fs.cfg().Trackers; len(trackers) > 0 {
+		meta["announce"] = trackers[0]
+		tiers := make([]interface{}, len(trackers))
+		for i, tr := range trackers {
+			tiers[i] = []string{tr}
+		}
+		meta["announce-list"] = tiers
+	}
+	var buf bytes.Buffer
+	bencode(&buf, meta)
+	return buf.Bytes()
+}
+
+// magnetLink returns the magnet URI of p with the web seed and trackers
+func (fs *FileServer) magnetLink(p string, t *torrentInfo, size int64, seed string) string {
+	q := url.Values{}
+	q.Set("dn", filepath.Base(p))
+	q.Set("xl", strconv.FormatInt(size, 10))
+	q.Set("ws", seed)
+	q["tr"] = fs.cfg().Trackers
+	return "magnet:?xt=urn:btih:" + t.infoHash() + "&" + q.Encode()
+}
+
+// API: GET /api/torrent?path= downloads a .torrent for a file with this server
+// as web seed; format=magnet returns its magnet link instead. Files larger than
+// torrentSyncMax that weren't hashed yet are hashed by a job first (202).
+func (fs *FileServer) handleTorrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	p = filepath.FromSlash(p)
+	if !fs.inRoots(p) {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	if !fs.rawAllowed(r, p) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	fi, ok := statFile(p)
+	if !ok {
+		httpError(w, "File not found", 404)
+		return
+	}
+
+	seed := fs.webSeedURL(r, p)
+	t, ok := cachedTorrent(p, fi)
+	if !ok && fi.Size() > torrentSyncMax {
+		title := "Torrent of " + fs.publicPath(p)
+		for _, j := range fs.jobs.list("torrent") {
+			if !j.finished() && j.Title == title {
+				acceptedJob(w, r, j)
+				return
+			}
+		}
+		j := fs.jobs.start("torrent", title, func(j *job) (interface{}, error) {
+			j.progress(func() { j.Total = fi.Size() })
+			t, err := hashTorrent(p, func(n int64) error {
+				j.add(n, fs.publicPath(p))
+				return j.checkpoint()
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := storeTorrent(p, t); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"infoHash": t.infoHash(), "magnet": fs.magnetLink(p, t, fi.Size(), seed)}, nil
+		})
+		acceptedJob(w, r, j)
+		return
+	}
+	if !ok {
+		var err error
+		if t, err = hashTorrent(p, func(int64) error { return r.Context().Err() }); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		if err := storeTorrent(p, t); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("format") == "magnet" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"infoHash": t.infoHash(), "magnet": fs.magnetLink(p, t, fi.Size(), seed)})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(p) + ".torrent"}))
+	w.Write(fs.torrentFile(t, seed))
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// transferChunk is how much is copied between pause/cancel checks
+const transferChunk = 1 << 20
+
+// Cross-root moves and copies run as background jobs. Every copied file is
+// verified by hashing the destination before a move deletes the source, so a
+// transfer interrupted at any point never loses data.
+
+// transferFile is one regular file of a transfer plan
+type transferFile struct {
+	src, dst string
+	size     int64
+}
+
+// transferItem is a selected file or folder and the path it is moved or copied to
+type transferItem struct {
+	src, dst string
+}
+
+// transferItems places every path into dest under its own name
+func transferItems(paths []string, dest string) []transferItem {
+	items := make([]transferItem, len(paths))
+	for i, p := range paths {
+		items[i] = transferItem{src: p, dst: filepath.Join(dest, filepath.Base(p))}
+	}
+	return items
+}
+
+// checkTransfer rejects transfers that would overwrite something or recurse into themselves
+func (fs *FileServer) checkTransfer(items []transferItem) error {
+	for _, it := range items {
+		if fileExists(it.dst) {
+			return fmt.Errorf("destination already exists: %s", fs.publicPath(it.dst))
+		}
+		if it.dst == it.src || strings.HasPrefix(it.dst, it.src+string(filepath.Separator)) {
+			return fmt.Errorf("cannot transfer %s into itself", fs.publicPath(it.src))
+		}
+	}
+	return nil
+}
+
+// planTransfer lists the files below the sources and where each one goes
+func planTransfer(items []transferItem) ([]transferFile, []string, error) {
+	var files []transferFile
+	var dirs []string
+	for _, it := range items {
+		src, base := it.src, it.dst
+		err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(src, p)
+			target := filepath.Join(base, rel)
+			if fi.IsDir() {
+				if isInternal(fi.Name()) {
+					return filepath.SkipDir
+				}
+				dirs = append(dirs, target)
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				files = append(files, transferFile{src: p, dst: target, size: fi.Size()})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, dirs, nil
+}
+
+func (fs *FileServer) doTransfer(j *job, op string, items []transferItem) error {
+	if err := fs.checkTransfer(items); err != nil {
+		return err
+	}
+
+	// Moves within one filesystem are a rename and need no copying
+	if op == "move" {
+		var rest []transferItem
+		for _, it := range items {
+			if err := os.Rename(it.src, it.dst); err != nil {
+				rest = append(rest, it)
+			}
+		}
+		if len(rest) == 0 {
+			return nil
+		}
+		items = rest
+	}
+
+	files, dirs, err := planTransfer(items)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	j.progress(func() {
+		j.Total = total
+		j.ItemsTotal = len(files)
+	})
+	if err := fs.checkFreeSpace(filepath.Dir(items[0].dst), total); err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := j.checkpoint(); err != nil {
+			return err
+		}
+		j.add(0, fs.publicPath(f.src))
+		if err := fs.copyVerified(j, f); err != nil {
+			return err
+		}
+		j.progress(func() { j.ItemsDone++ })
+	}
+
+	if op == "move" {
+		// Everything was copied and verified; only now drop the sources
+		for _, it := range items {
+			if err := os.RemoveAll(it.src); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyVerified copies one file in chunks (honouring pause and cancel), then
+// re-reads the destination and compares its hash with the source.
+func (fs *FileServer) copyVerified(j *job, f transferFile) error {
+	in, err := os.Open(f.src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(f.dst), "."+filepath.Base(f.dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	out.Chmod(fi.Mode().Perm())
+	tmp := out.Name()
+	h := sha256.New()
+	for {
+		if err := j.checkpoint(); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+		n, err := io.CopyN(io.MultiWriter(out, h), in, transferChunk)
+		j.add(n, "")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+	if got, err := hashFile(tmp); err != nil || got != want {
+		os.Remove(tmp)
+		if err == nil {
+			err = fmt.Errorf("verification failed for %s", fs.publicPath(f.dst))
+		}
+		return err
+	}
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	return os.Rename(tmp, f.dst)
+}
+
+// API: Move or copy paths into a folder as a background job (see /api/jobs)
+func (fs *FileServer) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Op    string   `json:"op"`
+		Paths []string `json:"paths"`
+		Dest  string   `json:"dest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return
+	}
+	if req.Op != "move" && req.Op != "copy" {
+		httpError(w, "op must be move or copy", 400)
+		return
+	}
+	paths, dest, ok := fs.transferPaths(w, r, req.Op, req.Paths, req.Dest)
+	if !ok {
+		return
+	}
+	items := transferItems(paths, dest)
+	if err := fs.checkTransfer(items); err != nil {
+		writeError(w, err, 409)
+		return
+	}
+	acceptedJob(w, r, fs.startTransfer(req.Op, items, dest))
+}
+
+// transferPaths validates the sources and the destination folder of a move or copy,
+// and that the client may write to them.
+func (fs *FileServer) transferPaths(w http.ResponseWriter, r *http.Request, op string, reqPaths []string, reqDest string) ([]string, string, bool) {
+	if len(reqPaths) == 0 || reqDest == "" {
+		httpError(w, "Missing paths or dest", 400)
+		return nil, "", false
+	}
+	reqPaths = append([]string(nil), reqPaths...)
+	if !fs.resolvePathList(w, reqPaths) || !fs.resolvePaths(w, &reqDest) {
+		return nil, "", false
+	}
+	if !fs.requireRead(w, r, append(reqPaths, reqDest)...) || !fs.requireLocal(w, r, append(reqPaths, reqDest)...) {
+		return nil, "", false
+	}
+	dest, _ := filepath.Abs(filepath.FromSlash(reqDest))
+	if !fs.inRoots(dest) {
+		httpError(w, "Destination is not inside a served folder", 403)
+		return nil, "", false
+	}
+	if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+		httpError(w, "Destination is not a folder", 400)
+		return nil, "", false
+	}
+	var paths []string
+	for _, p := range reqPaths {
+		abs, _ := filepath.Abs(filepath.FromSlash(p))
+		root := fs.rootOf(abs)
+		if root == "" || !fs.inRoots(abs) {
+			httpError(w, "Path is not inside a served folder: "+fs.publicPath(p), 403)
+			return nil, "", false
+		}
+		if abs == root {
+			httpError(w, "Cannot transfer a served folder itself", 400)
+			return nil, "", false
+		}
+		if _, err := os.Stat(abs); err != nil {
+			writeError(w, err, 400)
+			return nil, "", false
+		}
+		paths = append(paths, abs)
+	}
+	if !fs.requireWrite(w, r, dest) {
+		return nil, "", false
+	}
+	if op == "move" && !fs.requireWrite(w, r, paths...) {
+		return nil, "", false
+	}
+	return paths, dest, true
+}
+
+// startTransfer runs a move or copy of items into dest as a job
+func (fs *FileServer) startTransfer(op string, items []transferItem, dest string) *job {
+	title := fmt.Sprintf("%s %d item(s) to %s", op, len(items), fs.publicPath(dest))
+	return fs.jobs.start("transfer", title, func(j *job) (interface{}, error) {
+		return nil, fs.doTransfer(j, op, items)
+	})
+}
+
+// transferItemOf validates the {"src", "dst"} body of a move or copy of one
+// item: both inside the served folders, src not a served folder itself, dst
+// free and writable
+func (fs *FileServer) transferItemOf(w http.ResponseWriter, r *http.Request, op string) (transferItem, bool) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return transferItem{}, false
+	}
+	var req struct {
+		Src string `json:"src"`
+		Dst string `json:"dst"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid JSON body", 400)
+		return transferItem{}, false
+	}
+	if req.Src == "" || req.Dst == "" {
+		httpError(w, "Missing src or dst", 400)
+		return transferItem{}, false
+	}
+	if !fs.resolvePaths(w, &req.Src, &req.Dst) {
+		return transferItem{}, false
+	}
+	if !fs.requireRead(w, r, req.Src, req.Dst) || !fs.requireInRoots(w, req.Src, req.Dst) || !fs.requireLocal(w, r, req.Src, req.Dst) {
+		return transferItem{}, false
+	}
+	src, _ := filepath.Abs(filepath.FromSlash(req.Src))
+	dst, _ := filepath.Abs(filepath.FromSlash(req.Dst))
+	if op == "move" && src == fs.rootOf(src) {
+		httpError(w, "Cannot move a served folder itself", 400)
+		return transferItem{}, false
+	}
+	if _, err := lstat(fs.storageFor(src), src); err != nil {
+		httpError(w, "Not found: "+fs.publicPath(src), 404)
+		return transferItem{}, false
+	}
+	writes := []string{dst}
+	if op == "move" {
+		writes = append(writes, src)
+	}
+	if !fs.requireWrite(w, r, writes...) {
+		return transferItem{}, false
+	}
+	item := transferItem{src: src, dst: dst}
+	if err := fs.checkTransfer([]transferItem{item}); err != nil {
+		writeError(w, err, 409)
+		return transferItem{}, false
+	}
+	return item, true
+}
+
+// API: POST /api/move renames or moves one file or folder to a new path.
+// JSON body: {"src": "/old/path", "dst": "/new/path"}. Missing parent folders
+// of dst are created. Within one filesystem this is a rename and answers
+// {"success": true, "path": dst}; across filesystems the item is copied,
+// verified and deleted by a transfer job (202 with the job).
+func (fs *FileServer) handleMove(w http.ResponseWriter, r *http.Request) {
+	item, ok := fs.transferItemOf(w, r, "move")
+	if !ok {
+		return
+	}
+	store := fs.storageFor(item.src)
+	if store != fs.storageFor(item.dst) {
+		apiError(w, http.StatusNotImplemented, codeNotImplemented, "Cannot move between the local disk and object stores or between buckets")
+		return
+	}
+	if err := store.Mkdir(filepath.Dir(item.dst)); err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	if err := store.Rename(item.src, item.dst); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			writeError(w, err, 500)
+			return
+		}
+		acceptedJob(w, r, fs.startTransfer("move", []transferItem{item}, filepath.Dir(item.dst)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(item.dst)})
+}
+
+// API: POST /api/copy copies one file or folder, recursively, to a new path as
+// a transfer job (202 with the job; bytes copied and total through /api/jobs).
+// JSON body: {"src": "/path", "dst": "/new/path"}. Missing parent folders of
+// dst are created.
+func (fs *FileServer) handleCopy(w http.ResponseWriter, r *http.Request) {
+	item, ok := fs.transferItemOf(w, r, "copy")
+	if !ok {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(item.dst), 0755); err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	acceptedJob(w, r, fs.startTransfer("copy", []transferItem{item}, filepath.Dir(item.dst)))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// trashDirName is the per-root folder deleted files are moved to
+	trashDirName = ".trash"
+	// trashPurgeEvery is how often items older than -trash-max-age are removed
+	trashPurgeEvery = time.Hour
+)
+
+// trashIDPattern matches the IDs of trash items, which name files in the trash
+var trashIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// errNotEmpty is returned for deleting a folder with contents without recursive
+var errNotEmpty = errors.New("folder is not empty")
+
+// trashItem is a deleted file or folder. The item itself is <id> in the
+// trash folder of its root, and this description <id>.json next to it.
+type trashItem struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"` // where it was deleted from
+	Type    string    `json:"type"` // "file" or "folder"
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// remove deletes a file or folder, moving it to the trash of its served
+// folder unless -trash=false or the folder is in an object store. Folders
+// with contents need recursive.
+func (fs *FileServer) remove(p string, recursive bool) error {
+	if store := fs.storageFor(p); !*trashOn || store != localDisk {
+		return store.Remove(p, recursive)
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !recursive {
+		if entries, err := os.ReadDir(p); err != nil {
+			return err
+		} else if len(entries) > 0 {
+			return errNotEmpty
+		}
+	}
+	_, err = fs.moveToTrash(p)
+	return err
+}
+
+// moveToTrash moves a file or folder into the trash of its served folder
+func (fs *FileServer) moveToTrash(p string) (*trashItem, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	root := fs.rootOf(abs)
+	if root == "" || root == abs {
+		return nil, errors.New("not inside a served folder")
+	}
+	fi, err := os.Lstat(abs)
+	if err != nil {
+		return nil, err
+	}
+	item := &trashItem{
+		ID:      newJobID(),
+		Name:    filepath.Base(abs),
+		Path:    filepath.ToSlash(abs),
+		Type:    "file",
+		Size:    fi.Size(),
+		Deleted: time.Now().UTC(),
+	}
+	if fi.IsDir() {
+		item.Type = "folder"
+		size, _ := computeDirSize(abs)
+		item.Size = size.Bytes
+	}
+	dir := filepath.Join(root, trashDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(item)
+	meta := filepath.Join(dir, item.ID+".json")
+	if err := os.WriteFile(meta, data, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(abs, filepath.Join(dir, item.ID)); err != nil {
+		os.Remove(meta)
+		return nil, err
+	}
+	return item, nil
+}
+
+// trashOf lists the items in the trash of a served folder, newest first
+func trashOf(root string) []*trashItem {
+	metas, _ := filepath.Glob(filepath.Join(root, trashDirName, "*.json"))
+	var items []*trashItem
+	for _, m := range metas {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		var item trashItem
+		if json.Unmarshal(data, &item) != nil || !trashIDPattern.MatchString(item.ID) {
+			continue
+		}
+		items = append(items, &item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items
+}
+
+// findTrash looks an item up in the trash of every served folder, returning
+// the folder it belongs to
+func (fs *FileServer) findTrash(id string) (string, *trashItem) {
+	if !trashIDPattern.MatchString(id) {
+		return "", nil
+	}
+	for _, f := range fs.folderList() {
+		root, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, trashDirName, id+".json"))
+		if err != nil {
+			continue
+		}
+		var item trashItem
+		if json.Unmarshal(data, &item) == nil && item.ID == id {
+			return root, &item
+		}
+	}
+	return "", nil
+}
+
+// restoreTrash moves an item back to where it was deleted from, recreating
+// the folders it was in. If that name is taken again, it gets a free one
+// like "name (2).ext". It returns the path restored to.
+func restoreTrash(root string, item *trashItem) (string, error) {
+	dest := filepath.FromSlash(item.Path)
+	parent := filepath.Dir(dest)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	dest = filepath.Join(parent, freeName(localDisk, parent, filepath.Base(dest)))
+	dir := filepath.Join(root, trashDirName)
+	if err := os.Rename(filepath.Join(dir, item.ID), dest); err != nil {
+		return "", err
+	}
+	os.Remove(filepath.Join(dir, item.ID+".json"))
+	return dest, nil
+}
+
+// purgeTrash removes an item for good
+func purgeTrash(root string, item *trashItem) error {
+	dir := filepath.Join(root, trashDirName)
+	if err := os.RemoveAll(filepath.Join(dir, item.ID)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, item.ID+".json"))
+}
+
+// startTrashPurge removes items older than maxAge from the trash of every
+// root now and then periodically
+func (fs *FileServer) startTrashPurge(maxAge time.Duration) {
+	go func() {
+		for {
+			for _, f := range fs.folderList() {
+				root, err := filepath.Abs(f)
+				if err != nil {
+					continue
+				}
+				var purged int
+				for _, item := range trashOf(root) {
+					if time.Since(item.Deleted) > maxAge && purgeTrash(root, item) == nil {
+						purged++
+					}
+				}
+				if purged > 0 {
+					fs.notef("Trash: purged %d items older than %s from %s", purged, maxAge, root)
+				}
+			}
+			time.Sleep(trashPurgeEvery)
+		}
+	}()
+}
+
+// API: GET /api/trash?path=/files lists the deleted items of the served
+// folders, newest first, optionally only those deleted from below path:
+// {"items": [{"id", "name", "path", "type", "size", "deleted"}]}.
+// POST /api/trash/restore with {"ids": [...]} moves items back to where they
+// were deleted from (as "name (2).ext" if the name was taken since) and
+// answers the paths they were restored to. POST /api/trash/purge with
+// {"ids": [...]} removes items for good, {"all": true} empties the trash.
+func (fs *FileServer) handleTrash(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+	if action == "" {
+		fs.listTrash(w, r)
+		return
+	}
+	if action != "restore" && action != "purge" {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, 400, codeBadRequest, "Invalid JSON body")
+		return
+	}
+	type found struct {
+		root string
+		item *trashItem
+	}
+	var items []found
+	if req.All && action == "purge" {
+		if !fs.requireWrite(w, r) {
+			return
+		}
+		for _, root := range fs.visibleRoots(r, nil) {
+			abs, _ := filepath.Abs(root)
+			for _, item := range trashOf(abs) {
+				if fs.canWrite(r, filepath.FromSlash(item.Path)) {
+					items = append(items, found{abs, item})
+				}
+			}
+		}
+	} else {
+		if len(req.IDs) == 0 {
+			apiError(w, 400, codeBadRequest, "Missing ids")
+			return
+		}
+		// Every item is checked before anything is changed
+		for _, id := range req.IDs {
+			root, item := fs.findTrash(id)
+			if item == nil || !fs.canRead(r, filepath.FromSlash(item.Path)) {
+				apiError(w, http.StatusNotFound, codeNotFound, "Not in the trash: "+id)
+				return
+			}
+			if !fs.requireInRoots(w, item.Path) || !fs.requireWrite(w, r, item.Path) {
+				return
+			}
+			items = append(items, found{root, item})
+		}
+	}
+
+	done := []map[string]interface{}{}
+	for _, f := range items {
+		var err error
+		result := map[string]interface{}{"id": f.item.ID}
+		if action == "restore" {
+			var dest string
+			if dest, err = restoreTrash(f.root, f.item); err == nil {
+				result["path"] = fs.publicPath(dest)
+			}
+		} else {
+			err = purgeTrash(f.root, f.item)
+		}
+		if err != nil {
+			status, code := errorStatus(err, http.StatusInternalServerError)
+			writeErrorJSON(w, status, map[string]interface{}{"error": errorBody(code, errorMessage(err)), "done": done})
+			return
+		}
+		done = append(done, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "done": done})
+}
+
+func (fs *FileServer) listTrash(w http.ResponseWriter, r *http.Request) {
+	prefix := ""
+	if p := r.URL.Query().Get("path"); p != "" {
+		abs, err := filepath.Abs(filepath.FromSlash(p))
+		if err != nil {
+			writeError(w, err, 400)
+			return
+		}
+		prefix = filepath.ToSlash(abs)
+	}
+	items := []*trashItem{}
+	for _, root := range fs.visibleRoots(r, nil) {
+		abs, _ := filepath.Abs(root)
+		for _, item := range trashOf(abs) {
+			if prefix == "" || item.Path == prefix || strings.HasPrefix(item.Path, strings.TrimSuffix(prefix, "/")+"/") {
+				item.Path = fs.publicPath(item.Path)
+				items = append(items, item)
+			}
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
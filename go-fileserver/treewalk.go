@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// defaultTreeDepth is how many levels /api/tree/recursive lists without ?depth=
+	defaultTreeDepth = 3
+	// maxTreeDepth caps ?depth=
+	maxTreeDepth = 32
+	// maxTreeNodes caps the entries of one recursive listing
+	maxTreeNodes = 100000
+)
+
+// API: GET /api/tree/recursive?path=/path/to/folder&depth=3
+// The folder as a nested tree: each entry is described as in /api/tree with
+// size and modified, and folders down to depth levels below path carry their
+// entries as children. Deeper folders have no children, and a folder that
+// can't be read has an error instead. The filters, sort and order of
+// /api/tree apply on every level. Symlinked folders aren't followed. If the
+// tree has more than 100000 entries, the rest is left out and the top folder
+// is marked truncated.
+func (fs *FileServer) handleTreeRecursive(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := q.Get("path")
+	if p == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	dir := filepath.FromSlash(p)
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		httpError(w, "Folder not found", 404)
+		return
+	}
+	depth := defaultTreeDepth
+	if v := q.Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTreeDepth {
+			httpError(w, "Invalid depth", 400)
+			return
+		}
+		depth = n
+	}
+	filter, err := parseFileFilter(q)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	sortBy, order := q.Get("sort"), q.Get("order")
+	if sortBy != "" && !treeSorts[sortBy] || order != "" && order != "asc" && order != "desc" {
+		httpError(w, "Invalid sort or order", 400)
+		return
+	}
+
+	t := &treeWalk{fs: fs, ctx: r.Context(), filter: filter, meta: wantsMeta(r), sortBy: sortBy, desc: order == "desc"}
+	children, err := t.children(dir, depth)
+	if err != nil {
+		writeError(w, err, 400)
+		return
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	abs, _ := filepath.Abs(dir)
+	name := filepath.Base(abs)
+	if abs == fs.rootOf(abs) {
+		name = fs.rootName(abs)
+	}
+	top := map[string]interface{}{
+		"name":     name,
+		"type":     "folder",
+		"path":     fs.publicPath(abs),
+		"modified": fi.ModTime().Unix(),
+		"children": children,
+	}
+	if fs.sizeIndex != nil {
+		if size, ok := fs.sizeIndex.lookup(abs); ok {
+			top["size"] = size.Bytes
+		}
+	}
+	if t.truncated {
+		top["truncated"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(top)
+}
+
+// treeWalk is one recursive listing under way
+type treeWalk struct {
+	fs        *FileServer
+	ctx       context.Context
+	filter    *fileFilter
+	meta      bool
+	sortBy    string
+	desc      bool
+	nodes     int
+	truncated bool
+}
+
+// children describes the entries of dir, with those of the folders in it
+// down to depth levels
+func (t *treeWalk) children(dir string, depth int) ([]map[string]interface{}, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []map[string]interface{}{}
+	for _, entry := range entries {
+		if t.nodes >= maxTreeNodes || t.ctx.Err() != nil {
+			t.truncated = true
+			break
+		}
+		if item := t.fs.treeItem(dir, entry, t.filter, true, t.meta); item != nil {
+			out = append(out, item)
+			t.nodes++
+		}
+	}
+	if t.sortBy != "" || t.desc {
+		sortTreeItems(out, t.sortBy, t.desc)
+	}
+	if depth <= 1 {
+		return out, nil
+	}
+	for _, item := range out {
+		if item["type"] != "folder" || t.truncated {
+			continue
+		}
+		sub := filepath.Join(dir, item["name"].(string))
+		// Links to folders are listed but not followed
+		if fi, err := os.Lstat(sub); err != nil || !fi.IsDir() {
+			continue
+		}
+		if children, err := t.children(sub, depth-1); err != nil {
+			item["error"] = errorMessage(err)
+		} else {
+			item["children"] = children
+		}
+	}
+	return out, nil
+}
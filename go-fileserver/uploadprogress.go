@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// uploadProgressKeep is how long the progress of a finished upload stays
+	// available, for subscribers that come late
+	uploadProgressKeep = time.Minute
+	// uploadProgressWait is how long a subscriber waits for an upload to start
+	uploadProgressWait = 5 * time.Second
+)
+
+// uploadIDPattern is what clients may use as the id of a multipart upload
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// uploadProgress is how far one upload got, as seen by the server
+type uploadProgress struct {
+	Received int64 `json:"received"`
+	Total    int64 `json:"total"` // -1 when the client didn't say
+	Done     bool  `json:"done"`
+
+	path     string // the target folder or file
+	finished time.Time
+}
+
+// uploadTracker counts the bytes of uploads in flight that have an id: a
+// multipart upload sent with ?id=, or a resumable upload session
+type uploadTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{uploads: make(map[string]*uploadProgress)}
+}
+
+// track starts (or, for the next chunk of a resumable upload, continues)
+// counting the upload id at received bytes
+func (t *uploadTracker) track(id, path string, received, total int64) *uploadProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, p := range t.uploads {
+		if p.Done && time.Since(p.finished) > uploadProgressKeep {
+			delete(t.uploads, k)
+		}
+	}
+	p := &uploadProgress{Received: received, Total: total, path: path}
+	t.uploads[id] = p
+	return p
+}
+
+// add counts n more received bytes of p
+func (t *uploadTracker) add(p *uploadProgress, n int64) {
+	t.mu.Lock()
+	p.Received += n
+	t.mu.Unlock()
+}
+
+// finish marks the upload id as over, whether it succeeded or not
+func (t *uploadTracker) finish(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p := t.uploads[id]; p != nil && !p.Done {
+		p.Done = true
+		p.finished = time.Now()
+	}
+}
+
+// drop forgets the upload id. Between the chunks of a resumable upload its
+// session says how far it got.
+func (t *uploadTracker) drop(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.uploads, id)
+}
+
+// get returns a copy of the progress of id
+func (t *uploadTracker) get(id string) (uploadProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.uploads[id]
+	if p == nil {
+		return uploadProgress{}, false
+	}
+	return *p, true
+}
+
+// progressReader counts what is read from r as received bytes of p
+type progressReader struct {
+	r io.Reader
+	t *uploadTracker
+	p *uploadProgress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.t.add(r.p, int64(n))
+	}
+	return n, err
+}
+
+// progressOf returns how far the upload id got: one in flight, or a resumable
+// upload waiting for its next chunk
+func (fs *FileServer) progressOf(id string) (uploadProgress, bool) {
+	if p, ok := fs.progress.get(id); ok {
+		return p, true
+	}
+	if s, ok := fs.uploads.get(id); ok {
+		received, _ := s.received()
+		return uploadProgress{Received: received, Total: s.Size, path: s.Path}, true
+	}
+	return uploadProgress{}, false
+}
+
+// API: GET /api/upload/progress?id= streams how many bytes of an upload the
+// server received, as server-sent events: "progress" with {"received",
+// "total"} whenever it changes, and "done" when the upload is over. id is a
+// resumable upload (see /api/uploads) or the id a multipart upload was sent
+// with (/api/upload?id=). The stream may be opened just before the upload.
+func (fs *FileServer) handleUploadProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !uploadIDPattern.MatchString(id) {
+		httpError(w, "Missing or invalid id", 400)
+		return
+	}
+	p, ok := fs.progressOf(id)
+	for wait := time.Now(); !ok && time.Since(wait) < uploadProgressWait; p, ok = fs.progressOf(id) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(jobEventEvery):
+		}
+	}
+	if !ok {
+		httpError(w, "No such upload", 404)
+		return
+	}
+	if !fs.requireRead(w, r, p.path) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Streaming not supported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	tick := time.NewTicker(jobEventEvery)
+	defer tick.Stop()
+	last := uploadProgress{Received: -1}
+	for {
+		// A resumable upload that completed is gone from both places
+		cur, ok := fs.progressOf(id)
+		if !ok {
+			cur = last
+			cur.Done = true
+		}
+		if cur.Received != last.Received || cur.Done {
+			event := "progress"
+			if cur.Done {
+				event = "done"
+			}
+			data, _ := json.Marshal(cur)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			flusher.Flush()
+			last = cur
+		}
+		if cur.Done {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User accounts live in the store with a role each. Users log in with
+// /api/login, which issues a session cookie, or send HTTP basic auth with
+// every request. Admins manage the accounts with /api/admin/users. The -auth
+// and -token credentials act as an admin that isn't stored.
+
+// Roles, in increasing order of rights
+const (
+	roleReadOnly  = "read-only"  // browse and download
+	roleReadWrite = "read-write" // also upload and change files
+	roleAdmin     = "admin"      // also manage users and run maintenance
+)
+
+var roleRank = map[string]int{roleReadOnly: 1, roleReadWrite: 2, roleAdmin: 3}
+
+const (
+	sessionCookie = "fileserver_session"
+	// sessionTTL is how long a login lasts
+	sessionTTL = 30 * 24 * time.Hour
+	// passwordCacheTTL is how long a checked basic auth password is trusted
+	// without running bcrypt again
+	passwordCacheTTL = 5 * time.Minute
+	minPasswordLen   = 8
+)
+
+// account is a user as stored in the users bucket, keyed by name
+type account struct {
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Hash    string    `json:"hash,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// loginSession is a session as stored in the sessions bucket, keyed by the
+// SHA-256 of the cookie value so the store doesn't hold usable tokens
+type loginSession struct {
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires"`
+}
+
+// accountCount is the number of stored accounts; with any, logging in is on
+var accountCount int64
+
+// passwordCache remembers recently checked basic auth passwords, by hash of
+// user, stored hash and password, so a changed password isn't trusted
+var passwordCache sync.Map
+
+// loadAccounts counts the accounts and drops expired sessions
+func loadAccounts() error {
+	var n int64
+	if err := db.each(bucketUsers, func(string, []byte) error { n++; return nil }); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&accountCount, n)
+	var expired []string
+	err := db.each(bucketSessions, func(key string, data []byte) error {
+		var s loginSession
+		if json.Unmarshal(data, &s) != nil || time.Now().After(s.Expires) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	for _, key := range expired {
+		db.delete(bucketSessions, key)
+	}
+	return err
+}
+
+func getAccount(name string) (*account, bool) {
+	var a account
+	ok, err := db.get(bucketUsers, name, &a)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return &a, true
+}
+
+func validRole(role string) error {
+	if roleRank[role] == 0 {
+		return fmt.Errorf("unknown role %q, want admin, read-write or read-only", role)
+	}
+	return nil
+}
+
+func (a *account) setPassword(password string) error {
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("password must have at least %d characters", minPasswordLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.Hash = string(hash)
+	return nil
+}
+
+func (a *account) passwordOK(password string) bool {
+	sum := sha256.Sum256([]byte(a.Name + "\x00" + a.Hash + "\x00" + password))
+	key := string(sum[:])
+	if until, ok := passwordCache.Load(key); ok && time.Now().Before(until.(time.Time)) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(a.Hash), []byte(password)) != nil {
+		return false
+	}
+	passwordCache.Store(key, time.Now().Add(passwordCacheTTL))
+	return true
+}
+
+// has reports whether a's role includes the rights of role
+func (a *account) has(role string) bool {
+	return roleRank[a.Role] >= roleRank[role]
+}
+
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession logs user in and returns the cookie value
+func startSession(user string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, db.put(bucketSessions, sessionKey(token), loginSession{User: user, Expires: time.Now().Add(sessionTTL)})
+}
+
+// sessionAccount returns who the session cookie token belongs to
+func sessionAccount(token string) *account {
+	var s loginSession
+	if ok, err := db.get(bucketSessions, sessionKey(token), &s); err != nil || !ok {
+		return nil
+	}
+	if time.Now().After(s.Expires) {
+		db.delete(bucketSessions, sessionKey(token))
+		return nil
+	}
+	if owner := credentials.Load(); owner.user != "" && s.User == owner.user {
+		return ownerAccount(s.User)
+	}
+	a, _ := getAccount(s.User)
+	return a
+}
+
+// endSessions logs user out everywhere
+func endSessions(user string) {
+	var keys []string
+	db.each(bucketSessions, func(key string, data []byte) error {
+		var s loginSession
+		if json.Unmarshal(data, &s) == nil && s.User == user {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	for _, key := range keys {
+		db.delete(bucketSessions, key)
+	}
+}
+
+// requireRole answers 401 or 403 and returns false unless r's user has role.
+// Without accounts and -auth/-token everyone has every role.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if !authEnabled() {
+		return true
+	}
+	a := accountOf(r)
+	if a == nil {
+		authChallenge(w)
+		httpError(w, "Login required", http.StatusUnauthorized)
+		return false
+	}
+	if !a.has(role) {
+		apiError(w, http.StatusForbidden, codeForbidden, "This needs the "+role+" role")
+		return false
+	}
+	return true
+}
+
+// API: POST /api/login with {"user": "...", "password": "..."} starts a session
+// cookie. POST /api/logout ends it. GET /api/me tells who is logged in:
+// {"user": ..., "role": ...}, with null user for anonymous visitors.
+func (fs *FileServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/me":
+		a := accountOf(r)
+		w.Header().Set("Content-Type", "application/json")
+		if a == nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"user": nil, "loginEnabled": authEnabled()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": a.Name, "role": a.Role, "loginEnabled": true})
+		return
+	case "/api/logout":
+		if r.Method != http.MethodPost {
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			db.delete(bucketSessions, sessionKey(c.Value))
+		}
+		for _, name := range []string{sessionCookie, tokenCookie} {
+			http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, 400, codeBadRequest, "Invalid JSON body")
+		return
+	}
+	var a *account
+	if owner := credentials.Load(); owner.user != "" && req.User == owner.user {
+		if secretEqual(req.Password, owner.pass) {
+			a = ownerAccount(req.User)
+		}
+	} else if stored, ok := getAccount(req.User); ok && stored.passwordOK(req.Password) {
+		a = stored
+	}
+	if a == nil {
+		fs.logAuthFailure(r, req.User, "bad-login")
+		apiError(w, http.StatusUnauthorized, codeBadCredentials, "Wrong user name or password")
+		return
+	}
+	token, err := startSession(a.Name)
+	if err != nil {
+		writeError(w, err, 500)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(sessionTTL),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "user": a.Name, "role": a.Role})
+}
+
+// adminCount is the number of stored admin accounts
+func adminCount() int {
+	n := 0
+	db.each(bucketUsers, func(_ string, data []byte) error {
+		var a account
+		if json.Unmarshal(data, &a) == nil && a.Role == roleAdmin {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// API: /api/admin/users manages accounts, for admins. GET lists them; POST
+// creates one from {"name": "...", "password": "...", "role": "read-write"}.
+// PUT /api/admin/users/<name> changes the password and/or role, DELETE
+// removes the account. Changing a role or password, or deleting, ends the
+// user's sessions. Without -auth or -token the first account must be an
+// admin, and the last admin can't be removed or demoted.
+func (fs *FileServer) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, roleAdmin) {
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/users"), "/")
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, 400, codeBadRequest, "Invalid JSON body")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		users := []account{}
+		err := db.each(bucketUsers, func(_ string, data []byte) error {
+			var a account
+			if err := json.Unmarshal(data, &a); err != nil {
+				return err
+			}
+			a.Hash = ""
+			users = append(users, a)
+			return nil
+		})
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+		json.NewEncoder(w).Encode(map[string]interface{}{"users": users})
+
+	case r.Method == http.MethodPost && name == "":
+		if req.Name == "" || strings.ContainsAny(req.Name, ":/") || req.Name == credentials.Load().user {
+			apiError(w, 400, codeBadRequest, "Invalid user name")
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleReadWrite
+		}
+		if err := validRole(req.Role); err != nil {
+			apiError(w, 400, codeBadRequest, err.Error())
+			return
+		}
+		if atomic.LoadInt64(&accountCount) == 0 && !authEnabledByFlags() && req.Role != roleAdmin {
+			// Or nobody could manage the accounts once logging in is required
+			apiError(w, 400, codeBadRequest, "The first user must be an admin")
+			return
+		}
+		if _, exists := getAccount(req.Name); exists {
+			apiError(w, http.StatusConflict, codeExists, "User exists: "+req.Name)
+			return
+		}
+		a := &account{Name: req.Name, Role: req.Role, Created: time.Now()}
+		if err := a.setPassword(req.Password); err != nil {
+			apiError(w, 400, codeBadRequest, err.Error())
+			return
+		}
+		if err := db.put(bucketUsers, a.Name, a); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		if atomic.AddInt64(&accountCount, 1) == 1 && !authEnabledByFlags() {
+			log.Printf("Users: first account %s created, logging in is now required", a.Name)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "name": a.Name, "role": a.Role})
+
+	case r.Method == http.MethodPut && name != "":
+		a, ok := getAccount(name)
+		if !ok {
+			apiError(w, http.StatusNotFound, codeNotFound, "No such user: "+name)
+			return
+		}
+		if req.Role != "" {
+			if err := validRole(req.Role); err != nil {
+				apiError(w, 400, codeBadRequest, err.Error())
+				return
+			}
+			if a.Role == roleAdmin && req.Role != roleAdmin && adminCount() == 1 && !authEnabledByFlags() {
+				apiError(w, http.StatusConflict, codeLastAdmin, "Can't demote the last admin")
+				return
+			}
+			a.Role = req.Role
+		}
+		if req.Password != "" {
+			if err := a.setPassword(req.Password); err != nil {
+				apiError(w, 400, codeBadRequest, err.Error())
+				return
+			}
+		}
+		if err := db.put(bucketUsers, a.Name, a); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		endSessions(a.Name)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "name": a.Name, "role": a.Role})
+
+	case r.Method == http.MethodDelete && name != "":
+		a, ok := getAccount(name)
+		if !ok {
+			apiError(w, http.StatusNotFound, codeNotFound, "No such user: "+name)
+			return
+		}
+		if a.Role == roleAdmin && adminCount() == 1 && !authEnabledByFlags() {
+			apiError(w, http.StatusConflict, codeLastAdmin, "Can't delete the last admin")
+			return
+		}
+		if err := db.delete(bucketUsers, name); err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		atomic.AddInt64(&accountCount, -1)
+		endSessions(name)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// versionsDirName is the per-root folder earlier versions of files are kept in
+	versionsDirName = ".versions"
+	// versionsPruneEvery is how often versions older than -versions-max-age are removed
+	versionsPruneEvery = time.Hour
+)
+
+// versionIDPattern matches version IDs, the time they were saved in Unix
+// nanoseconds
+var versionIDPattern = regexp.MustCompile(`^[0-9]{1,19}$`)
+
+// fileVersionInfo describes one kept version of a file
+type fileVersionInfo struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"` // when this content was written
+	Saved    time.Time `json:"saved"`    // when it was replaced
+}
+
+// versionDir is where the versions of the file p in root are kept, named
+// by a hash of its path relative to the root
+func versionDir(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		rel = p
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(root, versionsDirName, key[:2], key)
+}
+
+// versionsOf returns where the versions of p are kept, "" if p isn't inside
+// a served folder
+func (fs *FileServer) versionsOf(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return ""
+	}
+	root := fs.rootOf(abs)
+	if root == "" || root == abs {
+		return ""
+	}
+	return versionDir(root, abs)
+}
+
+// keepVersion copies the file p, about to be overwritten, to its versions
+// and drops the ones beyond -versions and -versions-max-age. Nothing is kept
+// for new files or with -versions=0. Failing to keep a version is logged
+// rather than stopping the write.
+func (fs *FileServer) keepVersion(p string) {
+	if dir := fs.saveVersion(p); dir != "" {
+		pruneVersions(dir, *versNum, *versAge)
+	}
+}
+
+// saveVersion is keepVersion without pruning, returning the folder the
+// version went to or ""
+func (fs *FileServer) saveVersion(p string) string {
+	if *versNum <= 0 {
+		return ""
+	}
+	if _, ok := statFile(p); !ok {
+		return ""
+	}
+	dir := fs.versionsOf(p)
+	if dir == "" {
+		return ""
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := copyFile(p, filepath.Join(dir, id)); err != nil {
+		log.Printf("Versions: keeping %s: %v", p, err)
+		return ""
+	}
+	return dir
+}
+
+// listVersions returns the versions kept in dir, newest first
+func listVersions(dir string) []fileVersionInfo {
+	entries, _ := os.ReadDir(dir)
+	versions := []fileVersionInfo{}
+	for _, e := range entries {
+		if !versionIDPattern.MatchString(e.Name()) {
+			continue // e.g. a copy in progress
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		n, _ := strconv.ParseInt(e.Name(), 10, 64)
+		versions = append(versions, fileVersionInfo{ID: e.Name(), Size: fi.Size(), Modified: fi.ModTime().UTC(), Saved: time.Unix(0, n).UTC()})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Saved.After(versions[j].Saved) })
+	return versions
+}
+
+// pruneVersions keeps the newest keep versions in dir and none older than
+// maxAge (0 for no limit), removing dir once it is empty
+func pruneVersions(dir string, keep int, maxAge time.Duration) {
+	for i, v := range listVersions(dir) {
+		if i >= keep || maxAge > 0 && time.Since(v.Saved) > maxAge {
+			os.Remove(filepath.Join(dir, v.ID))
+		}
+	}
+	os.Remove(dir) // only succeeds when empty
+}
+
+// startVersionPrune removes versions older than maxAge from every root now
+// and then periodically, also of files that aren't written anymore
+func (fs *FileServer) startVersionPrune(maxAge time.Duration) {
+	go func() {
+		for {
+			for _, f := range fs.folderList() {
+				root, err := filepath.Abs(f)
+				if err != nil {
+					continue
+				}
+				dirs, _ := filepath.Glob(filepath.Join(root, versionsDirName, "*", "*"))
+				for _, dir := range dirs {
+					pruneVersions(dir, *versNum, maxAge)
+				}
+			}
+			time.Sleep(versionsPruneEvery)
+		}
+	}()
+}
+
+// API: GET /api/versions?path=/path/to/file lists the earlier versions kept of
+// a file, newest first: {"path", "versions": [{"id", "size", "modified",
+// "saved"}]}, modified being when that content was written and saved when it
+// was replaced. With &id= the content of that version is served instead.
+// POST /api/versions/restore with {"path": "...", "id": "..."} puts a
+// version back as the file's content; the content it replaces is kept as a
+// version in turn, so a restore can be undone.
+func (fs *FileServer) handleVersions(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/versions/restore" {
+		fs.restoreVersion(w, r)
+		return
+	}
+	if r.URL.Path != "/api/versions" {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		httpError(w, "Missing path", 400)
+		return
+	}
+	path = filepath.FromSlash(path)
+	dir := fs.versionsOf(path)
+	if dir == "" {
+		httpError(w, "Path is not inside a served folder", 403)
+		return
+	}
+	if id := r.URL.Query().Get("id"); id != "" {
+		if !versionIDPattern.MatchString(id) {
+			httpError(w, "Invalid id", 400)
+			return
+		}
+		if !fs.rawAllowed(r, path) {
+			httpError(w, "Missing or expired signature", 403)
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, id))
+		if err != nil {
+			httpError(w, "Version not found", 404)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			writeError(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", detectFileContentType(f, path))
+		http.ServeContent(w, r, filepath.Base(path), fi.ModTime(), f)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": fs.publicPath(path), "versions": listVersions(dir)})
+}
+
+func (fs *FileServer) restoreVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+		ID   string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, 400, codeBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Path == "" || !versionIDPattern.MatchString(req.ID) {
+		apiError(w, 400, codeBadRequest, "Missing path or id")
+		return
+	}
+	if !fs.resolvePaths(w, &req.Path) {
+		return
+	}
+	if !fs.requireInRoots(w, req.Path) || !fs.requireRead(w, r, req.Path) || !fs.requireWrite(w, r, req.Path) {
+		return
+	}
+	path := filepath.FromSlash(req.Path)
+	if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() {
+		apiError(w, http.StatusConflict, codeExists, "Not a file: "+fs.publicPath(path))
+		return
+	}
+	version := filepath.Join(fs.versionsOf(path), req.ID)
+	if _, ok := statFile(version); !ok {
+		apiError(w, http.StatusNotFound, codeNotFound, "Version not found: "+req.ID)
+		return
+	}
+	// Pruned only afterwards, as the version being restored may be the oldest
+	saved := fs.saveVersion(path)
+	err := copyFile(version, path)
+	if saved != "" {
+		pruneVersions(saved, *versNum, *versAge)
+	}
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// Restoring is a change, which sync clients go by
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	if abs, err := filepath.Abs(path); err == nil {
+		fs.events.publish(event{Type: eventModified, Path: filepath.ToSlash(abs)})
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "path": fs.publicPath(path), "size": fi.Size(), "version": fileVersion(fi)})
+}
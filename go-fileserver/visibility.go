@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Root visibility, set per root in the config
+const (
+	// visibilityPublic roots are listed for everyone (the default)
+	visibilityPublic = "public"
+	// visibilityPrivate roots are only listed and served to logged-in users;
+	// everyone else gets 404 as if they didn't exist
+	visibilityPrivate = "private"
+)
+
+// Hidden-file policies, for dot files and folders, set for all roots or per
+// root in the config
+const (
+	// hiddenShow lists and serves them like any other (the default)
+	hiddenShow = "show"
+	// hiddenHide leaves them out of listings, searches and archives, but
+	// serves them to whoever knows the path
+	hiddenHide = "hide"
+	// hiddenDeny also answers 404 for them, as if they didn't exist
+	hiddenDeny = "deny"
+)
+
+func validVisibility(v string) error {
+	switch v {
+	case "", visibilityPublic, visibilityPrivate:
+		return nil
+	}
+	return fmt.Errorf("unknown visibility: %s", v)
+}
+
+func validHidden(v string) error {
+	switch v {
+	case "", hiddenShow, hiddenHide, hiddenDeny:
+		return nil
+	}
+	return fmt.Errorf("unknown hidden policy: %s", v)
+}
+
+// hiddenPolicy is the hidden-file policy of the root containing path
+func (fs *FileServer) hiddenPolicy(path string) string {
+	if rc := fs.rootConfig(path); rc != nil && rc.Hidden != "" {
+		return rc.Hidden
+	}
+	if hidden := fs.cfg().Hidden; hidden != "" {
+		return hidden
+	}
+	return hiddenShow
+}
+
+// hidesDotFiles reports whether listings under path leave out dot entries
+func (fs *FileServer) hidesDotFiles(path string) bool {
+	return fs.hiddenPolicy(path) != hiddenShow
+}
+
+// isDotPath reports whether path, below its root, is or lies in a dot file
+// or folder. The root itself may be named with a dot.
+func (fs *FileServer) isDotPath(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(fs.rootOf(abs), abs)
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenPath reports whether path is a dot path its root leaves out of
+// listings and searches
+func (fs *FileServer) hiddenPath(path string) bool {
+	return fs.hidesDotFiles(path) && fs.isDotPath(path)
+}
+
+// visibleTo reports whether path may be seen by r: neither its root nor the
+// one a link in it leads to may be private to others, nor may it be a dot
+// path its root denies
+func (fs *FileServer) visibleTo(r *http.Request, path string) bool {
+	if fs.hiddenPolicy(path) == hiddenDeny && fs.isDotPath(path) {
+		return false
+	}
+	for _, p := range fs.accessPaths(path) {
+		if rc := fs.rootConfig(p); rc != nil && rc.Visibility == visibilityPrivate && !authenticated(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// visibleRoots filters roots (all served folders if empty) down to those r may see
+// and read
+func (fs *FileServer) visibleRoots(r *http.Request, roots []string) []string {
+	if len(roots) == 0 {
+		roots = fs.folderList()
+	}
+	var out []string
+	for _, root := range roots {
+		if fs.canRead(r, filepath.FromSlash(root)) {
+			out = append(out, root)
+		}
+	}
+	return out
+}
+
+// visibilityMiddleware hides private roots from requests that name paths in
+// the query string and keeps them to what r may read (see canRead), unless a
+// valid signature stands in for that; endpoints taking paths in a JSON body
+// check them with requireRead.
+func (fs *FileServer) visibilityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		for _, key := range pathParams {
+			for _, v := range q[key] {
+				if !isPathParam(r, key, v) {
+					continue
+				}
+				if *signRaw && key == "path" && fs.visibleTo(r, v) && fs.validSignature(r, v) == "" {
+					continue
+				}
+				if !fs.requireRead(w, r, v) {
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
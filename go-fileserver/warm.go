@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// warmer is called for every file and folder while warming, so a cache can be
+// populated before the first browse. Folder visits come after their contents.
+type warmer func(path string, fi os.FileInfo)
+
+// warm walks all served folders once, filling the folder size cache (or the
+// size index) and every registered warmer, as a background job.
+func (fs *FileServer) warm() *job {
+	return fs.jobs.start("warm", "Warm caches", func(j *job) (interface{}, error) {
+		var dirs, files int
+		for _, root := range fs.folderList() {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				continue
+			}
+			sizes := make(map[string]*dirSize)
+			err = filepath.Walk(abs, func(p string, fi os.FileInfo, err error) error {
+				if cerr := j.checkpoint(); cerr != nil {
+					return cerr
+				}
+				if err != nil {
+					return nil
+				}
+				if fi.IsDir() {
+					if isInternal(fi.Name()) {
+						return filepath.SkipDir
+					}
+					sizes[p] = &dirSize{}
+					dirs++
+					j.progress(func() {
+						j.Current = fs.publicPath(p)
+						j.ItemsDone = dirs
+					})
+					// Count the folder in every ancestor's total
+					if p != abs {
+						for d := filepath.Dir(p); ; d = filepath.Dir(d) {
+							sizes[d].Folders++
+							if d == abs {
+								break
+							}
+						}
+					}
+					return nil
+				}
+				if !fi.Mode().IsRegular() {
+					return nil
+				}
+				files++
+				for d := filepath.Dir(p); ; d = filepath.Dir(d) {
+					sizes[d].Bytes += fi.Size()
+					sizes[d].Files++
+					if d == abs {
+						break
+					}
+				}
+				for _, w := range fs.warmers {
+					w(p, fi)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			for d, s := range sizes {
+				fs.sizes.put(d, *s, now)
+				if len(fs.warmers) > 0 {
+					if fi, err := os.Stat(d); err == nil {
+						for _, w := range fs.warmers {
+							w(d, fi)
+						}
+					}
+				}
+			}
+		}
+		if fs.sizeIndex != nil {
+			for _, root := range fs.folderList() {
+				if abs, err := filepath.Abs(root); err == nil {
+					fs.sizeIndex.scan(abs)
+				}
+			}
+			fs.sizeIndex.save()
+		}
+		return map[string]interface{}{"folders": dirs, "files": files}, nil
+	})
+}
+
+// API: Pre-populate caches for all served folders (POST, runs as a job)
+func (fs *FileServer) handleWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, roleAdmin) {
+		return
+	}
+	acceptedJob(w, r, fs.warm())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFiles publishes created/modified/deleted/renamed events for everything below
+// the served folders. It is started by the first channel that needs
+// filesystem events; calling it again only watches folders added since.
+func (fs *FileServer) watchFiles() {
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+	if fs.watched == nil {
+		fs.watched = make(map[string]bool)
+	}
+	fs.watchRoots()
+}
+
+// watchAddedRoots watches the folders a reload added, if watchFiles was started
+func (fs *FileServer) watchAddedRoots() {
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+	if fs.watched != nil {
+		fs.watchRoots()
+	}
+}
+
+// watchRoots watches the served folders not watched yet, with watchMu held.
+// Watches aren't stopped when a reload removes a folder, but its events are
+// no longer published.
+func (fs *FileServer) watchRoots() {
+	publish := func(e event) {
+		if fs.rootOf(filepath.FromSlash(e.Path)) != "" {
+			fs.events.publish(e)
+		}
+	}
+	for _, root := range fs.folderList() {
+		abs, err := filepath.Abs(root)
+		if err != nil || fs.watched[abs] {
+			continue
+		}
+		fs.watched[abs] = true
+		if err := fs.storageFor(abs).Watch(abs, publish); err != nil {
+			log.Printf("Watcher: %s: %v", abs, err)
+		}
+	}
+}
+
+// Watch follows dir with fsnotify, adding folders as they are created
+func (localStorage) Watch(dir string, fn func(event)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watchTree(w, dir)
+	go forwardFileEvents(w, fn)
+	return nil
+}
+
+// watchTree adds watches for dir and all folders below it
+func watchTree(w *fsnotify.Watcher, dir string) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if isInternal(fi.Name()) {
+			return filepath.SkipDir
+		}
+		if err := w.Add(p); err != nil {
+			log.Printf("Watcher: cannot watch %s: %v", p, err)
+		}
+		return nil
+	})
+}
+
+// hasInternal reports whether any element of path is server bookkeeping
+func hasInternal(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if isInternal(part) {
+			return true
+		}
+	}
+	return false
+}
+
+func forwardFileEvents(w *fsnotify.Watcher, fn func(event)) {
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if hasInternal(ev.Name) {
+				continue
+			}
+			e := event{Path: filepath.ToSlash(ev.Name)}
+			switch {
+			case ev.Has(fsnotify.Create):
+				e.Type = eventCreated
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					e.Folder = true
+					watchTree(w, ev.Name)
+				}
+			case ev.Has(fsnotify.Write):
+				e.Type = eventModified
+			case ev.Has(fsnotify.Remove):
+				e.Type = eventDeleted
+			case ev.Has(fsnotify.Rename):
+				e.Type = eventRenamed
+			default:
+				continue
+			}
+			fn(e)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher: %v", err)
+		}
+	}
+}
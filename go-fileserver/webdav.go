@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davPrefix serves the served folders over WebDAV, for mounting the server as
+// a network drive. As under /browse/, /dav/<root>/<path> is <path> inside the
+// served folder named <root>, and /dav/ lists the roots.
+const davPrefix = "/dav/"
+
+// davLocks are the WebDAV locks, shared by all requests
+var davLocks = webdav.NewMemLS()
+
+// davWrites are the WebDAV methods that change files
+var davWrites = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"COPY":            true,
+	"MOVE":            true,
+	"PROPPATCH":       true,
+	"LOCK":            true, // may create an empty file
+}
+
+// API: WebDAV under /dav/
+func (fs *FileServer) handleDAV(w http.ResponseWriter, r *http.Request) {
+	dav := davFS{fs: fs, r: r}
+	paths := []string{}
+	if p, err := dav.resolve(strings.TrimPrefix(r.URL.Path, "/dav")); err == nil && p != "" {
+		paths = append(paths, p)
+	}
+	if d := r.Header.Get("Destination"); d != "" {
+		if u, err := url.Parse(d); err == nil {
+			if p, err := dav.resolve(strings.TrimPrefix(u.Path, "/dav")); err == nil && p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	if !fs.requireLocalDisk(w, "WebDAV", paths...) {
+		return
+	}
+	if davWrites[r.Method] {
+		if !fs.requireWrite(w, r, paths...) {
+			return
+		}
+		if r.Method == http.MethodPut && len(paths) > 0 {
+			if err := fs.checkFreeSpace(filepath.Dir(paths[0]), r.ContentLength); err != nil {
+				lowDiskError(w)
+				return
+			}
+		}
+	}
+	if r.Method == http.MethodGet && len(paths) > 0 && !fs.rawAllowed(r, paths[0]) {
+		httpError(w, "Missing or expired signature", 403)
+		return
+	}
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: dav,
+		LockSystem: davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil || r.Method != http.MethodPut {
+				return
+			}
+			if p, err := dav.resolve(strings.TrimPrefix(r.URL.Path, "/dav")); err == nil && p != "" {
+				fs.events.publish(event{Type: eventUploaded, Path: filepath.ToSlash(p)})
+			}
+		},
+	}
+	h.ServeHTTP(w, r)
+}
+
+// davFS maps the WebDAV namespace to the served folders r may see. Whether
+// r may write is checked by handleDAV; davFS only keeps the roots themselves
+// from being changed.
+type davFS struct {
+	fs *FileServer
+	r  *http.Request
+}
+
+// resolve returns the file that name stands for, "" for the list of roots
+func (d davFS) resolve(name string) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "", nil
+	}
+	rootName, rest, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	root := d.fs.browseRoot(d.r, rootName)
+	if root == "" {
+		return "", os.ErrNotExist
+	}
+	full := filepath.Join(root, filepath.FromSlash(rest))
+	if !d.fs.inRoots(full) {
+		return "", os.ErrPermission
+	}
+	if !d.fs.visibleTo(d.r, full) {
+		return "", os.ErrNotExist
+	}
+	if !d.fs.canRead(d.r, full) {
+		return "", os.ErrPermission
+	}
+	return full, nil
+}
+
+// resolveInRoot is resolve for changes, which the roots and the list of
+// them can't take
+func (d davFS) resolveInRoot(name string) (string, error) {
+	full, err := d.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if full == "" || full == d.fs.rootOf(full) {
+		return "", os.ErrPermission
+	}
+	return full, nil
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	full, err := d.resolveInRoot(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(full, perm)
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	full, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if full == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+			return nil, os.ErrPermission
+		}
+		return &davRootList{d: d}, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if full == d.fs.rootOf(full) {
+			return nil, os.ErrPermission
+		}
+		if flag&os.O_TRUNC != 0 {
+			d.fs.keepVersion(full)
+		}
+		// Writing into a hardlink would change every file dedup and -cas
+		// merged with it
+		if err := unshareFile(full, flag&os.O_TRUNC != 0); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(full, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return davFile{f, d.fs.hidesDotFiles(full)}, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	full, err := d.resolveInRoot(name)
+	if err != nil {
+		return err
+	}
+	if err := d.fs.remove(full, true); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, err := d.resolveInRoot(oldName)
+	if err != nil {
+		return err
+	}
+	to, err := d.resolveInRoot(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	full, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if full == "" {
+		return davDirInfo{name: "/"}, nil
+	}
+	return os.Stat(full)
+}
+
+// davFile is a file or folder in a served folder, without server bookkeeping
+// in its listing, nor dot entries with noHidden
+type davFile struct {
+	*os.File
+	noHidden bool
+}
+
+func (f davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	out := infos[:0]
+	for _, fi := range infos {
+		if !isInternal(fi.Name()) && !(f.noHidden && strings.HasPrefix(fi.Name(), ".")) {
+			out = append(out, fi)
+		}
+	}
+	return out, err
+}
+
+// davRootList is the folder at /dav/, listing the roots
+type davRootList struct {
+	d    davFS
+	read bool
+}
+
+func (l *davRootList) Close() error                              { return nil }
+func (l *davRootList) Read(p []byte) (int, error)                { return 0, io.EOF }
+func (l *davRootList) Write(p []byte) (int, error)               { return 0, os.ErrPermission }
+func (l *davRootList) Seek(off int64, whence int) (int64, error) { return 0, nil }
+func (l *davRootList) Stat() (os.FileInfo, error)                { return davDirInfo{name: "/"}, nil }
+
+func (l *davRootList) Readdir(count int) ([]os.FileInfo, error) {
+	if l.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	l.read = true
+	var infos []os.FileInfo
+	for _, f := range l.d.fs.visibleRoots(l.d.r, nil) {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(abs)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, davDirInfo{name: l.d.fs.rootName(abs), modTime: fi.ModTime()})
+	}
+	return infos, nil
+}
+
+// davDirInfo describes the list of roots and, in it, a root
+type davDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i davDirInfo) Name() string       { return i.name }
+func (i davDirInfo) Size() int64        { return 0 }
+func (i davDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (i davDirInfo) ModTime() time.Time { return i.modTime }
+func (i davDirInfo) IsDir() bool        { return true }
+func (i davDirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// webhookRetries are the waits between delivery attempts
+var webhookRetries = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// webhookConfig posts matching filesystem events to a URL
+type webhookConfig struct {
+	URL string `json:"url"`
+	eventFilter
+	// Secret signs each payload: X-Fileserver-Signature is "sha256=" plus the
+	// hex HMAC-SHA256 of the body with this key
+	Secret string `json:"secret"`
+	// Debounce is the quiet period after the last change before events are sent,
+	// e.g. "5s" (default 2s). Events for the same path in a batch are merged.
+	Debounce string `json:"debounce"`
+}
+
+func (c webhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook: invalid url %q", c.URL)
+	}
+	if c.Debounce != "" {
+		if d, err := time.ParseDuration(c.Debounce); err != nil || d < 0 {
+			return fmt.Errorf("webhook %s: invalid debounce %q", c.URL, c.Debounce)
+		}
+	}
+	if err := c.eventFilter.validate(); err != nil {
+		return fmt.Errorf("webhook %s: %v", c.URL, err)
+	}
+	return nil
+}
+
+// webhook delivers the event batches of one configured hook
+type webhook struct {
+	cfg    webhookConfig
+	client *http.Client
+}
+
+// startWebhooks subscribes the configured webhooks to the event bus
+func (fs *FileServer) startWebhooks(cfgs []webhookConfig) {
+	for _, c := range cfgs {
+		h := &webhook{cfg: c, client: &http.Client{Timeout: webhookTimeout}}
+		debounce := eventDebounce
+		if c.Debounce != "" {
+			debounce, _ = time.ParseDuration(c.Debounce)
+		}
+		fs.subscribeBatched("Webhook "+c.URL, c.eventFilter, debounce, true, h.deliver)
+	}
+	fs.watchFiles()
+}
+
+// deliver posts a batch of events
+func (h *webhook) deliver(events []event) {
+	body, err := json.Marshal(map[string]interface{}{
+		"events": events,
+		"sent":   time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	h.send(body, len(events))
+}
+
+// send posts body, retrying a few times on errors and non-2xx responses
+func (h *webhook) send(body []byte, n int) {
+	delivery := newJobID()
+	for attempt := 0; ; attempt++ {
+		err := h.post(body, delivery)
+		if err == nil {
+			return
+		}
+		if attempt == len(webhookRetries) {
+			log.Printf("Webhook %s: giving up on %d event(s): %v", h.cfg.URL, n, err)
+			return
+		}
+		time.Sleep(webhookRetries[attempt])
+	}
+}
+
+func (h *webhook) post(body []byte, delivery string) error {
+	req, err := http.NewRequest(http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-fileserver")
+	req.Header.Set("X-Fileserver-Delivery", delivery)
+	if h.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Fileserver-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}